@@ -5,7 +5,7 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"io/ioutil"
 	"unsafe"
@@ -75,11 +75,11 @@ func sendText(transfer PendingTransfer, msg string) {
 	go func() {
 		s := <-status
 		if s.Error != nil {
-			transfer.NotifyError(C.SendTextError, s.Error.Error())
+			transfer.NotifyError(C.SendTextError, s.Error)
 		} else if s.OK {
 			transfer.NotifySuccess()
 		} else {
-			transfer.NotifyError(C.SendTextError, "Unknown error")
+			transfer.NotifyError(C.SendTextError, errors.New("Unknown error"))
 		}
 	}()
 }
@@ -116,7 +116,7 @@ func sendFile(transfer PendingTransfer, fileName string) {
 				// transfer has started
 				// This can be removed if/when the client implements that behaviour
 				status <- wormhole.SendResult{
-					Error: fmt.Errorf(ERR_CONTEXT_CANCELLED),
+					Error: context.Canceled,
 				}
 				pendingTransfers[transferRef].CancelFunc()
 			}
@@ -126,11 +126,11 @@ func sendFile(transfer PendingTransfer, fileName string) {
 	go func() {
 		s := <-status
 		if s.Error != nil {
-			transfer.NotifyError(C.SendFileError, s.Error.Error())
+			transfer.NotifyError(C.SendFileError, s.Error)
 		} else if s.OK {
 			transfer.NotifySuccess()
 		} else {
-			transfer.NotifyError(C.SendFileError, "Unknown error")
+			transfer.NotifyError(C.SendFileError, errors.New("Unknown error"))
 		}
 	}()
 }
@@ -146,13 +146,13 @@ func receiveText(transfer PendingTransfer, code string) {
 
 	msg, err := transfer.NewClient().Receive(ctx, code, false)
 	if err != nil {
-		transfer.NotifyError(C.ReceiveTextError, err.Error())
+		transfer.NotifyError(C.ReceiveTextError, err)
 		return
 	}
 
 	data, err := ioutil.ReadAll(msg)
 	if err != nil {
-		transfer.NotifyError(C.ReceiveTextError, err.Error())
+		transfer.NotifyError(C.ReceiveTextError, err)
 		return
 	}
 
@@ -173,7 +173,7 @@ func recvFile(transfer PendingTransfer, code string) {
 	msg, err := transfer.NewClient().Receive(ctx, code, true, wormhole.WithProgress(transfer.UpdateProgress))
 
 	if err != nil {
-		transfer.NotifyError(C.ReceiveFileError, err.Error())
+		transfer.NotifyError(C.ReceiveFileError, err)
 		return
 	}
 
@@ -199,7 +199,7 @@ func recvFile(transfer PendingTransfer, code string) {
 		}
 
 		if err != nil && err != io.EOF {
-			transfer.NotifyError(C.ReceiveFileError, err.Error())
+			transfer.NotifyError(C.ReceiveFileError, err)
 			return
 		}
 
@@ -208,7 +208,7 @@ func recvFile(transfer PendingTransfer, code string) {
 
 	reject := func() {
 		msg.Reject()
-		transfer.NotifyError(C.TransferRejected, "Transfer rejected")
+		transfer.NotifyError(C.TransferRejected, wormhole.ErrTransferRejected)
 	}
 
 	go func() {
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"unsafe"
@@ -15,14 +17,9 @@ import (
 // #include "client.h"
 import "C"
 
-const (
-	ERR_CONTEXT_CANCELLED    = "context canceled"
-	ERR_BROKEN_PIPE          = "write: broken pipe"
-	ERR_UNEXPECTED_EOF       = "unexpected EOF"
-	ERR_TRANSFER_REJECTED    = "transfer rejected"
-	ERR_FAILED_TO_GET_READER = "failed to get reader"
-	ERR_WRONG_CODE           = "decrypt message failed"
-)
+// ERR_FAILED_TO_GET_READER is reported by the host application's
+// write callback when the user cancels a download.
+const ERR_FAILED_TO_GET_READER = "failed to get reader"
 
 const (
 	DEFAULT_APP_ID                      = "lothar.com/wormhole/text-or-file-xfer"
@@ -34,7 +31,7 @@ const (
 type PendingTransfer interface {
 	Log(message string, args ...interface{})
 	UpdateProgress(done int64, total int64)
-	NotifyError(result C.result_type_t, errorMessage string)
+	NotifyError(result C.result_type_t, err error)
 	UpdateMetadata(fileName string, length int64)
 	Write(bytes unsafe.Pointer, length int) error
 	Read(buffer *C.uint8_t, length int) (int, error)
@@ -48,27 +45,18 @@ type PendingTransfer interface {
 	Reference() unsafe.Pointer
 }
 
-// TODO when the original error type contains more information than
-// the error message, refactor this
-func extractErrorCode(fallback C.result_type_t, errorMessage string) C.result_type_t {
-	if fallback == C.SendFileError {
-		if strings.Contains(errorMessage, ERR_BROKEN_PIPE) ||
-			strings.Contains(errorMessage, ERR_CONTEXT_CANCELLED) {
-			return C.TransferCancelled
-		} else if strings.Contains(errorMessage, ERR_WRONG_CODE) {
-			return C.WrongCode
-		}
-	} else if fallback == C.ReceiveFileError {
-		if strings.Contains(errorMessage, ERR_UNEXPECTED_EOF) ||
-			strings.Contains(errorMessage, ERR_CONTEXT_CANCELLED) ||
-			strings.Contains(errorMessage, ERR_FAILED_TO_GET_READER) {
+func extractErrorCode(fallback C.result_type_t, err error) C.result_type_t {
+	if fallback == C.SendFileError || fallback == C.ReceiveFileError {
+		if errors.Is(err, context.Canceled) ||
+			errors.Is(err, wormhole.ErrPeerClosed) ||
+			strings.Contains(err.Error(), ERR_FAILED_TO_GET_READER) {
 			return C.TransferCancelled
-		} else if strings.Contains(errorMessage, ERR_WRONG_CODE) {
+		} else if errors.Is(err, wormhole.ErrBadCode) {
 			return C.WrongCode
 		}
 	}
 
-	if strings.Contains(errorMessage, ERR_TRANSFER_REJECTED) {
+	if errors.Is(err, wormhole.ErrTransferRejected) {
 		return C.TransferRejected
 	}
 
@@ -87,10 +75,10 @@ func (wctx *C.wrapped_context_t) UpdateProgress(done int64, total int64) {
 	C.call_update_progress(wctx)
 }
 
-func (wctx *C.wrapped_context_t) NotifyError(result C.result_type_t, errorMessage string) {
-	wctx.Log("Error: ErrorCode:%d %s", int(result), errorMessage)
-	wctx.result.result_type = extractErrorCode(result, errorMessage)
-	wctx.result.err_string = C.CString(errorMessage)
+func (wctx *C.wrapped_context_t) NotifyError(result C.result_type_t, err error) {
+	wctx.Log("Error: ErrorCode:%d %s", int(result), err)
+	wctx.result.result_type = extractErrorCode(result, err)
+	wctx.result.err_string = C.CString(err.Error())
 	C.call_notify(wctx)
 }
 
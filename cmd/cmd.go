@@ -4,7 +4,9 @@ package cmd
 
 import (
 	"os"
+	"path/filepath"
 
+	"github.com/psanford/wormhole-william/internal/socks5"
 	"github.com/psanford/wormhole-william/version"
 	"github.com/psanford/wormhole-william/wormhole"
 	"github.com/spf13/cobra"
@@ -23,30 +25,72 @@ var rootCmd = &cobra.Command{
 
 var (
 	appID           string
-	relayURL        string
-	transitHelper   string
+	relayURL        []string
+	transitHelper   []string
 	verify          bool
 	hideProgressBar bool
 	disableListener bool
+	listenPort      int
+	transitHints    []string
+	useTor          bool
+	socks5Proxy     string
 )
 
 func Execute() error {
-	rootCmd.PersistentFlags().StringVar(&relayURL, "relay-url", wormhole.DefaultRendezvousURL, "rendezvous relay to use")
-	if relayURL == "" {
-		relayURL = os.Getenv("WORMHOLE_RELAY_URL")
+	rootCmd.PersistentFlags().StringArrayVar(&relayURL, "relay-url", []string{wormhole.DefaultRendezvousURL}, "rendezvous relay to use (repeatable; tried in order)")
+	if len(relayURL) == 0 {
+		relayURL = []string{os.Getenv("WORMHOLE_RELAY_URL")}
 	}
 
-	rootCmd.PersistentFlags().StringVar(&transitHelper, "transit-helper", wormhole.DefaultTransitRelayURL, "relay server url")
-	if transitHelper == "" {
-		transitHelper = os.Getenv("WORMHOLE_TRANSITSERVER_URL")
+	rootCmd.PersistentFlags().StringArrayVar(&transitHelper, "transit-helper", []string{wormhole.DefaultTransitRelayURL}, "relay server url (repeatable; earlier ones are preferred)")
+	if len(transitHelper) == 0 {
+		transitHelper = []string{os.Getenv("WORMHOLE_TRANSITSERVER_URL")}
 	}
 
 	rootCmd.PersistentFlags().BoolVar(&disableListener, "no-listen", false, "(debug) don't open a listening socket for transit")
+	rootCmd.PersistentFlags().IntVar(&listenPort, "listen-port", 0, "port to listen on for direct transit connections (default random)")
+	rootCmd.PersistentFlags().StringArrayVar(&transitHints, "transit-hint", nil, "extra HOST[:PORT] to advertise for direct connections, e.g. a port-forwarded public address (repeatable)")
+
+	rootCmd.PersistentFlags().BoolVar(&useTor, "tor", false, "connect through Tor's SOCKS port at "+socks5.DefaultTorAddr+"; implies --no-listen")
+	rootCmd.PersistentFlags().StringVar(&socks5Proxy, "socks5", "", "connect through a SOCKS5 proxy, as HOST:PORT or socks5://[USER:PASS@]HOST:PORT; implies --no-listen")
 
 	rootCmd.PersistentFlags().StringVar(&appID, "appid", wormhole.WormholeCLIAppID, "AppID to use")
+	rootCmd.PersistentFlags().StringVar(&contactsFile, "contacts", configPath("contacts.json"), "file to keep contacts in")
 
 	rootCmd.AddCommand(recvCommand())
 	rootCmd.AddCommand(sendCommand())
 	rootCmd.AddCommand(completionCommand())
+	rootCmd.AddCommand(serverCommand())
+	rootCmd.AddCommand(relayCommand())
+	rootCmd.AddCommand(daemonCommand())
+	rootCmd.AddCommand(contactsCommand())
 	return rootCmd.Execute()
 }
+
+// configPath returns the default path of the file name in
+// ~/.wormhole-william.
+func configPath(name string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, ".wormhole-william", name)
+}
+
+// proxyDialer returns the dialer selected by --tor or --socks5, or
+// nil if neither was given.
+func proxyDialer() *socks5.Dialer {
+	switch {
+	case useTor && socks5Proxy != "":
+		bail("--tor and --socks5 cannot be used together")
+	case useTor:
+		return &socks5.Dialer{ProxyAddr: socks5.DefaultTorAddr}
+	case socks5Proxy != "":
+		d, err := socks5.ParseURL(socks5Proxy)
+		if err != nil {
+			bail("Invalid --socks5 proxy: %s", err)
+		}
+		return d
+	}
+	return nil
+}
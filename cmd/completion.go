@@ -131,7 +131,12 @@ func activeNameplates() ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 	defer cancel()
 
-	client := rendezvous.NewClient(url, sideID, appID)
+	var opts []rendezvous.ClientOption
+	if d := proxyDialer(); d != nil {
+		opts = append(opts, rendezvous.WithDialer(d))
+	}
+
+	client := rendezvous.NewClient(url, sideID, appID, opts...)
 
 	mood := rendezvous.Happy
 	defer client.Close(ctx, mood)
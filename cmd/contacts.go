@@ -0,0 +1,222 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psanford/wormhole-william/wormhole"
+	"github.com/spf13/cobra"
+)
+
+// After a verified transfer with --save-contact NAME, both sides keep
+// a contact key derived from the transfer's session in the --contacts
+// file. send --to NAME and recv --from NAME then use a code derived
+// from that key, so nothing has to be read out. The derived code is
+// a secret like the key itself and is never printed.
+
+var (
+	contactsFile string
+	sendTo       string
+	recvFrom     string
+	saveContact  string
+
+	// newContact is the contact to save for --save-contact, set
+	// once the peer has confirmed the key.
+	newContact *wormhole.Contact
+)
+
+type contactEntry struct {
+	Key       []byte    `json:"key"`
+	Initiator bool      `json:"initiator"`
+	Added     time.Time `json:"added"`
+}
+
+func loadContacts() (map[string]contactEntry, error) {
+	contacts := make(map[string]contactEntry)
+
+	data, err := ioutil.ReadFile(contactsFile)
+	if os.IsNotExist(err) {
+		return contacts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &contacts)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", contactsFile, err)
+	}
+
+	return contacts, nil
+}
+
+// saveContacts writes contacts to a temporary file, which is only
+// readable by the user, and renames it over the old one.
+func saveContacts(contacts map[string]contactEntry) error {
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(contactsFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(contactsFile), filepath.Base(contactsFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), contactsFile)
+}
+
+// lookupContact returns the contact called name, or bails if there
+// is none.
+func lookupContact(name string) wormhole.Contact {
+	contacts, err := loadContacts()
+	if err != nil {
+		bail("Failed to load contacts: %s", err)
+	}
+
+	entry, ok := contacts[name]
+	if !ok {
+		bail("No contact called %q; make one with --save-contact", name)
+	}
+
+	return wormhole.Contact{
+		Key:       entry.Key,
+		Initiator: entry.Initiator,
+	}
+}
+
+// contactOptions returns the options needed for --save-contact.
+func contactOptions() []wormhole.TransferOption {
+	if saveContact == "" {
+		return nil
+	}
+
+	if strings.TrimSpace(saveContact) != saveContact {
+		bail("Contact names can't start or end with spaces")
+	}
+
+	// anyone who got hold of the code would share the key, so make
+	// the user compare verifiers before trusting it
+	if !verify {
+		bail("--save-contact requires --verify")
+	}
+
+	return []wormhole.TransferOption{
+		wormhole.WithContact(func(c wormhole.Contact) {
+			newContact = &c
+		}),
+	}
+}
+
+// storeContact saves the contact for --save-contact after a
+// successful transfer.
+func storeContact() {
+	if newContact == nil {
+		return
+	}
+
+	contacts, err := loadContacts()
+	if err != nil {
+		bail("Failed to load contacts: %s", err)
+	}
+
+	contacts[saveContact] = contactEntry{
+		Key:       newContact.Key,
+		Initiator: newContact.Initiator,
+		Added:     time.Now(),
+	}
+
+	err = saveContacts(contacts)
+	if err != nil {
+		bail("Failed to save contact: %s", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Saved contact %s\n", saveContact)
+}
+
+func contactsCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "contacts",
+		Short: "List saved contacts",
+		Long: `List saved contacts.
+
+  A contact is saved on both sides of a verified transfer with
+  --save-contact NAME. Later transfers with send --to NAME and
+  recv --from NAME need no code.`,
+		Args: cobra.NoArgs,
+		Run:  contactsAction,
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove NAME...",
+		Short: "Remove saved contacts",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   contactsRemoveAction,
+	})
+
+	return &cmd
+}
+
+func contactsAction(cmd *cobra.Command, args []string) {
+	contacts, err := loadContacts()
+	if err != nil {
+		bail("Failed to load contacts: %s", err)
+	}
+
+	names := make([]string, 0, len(contacts))
+	for name := range contacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDED")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, contacts[name].Added.Format("2006-01-02 15:04"))
+	}
+	w.Flush()
+}
+
+func contactsRemoveAction(cmd *cobra.Command, args []string) {
+	contacts, err := loadContacts()
+	if err != nil {
+		bail("Failed to load contacts: %s", err)
+	}
+
+	for _, name := range args {
+		if _, ok := contacts[name]; !ok {
+			bail("No contact called %q", name)
+		}
+		delete(contacts, name)
+	}
+
+	err = saveContacts(contacts)
+	if err != nil {
+		bail("Failed to save contacts: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/psanford/wormhole-william/daemon"
+	"github.com/psanford/wormhole-william/wormhole"
+	"github.com/spf13/cobra"
+)
+
+var (
+	daemonSocket string
+	daemonQueue  string
+	daemonCode   string
+	daemonWait   time.Duration
+)
+
+func daemonCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "daemon [OPTIONS]",
+		Short: "Run a daemon that sends queued files in the background",
+		Long: `Run a daemon that sends queued files in the background.
+
+  Files and directories are queued with "daemon send", which prints
+  the code to give to the receiver. The daemon waits for the receiver,
+  retries with the same code if the connection fails, and keeps its
+  queue on disk so pending sends survive a restart.`,
+		Args: cobra.NoArgs,
+		Run:  daemonAction,
+	}
+
+	cmd.PersistentFlags().StringVar(&daemonSocket, "socket", configPath("daemon.sock"), "unix socket the daemon listens on")
+	cmd.Flags().StringVar(&daemonQueue, "queue", configPath("queue.json"), "file to keep the queue in")
+
+	cmd.AddCommand(daemonSendCommand())
+	cmd.AddCommand(daemonListCommand())
+	cmd.AddCommand(daemonCancelCommand())
+
+	return &cmd
+}
+
+func daemonAction(cmd *cobra.Command, args []string) {
+	err := os.MkdirAll(filepath.Dir(daemonQueue), 0700)
+	if err != nil {
+		bail("Create queue directory: %s", err)
+	}
+	err = os.MkdirAll(filepath.Dir(daemonSocket), 0700)
+	if err != nil {
+		bail("Create socket directory: %s", err)
+	}
+
+	opts := []daemon.Option{daemon.WithObserver(logObserver{})}
+	// newClient may set disableListener for --tor and --socks5
+	c := newClient()
+	if disableListener {
+		opts = append(opts, daemon.WithDisableListener())
+	}
+
+	d, err := daemon.New(c, daemonQueue, opts...)
+	if err != nil {
+		bail("Load queue: %s", err)
+	}
+
+	if conn, err := net.Dial("unix", daemonSocket); err == nil {
+		conn.Close()
+		bail("A daemon is already listening on %s", daemonSocket)
+	}
+	os.Remove(daemonSocket)
+
+	l, err := net.Listen("unix", daemonSocket)
+	if err != nil {
+		bail("Listen: %s", err)
+	}
+	err = os.Chmod(daemonSocket, 0600)
+	if err != nil {
+		bail("Chmod socket: %s", err)
+	}
+
+	hs := &http.Server{Handler: d}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		hs.Close()
+	}()
+
+	log.Printf("Daemon listening on %s", daemonSocket)
+	err = hs.Serve(l)
+	d.Close()
+	os.Remove(daemonSocket)
+	if err != nil && err != http.ErrServerClosed {
+		bail("Serve: %s", err)
+	}
+}
+
+// logObserver logs the outcome of every send attempt.
+type logObserver struct{}
+
+func (logObserver) SendFinished(item daemon.Item, result wormhole.SendResult) {
+	if result.OK {
+		log.Printf("Sent %s (%s) with code %s", item.Path, item.ID, item.Code)
+		return
+	}
+	log.Printf("Send of %s (%s) %s: %s", item.Path, item.ID, item.State, result.Error)
+}
+
+func daemonSendCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "send [WHAT]",
+		Short: "Queue a file or directory for the daemon to send",
+		Args:  cobra.ExactArgs(1),
+		Run:   daemonSendAction,
+	}
+
+	cmd.Flags().StringVar(&daemonCode, "code", "", "human-generated code phrase")
+	cmd.Flags().DurationVar(&daemonWait, "wait", 30*time.Second, "how long to wait for the daemon to allocate a code")
+
+	return &cmd
+}
+
+func daemonSendAction(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	c := daemon.NewClient(daemonSocket)
+
+	item, err := c.Enqueue(ctx, args[0], daemonCode)
+	if err != nil {
+		bail("Enqueue: %s", err)
+	}
+
+	deadline := time.Now().Add(daemonWait)
+	for item.Code == "" && !item.State.Finished() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		item, err = c.Get(ctx, item.ID)
+		if err != nil {
+			bail("Get: %s", err)
+		}
+	}
+
+	if item.Code == "" {
+		fmt.Printf("Queued as %s; the daemon hasn't got a code yet (%s). Check again with: wormhole-william daemon list\n", item.ID, item.Error)
+		return
+	}
+
+	fmt.Printf("Queued as %s\n", item.ID)
+	printInstructions(item.Code)
+}
+
+func daemonListCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the daemon's queue",
+		Args:  cobra.NoArgs,
+		Run:   daemonListAction,
+	}
+}
+
+func daemonListAction(cmd *cobra.Command, args []string) {
+	items, err := daemon.NewClient(daemonSocket).List(context.Background())
+	if err != nil {
+		bail("List: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tCODE\tATTEMPTS\tPATH\tERROR")
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", item.ID, item.State, item.Code, item.Attempts, item.Path, item.Error)
+	}
+	w.Flush()
+}
+
+func daemonCancelCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cancel ID...",
+		Short: "Cancel queued sends",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   daemonCancelAction,
+	}
+}
+
+func daemonCancelAction(cmd *cobra.Command, args []string) {
+	c := daemon.NewClient(daemonSocket)
+	for _, id := range args {
+		item, err := c.Cancel(context.Background(), id)
+		if err != nil {
+			bail("Cancel %s: %s", id, err)
+		}
+		fmt.Printf("Cancelled %s (%s)\n", item.ID, item.Path)
+	}
+}
@@ -0,0 +1,310 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// Files sent from a directory, or from several paths at once, can be
+// filtered with --include, --exclude and .gitignore-style files given
+// with --ignore-file. Patterns are matched against the path of each
+// file relative to the top of the transfer, using / as the separator.
+// A pattern without a / matches the name at any depth, a trailing /
+// only matches directories, ** matches any number of directories and
+// a leading ! in an ignore file re-includes what an earlier line
+// excluded. An --include pattern that matches a directory includes
+// everything under it, and with --include only the directories leading
+// to included files are sent.
+
+var (
+	sendInclude     []string
+	sendExclude     []string
+	sendIgnoreFiles []string
+	sendSymlinks    bool
+)
+
+type filterRule struct {
+	pattern []string
+	negate  bool
+	dirOnly bool
+}
+
+// parseFilterRule parses a line of an ignore file or an --include or
+// --exclude pattern. It returns false for blank lines and comments.
+func parseFilterRule(line string) (filterRule, bool) {
+	var r filterRule
+
+	s := strings.TrimRight(line, " \t\r")
+	if s == "" || strings.HasPrefix(s, "#") {
+		return r, false
+	}
+
+	if strings.HasPrefix(s, "!") {
+		r.negate = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, `\`) {
+		// \# and \! start patterns with a literal # or !
+		s = s[1:]
+	}
+
+	if strings.HasSuffix(s, "/") {
+		r.dirOnly = true
+		s = strings.TrimSuffix(s, "/")
+	}
+
+	if !strings.Contains(s, "/") {
+		s = "**/" + s
+	}
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return r, false
+	}
+
+	r.pattern = strings.Split(s, "/")
+	return r, true
+}
+
+func (r filterRule) match(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return matchSegments(r.pattern, strings.Split(name, "/"))
+}
+
+// matchSegments matches a pattern split on / against a path split on
+// /. A ** segment matches zero or more path segments.
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// sendFilter decides which files to send.
+type sendFilter struct {
+	include []filterRule
+	// ignore holds the rules from ignore files followed by
+	// --exclude. The last matching rule wins.
+	ignore []filterRule
+}
+
+// newSendFilter builds a sendFilter from the command line flags.
+func newSendFilter() (*sendFilter, error) {
+	var f sendFilter
+
+	for _, p := range sendInclude {
+		if r, ok := parseFilterRule(p); ok {
+			f.include = append(f.include, r)
+		}
+	}
+
+	for _, name := range sendIgnoreFiles {
+		rules, err := readIgnoreFile(name)
+		if err != nil {
+			return nil, err
+		}
+		f.ignore = append(f.ignore, rules...)
+	}
+
+	for _, p := range sendExclude {
+		if r, ok := parseFilterRule(p); ok {
+			r.negate = false
+			f.ignore = append(f.ignore, r)
+		}
+	}
+
+	return &f, nil
+}
+
+func readIgnoreFile(name string) ([]filterRule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []filterRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if r, ok := parseFilterRule(scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules, scanner.Err()
+}
+
+// skip reports whether the file or directory name should be left out
+// of the transfer. Skipped directories are not descended into.
+// Directories are only skipped by ignore rules, since files under them
+// may still be included; see included.
+func (f *sendFilter) skip(name string, isDir bool) bool {
+	var ignored bool
+	for _, r := range f.ignore {
+		if r.match(name, isDir) {
+			ignored = !r.negate
+		}
+	}
+	if ignored {
+		return true
+	}
+
+	return !isDir && !f.included(name, false)
+}
+
+// included reports whether name, or one of the directories it is in,
+// matches an --include pattern. Everything is included when there are
+// no --include patterns.
+func (f *sendFilter) included(name string, isDir bool) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for {
+		for _, r := range f.include {
+			if r.match(name, isDir) {
+				return true
+			}
+		}
+
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name, isDir = name[:i], true
+	}
+}
+
+// walkEntries adds the files and directories under root that pass the
+// filter to entries, along with symlinks if --symlinks is set. root's
+// own path in the transfer is rel, or the top of the transfer if rel
+// is empty, and every entry path is prefixed with top. With --include
+// patterns, a directory that isn't included itself is only added once
+// something under it is.
+func (f *sendFilter) walkEntries(entries []wormhole.DirectoryEntry, top, root, rel string) ([]wormhole.DirectoryEntry, error) {
+	// root was named by the user, so follow it if it is a symlink
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return entries, err
+	}
+
+	// pending holds the directories above the current path that
+	// haven't been added yet
+	var pending []wormhole.DirectoryEntry
+
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		r, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(rel, filepath.ToSlash(r))
+		if name == "." {
+			return nil
+		}
+
+		for len(pending) > 0 && !strings.HasPrefix(top+"/"+name, pending[len(pending)-1].Path+"/") {
+			pending = pending[:len(pending)-1]
+		}
+
+		if f.skip(name, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		entry := wormhole.DirectoryEntry{
+			Path:    top + "/" + name,
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+
+		switch {
+		case info.IsDir():
+			if !f.included(name, true) {
+				pending = append(pending, entry)
+				return nil
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if !sendSymlinks {
+				return nil
+			}
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entry.LinkTarget = filepath.ToSlash(target)
+		case info.Mode().IsRegular():
+			entry.Reader = func() (io.ReadCloser, error) {
+				return os.Open(p)
+			}
+		default:
+			return nil
+		}
+
+		entries = append(entries, pending...)
+		entries = append(entries, entry)
+		pending = pending[:0]
+		return nil
+	})
+
+	return entries, err
+}
+
+// batchEntries returns the entries for sending paths together as the
+// directory top. Each path is sent under its base name, so two paths
+// with the same base name are an error.
+func (f *sendFilter) batchEntries(top string, paths []string) ([]wormhole.DirectoryEntry, error) {
+	var (
+		entries []wormhole.DirectoryEntry
+		seen    = make(map[string]string)
+	)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		name := filepath.Base(p)
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be sent as %s", other, p, name)
+		}
+		seen[name] = p
+
+		if _, err := os.Stat(p); err != nil {
+			return nil, err
+		}
+
+		var err error
+		entries, err = f.walkEntries(entries, top, p, name)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", p, err)
+		}
+	}
+
+	return entries, nil
+}
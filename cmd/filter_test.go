@@ -0,0 +1,307 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// makeTree creates the files in paths under dir. Paths ending in /
+// are created as empty directories.
+func makeTree(t *testing.T, dir string, paths ...string) {
+	for _, p := range paths {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if strings.HasSuffix(p, "/") {
+			err := os.MkdirAll(full, 0777)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(full), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(full, []byte(p), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSendFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-william-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	makeTree(t, root,
+		"a.txt",
+		"b.log",
+		"keep.log",
+		"build/out.bin",
+		"src/build",
+		"src/main.go",
+		"src/vendor/x/y.go",
+		"src/docs/notes.md",
+		"docs/notes.md",
+		"empty/",
+	)
+
+	all := []string{
+		"a.txt",
+		"b.log",
+		"build",
+		"build/out.bin",
+		"docs",
+		"docs/notes.md",
+		"empty",
+		"keep.log",
+		"src",
+		"src/build",
+		"src/docs",
+		"src/docs/notes.md",
+		"src/main.go",
+		"src/vendor",
+		"src/vendor/x",
+		"src/vendor/x/y.go",
+	}
+
+	without := func(names ...string) []string {
+		var result []string
+	outer:
+		for _, p := range all {
+			for _, n := range names {
+				if p == n {
+					continue outer
+				}
+			}
+			result = append(result, p)
+		}
+		return result
+	}
+
+	testCases := []struct {
+		name    string
+		include []string
+		exclude []string
+		ignore  []string
+		expect  []string
+	}{
+		{
+			name:   "no filters",
+			expect: all,
+		},
+		{
+			name:    "exclude by name at any depth",
+			exclude: []string{"notes.md"},
+			expect:  without("docs/notes.md", "src/docs/notes.md"),
+		},
+		{
+			name:   "negation",
+			ignore: []string{"*.log", "!keep.log"},
+			expect: without("b.log"),
+		},
+		{
+			name:   "negation overridden by a later rule",
+			ignore: []string{"*.log", "!*.log", "b.log"},
+			expect: without("b.log"),
+		},
+		{
+			name:    "exclude beats negation in ignore file",
+			ignore:  []string{"*.log", "!keep.log"},
+			exclude: []string{"keep.log"},
+			expect:  without("b.log", "keep.log"),
+		},
+		{
+			name:    "trailing slash only matches directories",
+			exclude: []string{"build/"},
+			expect:  without("build", "build/out.bin"),
+		},
+		{
+			name:    "without a trailing slash files match too",
+			exclude: []string{"build"},
+			expect:  without("build", "build/out.bin", "src/build"),
+		},
+		{
+			name:   "nested path is anchored",
+			ignore: []string{"# vendored code", "src/vendor", "docs/*.md"},
+			expect: without("src/vendor", "src/vendor/x", "src/vendor/x/y.go", "docs/notes.md"),
+		},
+		{
+			name:   "leading slash anchors a name",
+			ignore: []string{"/docs/"},
+			expect: without("docs", "docs/notes.md"),
+		},
+		{
+			name:   "double star",
+			ignore: []string{"src/**/*.go"},
+			expect: without("src/main.go", "src/vendor/x/y.go"),
+		},
+		{
+			name:    "include",
+			include: []string{"*.go"},
+			expect: []string{
+				"src",
+				"src/main.go",
+				"src/vendor",
+				"src/vendor/x",
+				"src/vendor/x/y.go",
+			},
+		},
+		{
+			name:    "include and exclude",
+			include: []string{"*.go"},
+			exclude: []string{"vendor/"},
+			expect: []string{
+				"src",
+				"src/main.go",
+			},
+		},
+		{
+			name:    "include directory",
+			include: []string{"build/", "empty"},
+			expect: []string{
+				"build",
+				"build/out.bin",
+				"empty",
+			},
+		},
+		{
+			name:    "include nested directory",
+			include: []string{"src/docs"},
+			expect: []string{
+				"src",
+				"src/docs",
+				"src/docs/notes.md",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sendInclude = tc.include
+			sendExclude = tc.exclude
+			sendIgnoreFiles = nil
+			defer func() {
+				sendInclude, sendExclude, sendIgnoreFiles = nil, nil, nil
+			}()
+
+			if tc.ignore != nil {
+				ignoreFile := filepath.Join(dir, fmt.Sprintf("ignore%d", i))
+				err := ioutil.WriteFile(ignoreFile, []byte(strings.Join(tc.ignore, "\n")+"\n"), 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sendIgnoreFiles = []string{ignoreFile}
+			}
+
+			f, err := newSendFilter()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := f.walkEntries(nil, "top", root, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, e := range entries {
+				if !strings.HasPrefix(e.Path, "top/") {
+					t.Fatalf("entry %s isn't under the top directory", e.Path)
+				}
+				got = append(got, strings.TrimPrefix(e.Path, "top/"))
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("got %q\nexpected %q", got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestBatchEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-william-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	makeTree(t, dir,
+		"one/a.txt",
+		"two/a.txt",
+		"two/sub/b.txt",
+	)
+
+	var f sendFilter
+
+	testCases := []struct {
+		name   string
+		paths  []string
+		expect []string
+		err    string
+	}{
+		{
+			name:   "files and directories",
+			paths:  []string{"one/a.txt", "two/sub"},
+			expect: []string{"files/a.txt", "files/sub", "files/sub/b.txt"},
+		},
+		{
+			name:  "duplicate base names",
+			paths: []string{"one/a.txt", "two/a.txt"},
+			err:   "would both be sent as a.txt",
+		},
+		{
+			name:  "duplicate after cleaning",
+			paths: []string{"two/sub/", "two/sub"},
+			err:   "would both be sent as sub",
+		},
+		{
+			name:  "missing",
+			paths: []string{"one/a.txt", "three"},
+			err:   "no such file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var paths []string
+			for _, p := range tc.paths {
+				paths = append(paths, filepath.Join(dir, filepath.FromSlash(p)))
+			}
+
+			entries, err := f.batchEntries("files", paths)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error containing %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Path)
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tc.expect) {
+				t.Fatalf("got %q, expected %q", got, tc.expect)
+			}
+		})
+	}
+}
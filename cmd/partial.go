@@ -0,0 +1,186 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// A file being received into PATH is written to PATH.part.
+// PATH.part.state records which offer the partial file belongs to, so that receiving
+// the same file again after an interrupted transfer can resume where
+// it left off.
+
+type partialState struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	// Received and SHA256 describe the partial file as it was when
+	// the transfer stopped, so that one which has changed since isn't
+	// resumed. They are unset if the receiver was killed mid
+	// transfer, in which case only the size is checked.
+	Received int64  `json:"received,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+func partialFilePath(dest string) string {
+	return dest + ".part"
+}
+
+func partialStatePath(dest string) string {
+	return partialFilePath(dest) + ".state"
+}
+
+func removePartialFile(dest string) {
+	os.Remove(partialFilePath(dest))
+	os.Remove(partialStatePath(dest))
+}
+
+// openPartialFile opens the partial file to receive msg into on its
+// way to dest. If a previous transfer of the same file was
+// interrupted it asks the sender to resume and returns the number of
+// bytes already received. The returned file is positioned where the
+// next byte should be written.
+func openPartialFile(msg *wormhole.IncomingMessage, dest string) (*os.File, int64, error) {
+	f, offset, err := resumePartialFile(msg, dest)
+	if err == nil {
+		fmt.Printf("Resuming transfer, %s already received\n", formatBytes(offset))
+		return f, offset, nil
+	}
+
+	err = writePartialState(dest, partialState{
+		Name: msg.Name,
+		Size: msg.TransferBytes64,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, err = os.Create(partialFilePath(dest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return f, 0, nil
+}
+
+func resumePartialFile(msg *wormhole.IncomingMessage, dest string) (*os.File, int64, error) {
+	stateJSON, err := ioutil.ReadFile(partialStatePath(dest))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var state partialState
+	err = json.Unmarshal(stateJSON, &state)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if state.Name != msg.Name || state.Size != msg.TransferBytes64 {
+		return nil, 0, fmt.Errorf("partial file is for a different transfer")
+	}
+
+	f, err := os.OpenFile(partialFilePath(dest), os.O_RDWR, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err == nil && (offset == 0 || offset > msg.TransferBytes64) {
+		err = fmt.Errorf("partial file has unexpected size %d", offset)
+	}
+	if err == nil && state.SHA256 != "" {
+		err = checkPartialFile(f, offset, state)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		// leaves f positioned at offset
+		err = msg.Resume(f, offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, offset, nil
+}
+
+// checkPartialFile checks that f, which is size bytes long, is still
+// what was received before the transfer stopped.
+func checkPartialFile(f *os.File, size int64, state partialState) error {
+	if size != state.Received {
+		return fmt.Errorf("partial file is %d bytes but %d were received", size, state.Received)
+	}
+
+	sum, err := fileSHA256(f)
+	if err != nil {
+		return err
+	}
+	if sum != state.SHA256 {
+		return errors.New("partial file has changed since the transfer stopped")
+	}
+
+	return nil
+}
+
+// checkpointPartialFile records the size and digest of the partial
+// file for dest after the transfer of msg into it has stopped.
+func checkpointPartialFile(msg *wormhole.IncomingMessage, dest string) error {
+	f, err := os.Open(partialFilePath(dest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	received, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	sum, err := fileSHA256(f)
+	if err != nil {
+		return err
+	}
+
+	return writePartialState(dest, partialState{
+		Name:     msg.Name,
+		Size:     msg.TransferBytes64,
+		Received: received,
+		SHA256:   sum,
+	})
+}
+
+func writePartialState(dest string, state partialState) error {
+	stateJSON, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(partialStatePath(dest), stateJSON, 0666)
+}
+
+// fileSHA256 returns the hex SHA-256 digest of f's contents.
+func fileSHA256(f *os.File) (string, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,149 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func TestPartialFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wormhole-william-partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newMsg := func(name string, resume bool) *wormhole.IncomingMessage {
+		return &wormhole.IncomingMessage{
+			Name:             name,
+			Type:             wormhole.TransferFile,
+			TransferBytes64:  10,
+			PeerCapabilities: &wormhole.PeerCapabilities{Resume: resume},
+		}
+	}
+
+	// receive the first n bytes of a file into dest and stop
+	interrupt := func(t *testing.T, dest string, n int) {
+		msg := newMsg("a.txt", true)
+		f, offset, err := openPartialFile(msg, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != 0 {
+			t.Fatalf("expected a new partial file but got offset %d", offset)
+		}
+		_, err = f.Write([]byte("0123456789")[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	testCases := []struct {
+		name string
+		// modify is called between the interrupted transfer and
+		// the next one
+		modify     func(t *testing.T, dest string)
+		checkpoint bool
+		msg        *wormhole.IncomingMessage
+		offset     int64
+	}{
+		{
+			name:       "resume",
+			checkpoint: true,
+			msg:        newMsg("a.txt", true),
+			offset:     4,
+		},
+		{
+			name:   "killed without a checkpoint",
+			msg:    newMsg("a.txt", true),
+			offset: 4,
+		},
+		{
+			name:       "different file",
+			checkpoint: true,
+			msg:        newMsg("b.txt", true),
+			offset:     0,
+		},
+		{
+			name:       "sender can't resume",
+			checkpoint: true,
+			msg:        newMsg("a.txt", false),
+			offset:     0,
+		},
+		{
+			name: "partial file changed",
+			modify: func(t *testing.T, dest string) {
+				err := ioutil.WriteFile(partialFilePath(dest), []byte("0X23"), 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			checkpoint: true,
+			msg:        newMsg("a.txt", true),
+			offset:     0,
+		},
+		{
+			name: "partial file grew",
+			modify: func(t *testing.T, dest string) {
+				err := ioutil.WriteFile(partialFilePath(dest), []byte("012345"), 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			checkpoint: true,
+			msg:        newMsg("a.txt", true),
+			offset:     0,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dest := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+
+			interrupt(t, dest, 4)
+			if tc.checkpoint {
+				err := checkpointPartialFile(newMsg("a.txt", true), dest)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.modify != nil {
+				tc.modify(t, dest)
+			}
+
+			f, offset, err := openPartialFile(tc.msg, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			if offset != tc.offset {
+				t.Fatalf("got offset %d, expected %d", offset, tc.offset)
+			}
+
+			pos, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pos != tc.offset {
+				t.Fatalf("partial file is positioned at %d, expected %d", pos, tc.offset)
+			}
+
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != tc.offset {
+				t.Fatalf("partial file is %d bytes, expected %d", fi.Size(), tc.offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"bufio"
+	"io"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the width of the light border around a QR code, in
+// modules. The standard asks for 4 but scanners cope with less, and
+// it takes up terminal space.
+const qrQuietZone = 2
+
+// printQR writes text to w as a QR code drawn with block characters,
+// two rows of modules per line. Light modules are drawn as blocks, so
+// the code reads correctly on the usual light-on-dark terminal.
+func printQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.L)
+	if err != nil {
+		return err
+	}
+
+	light := func(x, y int) bool {
+		return !code.Black(x, y)
+	}
+
+	bw := bufio.NewWriter(w)
+	for y := -qrQuietZone; y < code.Size+qrQuietZone; y += 2 {
+		for x := -qrQuietZone; x < code.Size+qrQuietZone; x++ {
+			top := light(x, y)
+			// the bottom quiet zone ends after an odd number of
+			// rows, so it may need half a line
+			bottom := y+1 < code.Size+qrQuietZone && light(x, y+1)
+
+			switch {
+			case top && bottom:
+				bw.WriteString("█")
+			case top:
+				bw.WriteString("▀")
+			case bottom:
+				bw.WriteString("▄")
+			default:
+				bw.WriteString(" ")
+			}
+		}
+		bw.WriteString("\n")
+	}
+
+	return bw.Flush()
+}
@@ -5,6 +5,7 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,21 +15,40 @@ import (
 	"strings"
 
 	"github.com/cheggaaa/pb/v3"
-	"github.com/klauspost/compress/zip"
 	"github.com/psanford/wormhole-william/wormhole"
 	"github.com/spf13/cobra"
 )
 
+var (
+	recvOutputFile string
+	recvOutputDir  string
+	recvAcceptFile bool
+	recvNoSymlinks bool
+)
+
 func recvCommand() *cobra.Command {
 	cmd := cobra.Command{
-		Use:     "receive [OPTIONS] [CODE]...",
+		Use:     "receive [OPTIONS] [CODE|URI]...",
 		Aliases: []string{"recv"},
 		Short:   "Receive a text message, file, or directory...",
-		Run:     recvAction,
+		Long: `Receive a text message, file, or directory.
+
+  CODE may also be a wormhole-transfer: URI, as shown by send --qr.
+
+  With -o - a file is written to stdout, and a directory is written
+  to stdout as a zip file, e.g.
+  wormhole-william recv --accept-file -o - CODE | tar xz`,
+		Run: recvAction,
 	}
 
 	cmd.Flags().BoolVarP(&verify, "verify", "v", false, "display verification string (and wait for approval)")
 	cmd.Flags().BoolVar(&hideProgressBar, "hide-progress", false, "suppress progress-bar display")
+	cmd.Flags().StringVarP(&recvOutputFile, "output-file", "o", "", "file or directory to save to instead of the sender's name.\nUse '-' to write to stdout")
+	cmd.Flags().StringVar(&recvOutputDir, "output-dir", "", "directory to save into (default current directory)")
+	cmd.Flags().BoolVar(&recvAcceptFile, "accept-file", false, "accept files and directories without asking")
+	cmd.Flags().StringVar(&recvFrom, "from", "", "receive from a saved contact, without a code")
+	cmd.Flags().StringVar(&saveContact, "save-contact", "", "save the sender as a contact with this name (requires --verify)")
+	cmd.Flags().BoolVar(&recvNoSymlinks, "no-symlinks", false, "don't create symlinks from received directories")
 
 	cmd.ValidArgsFunction = recvCodeCompletion
 
@@ -46,9 +66,27 @@ func recvAction(cmd *cobra.Command, args []string) {
 		code = args[0]
 	}
 
+	if recvFrom != "" {
+		if code != "" {
+			bail("A code and --from can't be used together")
+		}
+		code = lookupContact(recvFrom).ReceiveCode()
+	}
+
+	if recvOutputFile != "" && recvOutputDir != "" {
+		bail("--output-file and --output-dir can't be used together")
+	}
+
+	if recvOutputDir != "" {
+		err := os.MkdirAll(recvOutputDir, 0777)
+		if err != nil {
+			bail("Failed to create output directory: %s", err)
+		}
+	}
+
 	if code == "" {
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Enter receive wormhole code: ")
+		fmt.Fprint(recvStatus(), "Enter receive wormhole code: ")
 
 		line, err := reader.ReadString('\n')
 		if err != nil {
@@ -57,194 +95,262 @@ func recvAction(cmd *cobra.Command, args []string) {
 		code = strings.TrimSpace(line)
 	}
 
+	// codes never contain a colon, so this is a wormhole: URI
+	if strings.Contains(code, ":") {
+		uri, err := wormhole.ParseURI(code)
+		if err != nil {
+			bail("Invalid wormhole URI: %s", err)
+		}
+
+		code = uri.Code
+		if uri.RendezvousURL != "" {
+			// the code only exists on the server that made it
+			c.RendezvousURL = uri.RendezvousURL
+			c.RendezvousURLs = nil
+		}
+	}
+
 	if verify {
 		c.VerifierOk = func(code string) bool {
-			fmt.Printf("Verifier %s.\n", code)
-			return true
+			if saveContact == "" {
+				fmt.Fprintf(recvStatus(), "Verifier %s.\n", code)
+				return true
+			}
+
+			// the saved contact is only as good as this check, so
+			// don't take it on trust
+			fmt.Fprintf(recvStatus(), "Verifier %s. ok? (yes/no): ", code)
+
+			yn, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			return strings.TrimSpace(yn) == "yes"
 		}
 	}
 
-	msg, err := c.Receive(ctx, code, disableListener)
+	msg, err := c.Receive(ctx, code, disableListener, contactOptions()...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	switch msg.Type {
-	case wormhole.TransferText:
+	received := true
+	for i := 0; ; i++ {
+		received = recvMessage(msg, i) && received
+
+		// transfer-v2 senders may offer more than one file or directory
+		msg, err = msg.Next(ctx)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if received {
+		storeContact()
+	}
+}
+
+// recvStatus returns where to print messages for the user. That is
+// stderr when the received data is written to stdout.
+func recvStatus() io.Writer {
+	if recvOutputFile == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// recvDest returns the path to save msg, the i'th offer from the
+// sender, to, or "-" for stdout.
+func recvDest(msg *wormhole.IncomingMessage, i int) (string, error) {
+	if recvOutputFile != "" {
+		if i > 0 {
+			// every offer would end up in the same place
+			return "", fmt.Errorf("sender offered more than one file or directory, but --output-file only names one")
+		}
+		return recvOutputFile, nil
+	}
+
+	// the name comes from the sender, don't let it point anywhere
+	// but the output directory
+	if msg.Name == "" || msg.Name == "." || msg.Name == ".." || filepath.Base(msg.Name) != msg.Name {
+		return "", fmt.Errorf("bad name %q", msg.Name)
+	}
+
+	return filepath.Join(recvOutputDir, msg.Name), nil
+}
+
+// confirmAccept asks the user whether to accept a transfer, unless
+// --accept-file was given.
+func confirmAccept() bool {
+	if recvAcceptFile {
+		return true
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Fprint(recvStatus(), "ok? (y/N):")
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		errf("Error reading from stdin: %s\n", err)
+	}
+	return strings.TrimSpace(line) == "y"
+}
+
+// recvMessage receives msg, the i'th offer from the sender. It
+// returns false if msg was refused without exiting.
+func recvMessage(msg *wormhole.IncomingMessage, i int) bool {
+	if msg.Type == wormhole.TransferText {
 		body, err := ioutil.ReadAll(msg)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		fmt.Println(string(body))
-	case wormhole.TransferFile:
-		var acceptFile bool
-		if _, err := os.Stat(msg.Name); err == nil {
+		return true
+	}
+
+	dest, err := recvDest(msg, i)
+	if err != nil {
+		msg.Reject()
+		bail("Refusing transfer: %s", err)
+	}
+
+	if dest != "-" {
+		if _, err := os.Stat(dest); err == nil {
 			msg.Reject()
-			errf("Error refusing to overwrite existing '%s'", msg.Name)
+			errf("Error refusing to overwrite existing '%s'", dest)
+			return false
 		} else if !os.IsNotExist(err) {
 			msg.Reject()
-			errf("Error stat'ing existing '%s'\n", msg.Name)
-		} else {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Printf("Receiving file (%s) into: %s\n", formatBytes(msg.TransferBytes64), msg.Name)
-			fmt.Print("ok? (y/N):")
-
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				errf("Error reading from stdin: %s\n", err)
-			}
-			line = strings.TrimSpace(line)
-			if line == "y" {
-				acceptFile = true
-			}
+			errf("Error stat'ing existing '%s'\n", dest)
+			return false
+		}
+	}
 
-			if !acceptFile {
-				msg.Reject()
-				bail("transfer rejected")
-			} else {
-				wd, err := os.Getwd()
-				if err != nil {
-					bail("Failed to get working directory: %s", err)
-				}
-				f, err := ioutil.TempFile(wd, fmt.Sprintf("%s.tmp", msg.Name))
-				if err != nil {
-					bail("Failed to create tempfile: %s", err)
-				}
+	into := dest
+	if dest == "-" {
+		into = "stdout"
+	}
+
+	switch msg.Type {
+	case wormhole.TransferFile:
+		size := "unknown size"
+		if msg.TransferBytes64 >= 0 {
+			size = formatBytes(msg.TransferBytes64)
+		}
+		fmt.Fprintf(recvStatus(), "Receiving file (%s) into: %s\n", size, into)
 
-				proxyReader := pbProxyReader(msg, msg.TransferBytes64)
+		if !confirmAccept() {
+			msg.Reject()
+			bail("transfer rejected")
+		}
 
-				_, err = io.Copy(f, proxyReader)
-				if err != nil {
-					os.Remove(f.Name())
-					bail("Receive file error: %s", err)
-				}
+		if dest == "-" {
+			recvStdout(msg, msg.TransferBytes64)
+			return true
+		}
 
-				proxyReader.Close()
+		f, offset, err := openPartialFile(msg, dest)
+		if err != nil {
+			bail("Failed to create partial file: %s", err)
+		}
 
-				tmpName := f.Name()
-				f.Close()
+		proxyReader := pbProxyReader(msg, msg.TransferBytes64-offset)
 
-				err = os.Rename(tmpName, msg.Name)
-				if err != nil {
-					bail("Rename %s to %s failed: %s", tmpName, msg.Name, err)
-				}
+		_, err = io.Copy(f, proxyReader)
+		if err != nil {
+			f.Close()
+			if errors.Is(err, wormhole.ErrResumeMismatch) {
+				// the sender's file doesn't start with what we
+				// have; start over next time.
+				removePartialFile(dest)
+				bail("Receive file error: %s", err)
 			}
+
+			cerr := checkpointPartialFile(msg, dest)
+			if cerr != nil {
+				removePartialFile(dest)
+				bail("Receive file error: %s", err)
+			}
+			bail("Receive file error: %s (partial file kept, receive again to resume)", err)
 		}
-	case wormhole.TransferDirectory:
-		var acceptDir bool
 
-		wd, err := os.Getwd()
+		proxyReader.Close()
+
+		err = f.Close()
 		if err != nil {
-			bail("Failed to get working directory: %s", err)
+			bail("Error closing %s: %s", f.Name(), err)
 		}
 
-		dirName := msg.Name
-		dirName, err = filepath.Abs(dirName)
+		err = os.Rename(f.Name(), dest)
 		if err != nil {
-			bail("Failed to get abs directory: %s", err)
+			bail("Rename %s to %s failed: %s", f.Name(), dest, err)
 		}
+		os.Remove(partialStatePath(dest))
+	case wormhole.TransferDirectory:
+		fmt.Fprintf(recvStatus(), "Receiving directory (%s) into: %s\n", formatBytes(msg.TransferBytes64), into)
+		fmt.Fprintf(recvStatus(), "%d files, %s (uncompressed)\n", msg.FileCount, formatBytes(msg.UncompressedBytes64))
 
-		if filepath.Dir(dirName) != wd {
-			bail("Bad Directory name %s", msg.Name)
+		if !confirmAccept() {
+			msg.Reject()
+			bail("transfer rejected")
 		}
 
-		if _, err := os.Stat(dirName); err == nil {
-			errf("Error refusing to overwrite existing '%s'", msg.Name)
-		} else if !os.IsNotExist(err) {
-			errf("Error stat'ing existing '%s'\n", msg.Name)
-		} else {
-			reader := bufio.NewReader(os.Stdin)
-			fmt.Printf("Receiving directory (%s) into: %s\n", formatBytes(msg.TransferBytes64), msg.Name)
-			fmt.Printf("%d files, %s (uncompressed)\n", msg.FileCount, formatBytes(msg.UncompressedBytes64))
-			fmt.Print("ok? (y/N):")
-
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				errf("Error reading from stdin: %s\n", err)
-			}
-			line = strings.TrimSpace(line)
-			if line == "y" {
-				acceptDir = true
-			}
-
-			if !acceptDir {
-				msg.Reject()
-				bail("transfer rejected")
-			} else {
-				err = os.Mkdir(msg.Name, 0777)
-				if err != nil {
-					bail("Mkdir error for %s: %s\n", msg.Name, err)
-				}
-
-				tmpFile, err := ioutil.TempFile(wd, fmt.Sprintf("%s.zip.tmp", msg.Name))
-				if err != nil {
-					bail("Failed to create tempfile: %s", err)
-				}
+		if dest == "-" {
+			// the zip file as it was sent
+			recvStdout(msg, msg.TransferBytes64)
+			return true
+		}
 
-				defer tmpFile.Close()
-				defer os.Remove(tmpFile.Name())
+		var (
+			args []wormhole.ExtractOption
+			bar  *pb.ProgressBar
+		)
 
-				proxyReader := pbProxyReader(msg, msg.TransferBytes64)
+		if recvNoSymlinks {
+			args = append(args, wormhole.WithSymlinks(wormhole.SymlinkSkip))
+		}
 
-				n, err := io.Copy(tmpFile, proxyReader)
-				if err != nil {
-					os.Remove(tmpFile.Name())
-					bail("Receive file error: %s", err)
+		if !hideProgressBar {
+			args = append(args, wormhole.WithExtractProgress(func(receivedBytes int64, totalBytes int64) {
+				if bar == nil {
+					bar = pb.Full.Start64(totalBytes)
+					bar.Set(pb.Bytes, true)
 				}
+				bar.SetCurrent(receivedBytes)
 
-				tmpFile.Seek(0, io.SeekStart)
-				zr, err := zip.NewReader(tmpFile, int64(n))
-				if err != nil {
-					bail("Read zip error: %s", err)
+				if receivedBytes == totalBytes {
+					bar.Finish()
 				}
+			}))
+		}
 
-				for _, zf := range zr.File {
-					p, err := filepath.Abs(filepath.Join(dirName, zf.Name))
-					if err != nil {
-						bail("Failes to calculate file path ABS: %s", err)
-					}
-
-					if !strings.HasPrefix(p, dirName) {
-						bail("Dangerous filename detected: %s", zf.Name)
-					}
-
-					rc, err := zf.Open()
-					if err != nil {
-						bail("Failed to open file in zip: %s %s", zf.Name, err)
-					}
-
-					dir := filepath.Dir(p)
-					err = os.MkdirAll(dir, 0777)
-					if err != nil {
-						bail("Failed to mkdirall %s: %s", dir, err)
-					}
-
-					f, err := os.Create(p)
-					if err != nil {
-						bail("Failed to open %s: %s", p, err)
-					}
-
-					_, err = io.Copy(f, rc)
-					if err != nil {
-						bail("Failed to write to %s: %s", p, err)
-					}
-
-					err = f.Close()
-					if err != nil {
-						bail("Error closing %s: %s", p, err)
-					}
-
-					rc.Close()
-				}
+		err = msg.ExtractTo(dest, args...)
+		if err != nil {
+			bail("Receive directory error: %s", err)
+		}
+	}
 
-				proxyReader.Close()
+	return true
+}
 
-			}
-		}
+// recvStdout writes msg to stdout.
+func recvStdout(msg *wormhole.IncomingMessage, size int64) {
+	err := copyWithProgress(os.Stdout, msg, size)
+	if err != nil {
+		bail("Receive error: %s", err)
 	}
 }
 
+// copyWithProgress copies r, which is size bytes long, to w. The
+// progress bar is drawn on stderr, so w may be stdout.
+func copyWithProgress(w io.Writer, r io.Reader, size int64) error {
+	proxyReader := pbProxyReader(r, size)
+	defer proxyReader.Close()
+
+	_, err := io.Copy(w, proxyReader)
+	return err
+}
+
 func errf(msg string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, msg, args...)
 	if !strings.HasSuffix("\n", msg) {
@@ -0,0 +1,129 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func TestRecvDest(t *testing.T) {
+	testCases := []struct {
+		name       string
+		outputFile string
+		outputDir  string
+		msgName    string
+		expect     string
+		err        bool
+	}{
+		{name: "sender's name", msgName: "a.txt", expect: "a.txt"},
+		{name: "output dir", outputDir: "out", msgName: "a.txt", expect: filepath.Join("out", "a.txt")},
+		{name: "nested output dir", outputDir: filepath.Join("out", "sub"), msgName: "a.txt", expect: filepath.Join("out", "sub", "a.txt")},
+		{name: "output file", outputFile: "b.txt", msgName: "a.txt", expect: "b.txt"},
+		{name: "output file overrides bad name", outputFile: "b.txt", msgName: "../x", expect: "b.txt"},
+		{name: "stdout", outputFile: "-", msgName: "a.txt", expect: "-"},
+		{name: "empty", msgName: "", err: true},
+		{name: "dot", msgName: ".", err: true},
+		{name: "dot dot", msgName: "..", err: true},
+		{name: "sub directory", msgName: "a/b", err: true},
+		{name: "parent", msgName: "../x", err: true},
+		{name: "parent with output dir", outputDir: "out", msgName: "../x", err: true},
+		{name: "absolute", msgName: "/etc/passwd", err: true},
+	}
+
+	defer func() {
+		recvOutputFile, recvOutputDir = "", ""
+	}()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recvOutputFile = tc.outputFile
+			recvOutputDir = tc.outputDir
+
+			got, err := recvDest(&wormhole.IncomingMessage{Name: tc.msgName}, 0)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error for %q but got %q", tc.msgName, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expect {
+				t.Fatalf("got %q, expected %q", got, tc.expect)
+			}
+		})
+	}
+}
+
+func TestRecvDestMultipleOffers(t *testing.T) {
+	defer func() {
+		recvOutputFile, recvOutputDir = "", ""
+	}()
+
+	for _, outputFile := range []string{"b.txt", "-"} {
+		recvOutputFile = outputFile
+
+		got, err := recvDest(&wormhole.IncomingMessage{Name: "a.txt"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != outputFile {
+			t.Fatalf("got %q, expected %q", got, outputFile)
+		}
+
+		got, err = recvDest(&wormhole.IncomingMessage{Name: "c.txt"}, 1)
+		if err == nil {
+			t.Fatalf("expected an error for a second offer with --output-file %q but got %q", outputFile, got)
+		}
+	}
+
+	// without --output-file every offer gets its own name
+	recvOutputFile = ""
+	for i, name := range []string{"a.txt", "c.txt"} {
+		got, err := recvDest(&wormhole.IncomingMessage{Name: name}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Fatalf("got %q, expected %q", got, name)
+		}
+	}
+}
+
+func TestRecvStdout(t *testing.T) {
+	defer func() {
+		recvOutputFile = ""
+		hideProgressBar = false
+	}()
+
+	recvOutputFile = "-"
+	if recvStatus() != os.Stderr {
+		t.Fatalf("expected status messages on stderr when writing to stdout")
+	}
+
+	recvOutputFile = ""
+	if recvStatus() != os.Stdout {
+		t.Fatalf("expected status messages on stdout")
+	}
+
+	content := strings.Repeat("unguarded-dirigible\n", 1000)
+	for _, hide := range []bool{true, false} {
+		hideProgressBar = hide
+
+		var out bytes.Buffer
+		err := copyWithProgress(&out, strings.NewReader(content), int64(len(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != content {
+			t.Fatalf("hide-progress=%t: output doesn't match, got %d bytes", hide, out.Len())
+		}
+	}
+}
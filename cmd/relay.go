@@ -0,0 +1,86 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/psanford/wormhole-william/metrics"
+	"github.com/psanford/wormhole-william/transit"
+	"github.com/spf13/cobra"
+)
+
+var (
+	relayListenAddr     string
+	relayWSListenAddr   string
+	relayBandwidthLimit int64
+	relayIdleTimeout    time.Duration
+	relayStatsInterval  time.Duration
+	relayMetricsAddr    string
+)
+
+func relayCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "relay [OPTIONS]",
+		Short: "Run a transit relay server",
+		Long: `Run a transit relay server.
+
+  Clients use it with --transit-helper tcp:HOST:PORT, or
+  --transit-helper ws://HOST:PORT when --ws-listen is set.`,
+		Args: cobra.NoArgs,
+		Run:  relayAction,
+	}
+
+	cmd.Flags().StringVar(&relayListenAddr, "listen", ":4001", "address to listen on for TCP connections")
+	cmd.Flags().StringVar(&relayWSListenAddr, "ws-listen", "", "address to listen on for websocket connections (default none)")
+	cmd.Flags().Int64Var(&relayBandwidthLimit, "bandwidth-limit", 0, "maximum bytes per second each connection may send (default unlimited)")
+	cmd.Flags().DurationVar(&relayIdleTimeout, "idle-timeout", transit.DefaultIdleTimeout, "close connections that are idle for this long")
+	cmd.Flags().DurationVar(&relayStatsInterval, "stats-interval", 0, "log usage statistics this often (default never)")
+	cmd.Flags().StringVar(&relayMetricsAddr, "metrics-listen", "", "address to serve metrics on at /metrics (default none)")
+
+	return &cmd
+}
+
+func relayAction(cmd *cobra.Command, args []string) {
+	collector := metrics.NewCollector()
+
+	s := transit.NewServer(
+		transit.WithObserver(collector),
+		transit.WithBandwidthLimit(relayBandwidthLimit),
+		transit.WithIdleTimeout(relayIdleTimeout),
+	)
+	defer s.Close()
+
+	if relayMetricsAddr != "" {
+		collector.WatchTransit(s)
+		go serveMetrics(relayMetricsAddr, collector)
+	}
+
+	if relayStatsInterval > 0 {
+		go func() {
+			for range time.Tick(relayStatsInterval) {
+				stats := s.Stats()
+				log.Printf("connections=%d waiting=%d sessions=%d total_sessions=%d bytes=%d moods=%v",
+					stats.Connections, stats.Waiting, stats.Sessions, stats.TotalSessions, stats.BytesRelayed, stats.Moods)
+			}
+		}()
+	}
+
+	if relayWSListenAddr != "" {
+		go func() {
+			log.Printf("Transit relay listening for websockets on %s", relayWSListenAddr)
+			log.Fatal(http.ListenAndServe(relayWSListenAddr, s))
+		}()
+	}
+
+	l, err := net.Listen("tcp", relayListenAddr)
+	if err != nil {
+		bail("Failed to listen: %s", err)
+	}
+
+	log.Printf("Transit relay listening on %s", l.Addr())
+	log.Fatal(s.Serve(l))
+}
@@ -6,11 +6,12 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/cheggaaa/pb/v3"
@@ -22,30 +23,55 @@ var (
 	codeLen      int
 	codeFlag     string
 	sendTextFlag string
+	streamDir    bool
+	sendName     string
+	sendQR       bool
+
+	// sendRendezvousURL is the rendezvous server the code's nameplate
+	// is on, which with several --relay-url values needn't be the
+	// first.
+	sendRendezvousURL string
 )
 
 func sendCommand() *cobra.Command {
 	cmd := cobra.Command{
-		Use:   "send [WHAT]",
+		Use:   "send [WHAT]...",
 		Short: "Send a text message, file, or directory...",
+		Long: `Send a text message, file, or directory.
+
+  Use - as WHAT to send standard input as a file, e.g.
+  tar cz dir | wormhole-william send --name dir.tar.gz -
+
+  Several files and directories are sent together as a single
+  directory called --name, e.g.
+  wormhole-william send --name logs --exclude '*.gz' a.txt b.log dir/`,
 		Run: func(cmd *cobra.Command, args []string) {
 			if len(args) == 0 {
 				sendText()
 				return
-			} else if len(args) > 1 {
-				bail("Too many arguments")
 			}
 
-			stat, err := os.Stat(args[0])
+			if len(args) == 1 && args[0] == "-" {
+				sendStdin()
+				return
+			}
+
+			paths := expandGlobs(args)
+			if len(paths) > 1 {
+				sendBatch(paths)
+				return
+			}
+
+			stat, err := os.Stat(paths[0])
 			if err != nil {
-				bail("Failed to read %s: %s", args[0], err)
+				bail("Failed to read %s: %s", paths[0], err)
 			}
 
 			if stat.IsDir() {
-				sendDir(args[0])
+				sendDir(paths[0])
 				return
 			} else {
-				sendFile(args[0])
+				sendFile(paths[0])
 				return
 			}
 		},
@@ -54,8 +80,17 @@ func sendCommand() *cobra.Command {
 	cmd.Flags().BoolVarP(&verify, "verify", "v", false, "display verification string (and wait for approval)")
 	cmd.Flags().IntVarP(&codeLen, "code-length", "c", 0, "length of code (in bytes/words)")
 	cmd.Flags().StringVar(&codeFlag, "code", "", "human-generated code phrase")
+	cmd.Flags().BoolVar(&sendQR, "qr", false, "also show the code as a wormhole-transfer: URI and a QR code, for phones")
+	cmd.Flags().StringVar(&sendTo, "to", "", "send to a saved contact, without a code")
+	cmd.Flags().StringVar(&saveContact, "save-contact", "", "save the receiver as a contact with this name (requires --verify)")
 	cmd.Flags().StringVar(&sendTextFlag, "text", "", "text message to send, instead of a file.\nUse '-' to read from stdin")
 	cmd.Flags().BoolVar(&hideProgressBar, "hide-progress", false, "suppress progress-bar display")
+	cmd.Flags().BoolVar(&streamDir, "stream-dir", false, "stream directories without building a temporary zip file (no compression)")
+	cmd.Flags().StringVar(&sendName, "name", "", "name to give the receiver for stdin ('-') or several paths\n(default \"stdin\" or \"files\")")
+	cmd.Flags().StringArrayVar(&sendInclude, "include", nil, "only send files matching this pattern (may be repeated)")
+	cmd.Flags().StringArrayVar(&sendExclude, "exclude", nil, "don't send files or directories matching this pattern (may be repeated)")
+	cmd.Flags().StringArrayVar(&sendIgnoreFiles, "ignore-file", nil, "skip files listed in this .gitignore-style file (may be repeated)")
+	cmd.Flags().BoolVar(&sendSymlinks, "symlinks", false, "send symlinks in directories as links instead of skipping them")
 
 	return &cmd
 }
@@ -63,9 +98,47 @@ func sendCommand() *cobra.Command {
 func newClient() wormhole.Client {
 	c := wormhole.Client{
 		AppID:                     appID,
-		RendezvousURL:             relayURL,
-		TransitRelayURL:           transitHelper,
 		PassPhraseComponentLength: codeLen,
+		TransitListenPort:         listenPort,
+	}
+
+	if len(relayURL) == 1 {
+		c.RendezvousURL = relayURL[0]
+	} else {
+		c.RendezvousURLs = relayURL
+	}
+
+	if len(transitHelper) == 1 {
+		c.TransitRelayURL = transitHelper[0]
+	} else {
+		for i, url := range transitHelper {
+			c.TransitRelays = append(c.TransitRelays, wormhole.TransitRelay{
+				URL:      url,
+				Priority: float64(len(transitHelper) - i),
+			})
+		}
+	}
+
+	for _, hint := range transitHints {
+		host, portStr, err := net.SplitHostPort(hint)
+		if err != nil {
+			// no port, use the listener's
+			c.ExtraTransitHints = append(c.ExtraTransitHints, wormhole.TransitHint{Hostname: hint})
+			continue
+		}
+
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			bail("Invalid port in transit hint %s", hint)
+		}
+		c.ExtraTransitHints = append(c.ExtraTransitHints, wormhole.TransitHint{Hostname: host, Port: port})
+	}
+
+	if d := proxyDialer(); d != nil {
+		c.Dialer = d
+		// our local addresses would be useless to the peer and would
+		// give away where we are
+		disableListener = true
 	}
 
 	if verify {
@@ -83,7 +156,34 @@ func newClient() wormhole.Client {
 	return c
 }
 
+// sendOptions returns the options shared by every kind of send: the
+// code from --code or --to, and --save-contact.
+func sendOptions() []wormhole.TransferOption {
+	code := codeFlag
+	if sendTo != "" {
+		if codeFlag != "" {
+			bail("--code and --to can't be used together")
+		}
+		code = lookupContact(sendTo).SendCode()
+	}
+
+	opts := []wormhole.TransferOption{
+		wormhole.WithCode(code),
+		wormhole.WithEventHandler(func(e wormhole.Event) {
+			if e.Type == wormhole.EventRendezvousConnected {
+				sendRendezvousURL = e.URL
+			}
+		}),
+	}
+	return append(opts, contactOptions()...)
+}
+
 func printInstructions(code string) {
+	if sendTo != "" {
+		fmt.Printf("Waiting for %s to run: wormhole-william recv --from NAME\n", sendTo)
+		return
+	}
+
 	mwCmd := "wormhole receive"
 	wwCmd := "wormhole-william recv"
 
@@ -94,6 +194,25 @@ func printInstructions(code string) {
 
 	fmt.Printf("On the other computer, please run: %s (or %s)\n", mwCmd, wwCmd)
 	fmt.Printf("Wormhole code is: %s\n", code)
+
+	if sendQR {
+		url := sendRendezvousURL
+		if url == "" {
+			// queued with the daemon, which uses its own connection
+			url = relayURL[0]
+		}
+
+		uri := wormhole.URI{
+			Code:          code,
+			RendezvousURL: url,
+		}
+
+		err := printQR(os.Stdout, uri.String())
+		if err != nil {
+			errf("Failed to make QR code: %s\n", err)
+		}
+		fmt.Printf("Wormhole URI is: %s\n", uri)
+	}
 }
 
 func sendFile(filename string) {
@@ -108,9 +227,7 @@ func sendFile(filename string) {
 
 	var bar *pb.ProgressBar
 
-	args := []wormhole.TransferOption{
-		wormhole.WithCode(codeFlag),
-	}
+	args := sendOptions()
 
 	if !hideProgressBar {
 		args = append(args, wormhole.WithProgress(func(sentBytes int64, totalBytes int64) {
@@ -137,11 +254,81 @@ func sendFile(filename string) {
 
 	if s.OK {
 		fmt.Println("file sent")
+		storeContact()
+	} else {
+		bail("Send error: %s", s.Error)
+	}
+}
+
+func sendStdin() {
+	c := newClient()
+
+	ctx := context.Background()
+
+	var bar *pb.ProgressBar
+
+	args := sendOptions()
+
+	if !hideProgressBar {
+		args = append(args, wormhole.WithProgress(func(sentBytes int64, totalBytes int64) {
+			if bar == nil {
+				// the size isn't known so only show a counter
+				bar = pb.Full.Start64(0)
+				bar.Set(pb.Bytes, true)
+			}
+			bar.SetCurrent(sentBytes)
+		}))
+	}
+
+	name := sendName
+	if name == "" {
+		name = "stdin"
+	}
+
+	code, status, err := c.SendStream(ctx, name, os.Stdin, disableListener, args...)
+	if err != nil {
+		bail("Error sending message: %s", err)
+	}
+
+	printInstructions(code)
+
+	s := <-status
+
+	if bar != nil {
+		bar.Finish()
+	}
+
+	if s.OK {
+		fmt.Println("file sent")
+		storeContact()
 	} else {
 		bail("Send error: %s", s.Error)
 	}
 }
 
+// expandGlobs expands arguments that contain glob patterns, for
+// shells that don't do it themselves. Arguments naming existing files
+// are kept as they are.
+func expandGlobs(args []string) []string {
+	var paths []string
+	for _, arg := range args {
+		if _, err := os.Lstat(arg); err == nil || !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			bail("Bad pattern %s: %s", arg, err)
+		}
+		if len(matches) == 0 {
+			bail("No files match %s", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths
+}
+
 func sendDir(dirpath string) {
 	dirpath = strings.TrimSuffix(dirpath, "/")
 
@@ -154,36 +341,57 @@ func sendDir(dirpath string) {
 		log.Fatalf("%s is not a directory", dirpath)
 	}
 
-	prefix, dirname := filepath.Split(dirpath)
+	dirname := filepath.Base(dirpath)
 
-	var entries []wormhole.DirectoryEntry
+	filter, err := newSendFilter()
+	if err != nil {
+		bail("Failed to read ignore file: %s", err)
+	}
 
-	filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
+	entries, err := filter.walkEntries(nil, dirname, dirpath, "")
+	if err != nil {
+		bail("Failed to read %s: %s", dirpath, err)
+	}
 
-		if !info.Mode().IsRegular() {
-			return nil
-		}
+	sendEntries(dirname, entries, "directory sent")
+}
 
-		relPath := strings.TrimPrefix(path, prefix)
+// sendBatch sends several files and directories as a single
+// directory.
+func sendBatch(paths []string) {
+	dirname := sendName
+	if dirname == "" {
+		dirname = "files"
+	}
 
-		entries = append(entries, wormhole.DirectoryEntry{
-			Path: relPath,
-			Mode: info.Mode(),
-			Reader: func() (io.ReadCloser, error) {
-				return os.Open(path)
-			},
-		})
+	filter, err := newSendFilter()
+	if err != nil {
+		bail("Failed to read ignore file: %s", err)
+	}
 
-		return nil
-	})
+	entries, err := filter.batchEntries(dirname, paths)
+	if err != nil {
+		bail("Failed to collect files: %s", err)
+	}
+
+	sendEntries(dirname, entries, "files sent")
+}
+
+func sendEntries(dirname string, entries []wormhole.DirectoryEntry, sentMsg string) {
+	if len(entries) == 0 {
+		bail("No files to send")
+	}
 
 	c := newClient()
 
+	args := sendOptions()
+
+	if streamDir {
+		args = append(args, wormhole.WithStreamingDirectory())
+	}
+
 	ctx := context.Background()
-	code, status, err := c.SendDirectory(ctx, dirname, entries, disableListener, wormhole.WithCode(codeFlag))
+	code, status, err := c.SendDirectory(ctx, dirname, entries, disableListener, args...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -193,7 +401,8 @@ func sendDir(dirpath string) {
 	s := <-status
 
 	if s.OK {
-		fmt.Println("directory sent")
+		fmt.Println(sentMsg)
+		storeContact()
 	} else {
 		bail("Send error: %s", s.Error)
 	}
@@ -219,7 +428,7 @@ func sendText() {
 	}
 
 	ctx := context.Background()
-	code, status, err := c.SendText(ctx, msg, wormhole.WithCode(codeFlag))
+	code, status, err := c.SendText(ctx, msg, sendOptions()...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -232,6 +441,7 @@ func sendText() {
 		log.Fatalf("Send error: %s", s.Error)
 	} else if s.OK {
 		fmt.Println("text message sent")
+		storeContact()
 	} else {
 		log.Fatalf("Hmm not ok but also not error")
 	}
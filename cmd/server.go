@@ -0,0 +1,102 @@
+// +build !js,!wasm
+
+package cmd
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/psanford/wormhole-william/metrics"
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serverListenAddr       string
+	serverMOTD             string
+	serverAdvertiseVersion string
+	serverDBPath           string
+	serverHashcashBits     uint
+	serverHashcashResource string
+	serverAllowNone        bool
+	serverExpiry           time.Duration
+	serverMetricsAddr      string
+)
+
+func serverCommand() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "server [OPTIONS]",
+		Short: "Run a rendezvous (mailbox) server",
+		Long: `Run a rendezvous (mailbox) server.
+
+  Clients connect to ws://HOST:PORT/v1, e.g. with
+  --relay-url ws://localhost:4000/v1.`,
+		Args: cobra.NoArgs,
+		Run:  serverAction,
+	}
+
+	cmd.Flags().StringVar(&serverListenAddr, "listen", ":4000", "address to listen on")
+	cmd.Flags().StringVar(&serverMOTD, "motd", "", "message of the day to send to clients")
+	cmd.Flags().StringVar(&serverAdvertiseVersion, "advertise-version", "", "latest client version to advertise to clients")
+	cmd.Flags().StringVar(&serverDBPath, "db", "", "file to keep nameplates and mailboxes in across restarts (default in memory only)")
+	cmd.Flags().UintVar(&serverHashcashBits, "hashcash-bits", 0, "require clients to submit a hashcash stamp with this many bits")
+	cmd.Flags().StringVar(&serverHashcashResource, "hashcash-resource", "wormhole", "hashcash resource string clients must use")
+	cmd.Flags().BoolVar(&serverAllowNone, "allow-none", false, "with --hashcash-bits, also allow clients that don't submit a stamp")
+	cmd.Flags().DurationVar(&serverExpiry, "expiry", server.DefaultExpiry, "how long to keep unused nameplates and mailboxes")
+	cmd.Flags().StringVar(&serverMetricsAddr, "metrics-listen", "", "address to serve metrics on at /metrics (default none)")
+
+	return &cmd
+}
+
+func serverAction(cmd *cobra.Command, args []string) {
+	collector := metrics.NewCollector()
+
+	opts := []server.Option{
+		server.WithObserver(collector),
+		server.WithMOTD(serverMOTD),
+		server.WithCurrentCLIVersion(serverAdvertiseVersion),
+		server.WithExpiry(serverExpiry),
+	}
+
+	if serverHashcashBits > 0 {
+		opts = append(opts, server.WithPermissions(server.Permissions{
+			None: serverAllowNone,
+			Hashcash: &server.Hashcash{
+				Bits:     serverHashcashBits,
+				Resource: serverHashcashResource,
+			},
+		}))
+	}
+
+	if serverDBPath != "" {
+		storage, err := server.NewFileStorage(serverDBPath)
+		if err != nil {
+			bail("Failed to open --db: %s", err)
+		}
+		opts = append(opts, server.WithStorage(storage))
+	}
+
+	s := server.NewServer(opts...)
+	defer s.Close()
+
+	if serverMetricsAddr != "" {
+		collector.WatchRendezvous(s)
+		go serveMetrics(serverMetricsAddr, collector)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1", s)
+
+	log.Printf("Rendezvous server listening on %s", serverListenAddr)
+	log.Fatal(http.ListenAndServe(serverListenAddr, mux))
+}
+
+// serveMetrics serves the metrics collected by c at /metrics on addr.
+func serveMetrics(addr string, c *metrics.Collector) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+
+	log.Printf("Serving metrics on %s/metrics", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// The JSON API served by a Daemon:
+//
+//	GET    /sends       list the queue, as a JSON array of Items
+//	POST   /sends       enqueue {"path": ..., "code": ...}; path must be absolute
+//	GET    /sends/ID    get one Item
+//	DELETE /sends/ID    cancel a send, returning its Item
+//
+// Errors are returned as {"error": "..."} with a 4xx or 5xx status.
+
+type enqueueRequest struct {
+	Path string `json:"path"`
+	Code string `json:"code,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP serves the Daemon's JSON API.
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case p == "/sends" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, d.List())
+
+	case p == "/sends" && r.Method == http.MethodPost:
+		var req enqueueRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !filepath.IsAbs(req.Path) {
+			writeError(w, http.StatusBadRequest, errors.New("path must be absolute"))
+			return
+		}
+
+		item, err := d.Enqueue(req.Path, req.Code)
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, item)
+
+	case strings.HasPrefix(p, "/sends/") && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+		id := strings.TrimPrefix(p, "/sends/")
+
+		var (
+			item Item
+			err  error
+		)
+		if r.Method == http.MethodGet {
+			item, err = d.Get(id)
+		} else {
+			item, err = d.Cancel(id)
+		}
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, item)
+
+	case p == "/sends" || strings.HasPrefix(p, "/sends/"):
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrFinished):
+		return http.StatusConflict
+	case errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
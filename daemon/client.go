@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+)
+
+// A Client talks to a Daemon's JSON API over a Unix socket.
+type Client struct {
+	httpClient *http.Client
+}
+
+// NewClient returns a Client for the Daemon listening on the Unix
+// socket at socketPath.
+func NewClient(socketPath string) *Client {
+	var dialer net.Dialer
+	return &Client{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Enqueue asks the daemon to send the file or directory at path,
+// with code if it isn't empty. A relative path is made absolute
+// first, since the daemon may have a different working directory.
+func (c *Client) Enqueue(ctx context.Context, path, code string) (Item, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Item{}, err
+	}
+
+	var item Item
+	err = c.do(ctx, http.MethodPost, "/sends", enqueueRequest{Path: path, Code: code}, &item)
+	return item, err
+}
+
+// List returns every item in the daemon's queue.
+func (c *Client) List(ctx context.Context) ([]Item, error) {
+	var items []Item
+	err := c.do(ctx, http.MethodGet, "/sends", nil, &items)
+	return items, err
+}
+
+// Get returns the item with the given ID.
+func (c *Client) Get(ctx context.Context, id string) (Item, error) {
+	var item Item
+	err := c.do(ctx, http.MethodGet, "/sends/"+id, nil, &item)
+	return item, err
+}
+
+// Cancel cancels the send with the given ID.
+func (c *Client) Cancel(ctx context.Context, id string) (Item, error) {
+	var item Item
+	err := c.do(ctx, http.MethodDelete, "/sends/"+id, nil, &item)
+	return item, err
+}
+
+// do makes a request and decodes the response into out. Errors from
+// the daemon that match ErrNotFound, ErrFinished or ErrClosed are
+// returned as those.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		err := json.NewEncoder(&body).Encode(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://daemon"+path, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp errorResponse
+		err = json.NewDecoder(resp.Body).Decode(&errResp)
+		if err != nil {
+			return errors.New(resp.Status)
+		}
+		for _, known := range []error{ErrNotFound, ErrFinished, ErrClosed} {
+			if errResp.Error == known.Error() {
+				return known
+			}
+		}
+		return errors.New(errResp.Error)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
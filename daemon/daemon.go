@@ -0,0 +1,619 @@
+// Package daemon implements a persistent queue of files and
+// directories to send with magic wormhole, for "fire and forget"
+// transfers.
+//
+// A Daemon keeps its queue in a JSON file, so pending sends survive a
+// restart. Each queued send keeps its code until it completes: the
+// Daemon waits for the receiver, and if the connection to the
+// rendezvous server or the transfer fails it tries again with the
+// same code after a delay. The outcome of every attempt is reported
+// to an Observer.
+//
+// A Daemon is also an http.Handler serving a small JSON API to
+// enqueue, list and cancel sends, usually on a Unix socket; Client
+// talks to it.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/rendezvous"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+const (
+	// DefaultMinRetryDelay is the default delay before the first
+	// retry of a failed send.
+	DefaultMinRetryDelay = 5 * time.Second
+	// DefaultMaxRetryDelay is the default limit for the delay
+	// between retries, which doubles after every failed attempt.
+	DefaultMaxRetryDelay = 5 * time.Minute
+)
+
+var (
+	// ErrNotFound is returned for an unknown item ID.
+	ErrNotFound = errors.New("daemon: no such item")
+	// ErrFinished is returned by Cancel if the send has already
+	// finished.
+	ErrFinished = errors.New("daemon: send already finished")
+	// ErrClosed is returned by Enqueue after Close is called.
+	ErrClosed = errors.New("daemon: closed")
+)
+
+// State is how far a queued send has got.
+type State string
+
+const (
+	// StatePending means the send is connecting to the rendezvous
+	// server or waiting to retry.
+	StatePending State = "pending"
+	// StateWaiting means the send has a code and is waiting for
+	// the receiver, or sending to it.
+	StateWaiting State = "waiting"
+	// StateSent means the send completed.
+	StateSent State = "sent"
+	// StateFailed means the send failed in a way that retrying
+	// won't fix, such as the receiver rejecting it.
+	StateFailed State = "failed"
+	// StateCancelled means the send was cancelled.
+	StateCancelled State = "cancelled"
+)
+
+// Finished reports whether a send in state s is over.
+func (s State) Finished() bool {
+	return s == StateSent || s == StateFailed || s == StateCancelled
+}
+
+// An Item is a file or directory in the queue.
+type Item struct {
+	ID string `json:"id"`
+	// Path is the absolute path of the file or directory to send.
+	Path string `json:"path"`
+	// Code is the code to give to the receiver. It is empty until
+	// the first attempt has allocated a nameplate, unless a code
+	// was given to Enqueue.
+	Code  string `json:"code,omitempty"`
+	State State  `json:"state"`
+	// Attempts is the number of times the send has been started.
+	Attempts int `json:"attempts"`
+	// Error is why the last attempt failed.
+	Error   string    `json:"error,omitempty"`
+	Added   time.Time `json:"added"`
+	Updated time.Time `json:"updated"`
+
+	// SideID identifies the sender to the rendezvous server across
+	// attempts; see wormhole.WithSideID.
+	SideID string `json:"side_id"`
+}
+
+// A Daemon sends the items in its queue. Create one with New.
+type Daemon struct {
+	client          wormhole.Client
+	path            string
+	disableListener bool
+	minDelay        time.Duration
+	maxDelay        time.Duration
+	observer        Observer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	items   map[string]*Item
+	cancels map[string]context.CancelFunc
+	nextID  int
+	closed  bool
+}
+
+type queueState struct {
+	Items []*Item `json:"items"`
+}
+
+// New returns a Daemon that sends with client and keeps its queue in
+// the file at queuePath, loading it if it exists. Sends that hadn't
+// finished are resumed with their codes.
+func New(client wormhole.Client, queuePath string, opts ...Option) (*Daemon, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Daemon{
+		client:   client,
+		path:     queuePath,
+		minDelay: DefaultMinRetryDelay,
+		maxDelay: DefaultMaxRetryDelay,
+		observer: nopObserver{},
+		ctx:      ctx,
+		cancel:   cancel,
+		items:    make(map[string]*Item),
+		cancels:  make(map[string]context.CancelFunc),
+		nextID:   1,
+	}
+
+	for _, opt := range opts {
+		opt.setValue(d)
+	}
+
+	data, err := ioutil.ReadFile(queuePath)
+	if err != nil && !os.IsNotExist(err) {
+		cancel()
+		return nil, err
+	}
+
+	if err == nil {
+		var state queueState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("read queue %s: %w", queuePath, err)
+		}
+
+		for _, item := range state.Items {
+			d.items[item.ID] = item
+			if n, err := strconv.Atoi(item.ID); err == nil && n >= d.nextID {
+				d.nextID = n + 1
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, item := range d.items {
+		if !item.State.Finished() {
+			// a send that was waiting for its receiver may have
+			// left messages in its mailbox
+			stale := item.State == StateWaiting
+			item.State = StatePending
+			d.start(item.ID, stale)
+		}
+	}
+
+	return d, nil
+}
+
+// Enqueue adds the file or directory at path to the queue and starts
+// sending it. If code is empty one is allocated by the rendezvous
+// server; it appears in the Item once the first attempt has
+// connected.
+func (d *Daemon) Enqueue(path, code string) (Item, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Item{}, err
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		return Item{}, err
+	}
+
+	if code != "" {
+		err = validateCode(code)
+		if err != nil {
+			return Item{}, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return Item{}, ErrClosed
+	}
+
+	now := time.Now()
+	item := &Item{
+		ID:      strconv.Itoa(d.nextID),
+		Path:    path,
+		Code:    code,
+		State:   StatePending,
+		Added:   now,
+		Updated: now,
+		SideID:  crypto.RandSideID(),
+	}
+	d.nextID++
+	d.items[item.ID] = item
+
+	err = d.save()
+	if err != nil {
+		delete(d.items, item.ID)
+		return Item{}, err
+	}
+
+	d.start(item.ID, false)
+	return *item, nil
+}
+
+// validateCode checks that code looks like a wormhole code, so that
+// a typo fails Enqueue instead of every attempt.
+func validateCode(code string) error {
+	parts := strings.SplitN(code, "-", 2)
+	if _, err := strconv.Atoi(parts[0]); err != nil || len(parts) < 2 || parts[1] == "" {
+		return errors.New("code must be a nameplate number followed by words, like 7-guitarist-revenge")
+	}
+	if strings.ContainsAny(code, " \t\n") {
+		return errors.New("code must not contain spaces")
+	}
+	return nil
+}
+
+// List returns every item in the queue, including finished ones, in
+// the order they were added.
+func (d *Daemon) List() []Item {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	items := make([]Item, 0, len(d.items))
+	for _, item := range d.items {
+		items = append(items, *item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := strconv.Atoi(items[i].ID)
+		b, _ := strconv.Atoi(items[j].ID)
+		return a < b
+	})
+
+	return items
+}
+
+// Get returns the item with the given ID.
+func (d *Daemon) Get(id string) (Item, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	item, ok := d.items[id]
+	if !ok {
+		return Item{}, ErrNotFound
+	}
+	return *item, nil
+}
+
+// Cancel stops sending the item with the given ID. It returns
+// ErrFinished if the send has already finished.
+func (d *Daemon) Cancel(id string) (Item, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	item, ok := d.items[id]
+	if !ok {
+		return Item{}, ErrNotFound
+	}
+	if item.State.Finished() {
+		return *item, ErrFinished
+	}
+
+	item.State = StateCancelled
+	item.Updated = time.Now()
+	if cancel := d.cancels[id]; cancel != nil {
+		cancel()
+		delete(d.cancels, id)
+	}
+
+	return *item, d.save()
+}
+
+// Close stops all sends and waits for them to return. Unfinished
+// sends stay in the queue and are resumed by the next Daemon that
+// uses it.
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	d.cancel()
+	d.wg.Wait()
+	return nil
+}
+
+// start starts the goroutine sending item id. stale says whether an
+// earlier Daemon may have left the item's mailbox on the rendezvous
+// server. d.mu must be held.
+func (d *Daemon) start(id string, stale bool) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.cancels[id] = cancel
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer cancel()
+		d.run(ctx, id, stale)
+	}()
+}
+
+// run sends item id until it succeeds, fails for good or ctx is
+// cancelled.
+func (d *Daemon) run(ctx context.Context, id string, stale bool) {
+	delay := d.minDelay
+
+	for {
+		var (
+			result    wormhole.SendResult
+			connected bool
+		)
+		if stale {
+			result = d.clear(ctx, id)
+			stale = result.Error != nil
+		}
+		if !stale {
+			result, connected = d.attempt(ctx, id)
+		}
+		if ctx.Err() != nil {
+			// cancelled or closed; Cancel has already set the
+			// state
+			return
+		}
+
+		state := StatePending
+		switch {
+		case result.OK:
+			state = StateSent
+		case permanent(result.Error):
+			state = StateFailed
+		}
+
+		item, ok := d.update(id, func(item *Item) {
+			item.State = state
+			item.Error = ""
+			if result.Error != nil {
+				item.Error = result.Error.Error()
+			}
+			if reclaimed(result.Error) {
+				// the server won't let this side claim the
+				// nameplate again while the receiver holds it
+				item.SideID = crypto.RandSideID()
+			}
+		})
+		if !ok {
+			return
+		}
+
+		d.observer.SendFinished(item, result)
+
+		if state.Finished() {
+			d.mu.Lock()
+			delete(d.cancels, id)
+			d.mu.Unlock()
+			return
+		}
+
+		if connected {
+			// the receiver was waited for; start backing off
+			// again from the beginning
+			delay = d.minDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > d.maxDelay {
+			delay = d.maxDelay
+		}
+	}
+}
+
+// clear closes the mailbox that an earlier Daemon opened for item id
+// and never closed, because it was stopped while waiting for the
+// receiver. The mailbox still holds the PAKE message from that
+// attempt, and a receiver would get it as well as the one from the
+// next attempt. If no receiver has joined, closing it removes it.
+func (d *Daemon) clear(ctx context.Context, id string) wormhole.SendResult {
+	item, ok := d.update(id, func(item *Item) {
+		item.State = StatePending
+	})
+	if !ok {
+		return wormhole.SendResult{Error: context.Canceled}
+	}
+
+	_, rc, err := d.client.CreateOrAttachMailbox(ctx, item.SideID, d.client.AppID, item.Code)
+	if err != nil {
+		return wormhole.SendResult{Error: err}
+	}
+
+	return wormhole.SendResult{Error: rc.Close(ctx, rendezvous.Errory)}
+}
+
+// attempt makes one attempt at sending item id. connected reports
+// whether it got as far as waiting for the receiver.
+func (d *Daemon) attempt(ctx context.Context, id string) (result wormhole.SendResult, connected bool) {
+	item, ok := d.update(id, func(item *Item) {
+		item.Attempts++
+		item.State = StatePending
+	})
+	if !ok {
+		return wormhole.SendResult{Error: context.Canceled}, false
+	}
+
+	opts := []wormhole.TransferOption{
+		wormhole.WithSideID(item.SideID),
+		// directories are zipped on the fly rather than into a
+		// temporary file on every attempt
+		wormhole.WithStreamingDirectory(),
+	}
+	if item.Code != "" {
+		opts = append(opts, wormhole.WithCode(item.Code))
+	}
+
+	code, ch, closer, err := d.send(ctx, item.Path, opts)
+	if err != nil {
+		return wormhole.SendResult{Error: err}, false
+	}
+	defer closer.Close()
+
+	_, ok = d.update(id, func(item *Item) {
+		item.Code = code
+		item.State = StateWaiting
+		item.Error = ""
+	})
+	if !ok {
+		return wormhole.SendResult{Error: context.Canceled}, true
+	}
+
+	select {
+	case result = <-ch:
+		return result, true
+	case <-ctx.Done():
+		return wormhole.SendResult{Error: ctx.Err()}, true
+	}
+}
+
+// send starts sending the file or directory at path. The returned
+// Closer must be closed once the send is over.
+func (d *Daemon) send(ctx context.Context, path string, opts []wormhole.TransferOption) (string, chan wormhole.SendResult, io.Closer, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	name := filepath.Base(path)
+
+	if info.IsDir() {
+		entries, err := directoryEntries(path)
+		if err != nil {
+			return "", nil, nil, err
+		}
+
+		code, ch, err := d.client.SendDirectory(ctx, name, entries, d.disableListener, opts...)
+		return code, ch, ioutil.NopCloser(nil), err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	code, ch, err := d.client.SendFile(ctx, name, f, d.disableListener, opts...)
+	if err != nil {
+		f.Close()
+		return "", nil, nil, err
+	}
+
+	return code, ch, f, nil
+}
+
+// directoryEntries returns the regular files and directories under
+// dir. Other files, such as symlinks, are skipped.
+func directoryEntries(dir string) ([]wormhole.DirectoryEntry, error) {
+	var entries []wormhole.DirectoryEntry
+	prefix := filepath.Base(dir)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		entry := wormhole.DirectoryEntry{
+			Path:    prefix + "/" + filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+		if info.Mode().IsRegular() {
+			entry.Reader = func() (io.ReadCloser, error) {
+				return os.Open(path)
+			}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+
+	return entries, err
+}
+
+// permanent reports whether a send that failed with err should not
+// be retried.
+func permanent(err error) bool {
+	var peerErr *wormhole.PeerError
+	return errors.Is(err, wormhole.ErrBadCode) ||
+		errors.Is(err, wormhole.ErrTransferRejected) ||
+		errors.As(err, &peerErr) ||
+		errors.Is(err, os.ErrNotExist)
+}
+
+// reclaimed reports whether err is the rendezvous server refusing to
+// let a side claim a nameplate it has already released.
+func reclaimed(err error) bool {
+	var serverErr *wormhole.ServerError
+	return errors.As(err, &serverErr) && serverErr.Message == "reclaimed"
+}
+
+// update calls f on item id and saves the queue, unless the item has
+// been cancelled. It returns a copy of the updated item and whether f
+// was called.
+func (d *Daemon) update(id string, f func(*Item)) (Item, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	item, ok := d.items[id]
+	if !ok || item.State == StateCancelled {
+		return Item{}, false
+	}
+
+	f(item)
+	item.Updated = time.Now()
+
+	// If the queue can't be written the send carries on; the
+	// next change will try again.
+	d.save()
+
+	return *item, true
+}
+
+// save writes the queue to a temporary file and renames it over the
+// old one. d.mu must be held.
+func (d *Daemon) save() error {
+	var state queueState
+	for _, item := range d.items {
+		state.Items = append(state.Items, item)
+	}
+	sort.Slice(state.Items, func(i, j int) bool {
+		return state.Items[i].Added.Before(state.Items[j].Added)
+	})
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), d.path)
+}
@@ -0,0 +1,411 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func newRendezvous(t *testing.T) (*httptest.Server, string) {
+	wormhole.DefaultTransitRelayURL = ""
+	ts := httptest.NewServer(server.NewServer())
+	return ts, "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1"
+}
+
+func newClient(url string) wormhole.Client {
+	var c wormhole.Client
+	c.AppID = wormhole.WormholeCLIAppID
+	c.RendezvousURL = url
+	return c
+}
+
+func waitFor(t *testing.T, d *Daemon, id string, cond func(Item) bool) Item {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		item, err := d.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond(item) {
+			return item
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for item, got %+v", item)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasCode(item Item) bool {
+	return item.Code != "" && item.State == StateWaiting
+}
+
+type testObserver struct {
+	mu      sync.Mutex
+	results []wormhole.SendResult
+}
+
+func (o *testObserver) SendFinished(item Item, result wormhole.SendResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.results = append(o.results, result)
+}
+
+func TestDaemonSend(t *testing.T) {
+	ctx := context.Background()
+
+	ts, url := newRendezvous(t)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "wormhole-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("fire and forget")
+	file := filepath.Join(dir, "report.txt")
+	err = ioutil.WriteFile(file, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var obs testObserver
+	d, err := New(newClient(url), filepath.Join(dir, "queue.json"), WithObserver(&obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	item, err := d.Enqueue(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.State != StatePending || item.Path != file {
+		t.Fatalf("got item %+v", item)
+	}
+
+	item = waitFor(t, d, item.ID, hasCode)
+
+	c := newClient(url)
+	msg, err := c.Receive(ctx, item.Code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Name != "report.txt" {
+		t.Fatalf("got name %q", msg.Name)
+	}
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("got %q expected %q", got, content)
+	}
+
+	item = waitFor(t, d, item.ID, func(item Item) bool { return item.State.Finished() })
+	if item.State != StateSent || item.Attempts != 1 {
+		t.Fatalf("got item %+v", item)
+	}
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if len(obs.results) != 1 || !obs.results[0].OK {
+		t.Fatalf("got results %+v", obs.results)
+	}
+}
+
+func TestDaemonRejected(t *testing.T) {
+	ctx := context.Background()
+
+	ts, url := newRendezvous(t)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "wormhole-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "photos")
+	err = os.Mkdir(sub, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sub, "a.jpg"), []byte("jpeg"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(newClient(url), filepath.Join(dir, "queue.json"), WithRetryDelay(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	item, err := d.Enqueue(sub, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item = waitFor(t, d, item.ID, hasCode)
+
+	c := newClient(url)
+	msg, err := c.Receive(ctx, item.Code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != wormhole.TransferDirectory || msg.Name != "photos" {
+		t.Fatalf("got %s %q", msg.Type, msg.Name)
+	}
+	err = msg.Reject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rejection is final, so the send isn't retried
+	item = waitFor(t, d, item.ID, func(item Item) bool { return item.State.Finished() })
+	if item.State != StateFailed || item.Attempts != 1 || item.Error == "" {
+		t.Fatalf("got item %+v", item)
+	}
+}
+
+func TestDaemonResume(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "wormhole-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "notes.txt")
+	err = ioutil.WriteFile(file, []byte("notes"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := filepath.Join(dir, "queue.json")
+
+	deadServer, deadURL := newRendezvous(t)
+	deadServer.Close()
+
+	d, err := New(newClient(deadURL), queue, WithRetryDelay(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Enqueue(file, "not-a-code")
+	if err == nil {
+		t.Fatal("expected an error for a bad code")
+	}
+
+	code := "8-daemon-resume"
+	item, err := d.Enqueue(file, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is down, so it keeps retrying
+	item = waitFor(t, d, item.ID, func(item Item) bool { return item.Attempts >= 2 })
+	if item.State != StatePending || item.Error == "" {
+		t.Fatalf("got item %+v", item)
+	}
+
+	d.Close()
+	_, err = d.Enqueue(file, "")
+	if err != ErrClosed {
+		t.Fatalf("got %v expected ErrClosed", err)
+	}
+
+	ts, url := newRendezvous(t)
+	defer ts.Close()
+
+	d, err = New(newClient(url), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	items := d.List()
+	if len(items) != 1 || items[0].ID != item.ID || items[0].Code != code || items[0].SideID != item.SideID {
+		t.Fatalf("got items %+v after restart, expected %+v", items, item)
+	}
+
+	waitFor(t, d, item.ID, hasCode)
+
+	c := newClient(url)
+	msg, err := c.Receive(ctx, code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "notes" {
+		t.Fatalf("got %q", got)
+	}
+
+	waitFor(t, d, item.ID, func(item Item) bool { return item.State == StateSent })
+
+	// a new item gets the next ID
+	next, err := d.Enqueue(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != "2" {
+		t.Fatalf("got ID %q expected 2", next.ID)
+	}
+}
+
+func TestDaemonRestartWhileWaiting(t *testing.T) {
+	ctx := context.Background()
+
+	ts, url := newRendezvous(t)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "wormhole-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "notes.txt")
+	err = ioutil.WriteFile(file, []byte("notes"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := filepath.Join(dir, "queue.json")
+
+	d, err := New(newClient(url), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item, err := d.Enqueue(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item = waitFor(t, d, item.ID, hasCode)
+
+	// the first attempt's PAKE message is left in the mailbox
+	d.Close()
+
+	d, err = New(newClient(url), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	waitFor(t, d, item.ID, func(item Item) bool { return hasCode(item) && item.Attempts == 2 })
+
+	c := newClient(url)
+	msg, err := c.Receive(ctx, item.Code, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "notes" {
+		t.Fatalf("got %q", got)
+	}
+
+	waitFor(t, d, item.ID, func(item Item) bool { return item.State == StateSent })
+}
+
+func TestDaemonAPI(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "wormhole-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "a.txt")
+	err = ioutil.WriteFile(file, []byte("a"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadServer, deadURL := newRendezvous(t)
+	deadServer.Close()
+
+	d, err := New(newClient(deadURL), filepath.Join(dir, "queue.json"), WithRetryDelay(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	socket := filepath.Join(dir, "daemon.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: d}
+	go hs.Serve(l)
+	defer hs.Close()
+
+	c := NewClient(socket)
+
+	item, err := c.Enqueue(ctx, file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.ID != "1" || item.Path != file {
+		t.Fatalf("got item %+v", item)
+	}
+
+	_, err = c.Enqueue(ctx, filepath.Join(dir, "missing"), "")
+	if err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+
+	items, err := c.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].ID != "1" {
+		t.Fatalf("got items %+v", items)
+	}
+
+	item, err = c.Cancel(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.State != StateCancelled {
+		t.Fatalf("got item %+v", item)
+	}
+
+	item, err = c.Get(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.State != StateCancelled {
+		t.Fatalf("got item %+v", item)
+	}
+
+	_, err = c.Cancel(ctx, "1")
+	if !errors.Is(err, ErrFinished) {
+		t.Fatalf("got %v expected ErrFinished", err)
+	}
+
+	_, err = c.Get(ctx, "7")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v expected ErrNotFound", err)
+	}
+}
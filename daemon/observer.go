@@ -0,0 +1,17 @@
+package daemon
+
+import "github.com/psanford/wormhole-william/wormhole"
+
+// An Observer is told the outcome of every send attempt. Its methods
+// are called from the Daemon's goroutines, so they must be safe for
+// concurrent use.
+type Observer interface {
+	// SendFinished is called when an attempt to send item ends,
+	// with the attempt's result. item.State says whether the send
+	// will be retried.
+	SendFinished(item Item, result wormhole.SendResult)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) SendFinished(Item, wormhole.SendResult) {}
@@ -0,0 +1,52 @@
+package daemon
+
+import "time"
+
+// An Option configures a Daemon.
+type Option interface {
+	setValue(*Daemon)
+}
+
+type retryDelayOption struct {
+	min, max time.Duration
+}
+
+func (o *retryDelayOption) setValue(d *Daemon) {
+	d.minDelay = o.min
+	d.maxDelay = o.max
+}
+
+// WithRetryDelay returns an Option that sets the delay before the
+// first retry of a failed send and the most it may grow to, as it
+// doubles after every failed attempt. The defaults are
+// DefaultMinRetryDelay and DefaultMaxRetryDelay.
+func WithRetryDelay(min, max time.Duration) Option {
+	return &retryDelayOption{min: min, max: max}
+}
+
+type disableListenerOption struct{}
+
+func (o *disableListenerOption) setValue(d *Daemon) {
+	d.disableListener = true
+}
+
+// WithDisableListener returns an Option that stops the Daemon from
+// listening for direct transit connections, so transfers go through
+// the transit relay.
+func WithDisableListener() Option {
+	return &disableListenerOption{}
+}
+
+type observerOption struct {
+	observer Observer
+}
+
+func (o *observerOption) setValue(d *Daemon) {
+	d.observer = o.observer
+}
+
+// WithObserver returns an Option that reports the outcome of every
+// send attempt to o.
+func WithObserver(o Observer) Option {
+	return &observerOption{observer: o}
+}
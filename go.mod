@@ -1,6 +1,6 @@
 module github.com/psanford/wormhole-william
 
-go 1.12
+go 1.13
 
 require (
 	github.com/LeastAuthority/hashcash v0.0.0-20210810065817-5a4897056c24
@@ -11,5 +11,6 @@ require (
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
 	nhooyr.io/websocket v1.8.6
+	rsc.io/qr v0.2.0
 	salsa.debian.org/vasudev/gospake2 v0.0.0-20180813171123-adcc69dd31d5
 )
@@ -0,0 +1,11 @@
+package internal
+
+import (
+	"context"
+	"net"
+)
+
+// ContextDialer is implemented by net.Dialer and by proxy dialers.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
@@ -0,0 +1,652 @@
+// Package msgpack implements the subset of the MessagePack
+// serialization format needed by the wormhole transfer protocols.
+//
+// Structs are encoded as maps keyed by field name. The `msgpack`
+// struct tag can be used to rename a field, to skip it ("-") or to
+// omit it when it has its zero value ("name,omitempty").
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the MessagePack encoded data into the value
+// pointed to by v. Map keys that do not match any struct field are
+// ignored.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("msgpack: Unmarshal requires a non-nil pointer")
+	}
+
+	d := decoder{data: data}
+	err := d.decodeValue(rv.Elem())
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		encodeInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		encodeUint(buf, v.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		encodeString(buf, v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if v.Type() == bytesType || v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeBin(buf, v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		encodeLen(buf, v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			err := encodeValue(buf, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		encodeLen(buf, v.Len(), 0x80, 0xde, 0xdf)
+		iter := v.MapRange()
+		for iter.Next() {
+			err := encodeValue(buf, iter.Key())
+			if err != nil {
+				return err
+			}
+			err = encodeValue(buf, iter.Value())
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		var include []field
+		for _, f := range fields {
+			if f.omitEmpty && isEmptyValue(v.Field(f.index)) {
+				continue
+			}
+			include = append(include, f)
+		}
+		encodeLen(buf, len(include), 0x80, 0xde, 0xdf)
+		for _, f := range include {
+			encodeString(buf, f.name)
+			err := encodeValue(buf, v.Field(f.index))
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		encodeUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func encodeUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n <= 31:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func encodeBin(buf *bytes.Buffer, b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// encodeLen writes an array or map header using the fix, 16 or 32
+// bit format as appropriate.
+func encodeLen(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n <= 15:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		name := sf.Name
+		var omitEmpty bool
+		if tag, ok := sf.Tag.Lookup("msgpack"); ok {
+			if tag == "-" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     i,
+			omitEmpty: omitEmpty,
+		})
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+var errShortBuffer = errors.New("msgpack: unexpected end of data")
+
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errShortBuffer
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) readUint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// decodeAny decodes the next value into its natural Go
+// representation: nil, bool, int64, uint64, float64, string, []byte,
+// []interface{} or map[string]interface{} (map[interface{}]interface{}
+// if any key is not a string).
+func (d *decoder) decodeAny() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.readString(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.readArray(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.readMap(int(c & 0x0f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 0xca:
+		u, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		u, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(n))
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func (d *decoder) readString(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) readArray(n int) ([]interface{}, error) {
+	// every element takes at least one byte
+	if n > len(d.data)-d.pos {
+		return nil, errShortBuffer
+	}
+	out := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (d *decoder) readMap(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errShortBuffer
+	}
+	strMap := make(map[string]interface{}, n)
+	var anyMap map[interface{}]interface{}
+	for i := 0; i < n; i++ {
+		k, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decodeAny()
+		if err != nil {
+			return nil, err
+		}
+
+		if s, ok := k.(string); ok && anyMap == nil {
+			strMap[s] = v
+			continue
+		}
+
+		if anyMap == nil {
+			anyMap = make(map[interface{}]interface{}, n)
+			for sk, sv := range strMap {
+				anyMap[sk] = sv
+			}
+		}
+		if !reflect.TypeOf(k).Comparable() {
+			return nil, errors.New("msgpack: unhashable map key")
+		}
+		anyMap[k] = v
+	}
+	if anyMap != nil {
+		return anyMap, nil
+	}
+	return strMap, nil
+}
+
+func (d *decoder) decodeValue(v reflect.Value) error {
+	raw, err := d.decodeAny()
+	if err != nil {
+		return err
+	}
+	return assign(v, raw)
+}
+
+// assign stores the generic decoded value src into dst, converting
+// it to dst's type.
+func assign(dst reflect.Value, src interface{}) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into %s", dst.Type())
+		}
+		dst.Set(reflect.ValueOf(src))
+		return nil
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return assign(dst.Elem(), src)
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return typeError(src, dst)
+		}
+		dst.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch n := src.(type) {
+		case int64:
+			i = n
+		default:
+			return typeError(src, dst)
+		}
+		if dst.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, dst.Type())
+		}
+		dst.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch n := src.(type) {
+		case int64:
+			if n < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", n, dst.Type())
+			}
+			u = uint64(n)
+		case uint64:
+			u = n
+		default:
+			return typeError(src, dst)
+		}
+		if dst.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, dst.Type())
+		}
+		dst.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch n := src.(type) {
+		case float64:
+			dst.SetFloat(n)
+		case int64:
+			dst.SetFloat(float64(n))
+		case uint64:
+			dst.SetFloat(float64(n))
+		default:
+			return typeError(src, dst)
+		}
+		return nil
+	case reflect.String:
+		switch s := src.(type) {
+		case string:
+			dst.SetString(s)
+		case []byte:
+			dst.SetString(string(s))
+		default:
+			return typeError(src, dst)
+		}
+		return nil
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := src.(type) {
+			case []byte:
+				dst.SetBytes(b)
+			case string:
+				dst.SetBytes([]byte(b))
+			default:
+				return typeError(src, dst)
+			}
+			return nil
+		}
+		arr, ok := src.([]interface{})
+		if !ok {
+			return typeError(src, dst)
+		}
+		out := reflect.MakeSlice(dst.Type(), len(arr), len(arr))
+		for i, elem := range arr {
+			err := assign(out.Index(i), elem)
+			if err != nil {
+				return err
+			}
+		}
+		dst.Set(out)
+		return nil
+	case reflect.Map:
+		out := reflect.MakeMap(dst.Type())
+		err := eachMapEntry(src, func(k, v interface{}) error {
+			kv := reflect.New(dst.Type().Key()).Elem()
+			err := assign(kv, k)
+			if err != nil {
+				return err
+			}
+			vv := reflect.New(dst.Type().Elem()).Elem()
+			err = assign(vv, v)
+			if err != nil {
+				return err
+			}
+			out.SetMapIndex(kv, vv)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		dst.Set(out)
+		return nil
+	case reflect.Struct:
+		fields := make(map[string]int)
+		for _, f := range structFields(dst.Type()) {
+			fields[f.name] = f.index
+		}
+		return eachMapEntry(src, func(k, v interface{}) error {
+			name, ok := k.(string)
+			if !ok {
+				return nil
+			}
+			idx, ok := fields[name]
+			if !ok {
+				return nil
+			}
+			return assign(dst.Field(idx), v)
+		})
+	}
+
+	return fmt.Errorf("msgpack: cannot decode into %s", dst.Type())
+}
+
+func eachMapEntry(src interface{}, f func(k, v interface{}) error) error {
+	switch m := src.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot decode %T into map or struct", src)
+	}
+	return nil
+}
+
+func typeError(src interface{}, dst reflect.Value) error {
+	return fmt.Errorf("msgpack: cannot decode %T into %s", src, dst.Type())
+}
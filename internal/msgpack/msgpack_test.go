@@ -0,0 +1,125 @@
+package msgpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal_knownEncodings(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    interface{}
+		expected string
+	}{
+		{name: "nil", input: nil, expected: "c0"},
+		{name: "true", input: true, expected: "c3"},
+		{name: "positive fixint", input: 7, expected: "07"},
+		{name: "negative fixint", input: -1, expected: "ff"},
+		{name: "uint16", input: 1000, expected: "cd03e8"},
+		{name: "int8", input: -100, expected: "d09c"},
+		{name: "int32", input: -100000, expected: "d2fffe7960"},
+		{name: "fixstr", input: "abc", expected: "a3616263"},
+		{name: "bin", input: []byte{1, 2}, expected: "c4020102"},
+		{name: "array", input: []int{1, 2}, expected: "920102"},
+		{name: "map", input: map[string]int{"a": 1}, expected: "81a16101"},
+		{name: "float64", input: 1.5, expected: "cb3ff8000000000000"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Marshal(tc.input)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, hex.EncodeToString(got))
+		})
+	}
+}
+
+type testOffer struct {
+	Filename  string   `msgpack:"filename"`
+	Bytes     int64    `msgpack:"bytes"`
+	Final     bool     `msgpack:"final,omitempty"`
+	Tags      []string `msgpack:"tags,omitempty"`
+	Skipped   string   `msgpack:"-"`
+	Untagged  uint32
+	Data      []byte `msgpack:"data,omitempty"`
+	unexposed int
+}
+
+func TestMarshal_structRoundTrip(t *testing.T) {
+	in := testOffer{
+		Filename:  strings.Repeat("x", 300),
+		Bytes:     32098461509,
+		Final:     true,
+		Tags:      []string{"a", "b"},
+		Skipped:   "skipped",
+		Untagged:  70000,
+		Data:      make([]byte, 70000),
+		unexposed: 3,
+	}
+
+	b, err := Marshal(in)
+	require.NoError(t, err)
+
+	var out testOffer
+	err = Unmarshal(b, &out)
+	require.NoError(t, err)
+
+	in.Skipped = ""
+	in.unexposed = 0
+	assert.Equal(t, in, out)
+}
+
+func TestMarshal_omitEmpty(t *testing.T) {
+	b, err := Marshal(testOffer{Filename: "f"})
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	err = Unmarshal(b, &m)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"filename": "f",
+		"bytes":    int64(0),
+		"Untagged": int64(0),
+	}, m)
+}
+
+func TestUnmarshal_errors(t *testing.T) {
+	var offer testOffer
+
+	// truncated fixstr
+	err := Unmarshal([]byte{0x81, 0xa8, 'f'}, &offer)
+	assert.Error(t, err)
+
+	// trailing data
+	err = Unmarshal([]byte{0x01, 0x02}, new(int))
+	assert.Error(t, err)
+
+	// overflow
+	err = Unmarshal([]byte{0xcd, 0x03, 0xe8}, new(int8))
+	assert.Error(t, err)
+
+	// type mismatch
+	err = Unmarshal([]byte{0x81, 0xa5, 'b', 'y', 't', 'e', 's', 0xa1, 'x'}, &offer)
+	assert.Error(t, err)
+
+	err = Unmarshal([]byte{0x01}, offer)
+	assert.Error(t, err)
+}
+
+func TestUnmarshal_ignoresUnknownKeys(t *testing.T) {
+	b, err := Marshal(map[string]interface{}{
+		"filename": "f.txt",
+		"future":   []interface{}{1, "two", nil},
+	})
+	require.NoError(t, err)
+
+	var offer testOffer
+	err = Unmarshal(b, &offer)
+	require.NoError(t, err)
+	assert.Equal(t, "f.txt", offer.Filename)
+}
@@ -0,0 +1,302 @@
+// Package socks5 implements the client side of the SOCKS5 protocol
+// (RFC 1928), with optional username/password authentication
+// (RFC 1929), for making TCP connections through a proxy such as Tor.
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	version5 = 0x05
+
+	authNone         = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xff
+
+	userPassVersion = 0x01
+
+	cmdConnect = 0x01
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// DefaultTorAddr is the address of the SOCKS port of a locally
+// running Tor daemon.
+const DefaultTorAddr = "127.0.0.1:9050"
+
+// A Dialer makes TCP connections through a SOCKS5 proxy. Host names
+// are passed to the proxy unresolved, so no DNS lookups are made
+// locally.
+type Dialer struct {
+	// ProxyAddr is the host:port of the SOCKS5 proxy.
+	ProxyAddr string
+
+	// Username and Password are used to authenticate to the proxy
+	// if Username is not empty.
+	Username string
+	Password string
+
+	// HandshakeTimeout limits how long the SOCKS5 handshake may
+	// take. If zero, only the context passed to DialContext applies.
+	HandshakeTimeout time.Duration
+}
+
+// ParseURL returns a Dialer for a proxy url of the form
+// socks5://[user:password@]host:port. A plain host:port is also
+// accepted.
+func ParseURL(rawurl string) (*Dialer, error) {
+	if !strings.Contains(rawurl, "://") {
+		if _, _, err := net.SplitHostPort(rawurl); err != nil {
+			return nil, err
+		}
+		return &Dialer{ProxyAddr: rawurl}, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy url %q has no port", rawurl)
+	}
+
+	d := Dialer{
+		ProxyAddr: u.Host,
+	}
+	if u.User != nil {
+		d.Username = u.User.Username()
+		d.Password, _ = u.User.Password()
+	}
+
+	return &d, nil
+}
+
+// DialContext connects to address through the proxy. Only the tcp,
+// tcp4 and tcp6 networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5: unsupported network %q", network)
+	}
+
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if d.HandshakeTimeout > 0 {
+		timeout := time.Now().Add(d.HandshakeTimeout)
+		if !hasDeadline || timeout.Before(deadline) {
+			deadline = timeout
+			hasDeadline = true
+		}
+	}
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+
+	// Abort the handshake if ctx is cancelled while we are waiting
+	// on the proxy.
+	done := make(chan struct{})
+	ctxErr := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			ctxErr <- ctx.Err()
+		case <-done:
+			ctxErr <- nil
+		}
+	}()
+
+	err = d.handshake(conn, address)
+	close(done)
+
+	if cerr := <-ctxErr; cerr != nil {
+		conn.Close()
+		return nil, cerr
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("socks5: invalid port in %q", address)
+	}
+
+	methods := []byte{authNone}
+	if d.Username != "" {
+		methods = []byte{authUserPass}
+	}
+
+	greeting := append([]byte{version5, byte(len(methods))}, methods...)
+	_, err = conn.Write(greeting)
+	if err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	_, err = io.ReadFull(conn, resp[:])
+	if err != nil {
+		return err
+	}
+	if resp[0] != version5 {
+		return fmt.Errorf("socks5: unexpected proxy version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case authNone:
+	case authUserPass:
+		err = d.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case authNoAcceptable:
+		return errors.New("socks5: proxy rejected authentication methods")
+	default:
+		return fmt.Errorf("socks5: proxy selected unsupported authentication method %d", resp[1])
+	}
+
+	req := []byte{version5, cmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, atypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, atypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name too long: %q", host)
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != version5 {
+		return fmt.Errorf("socks5: unexpected proxy version %d", reply[0])
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5: connect to %s failed: %s", address, replyString(reply[1]))
+	}
+
+	var addrLen int
+	switch reply[3] {
+	case atypIPv4:
+		addrLen = net.IPv4len
+	case atypIPv6:
+		addrLen = net.IPv6len
+	case atypDomain:
+		var l [1]byte
+		_, err = io.ReadFull(conn, l[:])
+		if err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d in reply", reply[3])
+	}
+
+	// skip the bound address and port
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func (d *Dialer) authenticate(conn net.Conn) error {
+	if d.Username == "" {
+		return errors.New("socks5: proxy requires a username and password")
+	}
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+
+	req := []byte{userPassVersion, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	_, err = io.ReadFull(conn, resp[:])
+	if err != nil {
+		return err
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5: proxy rejected username or password")
+	}
+
+	return nil
+}
+
+func replyString(code byte) string {
+	switch code {
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown error %d", code)
+	}
+}
@@ -0,0 +1,320 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testProxy is a minimal SOCKS5 server that connects to the requested
+// address itself and records what it was asked for.
+type testProxy struct {
+	ln       net.Listener
+	username string
+	password string
+	reply    byte
+
+	requests chan string
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	p := &testProxy{
+		ln:       ln,
+		requests: make(chan string, 10),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *testProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *testProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if p.username != "" {
+		conn.Write([]byte{version5, authUserPass})
+
+		var b [1]byte
+		io.ReadFull(conn, b[:]) // version
+		io.ReadFull(conn, b[:])
+		user := make([]byte, b[0])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, b[:])
+		pass := make([]byte, b[0])
+		io.ReadFull(conn, pass)
+
+		if string(user) != p.username || string(pass) != p.password {
+			conn.Write([]byte{userPassVersion, 0x01})
+			return
+		}
+		conn.Write([]byte{userPassVersion, 0x00})
+	} else {
+		conn.Write([]byte{version5, authNone})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case atypIPv4:
+		ip := make([]byte, net.IPv4len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case atypIPv6:
+		ip := make([]byte, net.IPv6len)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case atypDomain:
+		var l [1]byte
+		io.ReadFull(conn, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var portBytes [2]byte
+	io.ReadFull(conn, portBytes[:])
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	p.requests <- addr
+
+	if p.reply != 0 {
+		conn.Write([]byte{version5, p.reply, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+
+	if host == "localhost" {
+		addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	}
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{version5, 0x05, 0x00, atypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	conn.Write([]byte{version5, 0x00, 0x00, atypDomain, 4, 'p', 'r', 'o', 'x', 0, 0})
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func newEchoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestDialContext(t *testing.T) {
+	echo := newEchoServer(t)
+	defer echo.Close()
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		username   string
+		password   string
+		target     string
+		wantTarget string
+	}{
+		{
+			name:       "IPv4 target",
+			target:     echo.Addr().String(),
+			wantTarget: echo.Addr().String(),
+		},
+		{
+			name:       "host name is resolved by proxy",
+			target:     net.JoinHostPort("localhost", port),
+			wantTarget: net.JoinHostPort("localhost", port),
+		},
+		{
+			name:       "username and password",
+			username:   "alice",
+			password:   "hunter2",
+			target:     echo.Addr().String(),
+			wantTarget: echo.Addr().String(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := newTestProxy(t)
+			defer proxy.ln.Close()
+			proxy.username = tc.username
+			proxy.password = tc.password
+
+			d := Dialer{
+				ProxyAddr: proxy.ln.Addr().String(),
+				Username:  tc.username,
+				Password:  tc.password,
+			}
+
+			conn, err := d.DialContext(context.Background(), "tcp", tc.target)
+			require.NoError(t, err)
+			defer conn.Close()
+
+			assert.Equal(t, tc.wantTarget, <-proxy.requests)
+
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+
+			got := make([]byte, 5)
+			_, err = io.ReadFull(conn, got)
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(got))
+		})
+	}
+}
+
+func TestDialContext_errors(t *testing.T) {
+	t.Run("connect refused by proxy", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		defer proxy.ln.Close()
+		proxy.reply = 0x05
+
+		d := Dialer{ProxyAddr: proxy.ln.Addr().String()}
+		_, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection refused")
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		proxy := newTestProxy(t)
+		defer proxy.ln.Close()
+		proxy.username = "alice"
+		proxy.password = "hunter2"
+
+		d := Dialer{
+			ProxyAddr: proxy.ln.Addr().String(),
+			Username:  "alice",
+			Password:  "wrong",
+		}
+		_, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rejected username or password")
+	})
+
+	t.Run("unsupported network", func(t *testing.T) {
+		d := Dialer{ProxyAddr: "127.0.0.1:1"}
+		_, err := d.DialContext(context.Background(), "udp", "example.com:80")
+		require.Error(t, err)
+	})
+
+	t.Run("context cancelled during handshake", func(t *testing.T) {
+		// a proxy that accepts connections but never answers
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		d := Dialer{ProxyAddr: ln.Addr().String()}
+		_, err = d.DialContext(ctx, "tcp", "example.com:80")
+		require.Error(t, err)
+	})
+}
+
+func TestParseURL(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected Dialer
+		wantErr  bool
+	}{
+		{
+			name:     "host and port",
+			input:    "127.0.0.1:9050",
+			expected: Dialer{ProxyAddr: "127.0.0.1:9050"},
+		},
+		{
+			name:     "socks5 url",
+			input:    "socks5://proxy.example.com:1080",
+			expected: Dialer{ProxyAddr: "proxy.example.com:1080"},
+		},
+		{
+			name:     "socks5 url with credentials",
+			input:    "socks5://alice:hunter2@[::1]:1080",
+			expected: Dialer{ProxyAddr: "[::1]:1080", Username: "alice", Password: "hunter2"},
+		},
+		{
+			name:    "missing port",
+			input:   "socks5://proxy.example.com",
+			wantErr: true,
+		},
+		{
+			name:    "wrong scheme",
+			input:   "http://proxy.example.com:8080",
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			input:   "proxy.example.com",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := ParseURL(tc.input)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, *d)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// +build !js
+
+package internal
+
+import (
+	"errors"
+	"net/http"
+
+	"nhooyr.io/websocket"
+)
+
+// WebsocketDialOptions returns a copy of opts for websocket.Dial that
+// makes the underlying connection with d. If opts has an HTTPClient,
+// its transport is copied and made to dial with d; a transport that
+// isn't an *http.Transport can't be, and is an error. Either argument
+// may be nil.
+func WebsocketDialOptions(opts *websocket.DialOptions, d ContextDialer) (*websocket.DialOptions, error) {
+	if d == nil {
+		return opts, nil
+	}
+
+	var result websocket.DialOptions
+	if opts != nil {
+		result = *opts
+	}
+
+	if result.HTTPClient == nil {
+		result.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: d.DialContext,
+			},
+		}
+		return &result, nil
+	}
+
+	var transport *http.Transport
+	switch t := result.HTTPClient.Transport.(type) {
+	case nil:
+		transport = &http.Transport{}
+	case *http.Transport:
+		if t.DialTLS != nil {
+			return nil, errors.New("can't use a dialer with an HTTP transport that sets DialTLS")
+		}
+		transport = t.Clone()
+	default:
+		return nil, errors.New("can't use a dialer with a custom HTTP transport")
+	}
+	transport.DialContext = d.DialContext
+
+	client := *result.HTTPClient
+	client.Transport = transport
+	result.HTTPClient = &client
+
+	return &result, nil
+}
@@ -0,0 +1,13 @@
+// +build js
+
+package internal
+
+import (
+	"nhooyr.io/websocket"
+)
+
+// WebsocketDialOptions returns opts unchanged: browsers make websocket
+// connections themselves, so a custom dialer cannot be used.
+func WebsocketDialOptions(opts *websocket.DialOptions, d ContextDialer) (*websocket.DialOptions, error) {
+	return opts, nil
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import "math"
+
+var (
+	// durationBuckets are the upper bounds, in seconds, of the
+	// duration histograms.
+	durationBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+	// byteBuckets are the upper bounds of the byte count histograms.
+	byteBuckets = []float64{1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10}
+)
+
+// histogram counts observations in cumulative buckets, the way
+// Prometheus histograms do.
+type histogram struct {
+	bounds []float64
+	// counts[i] is the number of observations <= bounds[i].
+	counts []uint64
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	h.max = math.Max(h.max, v)
+}
+
+// Distribution summarizes a set of observations.
+type Distribution struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+}
+
+func (h *histogram) distribution() Distribution {
+	d := Distribution{
+		Count: h.count,
+		Sum:   h.sum,
+		Max:   h.max,
+	}
+	if h.count > 0 {
+		d.Mean = h.sum / float64(h.count)
+	}
+	return d
+}
@@ -0,0 +1,313 @@
+// Package metrics collects usage metrics from a rendezvous server and
+// a transit relay and serves them over HTTP, in the Prometheus text
+// format or as a JSON summary.
+//
+// A Collector is both a server.Observer and a transit.Observer:
+//
+//	c := metrics.NewCollector()
+//	rs := server.NewServer(server.WithObserver(c))
+//	ts := transit.NewServer(transit.WithObserver(c))
+//	c.WatchRendezvous(rs)
+//	c.WatchTransit(ts)
+//	http.Handle("/metrics", c)
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/psanford/wormhole-william/transit"
+)
+
+// A Collector accumulates metrics. Create one with NewCollector.
+type Collector struct {
+	mu sync.Mutex
+
+	rendezvous *server.Server
+	transit    *transit.Server
+
+	nameplatesCreated uint64
+	nameplatesDeleted uint64
+	mailboxesClosed   map[string]uint64
+	mailboxDuration   *histogram
+	mailboxMessages   *histogram
+
+	transitSessionBytes *histogram
+	transitMoods        map[string]uint64
+	transitBytes        uint64
+	transitDuration     *histogram
+	transitWaited       *histogram
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		mailboxesClosed:     make(map[string]uint64),
+		mailboxDuration:     newHistogram(durationBuckets),
+		mailboxMessages:     newHistogram([]float64{1, 2, 4, 8, 16, 32, 64}),
+		transitSessionBytes: newHistogram(byteBuckets),
+		transitMoods:        make(map[string]uint64),
+		transitDuration:     newHistogram(durationBuckets),
+		transitWaited:       newHistogram(durationBuckets),
+	}
+}
+
+// WatchRendezvous adds the current state of s, from s.Stats, to the
+// metrics served by c.
+func (c *Collector) WatchRendezvous(s *server.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rendezvous = s
+}
+
+// WatchTransit adds the current state of s, from s.Stats, to the
+// metrics served by c.
+func (c *Collector) WatchTransit(s *transit.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transit = s
+}
+
+// NameplateCreated implements server.Observer.
+func (c *Collector) NameplateCreated(appID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nameplatesCreated++
+}
+
+// NameplateDeleted implements server.Observer.
+func (c *Collector) NameplateDeleted(appID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nameplatesDeleted++
+}
+
+// MailboxClosed implements server.Observer.
+func (c *Collector) MailboxClosed(u server.MailboxUsage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mailboxesClosed[u.Mood]++
+	c.mailboxDuration.observe(u.Duration.Seconds())
+	c.mailboxMessages.observe(float64(u.Messages))
+}
+
+// SessionEnded implements transit.Observer.
+func (c *Collector) SessionEnded(s transit.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transitMoods[s.Mood]++
+	c.transitWaited.observe(s.Waited.Seconds())
+	if s.Mood == "happy" {
+		c.transitBytes += uint64(s.BytesRelayed)
+		c.transitSessionBytes.observe(float64(s.BytesRelayed))
+		c.transitDuration.observe(s.Duration.Seconds())
+	}
+}
+
+// Summary is the JSON form of a Collector's metrics.
+type Summary struct {
+	Rendezvous RendezvousSummary `json:"rendezvous"`
+	Transit    TransitSummary    `json:"transit"`
+}
+
+// RendezvousSummary summarizes the activity of a rendezvous server.
+// The current counts are only set if the server is being watched.
+type RendezvousSummary struct {
+	Connections       int               `json:"connections"`
+	Nameplates        int               `json:"nameplates"`
+	Mailboxes         int               `json:"mailboxes"`
+	NameplatesCreated uint64            `json:"nameplates_created"`
+	NameplatesDeleted uint64            `json:"nameplates_deleted"`
+	MailboxesClosed   map[string]uint64 `json:"mailboxes_closed"`
+	MailboxDuration   Distribution      `json:"mailbox_duration_seconds"`
+	MailboxMessages   Distribution      `json:"mailbox_messages"`
+}
+
+// TransitSummary summarizes the activity of a transit relay. The
+// current counts are only set if the relay is being watched.
+type TransitSummary struct {
+	Connections     int               `json:"connections"`
+	Waiting         int               `json:"waiting"`
+	Sessions        int               `json:"sessions"`
+	Moods           map[string]uint64 `json:"moods"`
+	BytesRelayed    uint64            `json:"bytes_relayed"`
+	SessionBytes    Distribution      `json:"session_bytes"`
+	SessionDuration Distribution      `json:"session_duration_seconds"`
+	Waited          Distribution      `json:"waited_seconds"`
+}
+
+// Summary returns a snapshot of c's metrics.
+func (c *Collector) Summary() Summary {
+	var sum Summary
+
+	c.mu.Lock()
+	rendezvous, relay := c.rendezvous, c.transit
+	c.mu.Unlock()
+
+	// Stats takes the servers' locks, so call it before taking
+	// ours. Observers are called with those locks held.
+	if rendezvous != nil {
+		stats, err := rendezvous.Stats()
+		if err == nil {
+			sum.Rendezvous.Connections = stats.Connections
+			sum.Rendezvous.Nameplates = stats.Nameplates
+			sum.Rendezvous.Mailboxes = stats.Mailboxes
+		}
+	}
+	if relay != nil {
+		stats := relay.Stats()
+		sum.Transit.Connections = stats.Connections
+		sum.Transit.Waiting = stats.Waiting
+		sum.Transit.Sessions = stats.Sessions
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sum.Rendezvous.NameplatesCreated = c.nameplatesCreated
+	sum.Rendezvous.NameplatesDeleted = c.nameplatesDeleted
+	sum.Rendezvous.MailboxesClosed = copyCounts(c.mailboxesClosed)
+	sum.Rendezvous.MailboxDuration = c.mailboxDuration.distribution()
+	sum.Rendezvous.MailboxMessages = c.mailboxMessages.distribution()
+
+	sum.Transit.Moods = copyCounts(c.transitMoods)
+	sum.Transit.BytesRelayed = c.transitBytes
+	sum.Transit.SessionBytes = c.transitSessionBytes.distribution()
+	sum.Transit.SessionDuration = c.transitDuration.distribution()
+	sum.Transit.Waited = c.transitWaited.distribution()
+
+	return sum
+}
+
+// ServeHTTP serves c's metrics in the Prometheus text format, or as
+// a JSON Summary if the request has ?format=json or accepts
+// application/json.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(c.Summary())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WritePrometheus(w)
+}
+
+// WritePrometheus writes c's metrics to w in the Prometheus text
+// exposition format.
+func (c *Collector) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	p := &promWriter{w: bw}
+
+	c.mu.Lock()
+	rendezvous, relay := c.rendezvous, c.transit
+	c.mu.Unlock()
+
+	if rendezvous != nil {
+		stats, err := rendezvous.Stats()
+		if err == nil {
+			p.gauge("wormhole_rendezvous_connections", "Connected rendezvous clients.", float64(stats.Connections))
+			p.gauge("wormhole_rendezvous_nameplates", "Nameplates in use.", float64(stats.Nameplates))
+			p.gauge("wormhole_rendezvous_mailboxes", "Open mailboxes.", float64(stats.Mailboxes))
+		}
+	}
+	if relay != nil {
+		stats := relay.Stats()
+		p.gauge("wormhole_transit_connections", "Connected transit clients.", float64(stats.Connections))
+		p.gauge("wormhole_transit_waiting", "Transit clients waiting for their peer.", float64(stats.Waiting))
+		p.gauge("wormhole_transit_sessions", "Transit sessions being relayed.", float64(stats.Sessions))
+	}
+
+	c.mu.Lock()
+	p.counter("wormhole_rendezvous_nameplates_created_total", "Nameplates created.", float64(c.nameplatesCreated))
+	p.counter("wormhole_rendezvous_nameplates_deleted_total", "Nameplates deleted.", float64(c.nameplatesDeleted))
+	p.countersByMood("wormhole_rendezvous_mailboxes_closed_total", "Mailboxes closed, by mood.", c.mailboxesClosed)
+	p.histogram("wormhole_rendezvous_mailbox_duration_seconds", "How long mailboxes existed.", c.mailboxDuration)
+	p.histogram("wormhole_rendezvous_mailbox_messages", "Messages added to each mailbox.", c.mailboxMessages)
+
+	p.countersByMood("wormhole_transit_sessions_total", "Transit sessions and unpaired connections, by mood.", c.transitMoods)
+	p.counter("wormhole_transit_bytes_total", "Bytes relayed.", float64(c.transitBytes))
+	p.histogram("wormhole_transit_session_bytes", "Bytes relayed per session.", c.transitSessionBytes)
+	p.histogram("wormhole_transit_session_duration_seconds", "How long sessions were relayed for.", c.transitDuration)
+	p.histogram("wormhole_transit_waited_seconds", "How long connections waited for their peer.", c.transitWaited)
+	c.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	return bw.Flush()
+}
+
+// promWriter writes metrics in the Prometheus text format, keeping
+// the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, format, args...)
+}
+
+func (p *promWriter) header(name, help, typ string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, help, "gauge")
+	p.printf("%s %s\n", name, formatFloat(v))
+}
+
+func (p *promWriter) counter(name, help string, v float64) {
+	p.header(name, help, "counter")
+	p.printf("%s %s\n", name, formatFloat(v))
+}
+
+func (p *promWriter) countersByMood(name, help string, counts map[string]uint64) {
+	p.header(name, help, "counter")
+
+	moods := make([]string, 0, len(counts))
+	for mood := range counts {
+		moods = append(moods, mood)
+	}
+	sort.Strings(moods)
+
+	for _, mood := range moods {
+		p.printf("%s{mood=%s} %d\n", name, strconv.Quote(mood), counts[mood])
+	}
+}
+
+func (p *promWriter) histogram(name, help string, h *histogram) {
+	p.header(name, help, "histogram")
+	for i, bound := range h.bounds {
+		p.printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.counts[i])
+	}
+	p.printf("%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	p.printf("%s_sum %s\n", name, formatFloat(h.sum))
+	p.printf("%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func copyCounts(m map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/psanford/wormhole-william/transit"
+)
+
+func TestCollectorPrometheus(t *testing.T) {
+	c := NewCollector()
+
+	c.NameplateCreated("appid")
+	c.NameplateCreated("appid")
+	c.NameplateDeleted("appid")
+	c.MailboxClosed(server.MailboxUsage{AppID: "appid", Mood: "happy", Duration: 3 * time.Second, Messages: 4})
+	c.MailboxClosed(server.MailboxUsage{AppID: "appid", Mood: "lonely", Duration: time.Hour})
+
+	c.SessionEnded(transit.Session{Mood: "happy", Waited: time.Second, Duration: 20 * time.Second, BytesRelayed: 5000})
+	c.SessionEnded(transit.Session{Mood: "lonely", Waited: time.Minute})
+
+	var buf bytes.Buffer
+	err := c.WritePrometheus(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE wormhole_rendezvous_nameplates_created_total counter",
+		"wormhole_rendezvous_nameplates_created_total 2",
+		"wormhole_rendezvous_nameplates_deleted_total 1",
+		`wormhole_rendezvous_mailboxes_closed_total{mood="happy"} 1`,
+		`wormhole_rendezvous_mailboxes_closed_total{mood="lonely"} 1`,
+		`wormhole_rendezvous_mailbox_duration_seconds_bucket{le="5"} 1`,
+		`wormhole_rendezvous_mailbox_duration_seconds_bucket{le="+Inf"} 2`,
+		"wormhole_rendezvous_mailbox_duration_seconds_sum 3603",
+		"wormhole_rendezvous_mailbox_duration_seconds_count 2",
+		`wormhole_transit_sessions_total{mood="happy"} 1`,
+		`wormhole_transit_sessions_total{mood="lonely"} 1`,
+		"wormhole_transit_bytes_total 5000",
+		`wormhole_transit_session_bytes_bucket{le="1000"} 0`,
+		`wormhole_transit_session_bytes_bucket{le="10000"} 1`,
+		"wormhole_transit_session_duration_seconds_count 1",
+		"wormhole_transit_waited_seconds_count 2",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("output is missing %q:\n%s", line, out)
+		}
+	}
+
+	// gauges are only reported for watched servers
+	if strings.Contains(out, "wormhole_transit_connections") {
+		t.Errorf("unexpected gauge for unwatched server:\n%s", out)
+	}
+}
+
+func TestCollectorHTTP(t *testing.T) {
+	c := NewCollector()
+
+	rs := server.NewServer(server.WithObserver(c))
+	defer rs.Close()
+	ts := transit.NewServer(transit.WithObserver(c))
+	defer ts.Close()
+
+	c.WatchRendezvous(rs)
+	c.WatchTransit(ts)
+
+	c.SessionEnded(transit.Session{Mood: "happy", Duration: 2 * time.Second, BytesRelayed: 100})
+	c.SessionEnded(transit.Session{Mood: "happy", Duration: 4 * time.Second, BytesRelayed: 300})
+
+	hs := httptest.NewServer(c)
+	defer hs.Close()
+
+	resp, err := http.Get(hs.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "wormhole_transit_connections 0\n") {
+		t.Fatalf("missing transit gauge:\n%s", body)
+	}
+	if !strings.Contains(string(body), "wormhole_rendezvous_mailboxes 0\n") {
+		t.Fatalf("missing rendezvous gauge:\n%s", body)
+	}
+
+	resp, err = http.Get(hs.URL + "/metrics?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	var summary Summary
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.Transit.Moods["happy"] != 2 || summary.Transit.BytesRelayed != 400 {
+		t.Fatalf("got unexpected transit summary %+v", summary.Transit)
+	}
+	if d := summary.Transit.SessionDuration; d.Count != 2 || d.Mean != 3 || d.Max != 4 {
+		t.Fatalf("got unexpected session duration %+v", d)
+	}
+}
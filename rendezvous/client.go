@@ -11,6 +11,7 @@ import (
 	"sync/atomic"
 
 	"github.com/LeastAuthority/hashcash"
+	"github.com/psanford/wormhole-william/internal"
 	"github.com/psanford/wormhole-william/internal/crypto"
 	"github.com/psanford/wormhole-william/rendezvous/internal/msgs"
 	"github.com/psanford/wormhole-william/version"
@@ -35,6 +36,9 @@ func NewClient(url, sideID, appID string, opts ...ClientOption) *Client {
 		pendingMailboxWaiters: make(map[uint32]chan int),
 
 		pendingMsgWaiters: make(map[uint32]chan uint32),
+
+		seenMsgs: make(map[string]bool),
+		done:     make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -44,6 +48,10 @@ func NewClient(url, sideID, appID string, opts ...ClientOption) *Client {
 	return c
 }
 
+// A Dialer makes network connections. net.Dialer implements it, as
+// do proxy dialers.
+type Dialer = internal.ContextDialer
+
 type pendingMsg struct {
 	// id will be monotonically increasing for each received
 	// message so waiters can know if they have seen all the
@@ -64,7 +72,18 @@ type Client struct {
 	agentString  string
 	agentVersion string
 
-	wsClient *websocket.Conn
+	dialer      Dialer
+	dialOptions *websocket.DialOptions
+
+	reconnectPolicy *ReconnectPolicy
+
+	// connMu protects wsClient and the in-flight command, which is
+	// resent if the connection is re-established before it is acked.
+	connMu     sync.Mutex
+	wsClient   *websocket.Conn
+	inflight   interface{}
+	inflightID string
+	closing    bool
 
 	mailboxMsgs           []MailboxEvent
 	pendingMailboxWaiters map[uint32]chan int
@@ -78,8 +97,15 @@ type Client struct {
 	pendingMsgs       []pendingMsg
 	pendingMsgWaiters map[uint32]chan uint32
 
+	// seenMsgs holds the mailbox messages already delivered, so that
+	// messages replayed by the server after a reconnect are dropped.
+	seenMsgs map[string]bool
+
 	clientState clientState
 	err         error
+
+	// done is closed when the connection is lost for good.
+	done chan struct{}
 }
 
 type MailboxEvent struct {
@@ -117,7 +143,19 @@ func (c clientState) String() string {
 
 func (c *Client) closeWithError(err error) {
 	atomic.StoreInt32((*int32)(&c.clientState), int32(stateError))
+	c.pendingMsgMu.Lock()
 	c.err = err
+	c.pendingMsgMu.Unlock()
+}
+
+// closedErr returns the error that stopped the client.
+func (c *Client) closedErr() error {
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+	if c.err == nil {
+		return errors.New("rendezvous connection closed")
+	}
+	return c.err
 }
 
 const (
@@ -140,15 +178,17 @@ func (c *Client) Connect(ctx context.Context) (*ConnectInfo, error) {
 		return nil, fmt.Errorf("current client state %s != pending, cannot connect", c.clientState)
 	}
 
-	var err error
-	c.wsClient, _, err = websocket.Dial(ctx, c.url, nil)
+	conn, err := c.dial(ctx)
 	if err != nil {
-		wrappedErr := fmt.Errorf("dial %s: %s", c.url, err)
-		c.closeWithError(wrappedErr)
-		return nil, wrappedErr
+		c.closeWithError(err)
+		return nil, err
 	}
 
-	go c.readMessages(ctx)
+	c.connMu.Lock()
+	c.wsClient = conn
+	c.connMu.Unlock()
+
+	go c.readMessages(ctx, conn)
 
 	var permType int
 	var welcome msgs.Welcome
@@ -159,7 +199,7 @@ func (c *Client) Connect(ctx context.Context) (*ConnectInfo, error) {
 	}
 
 	if welcome.Welcome.Error != "" {
-		err := fmt.Errorf("server error: %s", err)
+		err := &ServerError{Message: welcome.Welcome.Error}
 		c.closeWithError(err)
 		return nil, err
 	}
@@ -239,6 +279,32 @@ func (c *Client) searchPendingMsgs(ctx context.Context, msgType string) *pending
 	return nil
 }
 
+// searchPendingError removes and returns the server's error for the
+// command with the given id, if there is one.
+func (c *Client) searchPendingError(id string) *ServerError {
+	if id == "" {
+		return nil
+	}
+
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+
+	for i, pending := range c.pendingMsgs {
+		if pending.msgType != "error" {
+			continue
+		}
+		serverErr, origID := parseServerError(pending.raw)
+		if origID == id {
+			orig := c.pendingMsgs
+			c.pendingMsgs = c.pendingMsgs[:i]
+			c.pendingMsgs = append(c.pendingMsgs, orig[i+1:]...)
+			return serverErr
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) registerWaiter() (uint32, <-chan uint32) {
 	nextID := atomic.AddUint32(&c.pendingMsgWaiterCntr, 1)
 	ch := make(chan uint32, 1)
@@ -260,23 +326,51 @@ func (c *Client) deregisterWaiter(id uint32) {
 }
 
 func (c *Client) readMsg(ctx context.Context, m interface{}) error {
+	return c.readReply(ctx, "", m)
+}
+
+// readReply waits for a message like readMsg. If id is not empty, it
+// also returns a *ServerError if the server reports an error for the
+// command with that id instead of replying to it.
+func (c *Client) readReply(ctx context.Context, id string, m interface{}) error {
 	expectMsgType := msgType(m)
 
 	waiterID, ch := c.registerWaiter()
 	defer c.deregisterWaiter(waiterID)
 
-	for {
-		<-ch
-		msg := c.searchPendingMsgs(ctx, expectMsgType)
-		if msg != nil {
+	unmarshal := func(msg *pendingMsg) error {
+		err := json.Unmarshal(msg.raw, m)
+		if err != nil {
+			wrappedErr := fmt.Errorf("JSON unmarshal: %s", err)
+			return wrappedErr
+		}
+
+		return nil
+	}
 
-			err := json.Unmarshal(msg.raw, m)
-			if err != nil {
-				wrappedErr := fmt.Errorf("JSON unmarshal: %s", err)
-				return wrappedErr
+	for {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			// the message may have arrived just before the
+			// connection was lost
+			if msg := c.searchPendingMsgs(ctx, expectMsgType); msg != nil {
+				return unmarshal(msg)
 			}
+			if serverErr := c.searchPendingError(id); serverErr != nil {
+				return serverErr
+			}
+			return c.closedErr()
+		}
 
-			return nil
+		msg := c.searchPendingMsgs(ctx, expectMsgType)
+		if msg != nil {
+			return unmarshal(msg)
+		}
+		if serverErr := c.searchPendingError(id); serverErr != nil {
+			return serverErr
 		}
 	}
 }
@@ -313,7 +407,7 @@ func (c *Client) CreateMailbox(ctx context.Context) (string, error) {
 		c.closeWithError(err)
 		return "", err
 	}
-	c.nameplate = nameplateResp.Nameplate
+	c.setNameplate(nameplateResp.Nameplate)
 
 	err = c.openMailbox(ctx, claimed.Mailbox)
 	if err != nil {
@@ -332,7 +426,7 @@ func (c *Client) AttachMailbox(ctx context.Context, nameplate string) error {
 		c.closeWithError(err)
 		return err
 	}
-	c.nameplate = nameplate
+	c.setNameplate(nameplate)
 
 	err = c.openMailbox(ctx, claimed.Mailbox)
 	if err != nil {
@@ -351,12 +445,12 @@ func (c *Client) ListNameplates(ctx context.Context) ([]string, error) {
 		listReq        msgs.List
 	)
 
-	_, err := c.sendAndWait(ctx, &listReq)
+	ack, err := c.sendAndWait(ctx, &listReq)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.readMsg(ctx, &nameplatesResp)
+	err = c.readReply(ctx, ack.ID, &nameplatesResp)
 	if err != nil {
 		return nil, err
 	}
@@ -418,10 +512,10 @@ OUTER:
 				// Only send messages from the other side
 				outCh <- *nextMsg
 
-				if c.nameplate != "" {
+				if nameplate := c.getNameplate(); nameplate != "" {
 					// release the nameplate when we get a response from the other side
-					c.releaseNameplate(ctx, c.nameplate)
-					c.nameplate = ""
+					c.releaseNameplate(ctx, nameplate)
+					c.setNameplate("")
 				}
 
 			}
@@ -438,6 +532,18 @@ OUTER:
 	close(outCh)
 }
 
+func (c *Client) getNameplate() string {
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+	return c.nameplate
+}
+
+func (c *Client) setNameplate(nameplate string) {
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+	c.nameplate = nameplate
+}
+
 func (c *Client) registerMailboxWaiter() (uint32, <-chan int) {
 	nextID := atomic.AddUint32(&c.pendingMsgWaiterCntr, 1)
 	ch := make(chan int, 1)
@@ -470,11 +576,18 @@ func (c *Client) Close(ctx context.Context, mood Mood) error {
 		mood = Happy
 	}
 
+	c.connMu.Lock()
 	if c.wsClient == nil {
+		c.connMu.Unlock()
 		return errors.New("Close called on non-open rendezvous connection")
 	}
+	// don't reconnect once we've started closing
+	c.closing = true
+	c.connMu.Unlock()
 
 	defer func() {
+		c.connMu.Lock()
+		defer c.connMu.Unlock()
 		if c.wsClient != nil {
 			c.wsClient.Close(websocket.StatusNormalClosure, "")
 			c.wsClient = nil
@@ -488,12 +601,12 @@ func (c *Client) Close(ctx context.Context, mood Mood) error {
 		Mailbox: c.mailboxID,
 	}
 
-	_, err := c.sendAndWait(ctx, &closeReq)
+	ack, err := c.sendAndWait(ctx, &closeReq)
 	if err != nil {
 		return err
 	}
 
-	err = c.readMsg(ctx, &closedResp)
+	err = c.readReply(ctx, ack.ID, &closedResp)
 	return err
 }
 
@@ -506,19 +619,38 @@ func (c *Client) sendAndWait(ctx context.Context, msg interface{}) (*msgs.Ack, e
 	}
 
 	c.sendCmdMu.Lock()
+	defer c.sendCmdMu.Unlock()
+
+	c.connMu.Lock()
+	if c.wsClient == nil {
+		c.connMu.Unlock()
+		return nil, errors.New("rendezvous connection is not open")
+	}
+	if c.reconnectPolicy != nil {
+		c.inflight = msg
+		c.inflightID = id
+	}
 	err = wsjson.Write(ctx, c.wsClient, msg)
-	if err != nil {
-		c.sendCmdMu.Unlock()
+	c.connMu.Unlock()
+
+	defer func() {
+		c.connMu.Lock()
+		c.inflight = nil
+		c.inflightID = ""
+		c.connMu.Unlock()
+	}()
+
+	// if we're going to reconnect, the message is resent on the
+	// new connection and we just need to wait for its ack
+	if err != nil && (c.reconnectPolicy == nil || ctx.Err() != nil) {
 		return nil, err
 	}
 
 	var ack msgs.Ack
 	err = c.readMsg(ctx, &ack)
 	if err != nil {
-		c.sendCmdMu.Unlock()
 		return nil, err
 	}
-	c.sendCmdMu.Unlock()
 
 	if ack.ID != id {
 		return nil, fmt.Errorf("got ack for different message. got %s send: %+v", ack.ID, msg)
@@ -611,12 +743,12 @@ func (c *Client) allocateNameplate(ctx context.Context) (*msgs.AllocatedResp, er
 		allocedResp msgs.AllocatedResp
 	)
 
-	_, err := c.sendAndWait(ctx, &allocReq)
+	ack, err := c.sendAndWait(ctx, &allocReq)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.readMsg(ctx, &allocedResp)
+	err = c.readReply(ctx, ack.ID, &allocedResp)
 	if err != nil {
 		return nil, err
 	}
@@ -631,12 +763,12 @@ func (c *Client) claimNameplate(ctx context.Context, nameplate string) (*msgs.Cl
 		Nameplate: nameplate,
 	}
 
-	_, err := c.sendAndWait(ctx, &claimReq)
+	ack, err := c.sendAndWait(ctx, &claimReq)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.readMsg(ctx, &claimResp)
+	err = c.readReply(ctx, ack.ID, &claimResp)
 	if err != nil {
 		return nil, err
 	}
@@ -651,12 +783,12 @@ func (c *Client) releaseNameplate(ctx context.Context, nameplate string) error {
 		Nameplate: nameplate,
 	}
 
-	_, err := c.sendAndWait(ctx, &releaseReq)
+	ack, err := c.sendAndWait(ctx, &releaseReq)
 	if err != nil {
 		return err
 	}
 
-	err = c.readMsg(ctx, &releasedResp)
+	err = c.readReply(ctx, ack.ID, &releasedResp)
 	if err != nil {
 		return err
 	}
@@ -678,73 +810,103 @@ func (c *Client) openMailbox(ctx context.Context, mailbox string) error {
 }
 
 // readMessages reads off the websocket and dispatches messages
-// to either pendingMsg or pendingMailboxMsg.
-func (c *Client) readMessages(ctx context.Context) {
+// to either pendingMsg or pendingMailboxMsg. If the connection is
+// lost and reconnecting is enabled, it reconnects and carries on
+// reading from the new connection.
+func (c *Client) readMessages(ctx context.Context, conn *websocket.Conn) {
+	defer close(c.done)
+
 	for {
 		if err := ctx.Err(); err != nil {
 			c.closeWithError(err)
 			break
 		}
 
-		_, msg, err := c.wsClient.Read(ctx)
+		_, msg, err := conn.Read(ctx)
 		if err != nil {
 			wrappedErr := fmt.Errorf("WS Read: %s", err)
+
+			if c.reconnectPolicy != nil && ctx.Err() == nil && !c.isClosing() {
+				var rerr error
+				conn, rerr = c.reconnect(ctx)
+				if rerr == nil {
+					continue
+				}
+				wrappedErr = fmt.Errorf("%s; %s", wrappedErr, rerr)
+			}
+
 			c.closeWithError(wrappedErr)
 			break
 		}
 
-		var genericMsg msgs.GenericServerMsg
-		err = json.Unmarshal(msg, &genericMsg)
+		err = c.dispatch(msg)
 		if err != nil {
-			wrappedErr := fmt.Errorf("JSON unmarshal: %s", err)
-			c.closeWithError(wrappedErr)
+			c.closeWithError(err)
 			break
 		}
+	}
+}
 
-		if genericMsg.Type == "message" {
-			var mm msgs.Message
-			err := json.Unmarshal(msg, &mm)
-			if err != nil {
-				wrappedErr := fmt.Errorf("JSON unmarshal: %s", err)
-				c.closeWithError(wrappedErr)
-				break
-			}
+// dispatch queues a message read from the server for the goroutines
+// waiting on it.
+func (c *Client) dispatch(msg []byte) error {
+	var genericMsg msgs.GenericServerMsg
+	err := json.Unmarshal(msg, &genericMsg)
+	if err != nil {
+		return fmt.Errorf("JSON unmarshal: %s", err)
+	}
 
-			mboxMsg := MailboxEvent{
-				Side:  mm.Side,
-				Phase: mm.Phase,
-				Body:  mm.Body,
-			}
+	if genericMsg.Type == "message" {
+		var mm msgs.Message
+		err := json.Unmarshal(msg, &mm)
+		if err != nil {
+			return fmt.Errorf("JSON unmarshal: %s", err)
+		}
 
-			c.pendingMsgMu.Lock()
-			c.mailboxMsgs = append(c.mailboxMsgs, mboxMsg)
-			maxOffset := len(c.mailboxMsgs) - 1
+		mboxMsg := MailboxEvent{
+			Side:  mm.Side,
+			Phase: mm.Phase,
+			Body:  mm.Body,
+		}
 
-			for _, waiter := range c.pendingMailboxWaiters {
-				select {
-				case waiter <- maxOffset:
-				default:
-				}
-			}
-			c.pendingMsgMu.Unlock()
-		} else {
-			nextID := atomic.AddUint32(&c.pendingMsgIDCntr, 1)
+		c.pendingMsgMu.Lock()
+		defer c.pendingMsgMu.Unlock()
 
-			c.pendingMsgMu.Lock()
-			c.pendingMsgs = append(c.pendingMsgs, pendingMsg{
-				id:      nextID,
-				msgType: genericMsg.Type,
-				raw:     msg,
-			})
-
-			for _, waiter := range c.pendingMsgWaiters {
-				select {
-				case waiter <- nextID:
-				default:
-				}
-			}
-			c.pendingMsgMu.Unlock()
+		// the server sends every message in the mailbox again
+		// when we reopen it after reconnecting
+		key := mm.Side + "/" + mm.Phase + "/" + mm.ID
+		if c.seenMsgs[key] {
+			return nil
 		}
+		c.seenMsgs[key] = true
+
+		c.mailboxMsgs = append(c.mailboxMsgs, mboxMsg)
+		maxOffset := len(c.mailboxMsgs) - 1
 
+		for _, waiter := range c.pendingMailboxWaiters {
+			select {
+			case waiter <- maxOffset:
+			default:
+			}
+		}
+	} else {
+		nextID := atomic.AddUint32(&c.pendingMsgIDCntr, 1)
+
+		c.pendingMsgMu.Lock()
+		defer c.pendingMsgMu.Unlock()
+		c.pendingMsgs = append(c.pendingMsgs, pendingMsg{
+			id:      nextID,
+			msgType: genericMsg.Type,
+			raw:     msg,
+		})
+
+		for _, waiter := range c.pendingMsgWaiters {
+			select {
+			case waiter <- nextID:
+			default:
+			}
+		}
 	}
+
+	return nil
 }
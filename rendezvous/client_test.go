@@ -2,12 +2,18 @@ package rendezvous
 
 import (
 	"context"
+	"errors"
+	"net"
+	"net/http"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/psanford/wormhole-william/internal/crypto"
 	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
 	"github.com/psanford/wormhole-william/version"
+	"nhooyr.io/websocket"
 )
 
 func TestBasicClient(t *testing.T) {
@@ -222,3 +228,288 @@ func TestConnectWithPermissionsHashcash(t *testing.T) {
 		t.Fatalf("Server expects permissions, but client connected without permissions")
 	}
 }
+
+// recordingTransport records the Authorization header of the
+// requests it sends.
+type recordingTransport struct {
+	mu    sync.Mutex
+	auths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.auths = append(rt.auths, req.Header.Get("Authorization"))
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCustomDialOptions(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	side0 := crypto.RandSideID()
+	appID := "bookmobiles-unkindly"
+
+	var rt recordingTransport
+	opts := websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &rt},
+		HTTPHeader: http.Header{
+			"Authorization": []string{"Bearer dangerously-reticent"},
+		},
+	}
+
+	c0 := NewClient(ts.WebSocketURL(), side0, appID, WithDialOptions(&opts))
+
+	ctx := context.Background()
+
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close(ctx, "")
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if len(rt.auths) != 1 {
+		t.Fatalf("expected 1 request through custom HTTPClient but got %d", len(rt.auths))
+	}
+
+	got := rt.auths[0]
+	if got != "Bearer dangerously-reticent" {
+		t.Fatalf("got Authorization=%q expected=%q", got, "Bearer dangerously-reticent")
+	}
+}
+
+// countingDialer counts the connections it makes.
+type countingDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	d.mu.Unlock()
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func TestDialerWithDialOptions(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	appID := "pennywhistle-overbid"
+	ctx := context.Background()
+
+	var d countingDialer
+	opts := websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{}},
+	}
+
+	c0 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), appID, WithDialer(&d), WithDialOptions(&opts))
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c0.Close(ctx, "")
+
+	d.mu.Lock()
+	dials := d.dials
+	d.mu.Unlock()
+	if dials != 1 {
+		t.Fatalf("expected 1 connection through the dialer but got %d", dials)
+	}
+
+	// a custom transport can't be made to use the dialer
+	opts = websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &recordingTransport{}},
+	}
+	c1 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), appID, WithDialer(&d), WithDialOptions(&opts))
+	_, err = c1.Connect(ctx)
+	if err == nil {
+		c1.Close(ctx, "")
+		t.Fatal("expected an error connecting with a dialer and a custom transport")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	side0 := crypto.RandSideID()
+	side1 := crypto.RandSideID()
+	appID := "unclogged-hairsprings"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reconnect := WithReconnect(ReconnectPolicy{
+		MinDelay: 10 * time.Millisecond,
+	})
+
+	c0 := NewClient(ts.WebSocketURL(), side0, appID, reconnect)
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nameplate, err := c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c0Msgs := c0.MsgChan(ctx)
+
+	phase0 := "stockrooms-apportion"
+	body0 := "forswearing-greyhound"
+	err = c0.AddMessage(ctx, phase0, body0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sender is waiting for the receiver when the server goes away
+	ts.DropConnections()
+
+	c1 := NewClient(ts.WebSocketURL(), side1, appID, reconnect)
+	_, err = c1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close(ctx, Happy)
+
+	err = c1.AttachMailbox(ctx, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1Msgs := c1.MsgChan(ctx)
+
+	expectRecv := func(ch <-chan MailboxEvent, expect MailboxEvent) {
+		t.Helper()
+		select {
+		case msg := <-ch:
+			if !reflect.DeepEqual(expect, msg) {
+				t.Fatalf("Message mismatch got=%+v, expect=%+v", msg, expect)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %+v", expect)
+		}
+	}
+
+	expectRecv(c1Msgs, MailboxEvent{Side: side0, Phase: phase0, Body: body0})
+
+	phase1 := "pinwheels-thereabouts"
+	body1 := "befuddled-gumdrops"
+	err = c1.AddMessage(ctx, phase1, body1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectRecv(c0Msgs, MailboxEvent{Side: side1, Phase: phase1, Body: body1})
+
+	// drop both clients; reopening the mailbox replays body0 and
+	// body1, which must not be delivered a second time
+	ts.DropConnections()
+
+	phase2 := "peppercorns-misgiving"
+	body2 := "ramparts-untutored"
+	err = c0.AddMessage(ctx, phase2, body2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phase3 := "hollowness-wildflower"
+	body3 := "embalmers-sculptors"
+	err = c1.AddMessage(ctx, phase3, body3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectRecv(c1Msgs, MailboxEvent{Side: side0, Phase: phase2, Body: body2})
+	expectRecv(c0Msgs, MailboxEvent{Side: side1, Phase: phase3, Body: body3})
+
+	err = c0.Close(ctx, Happy)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoReconnectByDefault(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c0 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), "sparkled-ringleader")
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.DropConnections()
+
+	// commands fail instead of waiting forever for an ack
+	err = c0.AddMessage(ctx, "chowders-lifeblood", "unopposed-clementine")
+	if err == nil {
+		t.Fatal("expected AddMessage to fail after the connection dropped")
+	}
+	if ctx.Err() != nil {
+		t.Fatal("AddMessage waited for the context to expire")
+	}
+}
+
+func TestServerError(t *testing.T) {
+	ts := rendezvousservertest.NewServerLegacy()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	appID := "pizzicato-bloodbath"
+
+	c0 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), appID)
+	_, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nameplate, err := c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), appID)
+	_, err = c1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c1.AttachMailbox(ctx, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a third side can't claim the nameplate
+	c2 := NewClient(ts.WebSocketURL(), crypto.RandSideID(), appID)
+	_, err = c2.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c2.AttachMailbox(ctx, nameplate)
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Message != "crowded" {
+		t.Fatalf("expected crowded ServerError but got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("AttachMailbox waited for the context to expire")
+	}
+}
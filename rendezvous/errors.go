@@ -0,0 +1,32 @@
+package rendezvous
+
+import (
+	"encoding/json"
+)
+
+// A ServerError is an error reported by the rendezvous server, such
+// as "crowded" when a nameplate is already claimed by two other
+// clients.
+type ServerError struct {
+	// Message is the error as sent by the server.
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "rendezvous server error: " + e.Message
+}
+
+// parseServerError parses an "error" message from the server. It
+// returns the error and the id of the command that caused it, if the
+// server included it.
+func parseServerError(raw []byte) (*ServerError, string) {
+	var errMsg struct {
+		Error string `json:"error"`
+		Orig  struct {
+			ID string `json:"id"`
+		} `json:"orig"`
+	}
+	json.Unmarshal(raw, &errMsg)
+
+	return &ServerError{Message: errMsg.Error}, errMsg.Orig.ID
+}
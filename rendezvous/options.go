@@ -1,5 +1,7 @@
 package rendezvous
 
+import "nhooyr.io/websocket"
+
 type ClientOption interface {
 	setValue(*Client)
 }
@@ -22,3 +24,62 @@ func WithVersion(agentID string, version string) ClientOption {
 		agentVersion: version,
 	}
 }
+
+type dialerOption struct {
+	dialer Dialer
+}
+
+func (o *dialerOption) setValue(c *Client) {
+	c.dialer = o.dialer
+}
+
+// WithDialer returns a ClientOption that makes the connection to the
+// rendezvous server with d, for example to go through a SOCKS5 proxy.
+// It has no effect in the browser.
+func WithDialer(d Dialer) ClientOption {
+	return &dialerOption{
+		dialer: d,
+	}
+}
+
+type dialOptionsOption struct {
+	opts *websocket.DialOptions
+}
+
+func (o *dialOptionsOption) setValue(c *Client) {
+	c.dialOptions = o.opts
+}
+
+// WithDialOptions returns a ClientOption that passes opts to
+// websocket.Dial when connecting to the rendezvous server. Use it to
+// set request headers, subprotocols, or an HTTP client with a custom
+// TLS configuration. If opts sets an HTTPClient as well as WithDialer
+// being used, the client's *http.Transport is copied to dial with the
+// Dialer; connecting fails if the client has another kind of
+// transport.
+func WithDialOptions(opts *websocket.DialOptions) ClientOption {
+	return &dialOptionsOption{
+		opts: opts,
+	}
+}
+
+type reconnectOption struct {
+	policy ReconnectPolicy
+}
+
+func (o *reconnectOption) setValue(c *Client) {
+	policy := o.policy
+	c.reconnectPolicy = &policy
+}
+
+// WithReconnect returns a ClientOption that makes the client reconnect
+// if its connection to the rendezvous server drops after Connect has
+// succeeded. On reconnecting the client binds again, reclaims its
+// nameplate and reopens its mailbox; messages the server sends again
+// are only delivered once. Commands that were waiting for an ack are
+// resent.
+func WithReconnect(policy ReconnectPolicy) ClientOption {
+	return &reconnectOption{
+		policy: policy,
+	}
+}
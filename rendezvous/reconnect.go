@@ -0,0 +1,304 @@
+package rendezvous
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LeastAuthority/hashcash"
+	"github.com/psanford/wormhole-william/internal"
+	"github.com/psanford/wormhole-william/rendezvous/internal/msgs"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// ReconnectPolicy controls how a Client reconnects to the rendezvous
+// server after its connection drops.
+type ReconnectPolicy struct {
+	// MinDelay is how long to wait before the first reconnect
+	// attempt. The delay doubles after each failed attempt. If zero,
+	// 1 second is used.
+	MinDelay time.Duration
+	// MaxDelay caps the delay between attempts. If zero, 30 seconds
+	// is used.
+	MaxDelay time.Duration
+	// MaxAttempts is the number of consecutive failed attempts after
+	// which the client gives up. If zero, the client keeps trying
+	// until the context passed to Connect is done or Close is called.
+	MaxAttempts int
+}
+
+func (p *ReconnectPolicy) minDelay() time.Duration {
+	if p.MinDelay > 0 {
+		return p.MinDelay
+	}
+	return 1 * time.Second
+}
+
+func (p *ReconnectPolicy) maxDelay() time.Duration {
+	if p.MaxDelay > 0 {
+		return p.MaxDelay
+	}
+	return 30 * time.Second
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	opts, err := internal.WebsocketDialOptions(c.dialOptions, c.dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := websocket.Dial(ctx, c.url, opts)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %s", c.url, err)
+	}
+	return conn, nil
+}
+
+func (c *Client) isClosing() bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.closing
+}
+
+// reconnect re-establishes the connection to the server with
+// backoff, and restores the client's binding, nameplate claim and
+// open mailbox. It returns the new connection.
+func (c *Client) reconnect(ctx context.Context) (*websocket.Conn, error) {
+	var (
+		policy = c.reconnectPolicy
+		delay  = policy.minDelay()
+		err    error
+	)
+
+	for attempt := 1; ; attempt++ {
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+
+		if c.isClosing() {
+			return nil, errors.New("client closed")
+		}
+
+		var conn *websocket.Conn
+		conn, err = c.redial(ctx)
+		if err == nil {
+			return conn, nil
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return nil, fmt.Errorf("reconnect failed after %d attempts: %s", attempt, err)
+		}
+
+		delay *= 2
+		if delay > policy.maxDelay() {
+			delay = policy.maxDelay()
+		}
+	}
+}
+
+func (c *Client) redial(ctx context.Context) (*websocket.Conn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.connMu.Lock()
+	inflight := c.inflight
+	c.connMu.Unlock()
+
+	err = c.resync(ctx, conn, inflight)
+	if err != nil {
+		conn.Close(websocket.StatusInternalError, "")
+		return nil, err
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.closing {
+		conn.Close(websocket.StatusNormalClosure, "")
+		return nil, errors.New("client closed")
+	}
+	c.wsClient = conn
+
+	// Resend the command that was waiting for an ack when the old
+	// connection dropped, unless the ack made it through.
+	if c.inflight != nil && !c.hasAck(c.inflightID) {
+		wsjson.Write(ctx, conn, c.inflight)
+	}
+
+	return conn, nil
+}
+
+// hasAck reports whether an ack for the message with the given id is
+// waiting to be read.
+func (c *Client) hasAck(id string) bool {
+	c.pendingMsgMu.Lock()
+	defer c.pendingMsgMu.Unlock()
+
+	for _, pending := range c.pendingMsgs {
+		if pending.msgType != "ack" {
+			continue
+		}
+		var ack msgs.Ack
+		if json.Unmarshal(pending.raw, &ack) == nil && ack.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// resync repeats the handshake on a new connection: it binds, claims
+// the nameplate if we still hold it and reopens the mailbox. Opening
+// the mailbox makes the server send all of its messages again. If the
+// in-flight command is a claim or open it is left for redial to
+// resend, so that its caller gets the response.
+func (c *Client) resync(ctx context.Context, conn *websocket.Conn, inflight interface{}) error {
+	var welcome msgs.Welcome
+	err := c.readDirect(ctx, conn, &welcome, "")
+	if err != nil {
+		return err
+	}
+
+	if welcome.Welcome.Error != "" {
+		return fmt.Errorf("server error: %s", welcome.Welcome.Error)
+	}
+
+	permissionRequired := welcome.Welcome.PermissionRequired
+	if permissionRequired != nil &&
+		!(permissionRequired.None != nil && *permissionRequired.None == struct{}{}) {
+		if permissionRequired.HashCash == nil {
+			return errors.New("unsupported permission method")
+		}
+
+		stamp, err := hashcash.Mint(permissionRequired.HashCash.Bits, permissionRequired.HashCash.Resource)
+		if err != nil {
+			return err
+		}
+
+		err = c.callDirect(ctx, conn, &msgs.SubmitPermissions{Method: "hashcash", Stamp: stamp}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	agent, version := c.agentID()
+	bind := msgs.Bind{
+		Side:          c.sideID,
+		AppID:         c.appID,
+		ClientVersion: []string{agent, version},
+	}
+	err = c.callDirect(ctx, conn, &bind, nil)
+	if err != nil {
+		return err
+	}
+
+	c.pendingMsgMu.Lock()
+	nameplate := c.nameplate
+	mailbox := c.mailboxID
+	c.pendingMsgMu.Unlock()
+
+	_, claimInflight := inflight.(*msgs.Claim)
+	if nameplate != "" && !claimInflight {
+		var claimed msgs.ClaimedResp
+		err = c.callDirect(ctx, conn, &msgs.Claim{Nameplate: nameplate}, &claimed)
+		if err != nil && mailbox == "" {
+			return err
+		} else if err != nil {
+			// The nameplate has gone, but we don't need it to
+			// reopen the mailbox.
+			c.setNameplate("")
+		} else if mailbox != "" && claimed.Mailbox != mailbox {
+			return fmt.Errorf("nameplate %s now refers to a different mailbox", nameplate)
+		}
+	}
+
+	_, openInflight := inflight.(*msgs.Open)
+	if mailbox != "" && !openInflight {
+		err = c.callDirect(ctx, conn, &msgs.Open{Mailbox: mailbox}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// callDirect sends msg on conn and waits for its ack and, if resp
+// is non-nil, for a response of resp's type. It must only be called
+// before conn is handed to readMessages.
+func (c *Client) callDirect(ctx context.Context, conn *websocket.Conn, msg interface{}, resp interface{}) error {
+	id, err := c.prepareMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	err = wsjson.Write(ctx, conn, msg)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var ack msgs.Ack
+		err = c.readDirect(ctx, conn, &ack, id)
+		if err != nil {
+			return err
+		}
+		if ack.ID == id {
+			break
+		}
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	return c.readDirect(ctx, conn, resp, id)
+}
+
+// readDirect reads from conn until it gets a message of m's type.
+// Mailbox messages are dispatched as usual, server errors about the
+// message with the given id are returned and anything else is
+// dropped.
+func (c *Client) readDirect(ctx context.Context, conn *websocket.Conn, m interface{}, id string) error {
+	expectMsgType := msgType(m)
+
+	for {
+		_, msg, err := conn.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		var genericMsg msgs.GenericServerMsg
+		err = json.Unmarshal(msg, &genericMsg)
+		if err != nil {
+			return fmt.Errorf("JSON unmarshal: %s", err)
+		}
+
+		switch genericMsg.Type {
+		case expectMsgType:
+			err = json.Unmarshal(msg, m)
+			if err != nil {
+				return fmt.Errorf("JSON unmarshal: %s", err)
+			}
+			return nil
+		case "error":
+			serverErr, origID := parseServerError(msg)
+			if origID == id {
+				return serverErr
+			}
+		case "message":
+			err = c.dispatch(msg)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math"
 	"net/http"
@@ -27,6 +26,7 @@ type TestServer struct {
 	mailboxes  map[string]*mailbox
 	nameplates map[int16]string
 	agents     [][]string
+	conns      map[*websocket.Conn]bool
 }
 
 var TestMotd = "ordure-posts"
@@ -37,6 +37,7 @@ func NewServerLegacy() *TestServer {
 	ts := &TestServer{
 		mailboxes:  make(map[string]*mailbox),
 		nameplates: make(map[int16]string),
+		conns:      make(map[*websocket.Conn]bool),
 	}
 
 	smux := http.NewServeMux()
@@ -55,6 +56,7 @@ func NewServerWithPermNone() *TestServer {
 	ts := &TestServer{
 		mailboxes:  make(map[string]*mailbox),
 		nameplates: make(map[int16]string),
+		conns:      make(map[*websocket.Conn]bool),
 	}
 
 	smux := http.NewServeMux()
@@ -76,6 +78,7 @@ func NewServerWithPermNoneAndHashcash() *TestServer {
 	ts := &TestServer{
 		mailboxes:  make(map[string]*mailbox),
 		nameplates: make(map[int16]string),
+		conns:      make(map[*websocket.Conn]bool),
 	}
 
 	smux := http.NewServeMux()
@@ -102,6 +105,7 @@ func NewServerWithPermHashcash() *TestServer {
 	ts := &TestServer{
 		mailboxes:  make(map[string]*mailbox),
 		nameplates: make(map[int16]string),
+		conns:      make(map[*websocket.Conn]bool),
 	}
 
 	smux := http.NewServeMux()
@@ -128,6 +132,16 @@ func (ts *TestServer) Agents() [][]string {
 	return ts.agents
 }
 
+// DropConnections abruptly closes all client connections, as if the
+// server had restarted. Nameplates and mailboxes are kept.
+func (ts *TestServer) DropConnections() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for c := range ts.conns {
+		c.UnderlyingConn().Close()
+	}
+}
+
 func (ts *TestServer) WebSocketURL() string {
 	u, err := url.Parse(ts.URL)
 	if err != nil {
@@ -144,15 +158,18 @@ func (ts *TestServer) WebSocketURL() string {
 
 type mailbox struct {
 	sync.Mutex
-	claimCount int
-	msgs       []mboxMsg
-	clients    map[string]chan mboxMsg
+	claimed  map[string]bool
+	released map[string]bool
+	msgs     []mboxMsg
+	clients  map[string]chan mboxMsg
 }
 
 func newMailbox() *mailbox {
 	return &mailbox{
-		msgs:    make([]mboxMsg, 0, 4),
-		clients: make(map[string]chan mboxMsg),
+		claimed:  make(map[string]bool),
+		released: make(map[string]bool),
+		msgs:     make([]mboxMsg, 0, 4),
+		clients:  make(map[string]chan mboxMsg),
 	}
 }
 
@@ -161,6 +178,7 @@ func (m *mailbox) Add(side string, addMsg *msgs.Add) {
 	defer m.Unlock()
 
 	msg := mboxMsg{
+		id:    addMsg.ID,
 		side:  side,
 		phase: addMsg.Phase,
 		body:  addMsg.Body,
@@ -178,6 +196,7 @@ func (m *mailbox) Add(side string, addMsg *msgs.Add) {
 }
 
 type mboxMsg struct {
+	id    string
 	side  string
 	phase string
 	body  string
@@ -251,15 +270,24 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 		}
 		defer c.Close()
 
+		ts.mu.Lock()
+		ts.conns[c] = true
+		ts.mu.Unlock()
+		defer func() {
+			ts.mu.Lock()
+			delete(ts.conns, c)
+			ts.mu.Unlock()
+		}()
+
 		var sendMu sync.Mutex
 		sendMsg := func(msg interface{}) {
 			prepareServerMsg(msg)
 			sendMu.Lock()
 			defer sendMu.Unlock()
-			err = c.WriteJSON(msg)
-			if err != nil {
-				panic(err)
-			}
+			// the client may close its connection while messages
+			// from its mailbox are still being delivered; the read
+			// loop notices and cleans up.
+			c.WriteJSON(msg)
 		}
 
 		var requiredBits uint
@@ -272,7 +300,9 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 			}
 		}
 
-		sendMsg(welcomeMsg)
+		// copy the welcome, as sendMsg fills in its type
+		welcome := *welcomeMsg
+		sendMsg(&welcome)
 
 		ackMsg := func(id string) {
 			ack := &msgs.Ack{
@@ -292,11 +322,15 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 
 		var sideID string
 		var openMailbox *mailbox
+		var openMsgChan chan mboxMsg
 
 		defer func() {
 			if sideID != "" && openMailbox != nil {
 				openMailbox.Lock()
-				delete(openMailbox.clients, sideID)
+				// the client may have already reconnected
+				if openMailbox.clients[sideID] == openMsgChan {
+					delete(openMailbox.clients, sideID)
+				}
 				openMailbox.Unlock()
 			}
 		}()
@@ -311,10 +345,10 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 		}
 		for {
 			_, msgBytes, err := c.ReadMessage()
-			if _, isCloseErr := err.(*websocket.CloseError); err == io.EOF || isCloseErr {
+			if err != nil {
+				// closed by the client, or dropped by
+				// DropConnections
 				break
-			} else if err != nil {
-				panic(err)
 			}
 
 			msg, err := serverUnmarshal(msgBytes)
@@ -432,12 +466,14 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 					continue
 				}
 
+				// claiming again from the same side (e.g. after
+				// reconnecting) is allowed
 				var crowded bool
 				mbox.Lock()
-				if mbox.claimCount > 1 {
+				if !mbox.claimed[sideID] && len(mbox.claimed) > 1 {
 					crowded = true
 				} else {
-					mbox.claimCount++
+					mbox.claimed[sideID] = true
 				}
 				mbox.Unlock()
 
@@ -477,6 +513,7 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 
 				for _, mboxMsg := range pendingMsgs {
 					msg := &msgs.Message{
+						ID:    mboxMsg.id,
 						Side:  mboxMsg.side,
 						Phase: mboxMsg.phase,
 						Body:  mboxMsg.body,
@@ -487,6 +524,7 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 				go func() {
 					for mboxMsg := range msgChan {
 						msg := &msgs.Message{
+							ID:    mboxMsg.id,
 							Side:  mboxMsg.side,
 							Phase: mboxMsg.phase,
 							Body:  mboxMsg.body,
@@ -496,6 +534,7 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 				}()
 
 				openMailbox = mbox
+				openMsgChan = msgChan
 			case *msgs.Release:
 				ackMsg(m.ID)
 
@@ -505,8 +544,20 @@ func (ts *TestServer) withWelcome(welcomeMsg *msgs.Welcome) func(http.ResponseWr
 					continue
 				}
 
+				// the nameplate is freed once every side that
+				// claimed it has released it
 				ts.mu.Lock()
-				delete(ts.nameplates, int16(nameplate))
+				mbox := ts.mailboxes[ts.nameplates[int16(nameplate)]]
+				free := true
+				if mbox != nil {
+					mbox.Lock()
+					mbox.released[sideID] = true
+					free = len(mbox.released) >= len(mbox.claimed)
+					mbox.Unlock()
+				}
+				if free {
+					delete(ts.nameplates, int16(nameplate))
+				}
 				ts.mu.Unlock()
 
 				sendMsg(&msgs.ReleasedResp{})
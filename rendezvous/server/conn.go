@@ -0,0 +1,466 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/LeastAuthority/hashcash"
+	"github.com/psanford/wormhole-william/rendezvous/internal/msgs"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const (
+	// maxMessageSize is the largest message accepted from a client.
+	maxMessageSize = 1 << 20
+	// sendQueueLen is how many messages may be waiting to be sent
+	// to a client before it is disconnected for being too slow.
+	sendQueueLen = 64
+)
+
+// conn is a client connection. Its fields other than out are only
+// used by the goroutine running readLoop.
+type conn struct {
+	s      *Server
+	ws     *websocket.Conn
+	out    chan interface{}
+	cancel context.CancelFunc
+
+	appID     string
+	side      string
+	bound     bool
+	permitted bool
+	nameplate string
+	mailbox   string
+}
+
+type pingMsg struct {
+	Ping int `json:"ping"`
+}
+
+type pongMsg struct {
+	Type     string  `json:"type"`
+	Pong     int     `json:"pong"`
+	ServerTX float64 `json:"server_tx"`
+}
+
+// ServeHTTP accepts a websocket connection from a rendezvous client
+// and serves it until it is closed.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// browser clients connect from arbitrary origins
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return
+	}
+	ws.SetReadLimit(maxMessageSize)
+
+	ctx, cancel := context.WithCancel(r.Context())
+
+	c := &conn{
+		s:      s,
+		ws:     ws,
+		out:    make(chan interface{}, sendQueueLen),
+		cancel: cancel,
+	}
+
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.conns--
+		if c.mailbox != "" {
+			s.unsubscribe(c, c.appID, c.mailbox)
+		}
+		s.mu.Unlock()
+
+		cancel()
+		ws.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	go c.writeLoop(ctx)
+
+	c.send(s.welcome())
+	c.readLoop(ctx)
+}
+
+func (s *Server) welcome() *msgs.Welcome {
+	welcome := msgs.Welcome{
+		Type: "welcome",
+		Welcome: msgs.WelcomeServerInfo{
+			MOTD:              s.motd,
+			CurrentCLIVersion: s.currentCLIVersion,
+		},
+		ServerTX: s.serverTX(),
+	}
+
+	// Servers that only allow "none" don't mention permissions, so
+	// that clients from before permissions were added can connect.
+	if s.permissions.Hashcash != nil {
+		welcome.Welcome.PermissionRequired = &msgs.PermissionRequiredInfo{
+			HashCash: &msgs.HashCashInfo{
+				Bits:     s.permissions.Hashcash.Bits,
+				Resource: s.permissions.Hashcash.Resource,
+			},
+		}
+		if s.permissions.None {
+			welcome.Welcome.PermissionRequired.None = &struct{}{}
+		}
+	}
+
+	return &welcome
+}
+
+// send queues msg to be sent to the client. A client that isn't
+// reading its messages is disconnected.
+func (c *conn) send(msg interface{}) {
+	select {
+	case c.out <- msg:
+	default:
+		c.cancel()
+	}
+}
+
+func (c *conn) sendMessage(msg Message) {
+	c.send(&msgs.Message{
+		Type:     "message",
+		ID:       msg.ID,
+		Side:     msg.Side,
+		Phase:    msg.Phase,
+		Body:     msg.Body,
+		ServerRX: msg.ServerRX,
+		ServerTX: c.s.serverTX(),
+	})
+}
+
+func (c *conn) writeLoop(ctx context.Context) {
+	for {
+		select {
+		case msg := <-c.out:
+			err := wsjson.Write(ctx, c.ws, msg)
+			if err != nil {
+				c.cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *conn) readLoop(ctx context.Context) {
+	for {
+		var raw json.RawMessage
+		err := wsjson.Read(ctx, c.ws, &raw)
+		if err != nil {
+			return
+		}
+
+		var generic msgs.GenericServerMsg
+		err = json.Unmarshal(raw, &generic)
+		if err != nil {
+			c.sendError(err, raw)
+			continue
+		}
+
+		if generic.Type != "ping" {
+			c.send(&msgs.Ack{
+				Type:     "ack",
+				ID:       generic.ID,
+				ServerTX: c.s.serverTX(),
+			})
+		}
+
+		err = c.handle(generic.Type, raw)
+		if err != nil {
+			c.sendError(err, raw)
+		}
+	}
+}
+
+func (c *conn) sendError(err error, orig json.RawMessage) {
+	c.send(&msgs.Error{
+		Type:     "error",
+		Error:    err.Error(),
+		Orig:     orig,
+		ServerTx: c.s.serverTX(),
+	})
+}
+
+func (c *conn) handle(msgType string, raw json.RawMessage) error {
+	if msgType == "ping" {
+		var ping pingMsg
+		err := json.Unmarshal(raw, &ping)
+		if err != nil {
+			return err
+		}
+		c.send(&pongMsg{Type: "pong", Pong: ping.Ping, ServerTX: c.s.serverTX()})
+		return nil
+	}
+
+	proto, found := msgs.MsgMap[msgType]
+	if !found {
+		return fmt.Errorf("unknown type %q", msgType)
+	}
+
+	switch proto.(type) {
+	case msgs.SubmitPermissions:
+		var m msgs.SubmitPermissions
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleSubmitPermissions(&m)
+	case msgs.Bind:
+		var m msgs.Bind
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleBind(&m)
+	}
+
+	if !c.bound {
+		return errors.New("must bind first")
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	switch proto.(type) {
+	case msgs.List:
+		return c.handleList()
+	case msgs.Allocate:
+		return c.handleAllocate()
+	case msgs.Claim:
+		var m msgs.Claim
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleClaim(&m)
+	case msgs.Release:
+		var m msgs.Release
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleRelease(&m)
+	case msgs.Open:
+		var m msgs.Open
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleOpen(&m)
+	case msgs.Add:
+		var m msgs.Add
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleAdd(&m)
+	case msgs.Close:
+		var m msgs.Close
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return c.handleClose(&m)
+	default:
+		return fmt.Errorf("unexpected type %q", msgType)
+	}
+}
+
+func (c *conn) handleSubmitPermissions(m *msgs.SubmitPermissions) error {
+	if c.bound {
+		return errors.New("already bound")
+	}
+
+	permissions := c.s.permissions
+
+	switch m.Method {
+	case "none":
+		if !permissions.None {
+			return errors.New("permission method none is not allowed")
+		}
+	case "hashcash":
+		if permissions.Hashcash == nil {
+			return errors.New("permission method hashcash is not allowed")
+		}
+		ok, err := hashcash.Evaluate(m.Stamp, permissions.Hashcash.Bits, permissions.Hashcash.Resource, 0)
+		if !ok {
+			return fmt.Errorf("bad stamp, permission denied: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown permission method %q", m.Method)
+	}
+
+	c.permitted = true
+	return nil
+}
+
+func (c *conn) handleBind(m *msgs.Bind) error {
+	if c.bound {
+		return errors.New("already bound")
+	}
+	if m.AppID == "" {
+		return errors.New("bind requires 'appid'")
+	}
+	if m.Side == "" {
+		return errors.New("bind requires 'side'")
+	}
+	if !c.permitted && !c.s.permissions.None {
+		return errors.New("must send submit-permissions first")
+	}
+
+	c.appID = m.AppID
+	c.side = m.Side
+	c.bound = true
+	return nil
+}
+
+func (c *conn) handleList() error {
+	ids, err := c.s.listNameplates(c.appID)
+	if err != nil {
+		return err
+	}
+
+	resp := msgs.Nameplates{
+		Type:     "nameplates",
+		ServerTX: c.s.serverTX(),
+	}
+	for _, id := range ids {
+		resp.Nameplates = append(resp.Nameplates, struct {
+			ID string `json:"id"`
+		}{ID: id})
+	}
+
+	c.send(&resp)
+	return nil
+}
+
+func (c *conn) handleAllocate() error {
+	if c.nameplate != "" {
+		return errors.New("you already allocated one, don't be greedy")
+	}
+
+	id, err := c.s.allocateNameplate(c.appID, c.side)
+	if err != nil {
+		return err
+	}
+	c.nameplate = id
+
+	c.send(&msgs.AllocatedResp{
+		Type:      "allocated",
+		Nameplate: id,
+		ServerTX:  c.s.serverTX(),
+	})
+	return nil
+}
+
+func (c *conn) handleClaim(m *msgs.Claim) error {
+	if m.Nameplate == "" {
+		return errors.New("claim requires 'nameplate'")
+	}
+	if c.nameplate != "" && c.nameplate != m.Nameplate {
+		return errors.New("only one claim per connection")
+	}
+
+	mailbox, err := c.s.claimNameplate(c.appID, m.Nameplate, c.side)
+	if err != nil {
+		return err
+	}
+	c.nameplate = m.Nameplate
+
+	c.send(&msgs.ClaimedResp{
+		Type:     "claimed",
+		Mailbox:  mailbox,
+		ServerTX: c.s.serverTX(),
+	})
+	return nil
+}
+
+func (c *conn) handleRelease(m *msgs.Release) error {
+	nameplate := m.Nameplate
+	if nameplate == "" {
+		nameplate = c.nameplate
+	}
+	if nameplate == "" {
+		return errors.New("release without nameplate must follow claim")
+	}
+
+	err := c.s.releaseNameplate(c.appID, nameplate, c.side)
+	if err != nil {
+		return err
+	}
+	if nameplate == c.nameplate {
+		c.nameplate = ""
+	}
+
+	c.send(&msgs.ReleasedResp{
+		Type:     "released",
+		ServerTX: c.s.serverTX(),
+	})
+	return nil
+}
+
+func (c *conn) handleOpen(m *msgs.Open) error {
+	if m.Mailbox == "" {
+		return errors.New("open requires 'mailbox'")
+	}
+	if c.mailbox != "" {
+		return errors.New("only one open per connection")
+	}
+
+	existing, err := c.s.openMailbox(c, c.appID, m.Mailbox, c.side)
+	if err != nil {
+		return err
+	}
+	c.mailbox = m.Mailbox
+
+	for _, msg := range existing {
+		c.sendMessage(msg)
+	}
+	return nil
+}
+
+func (c *conn) handleAdd(m *msgs.Add) error {
+	if c.mailbox == "" {
+		return errors.New("must open mailbox before adding")
+	}
+	if m.Phase == "" {
+		return errors.New("missing 'phase'")
+	}
+
+	return c.s.addMessage(c.appID, c.mailbox, Message{
+		ID:       m.ID,
+		Side:     c.side,
+		Phase:    m.Phase,
+		Body:     m.Body,
+		ServerRX: c.s.serverTX(),
+	})
+}
+
+func (c *conn) handleClose(m *msgs.Close) error {
+	mailbox := m.Mailbox
+	if mailbox == "" {
+		mailbox = c.mailbox
+	}
+	if mailbox == "" {
+		return errors.New("close requires 'mailbox'")
+	}
+
+	err := c.s.closeMailbox(c, c.appID, mailbox, c.side, m.Mood)
+	if err != nil {
+		return err
+	}
+	if mailbox == c.mailbox {
+		c.mailbox = ""
+	}
+
+	c.send(&msgs.ClosedResp{
+		Type:     "closed",
+		ServerTx: c.s.serverTX(),
+	})
+	return nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage is a Storage that keeps everything in memory and
+// writes it to a JSON file after every change, so that mailboxes
+// survive a server restart. It is meant for small deployments; each
+// change rewrites the whole file.
+type FileStorage struct {
+	path string
+
+	mu  sync.Mutex
+	mem *MemoryStorage
+}
+
+type fileStorageState struct {
+	Nameplates []*Nameplate `json:"nameplates"`
+	Mailboxes  []*Mailbox   `json:"mailboxes"`
+}
+
+// NewFileStorage returns a FileStorage backed by the file at path,
+// loading its contents if it exists.
+func NewFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path: path,
+		mem:  NewMemoryStorage(),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state fileStorageState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range state.Nameplates {
+		s.mem.PutNameplate(n)
+	}
+	for _, m := range state.Mailboxes {
+		s.mem.PutMailbox(m)
+	}
+
+	return s, nil
+}
+
+// save writes the current state to a temporary file and renames it
+// over the old one.
+func (s *FileStorage) save() error {
+	var (
+		state fileStorageState
+		err   error
+	)
+
+	state.Nameplates, err = s.mem.ListNameplates("")
+	if err != nil {
+		return err
+	}
+	state.Mailboxes, err = s.mem.ListMailboxes("")
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileStorage) GetNameplate(appID, id string) (*Nameplate, error) {
+	return s.mem.GetNameplate(appID, id)
+}
+
+func (s *FileStorage) PutNameplate(n *Nameplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mem.PutNameplate(n)
+	return s.save()
+}
+
+func (s *FileStorage) DeleteNameplate(appID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mem.DeleteNameplate(appID, id)
+	return s.save()
+}
+
+func (s *FileStorage) ListNameplates(appID string) ([]*Nameplate, error) {
+	return s.mem.ListNameplates(appID)
+}
+
+func (s *FileStorage) GetMailbox(appID, id string) (*Mailbox, error) {
+	return s.mem.GetMailbox(appID, id)
+}
+
+func (s *FileStorage) PutMailbox(m *Mailbox) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mem.PutMailbox(m)
+	return s.save()
+}
+
+func (s *FileStorage) DeleteMailbox(appID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mem.DeleteMailbox(appID, id)
+	return s.save()
+}
+
+func (s *FileStorage) ListMailboxes(appID string) ([]*Mailbox, error) {
+	return s.mem.ListMailboxes(appID)
+}
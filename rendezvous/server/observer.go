@@ -0,0 +1,30 @@
+package server
+
+import "time"
+
+// MailboxUsage describes a mailbox that has gone away.
+type MailboxUsage struct {
+	AppID string
+	// Mood is how the mailbox ended; see Stats.Moods.
+	Mood string
+	// Duration is how long the mailbox existed.
+	Duration time.Duration
+	// Messages is the number of messages added to the mailbox.
+	Messages int
+}
+
+// An Observer is told about changes to a Server's nameplates and
+// mailboxes, e.g. to collect metrics. Its methods are called with the
+// Server's lock held, so they must be quick and must not call back
+// into the Server.
+type Observer interface {
+	NameplateCreated(appID string)
+	NameplateDeleted(appID string)
+	MailboxClosed(MailboxUsage)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) NameplateCreated(string)    {}
+func (nopObserver) NameplateDeleted(string)    {}
+func (nopObserver) MailboxClosed(MailboxUsage) {}
@@ -0,0 +1,112 @@
+package server
+
+import "time"
+
+// An Option configures a Server.
+type Option interface {
+	setValue(*Server)
+}
+
+type motdOption struct {
+	motd string
+}
+
+func (o *motdOption) setValue(s *Server) {
+	s.motd = o.motd
+}
+
+// WithMOTD returns an Option that sets the message of the day sent to
+// clients when they connect.
+func WithMOTD(motd string) Option {
+	return &motdOption{motd: motd}
+}
+
+type currentCLIVersionOption struct {
+	version string
+}
+
+func (o *currentCLIVersionOption) setValue(s *Server) {
+	s.currentCLIVersion = o.version
+}
+
+// WithCurrentCLIVersion returns an Option that advertises the latest
+// client version to connecting clients.
+func WithCurrentCLIVersion(version string) Option {
+	return &currentCLIVersionOption{version: version}
+}
+
+// Permissions are the methods clients may use to get permission to
+// use the server.
+type Permissions struct {
+	// None allows clients to bind without submitting any
+	// permissions.
+	None bool
+	// Hashcash, if non-nil, lets clients bind after submitting a
+	// hashcash stamp.
+	Hashcash *Hashcash
+}
+
+// Hashcash holds the parameters of the hashcash permission method.
+type Hashcash struct {
+	Bits     uint
+	Resource string
+}
+
+type permissionsOption struct {
+	permissions Permissions
+}
+
+func (o *permissionsOption) setValue(s *Server) {
+	s.permissions = o.permissions
+}
+
+// WithPermissions returns an Option that sets the permission methods
+// clients may use. The default is Permissions{None: true}. Clients
+// prefer "none" if it is offered, so requiring hashcash means
+// leaving None false.
+func WithPermissions(p Permissions) Option {
+	return &permissionsOption{permissions: p}
+}
+
+type storageOption struct {
+	storage Storage
+}
+
+func (o *storageOption) setValue(s *Server) {
+	s.storage = o.storage
+}
+
+// WithStorage returns an Option that sets where nameplates and
+// mailboxes are kept. The default is a MemoryStorage.
+func WithStorage(storage Storage) Option {
+	return &storageOption{storage: storage}
+}
+
+type expiryOption struct {
+	expiry time.Duration
+}
+
+func (o *expiryOption) setValue(s *Server) {
+	s.expiry = o.expiry
+}
+
+// WithExpiry returns an Option that sets how long nameplates and
+// mailboxes are kept after they were last used, while nobody is
+// connected to them. The default is DefaultExpiry.
+func WithExpiry(d time.Duration) Option {
+	return &expiryOption{expiry: d}
+}
+
+type observerOption struct {
+	observer Observer
+}
+
+func (o *observerOption) setValue(s *Server) {
+	s.observer = o.observer
+}
+
+// WithObserver returns an Option that reports changes to nameplates
+// and mailboxes to o.
+func WithObserver(o Observer) Option {
+	return &observerOption{observer: o}
+}
@@ -0,0 +1,484 @@
+// Package server implements a magic wormhole rendezvous (mailbox)
+// server.
+//
+// A Server is an http.Handler that accepts websocket connections
+// from rendezvous clients. Nameplates and mailboxes are kept in a
+// Storage, so that a server backed by a FileStorage can be restarted
+// without losing the mailboxes of clients waiting for their peer.
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/crypto"
+)
+
+// DefaultExpiry is how long unused nameplates and mailboxes are kept
+// by default.
+const DefaultExpiry = 11 * time.Hour
+
+// maxNameplateDigits limits how long allocated nameplates can get.
+const maxNameplateDigits = 6
+
+var (
+	errCrowded   = errors.New("crowded")
+	errReclaimed = errors.New("reclaimed")
+)
+
+// A Server is a rendezvous server. Create one with NewServer.
+type Server struct {
+	motd              string
+	currentCLIVersion string
+	permissions       Permissions
+	storage           Storage
+	expiry            time.Duration
+	observer          Observer
+	now               func() time.Time
+
+	mu sync.Mutex
+	// listeners holds the connections that have each mailbox open.
+	listeners map[storageKey]map[*conn]bool
+	conns     int
+	moods     map[string]int
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewServer returns a Server configured by opts. It starts a
+// goroutine that removes expired nameplates and mailboxes until
+// Close is called.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		permissions: Permissions{None: true},
+		expiry:      DefaultExpiry,
+		observer:    nopObserver{},
+		now:         time.Now,
+		listeners:   make(map[storageKey]map[*conn]bool),
+		moods:       make(map[string]int),
+		done:        make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt.setValue(s)
+	}
+
+	if s.storage == nil {
+		s.storage = NewMemoryStorage()
+	}
+
+	go s.pruneLoop()
+
+	return s
+}
+
+// Close stops removing expired nameplates and mailboxes. It does not
+// close client connections; those end when the http.Server serving
+// s is shut down.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// Stats is a snapshot of a Server's activity.
+type Stats struct {
+	// Connections is the number of connected clients.
+	Connections int
+	// Nameplates is the number of nameplates in use.
+	Nameplates int
+	// Mailboxes is the number of open mailboxes.
+	Mailboxes int
+	// Moods counts the mailboxes that have gone away by how they
+	// ended: "happy", "lonely", "scary", "errory", or "pruney" for
+	// mailboxes removed after expiring.
+	Moods map[string]int
+}
+
+// Stats returns a snapshot of the server's activity.
+func (s *Server) Stats() (Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nameplates, err := s.storage.ListNameplates("")
+	if err != nil {
+		return Stats{}, err
+	}
+	mailboxes, err := s.storage.ListMailboxes("")
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		Connections: s.conns,
+		Nameplates:  len(nameplates),
+		Mailboxes:   len(mailboxes),
+		Moods:       make(map[string]int, len(s.moods)),
+	}
+	for mood, count := range s.moods {
+		stats.Moods[mood] = count
+	}
+
+	return stats, nil
+}
+
+func (s *Server) pruneLoop() {
+	interval := s.expiry / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.prune(s.now())
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// prune removes the mailboxes and nameplates that haven't been used
+// since before now minus the expiry time and that nobody is
+// connected to.
+func (s *Server) prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := now.Add(-s.expiry)
+
+	mailboxes, err := s.storage.ListMailboxes("")
+	if err != nil {
+		return err
+	}
+	for _, m := range mailboxes {
+		key := storageKey{m.AppID, m.ID}
+		if m.Updated.Before(old) && len(s.listeners[key]) == 0 {
+			err = s.storage.DeleteMailbox(m.AppID, m.ID)
+			if err != nil {
+				return err
+			}
+			s.moods["pruney"]++
+			s.observer.MailboxClosed(MailboxUsage{
+				AppID:    m.AppID,
+				Mood:     "pruney",
+				Duration: now.Sub(m.Created),
+				Messages: len(m.Messages),
+			})
+		}
+	}
+
+	nameplates, err := s.storage.ListNameplates("")
+	if err != nil {
+		return err
+	}
+	for _, n := range nameplates {
+		key := storageKey{n.AppID, n.Mailbox}
+		if n.Updated.Before(old) && len(s.listeners[key]) == 0 {
+			err = s.storage.DeleteNameplate(n.AppID, n.ID)
+			if err != nil {
+				return err
+			}
+			s.observer.NameplateDeleted(n.AppID)
+		}
+	}
+
+	return nil
+}
+
+// The methods below implement the mailbox protocol. They must be
+// called with s.mu held.
+
+func (s *Server) listNameplates(appID string) ([]string, error) {
+	nameplates, err := s.storage.ListNameplates(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(nameplates))
+	for i, n := range nameplates {
+		ids[i] = n.ID
+	}
+	return ids, nil
+}
+
+// allocateNameplate picks an unused nameplate, preferring short
+// ones, and claims it for side.
+func (s *Server) allocateNameplate(appID, side string) (string, error) {
+	nameplates, err := s.storage.ListNameplates(appID)
+	if err != nil {
+		return "", err
+	}
+
+	used := make(map[string]bool, len(nameplates))
+	for _, n := range nameplates {
+		used[n.ID] = true
+	}
+
+	limit := 1
+	for digits := 1; digits <= maxNameplateDigits; digits++ {
+		limit *= 10
+
+		var free []int
+		for i := 1; i < limit; i++ {
+			if !used[strconv.Itoa(i)] {
+				free = append(free, i)
+			}
+		}
+		if len(free) == 0 {
+			continue
+		}
+
+		choice, err := rand.Int(rand.Reader, big.NewInt(int64(len(free))))
+		if err != nil {
+			return "", err
+		}
+		id := strconv.Itoa(free[choice.Int64()])
+
+		_, err = s.claimNameplate(appID, id, side)
+		if err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	return "", errors.New("no nameplates available")
+}
+
+// claimNameplate claims the nameplate id for side, creating it and
+// its mailbox if necessary. It returns the mailbox id. Claiming a
+// nameplate again from the same side is allowed.
+func (s *Server) claimNameplate(appID, id, side string) (string, error) {
+	n, err := s.storage.GetNameplate(appID, id)
+	created := false
+	if err == ErrNotFound {
+		created = true
+		n = &Nameplate{
+			AppID:   appID,
+			ID:      id,
+			Mailbox: crypto.RandHex(8),
+			Sides:   make(map[string]bool),
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	claimed, seen := n.Sides[side]
+	if seen && !claimed {
+		return "", errReclaimed
+	}
+	if !seen && len(n.Sides) >= 2 {
+		return "", errCrowded
+	}
+
+	n.Sides[side] = true
+	n.Updated = s.now()
+
+	_, err = s.addMailboxSide(appID, n.Mailbox, side)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.storage.PutNameplate(n)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		s.observer.NameplateCreated(appID)
+	}
+
+	return n.Mailbox, nil
+}
+
+// releaseNameplate gives up side's claim on the nameplate. The
+// nameplate is removed once every side has released it.
+func (s *Server) releaseNameplate(appID, id, side string) error {
+	n, err := s.storage.GetNameplate(appID, id)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, seen := n.Sides[side]; seen {
+		n.Sides[side] = false
+	}
+	n.Updated = s.now()
+
+	for _, claimed := range n.Sides {
+		if claimed {
+			return s.storage.PutNameplate(n)
+		}
+	}
+
+	err = s.storage.DeleteNameplate(appID, id)
+	if err != nil {
+		return err
+	}
+	s.observer.NameplateDeleted(appID)
+
+	return nil
+}
+
+// addMailboxSide adds side to the mailbox, creating the mailbox if
+// it doesn't exist.
+func (s *Server) addMailboxSide(appID, id, side string) (*Mailbox, error) {
+	now := s.now()
+
+	m, err := s.storage.GetMailbox(appID, id)
+	if err == ErrNotFound {
+		m = &Mailbox{
+			AppID:   appID,
+			ID:      id,
+			Sides:   make(map[string]*MailboxSide),
+			Created: now,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	ms := m.Sides[side]
+	if ms == nil {
+		if len(m.Sides) >= 2 {
+			return nil, errCrowded
+		}
+		ms = &MailboxSide{}
+		m.Sides[side] = ms
+	}
+	ms.Closed = false
+	m.Updated = now
+
+	err = s.storage.PutMailbox(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// openMailbox adds side to the mailbox and subscribes c to its
+// messages. It returns the messages already in the mailbox.
+func (s *Server) openMailbox(c *conn, appID, id, side string) ([]Message, error) {
+	m, err := s.addMailboxSide(appID, id, side)
+	if err != nil {
+		return nil, err
+	}
+
+	key := storageKey{appID, id}
+	if s.listeners[key] == nil {
+		s.listeners[key] = make(map[*conn]bool)
+	}
+	s.listeners[key][c] = true
+
+	return m.Messages, nil
+}
+
+// addMessage stores msg in the mailbox and sends it to everyone who
+// has the mailbox open, including its sender.
+func (s *Server) addMessage(appID, id string, msg Message) error {
+	m, err := s.storage.GetMailbox(appID, id)
+	if err != nil {
+		return err
+	}
+
+	m.Messages = append(m.Messages, msg)
+	m.Updated = s.now()
+
+	err = s.storage.PutMailbox(m)
+	if err != nil {
+		return err
+	}
+
+	for c := range s.listeners[storageKey{appID, id}] {
+		c.sendMessage(msg)
+	}
+
+	return nil
+}
+
+// closeMailbox marks side as done with the mailbox. Once every side
+// has closed it, the mailbox is removed and its mood recorded.
+func (s *Server) closeMailbox(c *conn, appID, id, side, mood string) error {
+	s.unsubscribe(c, appID, id)
+
+	m, err := s.storage.GetMailbox(appID, id)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ms := m.Sides[side]
+	if ms == nil {
+		ms = &MailboxSide{}
+		m.Sides[side] = ms
+	}
+	ms.Closed = true
+	ms.Mood = mood
+	m.Updated = s.now()
+
+	for _, ms := range m.Sides {
+		if !ms.Closed {
+			return s.storage.PutMailbox(m)
+		}
+	}
+
+	err = s.storage.DeleteMailbox(appID, id)
+	if err != nil {
+		return err
+	}
+
+	summary := summarizeMoods(m)
+	s.moods[summary]++
+	s.observer.MailboxClosed(MailboxUsage{
+		AppID:    appID,
+		Mood:     summary,
+		Duration: m.Updated.Sub(m.Created),
+		Messages: len(m.Messages),
+	})
+
+	return nil
+}
+
+func (s *Server) unsubscribe(c *conn, appID, id string) {
+	key := storageKey{appID, id}
+	delete(s.listeners[key], c)
+	if len(s.listeners[key]) == 0 {
+		delete(s.listeners, key)
+	}
+}
+
+// summarizeMoods describes how a closed mailbox went.
+func summarizeMoods(m *Mailbox) string {
+	if len(m.Sides) < 2 {
+		return "lonely"
+	}
+
+	moods := make(map[string]bool)
+	for _, ms := range m.Sides {
+		moods[ms.Mood] = true
+	}
+
+	for _, mood := range []string{"errory", "scary", "lonely"} {
+		if moods[mood] {
+			return mood
+		}
+	}
+
+	return "happy"
+}
+
+// serverTX returns the current time in the format used for the
+// server_tx and server_rx fields.
+func (s *Server) serverTX() float64 {
+	return float64(s.now().UnixNano()) / float64(time.Second)
+}
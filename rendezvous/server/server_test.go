@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/rendezvous"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+func newTestServer(t *testing.T, opts ...Option) (*Server, string, func()) {
+	s := NewServer(opts...)
+	ts := httptest.NewServer(s)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1"
+
+	return s, url, func() {
+		ts.Close()
+		s.Close()
+	}
+}
+
+func TestWormholeSendRecvText(t *testing.T) {
+	ctx := context.Background()
+
+	_, url, done := newTestServer(t)
+	defer done()
+
+	var c0, c1 wormhole.Client
+	c0.AppID = wormhole.WormholeCLIAppID
+	c0.RendezvousURL = url
+	c1.AppID = wormhole.WormholeCLIAppID
+	c1.RendezvousURL = url
+
+	secretText := "presumptuously-overtaxed"
+	code, statusChan, err := c0.SendText(ctx, secretText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != secretText {
+		t.Fatalf("got text %q, expected %q", body, secretText)
+	}
+
+	status := <-statusChan
+	if !status.OK || status.Error != nil {
+		t.Fatalf("Send side expected OK status but got: %+v", status)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	ctx := context.Background()
+
+	s, url, done := newTestServer(t, WithMOTD("hello"))
+	defer done()
+
+	appID := "unspeakably-hangnails"
+	side0 := crypto.RandSideID()
+	side1 := crypto.RandSideID()
+
+	c0 := rendezvous.NewClient(url, side0, appID)
+	info, err := c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MOTD != "hello" {
+		t.Fatalf("MOTD got=%q expected=%q", info.MOTD, "hello")
+	}
+
+	nameplate, err := c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1 := rendezvous.NewClient(url, side1, appID)
+	_, err = c1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nameplates, err := c1.ListNameplates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nameplates) != 1 || nameplates[0] != nameplate {
+		t.Fatalf("ListNameplates got=%v expected=[%s]", nameplates, nameplate)
+	}
+
+	err = c1.AttachMailbox(ctx, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c0.AddMessage(ctx, "pake", "Bartholomew")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c1Msgs := c1.MsgChan(ctx)
+	msg := <-c1Msgs
+	if msg.Error != nil {
+		t.Fatal(msg.Error)
+	}
+	if msg.Side != side0 || msg.Phase != "pake" || msg.Body != "Bartholomew" {
+		t.Fatalf("got unexpected message %+v", msg)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Connections != 2 || stats.Mailboxes != 1 {
+		t.Fatalf("got stats %+v, expected 2 connections and 1 mailbox", stats)
+	}
+
+	err = c0.Close(ctx, rendezvous.Happy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c1.Close(ctx, rendezvous.Happy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Mailboxes != 0 || stats.Moods["happy"] != 1 {
+		t.Fatalf("got stats %+v, expected no mailboxes and 1 happy mood", stats)
+	}
+}
+
+func TestClaimCrowded(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	appID := "crowded-appid"
+
+	_, err := s.claimNameplate(appID, "7", "side0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.claimNameplate(appID, "7", "side1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.claimNameplate(appID, "7", "side2")
+	if err != errCrowded {
+		t.Fatalf("expected crowded error but got: %v", err)
+	}
+
+	err = s.releaseNameplate(appID, "7", "side0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.claimNameplate(appID, "7", "side0")
+	if err != errReclaimed {
+		t.Fatalf("expected reclaimed error but got: %v", err)
+	}
+}
+
+func TestHashcashRequired(t *testing.T) {
+	ctx := context.Background()
+
+	_, url, done := newTestServer(t, WithPermissions(Permissions{
+		Hashcash: &Hashcash{Bits: 6, Resource: "wormhole"},
+	}))
+	defer done()
+
+	c := rendezvous.NewClient(url, crypto.RandSideID(), "hashcash-appid")
+	_, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStorageRestart(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "wormhole-william-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.json")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, url, done := newTestServer(t, WithStorage(storage))
+
+	appID := "restart-appid"
+	side0 := crypto.RandSideID()
+
+	c0 := rendezvous.NewClient(url, side0, appID)
+	_, err = c0.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameplate, err := c0.CreateMailbox(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c0.AddMessage(ctx, "pake", "survives-restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done()
+
+	storage, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, url, done = newTestServer(t, WithStorage(storage))
+	defer done()
+
+	c1 := rendezvous.NewClient(url, crypto.RandSideID(), appID)
+	_, err = c1.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c1.AttachMailbox(ctx, nameplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-c1.MsgChan(ctx)
+	if msg.Error != nil {
+		t.Fatal(msg.Error)
+	}
+	if msg.Side != side0 || msg.Body != "survives-restart" {
+		t.Fatalf("got unexpected message %+v", msg)
+	}
+}
+
+type recordingObserver struct {
+	created, deleted int
+	closed           []MailboxUsage
+}
+
+func (o *recordingObserver) NameplateCreated(string)      { o.created++ }
+func (o *recordingObserver) NameplateDeleted(string)      { o.deleted++ }
+func (o *recordingObserver) MailboxClosed(u MailboxUsage) { o.closed = append(o.closed, u) }
+
+func TestPrune(t *testing.T) {
+	var obs recordingObserver
+	s := NewServer(WithExpiry(time.Hour), WithObserver(&obs))
+	defer s.Close()
+
+	s.mu.Lock()
+	mailbox, err := s.claimNameplate("prune-appid", "4", "side0")
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.prune(time.Now().Add(30 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.storage.GetMailbox("prune-appid", mailbox)
+	if err != nil {
+		t.Fatalf("mailbox pruned before it expired: %s", err)
+	}
+
+	err = s.prune(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Nameplates != 0 || stats.Mailboxes != 0 || stats.Moods["pruney"] != 1 {
+		t.Fatalf("got stats %+v, expected everything pruned", stats)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obs.created != 1 || obs.deleted != 1 || len(obs.closed) != 1 || obs.closed[0].Mood != "pruney" {
+		t.Fatalf("got observed events %+v", obs)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a Storage when a nameplate or mailbox
+// does not exist.
+var ErrNotFound = errors.New("not found")
+
+// A Nameplate is the short, numeric name that clients use to find a
+// mailbox. It exists until every side that claimed it has released
+// it.
+type Nameplate struct {
+	AppID   string `json:"appid"`
+	ID      string `json:"id"`
+	Mailbox string `json:"mailbox"`
+	// Sides maps each side that has claimed the nameplate to
+	// whether it still holds its claim.
+	Sides   map[string]bool `json:"sides"`
+	Updated time.Time       `json:"updated"`
+}
+
+// A Mailbox holds the messages exchanged by two sides.
+type Mailbox struct {
+	AppID    string                  `json:"appid"`
+	ID       string                  `json:"id"`
+	Sides    map[string]*MailboxSide `json:"sides"`
+	Messages []Message               `json:"messages"`
+	Created  time.Time               `json:"created"`
+	Updated  time.Time               `json:"updated"`
+}
+
+// MailboxSide records a side's use of a mailbox.
+type MailboxSide struct {
+	Closed bool   `json:"closed"`
+	Mood   string `json:"mood,omitempty"`
+}
+
+// A Message is a message added to a mailbox.
+type Message struct {
+	ID       string  `json:"id"`
+	Side     string  `json:"side"`
+	Phase    string  `json:"phase"`
+	Body     string  `json:"body"`
+	ServerRX float64 `json:"server_rx"`
+}
+
+// Storage persists nameplates and mailboxes. The Server serializes
+// its calls to a Storage. Records passed to and returned from a
+// Storage are not retained by the caller or the Storage, so an
+// implementation must copy them if it keeps them in memory.
+type Storage interface {
+	// GetNameplate returns ErrNotFound if the nameplate doesn't exist.
+	GetNameplate(appID, id string) (*Nameplate, error)
+	PutNameplate(n *Nameplate) error
+	DeleteNameplate(appID, id string) error
+	// ListNameplates returns the nameplates of appID, or of all
+	// apps if appID is empty.
+	ListNameplates(appID string) ([]*Nameplate, error)
+
+	// GetMailbox returns ErrNotFound if the mailbox doesn't exist.
+	GetMailbox(appID, id string) (*Mailbox, error)
+	PutMailbox(m *Mailbox) error
+	DeleteMailbox(appID, id string) error
+	// ListMailboxes returns the mailboxes of appID, or of all apps
+	// if appID is empty.
+	ListMailboxes(appID string) ([]*Mailbox, error)
+}
+
+func (n *Nameplate) clone() *Nameplate {
+	c := *n
+	c.Sides = make(map[string]bool, len(n.Sides))
+	for side, claimed := range n.Sides {
+		c.Sides[side] = claimed
+	}
+	return &c
+}
+
+func (m *Mailbox) clone() *Mailbox {
+	c := *m
+	c.Sides = make(map[string]*MailboxSide, len(m.Sides))
+	for side, ms := range m.Sides {
+		msCopy := *ms
+		c.Sides[side] = &msCopy
+	}
+	c.Messages = make([]Message, len(m.Messages))
+	copy(c.Messages, m.Messages)
+	return &c
+}
+
+type storageKey struct {
+	appID string
+	id    string
+}
+
+// MemoryStorage is a Storage that keeps everything in memory.
+type MemoryStorage struct {
+	mu         sync.Mutex
+	nameplates map[storageKey]*Nameplate
+	mailboxes  map[storageKey]*Mailbox
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		nameplates: make(map[storageKey]*Nameplate),
+		mailboxes:  make(map[storageKey]*Mailbox),
+	}
+}
+
+func (s *MemoryStorage) GetNameplate(appID, id string) (*Nameplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nameplates[storageKey{appID, id}]
+	if n == nil {
+		return nil, ErrNotFound
+	}
+	return n.clone(), nil
+}
+
+func (s *MemoryStorage) PutNameplate(n *Nameplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nameplates[storageKey{n.AppID, n.ID}] = n.clone()
+	return nil
+}
+
+func (s *MemoryStorage) DeleteNameplate(appID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nameplates, storageKey{appID, id})
+	return nil
+}
+
+func (s *MemoryStorage) ListNameplates(appID string) ([]*Nameplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*Nameplate
+	for key, n := range s.nameplates {
+		if appID == "" || key.appID == appID {
+			result = append(result, n.clone())
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStorage) GetMailbox(appID, id string) (*Mailbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.mailboxes[storageKey{appID, id}]
+	if m == nil {
+		return nil, ErrNotFound
+	}
+	return m.clone(), nil
+}
+
+func (s *MemoryStorage) PutMailbox(m *Mailbox) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mailboxes[storageKey{m.AppID, m.ID}] = m.clone()
+	return nil
+}
+
+func (s *MemoryStorage) DeleteMailbox(appID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.mailboxes, storageKey{appID, id})
+	return nil
+}
+
+func (s *MemoryStorage) ListMailboxes(appID string) ([]*Mailbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []*Mailbox
+	for key, m := range s.mailboxes {
+		if appID == "" || key.appID == appID {
+			result = append(result, m.clone())
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,30 @@
+package transit
+
+import "time"
+
+// A Session describes how a pair of connections, or a connection
+// that was never paired, was handled by a Server.
+type Session struct {
+	// Mood is "happy" for a pair of connections that was relayed,
+	// or "lonely", "redundant" or "errory" for a single connection
+	// that wasn't; see Stats.Moods.
+	Mood string
+	// Waited is how long the first connection waited for its peer.
+	Waited time.Duration
+	// Duration is how long the pair was relayed for.
+	Duration time.Duration
+	// BytesRelayed is the number of bytes relayed in both
+	// directions.
+	BytesRelayed int64
+}
+
+// An Observer is told about every Session when it ends. Its methods
+// are called from the Server's connection goroutines, so they must
+// be safe for concurrent use.
+type Observer interface {
+	SessionEnded(Session)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) SessionEnded(Session) {}
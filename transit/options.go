@@ -0,0 +1,53 @@
+package transit
+
+import "time"
+
+// An Option configures a Server.
+type Option interface {
+	setValue(*Server)
+}
+
+type bandwidthLimitOption struct {
+	bytesPerSecond int64
+}
+
+func (o *bandwidthLimitOption) setValue(s *Server) {
+	s.bandwidthLimit = o.bytesPerSecond
+}
+
+// WithBandwidthLimit returns an Option that limits how fast each
+// connection may send, in bytes per second. Zero, the default,
+// means no limit.
+func WithBandwidthLimit(bytesPerSecond int64) Option {
+	return &bandwidthLimitOption{bytesPerSecond: bytesPerSecond}
+}
+
+type idleTimeoutOption struct {
+	timeout time.Duration
+}
+
+func (o *idleTimeoutOption) setValue(s *Server) {
+	s.idleTimeout = o.timeout
+}
+
+// WithIdleTimeout returns an Option that sets how long a connection
+// may go without completing its handshake, finding its peer, or
+// relaying any data before it is closed. The default is
+// DefaultIdleTimeout; zero means no timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return &idleTimeoutOption{timeout: d}
+}
+
+type observerOption struct {
+	observer Observer
+}
+
+func (o *observerOption) setValue(s *Server) {
+	s.observer = o.observer
+}
+
+// WithObserver returns an Option that reports every Session to o,
+// e.g. to collect metrics.
+func WithObserver(o Observer) Option {
+	return &observerOption{observer: o}
+}
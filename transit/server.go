@@ -0,0 +1,552 @@
+// Package transit implements a magic wormhole transit relay server.
+//
+// Two clients that can't connect to each other directly both connect
+// to the relay and send a handshake naming the same token. The relay
+// pairs them up and copies bytes between them. It never sees the
+// plaintext; the data it relays is encrypted end to end by the
+// clients.
+//
+// A Server accepts raw TCP connections with Serve and websocket
+// connections as an http.Handler.
+package transit
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// DefaultIdleTimeout is the default for WithIdleTimeout.
+const DefaultIdleTimeout = 10 * time.Minute
+
+const (
+	// maxHandshakeLen bounds the length of a handshake line.
+	maxHandshakeLen = 256
+	// copyBufferSize is the most that is read from a connection at
+	// once.
+	copyBufferSize = 32 * 1024
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close is called.
+	ErrServerClosed = errors.New("transit: Server closed")
+
+	errBadHandshake = errors.New("bad handshake")
+)
+
+// A Server is a transit relay. Create one with NewServer.
+type Server struct {
+	bandwidthLimit int64
+	idleTimeout    time.Duration
+	observer       Observer
+
+	mu sync.Mutex
+	// pending holds the connections waiting for their peer, by token.
+	pending   map[string][]*relayConn
+	conns     map[net.Conn]bool
+	listeners map[net.Listener]bool
+	closed    bool
+
+	sessions      int
+	totalSessions int
+	bytesRelayed  int64
+	moods         map[string]int
+}
+
+// NewServer returns a Server configured by opts.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		idleTimeout: DefaultIdleTimeout,
+		observer:    nopObserver{},
+		pending:     make(map[string][]*relayConn),
+		conns:       make(map[net.Conn]bool),
+		listeners:   make(map[net.Listener]bool),
+		moods:       make(map[string]int),
+	}
+
+	for _, opt := range opts {
+		opt.setValue(s)
+	}
+
+	return s
+}
+
+// Stats is a snapshot of a Server's activity.
+type Stats struct {
+	// Connections is the number of connected clients.
+	Connections int
+	// Waiting is the number of clients waiting for their peer.
+	Waiting int
+	// Sessions is the number of pairs of clients being relayed.
+	Sessions int
+	// TotalSessions is the number of pairs of clients that have
+	// been relayed since the server started.
+	TotalSessions int
+	// BytesRelayed is the total number of bytes relayed in either
+	// direction since the server started.
+	BytesRelayed int64
+	// Moods counts the connections that have ended by how they
+	// ended: "happy" for both sides of a relayed session, "lonely"
+	// if the peer never showed up, "redundant" if another
+	// connection from the same side was paired instead, or
+	// "errory" for a bad handshake.
+	Moods map[string]int
+}
+
+// Stats returns a snapshot of the server's activity.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := Stats{
+		Connections:   len(s.conns),
+		Sessions:      s.sessions,
+		TotalSessions: s.totalSessions,
+		BytesRelayed:  s.bytesRelayed,
+		Moods:         make(map[string]int, len(s.moods)),
+	}
+	for _, waiting := range s.pending {
+		stats.Waiting += len(waiting)
+	}
+	for mood, count := range s.moods {
+		stats.Moods[mood] = count
+	}
+
+	return stats
+}
+
+// Serve accepts TCP connections on l and relays them until l fails
+// or Close is called. It always returns a non-nil error.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// ServeHTTP accepts a websocket connection and relays it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// browser clients connect from arbitrary origins
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return
+	}
+
+	// The request's context ends when ServeHTTP returns, so the
+	// connection gets its own.
+	s.handleConn(websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary))
+}
+
+// Close stops all listeners passed to Serve and closes every client
+// connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	for token, waiting := range s.pending {
+		for _, rc := range waiting {
+			close(rc.done)
+		}
+		delete(s.pending, token)
+	}
+
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// relayConn is a client connection that has completed its
+// handshake.
+type relayConn struct {
+	net.Conn
+	token   string
+	side    string
+	arrived time.Time
+	// done is closed once the connection has been relayed or
+	// dropped, by whoever removed it from Server.pending.
+	done chan struct{}
+}
+
+func (s *Server) handleConn(c net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+
+	arrived := time.Now()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		c.Close()
+	}()
+
+	if s.idleTimeout > 0 {
+		c.SetDeadline(time.Now().Add(s.idleTimeout))
+	}
+	token, side, err := readHandshake(c)
+	if err != nil {
+		if err == errBadHandshake {
+			c.Write([]byte("bad handshake\n"))
+		}
+		s.countMood("errory")
+		s.observer.SessionEnded(Session{Mood: "errory"})
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	rc := &relayConn{
+		Conn:    c,
+		token:   token,
+		side:    side,
+		arrived: arrived,
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	peer, redundant := s.pair(rc)
+	if peer == nil {
+		s.pending[token] = append(s.pending[token], rc)
+		s.mu.Unlock()
+
+		s.wait(rc)
+		return
+	}
+	s.sessions++
+	s.totalSessions++
+	s.moods["redundant"] += len(redundant)
+	s.mu.Unlock()
+
+	paired := time.Now()
+
+	for _, r := range redundant {
+		r.Close()
+		close(r.done)
+		s.observer.SessionEnded(Session{
+			Mood:   "redundant",
+			Waited: paired.Sub(r.arrived),
+		})
+	}
+
+	bytes := s.relay(peer, rc)
+
+	s.mu.Lock()
+	s.sessions--
+	s.moods["happy"] += 2
+	s.mu.Unlock()
+
+	close(peer.done)
+
+	s.observer.SessionEnded(Session{
+		Mood:         "happy",
+		Waited:       paired.Sub(peer.arrived),
+		Duration:     time.Since(paired),
+		BytesRelayed: bytes,
+	})
+}
+
+// pair looks for a waiting connection with the same token as rc from
+// a different side. If there is one, it is removed from s.pending
+// and returned, along with the other connections that were waiting
+// for the same token, which will never be paired now. It must be
+// called with s.mu held.
+func (s *Server) pair(rc *relayConn) (*relayConn, []*relayConn) {
+	waiting := s.pending[rc.token]
+	for i, other := range waiting {
+		// old clients don't send a side, so they pair with anybody
+		if other.side == "" || rc.side == "" || other.side != rc.side {
+			redundant := append(waiting[:i:i], waiting[i+1:]...)
+			delete(s.pending, rc.token)
+			return other, redundant
+		}
+	}
+	return nil, nil
+}
+
+// wait blocks until rc has been relayed or dropped, or until it
+// times out waiting for its peer.
+func (s *Server) wait(rc *relayConn) {
+	var timeout <-chan time.Time
+	if s.idleTimeout > 0 {
+		t := time.NewTimer(s.idleTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-rc.done:
+		return
+	case <-timeout:
+	}
+
+	s.mu.Lock()
+	removed := false
+	waiting := s.pending[rc.token]
+	for i, other := range waiting {
+		if other == rc {
+			s.pending[rc.token] = append(waiting[:i:i], waiting[i+1:]...)
+			if len(s.pending[rc.token]) == 0 {
+				delete(s.pending, rc.token)
+			}
+			removed = true
+			break
+		}
+	}
+	if removed {
+		s.moods["lonely"]++
+	}
+	s.mu.Unlock()
+
+	if removed {
+		s.observer.SessionEnded(Session{
+			Mood:   "lonely",
+			Waited: time.Since(rc.arrived),
+		})
+		return
+	}
+
+	// we were paired just as we timed out
+	<-rc.done
+}
+
+// session tracks a pair of connections being relayed. Its fields
+// are accessed atomically.
+type session struct {
+	// lastActivity is the time, in unix nanoseconds, that data was
+	// last relayed in either direction.
+	lastActivity int64
+	// bytes is the number of bytes relayed in both directions.
+	bytes int64
+}
+
+// relay tells a and b that they have been paired and copies data
+// between them until either side closes its connection or the
+// session goes idle. It returns the number of bytes relayed.
+func (s *Server) relay(a, b *relayConn) int64 {
+	ok := []byte("ok\n")
+	if _, err := a.Write(ok); err != nil {
+		return 0
+	}
+	if _, err := b.Write(ok); err != nil {
+		return 0
+	}
+
+	sess := &session{
+		lastActivity: time.Now().UnixNano(),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.pipe(a, b, sess)
+	}()
+	go func() {
+		defer wg.Done()
+		s.pipe(b, a, sess)
+	}()
+
+	done := make(chan struct{})
+	if s.idleTimeout > 0 {
+		go s.watchIdle(a, b, sess, done)
+	}
+
+	wg.Wait()
+	close(done)
+
+	return atomic.LoadInt64(&sess.bytes)
+}
+
+// pipe copies from src to dst, then closes both connections so that
+// the other direction stops too.
+func (s *Server) pipe(dst, src net.Conn, sess *session) {
+	defer func() {
+		src.Close()
+		dst.Close()
+	}()
+
+	bufSize := copyBufferSize
+	var lim *limiter
+	if s.bandwidthLimit > 0 {
+		lim = newLimiter(s.bandwidthLimit)
+		if int64(bufSize) > s.bandwidthLimit {
+			bufSize = int(s.bandwidthLimit)
+		}
+	}
+
+	buf := make([]byte, bufSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.StoreInt64(&sess.lastActivity, time.Now().UnixNano())
+			atomic.AddInt64(&sess.bytes, int64(n))
+
+			s.mu.Lock()
+			s.bytesRelayed += int64(n)
+			s.mu.Unlock()
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			if lim != nil {
+				lim.wait(n)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// watchIdle closes a and b once no data has been relayed for the
+// idle timeout.
+func (s *Server) watchIdle(a, b net.Conn, sess *session, done chan struct{}) {
+	interval := s.idleTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&sess.lastActivity))
+			if time.Since(last) > s.idleTimeout {
+				a.Close()
+				b.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) countMood(mood string) {
+	s.mu.Lock()
+	s.moods[mood]++
+	s.mu.Unlock()
+}
+
+// readHandshake reads a handshake line of the form
+//
+//	please relay TOKEN for side SIDE\n
+//
+// where TOKEN is 32 hex encoded bytes and SIDE is 8. Old clients
+// leave off the " for side SIDE" part.
+func readHandshake(r io.Reader) (token, side string, err error) {
+	line := make([]byte, 0, 128)
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxHandshakeLen {
+			return "", "", errBadHandshake
+		}
+		line = append(line, b[0])
+	}
+
+	const prefix = "please relay "
+	if !strings.HasPrefix(string(line), prefix) {
+		return "", "", errBadHandshake
+	}
+	parts := strings.SplitN(string(line[len(prefix):]), " for side ", 2)
+
+	token = parts[0]
+	if !isHex(token, 32) {
+		return "", "", errBadHandshake
+	}
+
+	if len(parts) == 2 {
+		side = parts[1]
+		if !isHex(side, 8) {
+			return "", "", errBadHandshake
+		}
+	}
+
+	return token, side, nil
+}
+
+func isHex(s string, n int) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == n
+}
+
+// limiter slows a copy loop down to an average rate.
+type limiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	total          int64
+}
+
+func newLimiter(bytesPerSecond int64) *limiter {
+	return &limiter{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// wait records that n more bytes were sent and sleeps until sending
+// them is within the rate limit.
+func (l *limiter) wait(n int) {
+	l.total += int64(n)
+	due := time.Duration(float64(l.total) / float64(l.bytesPerSecond) * float64(time.Second))
+	if d := due - time.Since(l.start); d > 0 {
+		time.Sleep(d)
+	}
+}
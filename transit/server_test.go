@@ -0,0 +1,290 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+const (
+	testToken = "10bf5ab71e48a3ca74b0a0d4d54f66f38704a76d15885442a8df141680fd0102"
+	testSide0 = "4a74cb8a377c970a"
+	testSide1 = "0123456789abcdef"
+)
+
+func newTCPServer(t *testing.T, opts ...Option) (*Server, string) {
+	s := NewServer(opts...)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func dialHandshake(t *testing.T, addr, token, side string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := "please relay " + token
+	if side != "" {
+		handshake += " for side " + side
+	}
+	_, err = c.Write([]byte(handshake + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func expectLine(t *testing.T, c net.Conn, expect string) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+
+	got := make([]byte, len(expect))
+	_, err := io.ReadFull(c, got)
+	if err != nil {
+		t.Fatalf("reading %q: %s", expect, err)
+	}
+	if string(got) != expect {
+		t.Fatalf("got %q expected %q", got, expect)
+	}
+}
+
+type recordingObserver chan Session
+
+func (o recordingObserver) SessionEnded(s Session) { o <- s }
+
+func TestRelay(t *testing.T) {
+	obs := make(recordingObserver, 1)
+	s, addr := newTCPServer(t, WithObserver(obs))
+	defer s.Close()
+
+	c0 := dialHandshake(t, addr, testToken, testSide0)
+	defer c0.Close()
+	c1 := dialHandshake(t, addr, testToken, testSide1)
+	defer c1.Close()
+
+	expectLine(t, c0, "ok\n")
+	expectLine(t, c1, "ok\n")
+
+	msg := []byte("Ticonderoga-ballerinas")
+	go c0.Write(msg)
+	expectLine(t, c1, string(msg))
+
+	go c1.Write(msg)
+	expectLine(t, c0, string(msg))
+
+	stats := s.Stats()
+	if stats.Sessions != 1 || stats.BytesRelayed != int64(2*len(msg)) {
+		t.Fatalf("got stats %+v, expected 1 session and %d bytes", stats, 2*len(msg))
+	}
+
+	c0.Close()
+	_, err := c1.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected EOF after peer closed but got %v", err)
+	}
+
+	sess := <-obs
+	if sess.Mood != "happy" || sess.BytesRelayed != int64(2*len(msg)) {
+		t.Fatalf("got unexpected session %+v", sess)
+	}
+}
+
+func TestRelaySameSide(t *testing.T) {
+	s, addr := newTCPServer(t)
+	defer s.Close()
+
+	c0 := dialHandshake(t, addr, testToken, testSide0)
+	defer c0.Close()
+	c1 := dialHandshake(t, addr, testToken, testSide0)
+	defer c1.Close()
+
+	// connections from the same side are never paired
+	waitFor(t, func() bool { return s.Stats().Waiting == 2 })
+
+	c2 := dialHandshake(t, addr, testToken, testSide1)
+	defer c2.Close()
+
+	expectLine(t, c2, "ok\n")
+
+	waitFor(t, func() bool { return s.Stats().Moods["redundant"] == 1 })
+}
+
+func TestRelayBadHandshake(t *testing.T) {
+	s, addr := newTCPServer(t)
+	defer s.Close()
+
+	for _, handshake := range []string{
+		"please relay me\n",
+		"please relay " + testToken + " for side nothex\n",
+		"hello\n",
+		strings.Repeat("x", maxHandshakeLen+1),
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.Write([]byte(handshake))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectLine(t, c, "bad handshake\n")
+		c.Close()
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	s, addr := newTCPServer(t, WithIdleTimeout(100*time.Millisecond))
+	defer s.Close()
+
+	lonely := dialHandshake(t, addr, testToken, testSide0)
+	defer lonely.Close()
+
+	lonely.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := lonely.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected lonely connection to be closed but got %v", err)
+	}
+
+	c0 := dialHandshake(t, addr, testToken, testSide0)
+	defer c0.Close()
+	c1 := dialHandshake(t, addr, testToken, testSide1)
+	defer c1.Close()
+
+	expectLine(t, c0, "ok\n")
+	expectLine(t, c1, "ok\n")
+
+	c0.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c0.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("expected idle session to be closed but got %v", err)
+	}
+
+	waitFor(t, func() bool { return s.Stats().Moods["lonely"] == 1 })
+}
+
+func TestRelayBandwidthLimit(t *testing.T) {
+	const limit = 64 * 1024
+
+	s, addr := newTCPServer(t, WithBandwidthLimit(limit))
+	defer s.Close()
+
+	c0 := dialHandshake(t, addr, testToken, testSide0)
+	defer c0.Close()
+	c1 := dialHandshake(t, addr, testToken, testSide1)
+	defer c1.Close()
+
+	expectLine(t, c0, "ok\n")
+	expectLine(t, c1, "ok\n")
+
+	msg := make([]byte, limit/2)
+	start := time.Now()
+	go func() {
+		for i := 0; i < 3; i++ {
+			c0.Write(msg)
+		}
+	}()
+
+	_, err := io.ReadFull(c1, make([]byte, 3*len(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last chunk can't be sent before a second has passed
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("relayed %d bytes in %s, faster than the %d bytes/s limit", 3*len(msg), elapsed, limit)
+	}
+}
+
+func TestWormholeSendRecvFileViaRelay(t *testing.T) {
+	ctx := context.Background()
+
+	rs := server.NewServer()
+	defer rs.Close()
+	rts := httptest.NewServer(rs)
+	defer rts.Close()
+	rendezvousURL := "ws" + strings.TrimPrefix(rts.URL, "http") + "/v1"
+
+	s, addr := newTCPServer(t)
+	defer s.Close()
+	wts := httptest.NewServer(s)
+	defer wts.Close()
+
+	relayURLs := map[string]string{
+		"TCP": "tcp:" + addr,
+		"WS":  "ws://" + wts.Listener.Addr().String(),
+	}
+
+	for proto, relayURL := range relayURLs {
+		relayURL := relayURL
+		t.Run(fmt.Sprintf("With %s relay", proto), func(t *testing.T) {
+			var c0, c1 wormhole.Client
+			c0.AppID = wormhole.WormholeCLIAppID
+			c0.RendezvousURL = rendezvousURL
+			c0.TransitRelayURL = relayURL
+			c1.AppID = wormhole.WormholeCLIAppID
+			c1.RendezvousURL = rendezvousURL
+			c1.TransitRelayURL = relayURL
+
+			fileContent := make([]byte, 1<<16)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		})
+	}
+
+	if stats := s.Stats(); stats.TotalSessions != 2 {
+		t.Fatalf("got stats %+v, expected 2 sessions", stats)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -17,5 +17,6 @@ func init() {
 	clientObj.Set("recvFile", js.FuncOf(Client_RecvFile))
 
 	wormholeObj.Set("Client", clientObj)
+	wormholeObj.Set("errorCodes", errorCodes())
 	js.Global().Set("Wormhole", wormholeObj)
 }
@@ -0,0 +1,64 @@
+// +build js,wasm
+
+package wasm
+
+import (
+	"context"
+	"errors"
+	"syscall/js"
+
+	"github.com/psanford/wormhole-william/wormhole"
+)
+
+// Values of the code property of the errors promises are rejected
+// with. They are also available to JS as Wormhole.errorCodes.
+const (
+	ErrCodeUnknown          = "unknown"
+	ErrCodeCancelled        = "cancelled"
+	ErrCodeBadCode          = "bad_code"
+	ErrCodeTransferRejected = "transfer_rejected"
+	ErrCodePeerClosed       = "peer_closed"
+	ErrCodeRelayUnreachable = "relay_unreachable"
+	ErrCodeServerError      = "server_error"
+)
+
+func errorCode(err error) string {
+	var serverErr *wormhole.ServerError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCancelled
+	case errors.Is(err, wormhole.ErrBadCode):
+		return ErrCodeBadCode
+	case errors.Is(err, wormhole.ErrTransferRejected):
+		return ErrCodeTransferRejected
+	case errors.Is(err, wormhole.ErrPeerClosed):
+		return ErrCodePeerClosed
+	case errors.Is(err, wormhole.ErrRelayUnreachable):
+		return ErrCodeRelayUnreachable
+	case errors.As(err, &serverErr):
+		return ErrCodeServerError
+	default:
+		return ErrCodeUnknown
+	}
+}
+
+func errorCodes() map[string]interface{} {
+	return map[string]interface{}{
+		"UNKNOWN":           ErrCodeUnknown,
+		"CANCELLED":         ErrCodeCancelled,
+		"BAD_CODE":          ErrCodeBadCode,
+		"TRANSFER_REJECTED": ErrCodeTransferRejected,
+		"PEER_CLOSED":       ErrCodePeerClosed,
+		"RELAY_UNREACHABLE": ErrCodeRelayUnreachable,
+		"SERVER_ERROR":      ErrCodeServerError,
+	}
+}
+
+// jsError converts err to a JS Error with a code property, so that
+// callers can tell errors apart without matching on the message.
+func jsError(err error) js.Value {
+	jsErr := js.Global().Get("Error").New(err.Error())
+	jsErr.Set("code", errorCode(err))
+	return jsErr
+}
@@ -24,7 +24,7 @@ func NewPromise(fn PromiseFn) *Promise {
 			obj.Call("resolve", val)
 		}
 		reject := func(err error) {
-			obj.Call("reject", err.Error())
+			obj.Call("reject", jsError(err))
 		}
 
 		go func() {
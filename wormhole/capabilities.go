@@ -0,0 +1,122 @@
+package wormhole
+
+import (
+	"context"
+
+	"github.com/psanford/wormhole-william/version"
+)
+
+// PeerCapabilities describes what a peer advertised in its
+// app_versions message. Fields the peer did not send are left empty;
+// the Python client, for example, sends an empty app_versions.
+type PeerCapabilities struct {
+	// ClientName and ClientVersion identify the software the peer
+	// is running.
+	ClientName    string
+	ClientVersion string
+
+	// TransitAbilities lists the transit connection types the peer
+	// supports, such as "direct-tcp-v1" and "relay-v1".
+	TransitAbilities []string
+
+	// TransferVersions lists the file transfer protocol versions the
+	// peer supports. Version 1 is supported by every client and is
+	// always included.
+	TransferVersions []int
+
+	// CanDilate is true if the peer supports the dilation protocol.
+	// DilationAbilities lists the connection types it supports for
+	// dilated connections.
+	CanDilate         bool
+	DilationAbilities []string
+
+	// Compression lists the payload compression schemes the peer
+	// can decode.
+	Compression []string
+
+	// Resume is true if the peer can continue an interrupted file
+	// transfer. See IncomingMessage.Resume.
+	Resume bool
+
+	// Stream is true if the peer can receive files of unknown size.
+	// See Client.SendStream.
+	Stream bool
+}
+
+type appVersionsClient struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// defaultAppVersions returns the app_versions every client sends.
+// Optional protocols such as dilation and transfer-v2 are added by the
+// code paths that can use them.
+func defaultAppVersions() appVersionsMsg {
+	return appVersionsMsg{
+		Client: &appVersionsClient{
+			Name:    version.AgentString,
+			Version: version.AgentVersion,
+		},
+		TransitAbilities: []transitAbility{
+			{Type: "direct-tcp-v1"},
+			{Type: "relay-v1"},
+		},
+		Resume: &resumeVersions{
+			Version: resumeVersion,
+		},
+		Stream: &streamVersions{
+			Version: streamVersion,
+		},
+	}
+}
+
+func (v *versionMsg) capabilities() *PeerCapabilities {
+	av := &v.AppVersions
+	caps := PeerCapabilities{
+		TransferVersions: []int{1},
+		CanDilate:        v.canDilate(),
+		Compression:      av.Compression,
+		Resume:           av.supportsResume(),
+		Stream:           av.supportsStream(),
+	}
+
+	if av.Client != nil {
+		caps.ClientName = av.Client.Name
+		caps.ClientVersion = av.Client.Version
+	}
+	for _, a := range av.TransitAbilities {
+		caps.TransitAbilities = append(caps.TransitAbilities, a.Type)
+	}
+	for _, a := range v.DilationAbilities {
+		caps.DilationAbilities = append(caps.DilationAbilities, a.Type)
+	}
+	if v.supportsTransferV2() {
+		caps.TransferVersions = append(caps.TransferVersions, 2)
+	}
+
+	return &caps
+}
+
+// checkPeerCapabilities runs the WithPeerCapabilities callback, if
+// any. If the callback rejects the peer the error is also sent to the
+// peer so it doesn't wait for a transfer that will never happen.
+func checkPeerCapabilities(ctx context.Context, clientProto *clientProtocol, caps *PeerCapabilities, options *transferOptions) error {
+	if options.peerCapabilitiesFunc == nil {
+		return nil
+	}
+
+	err := options.peerCapabilitiesFunc(*caps)
+	if err == nil {
+		return nil
+	}
+
+	errMsg := err.Error()
+	writeErr := clientProto.WriteAppData(ctx, &genericMessage{
+		Error: &errMsg,
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return err
+}
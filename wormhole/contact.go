@@ -0,0 +1,120 @@
+package wormhole
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Contacts let two peers that have made a transfer before make more
+// without exchanging a code. Both sides derive the same contact key
+// from the PAKE session key of the first transfer, and later
+// transfers use a code derived from it: a fixed nameplate and a
+// random-looking password for each direction. Nobody without the
+// contact key can work out the password, so the PAKE protects these
+// transfers as it does ones with a spoken code. The nameplate is the
+// same for every transfer in a direction, so the rendezvous server
+// can tell when the same pair of peers meets again.
+
+const (
+	// contactKeyPurpose is the HKDF purpose for deriving a contact
+	// key from a session key.
+	contactKeyPurpose = "wormhole-william:contact-key-v1"
+
+	// contactNameplateBase keeps contact nameplates at ten digits,
+	// well clear of the short ones servers allocate.
+	contactNameplateBase = 1000000000
+	contactNameplateMod  = 9000000000
+)
+
+// A Contact is what a peer keeps to make transfers with the same peer
+// later without a code. Key must be kept secret: anyone who has it
+// can send to the peer or receive what the peer sends.
+type Contact struct {
+	// Key is derived from the session key of the transfer the
+	// contact was made in. Both peers get the same Key.
+	Key []byte
+	// Initiator is true for the peer that sent the transfer the
+	// contact was made in, and false for the receiver. It tells the
+	// two directions apart.
+	Initiator bool
+}
+
+func newContact(sharedKey []byte, initiator bool) Contact {
+	r := hkdf.New(sha256.New, sharedKey, nil, []byte(contactKeyPurpose))
+	key := make([]byte, secreboxKeySize)
+
+	_, err := io.ReadFull(r, key)
+	if err != nil {
+		panic(err)
+	}
+
+	return Contact{
+		Key:       key,
+		Initiator: initiator,
+	}
+}
+
+// SendCode returns the code to send to the contact with. The contact
+// receives with its ReceiveCode.
+func (c Contact) SendCode() string {
+	return c.code(c.Initiator)
+}
+
+// ReceiveCode returns the code to receive from the contact with. The
+// contact sends with its SendCode.
+func (c Contact) ReceiveCode() string {
+	return c.code(!c.Initiator)
+}
+
+// code returns the code for transfers from the initiator if
+// fromInitiator is set, or to it otherwise.
+func (c Contact) code(fromInitiator bool) string {
+	purpose := "wormhole-william:contact-code:responder"
+	if fromInitiator {
+		purpose = "wormhole-william:contact-code:initiator"
+	}
+
+	r := hkdf.New(sha256.New, c.Key, nil, []byte(purpose))
+	out := make([]byte, 8+16)
+
+	_, err := io.ReadFull(r, out)
+	if err != nil {
+		panic(err)
+	}
+
+	nameplate := contactNameplateBase + binary.BigEndian.Uint64(out[:8])%contactNameplateMod
+	return fmt.Sprintf("%d-%s", nameplate, hex.EncodeToString(out[8:]))
+}
+
+type contactTransferOption struct {
+	f func(Contact)
+}
+
+func (o contactTransferOption) setOption(opts *transferOptions) error {
+	opts.contactFunc = o.f
+	return nil
+}
+
+// WithContact returns a TransferOption that calls f with a Contact
+// for the peer once both sides are known to have used the same code
+// and, if Client.VerifierOk is set, the verifier has been accepted.
+// f is called before the transfer is over; only keep the Contact if
+// the transfer succeeds. Both peers get the same Key, so the contact
+// is only as trustworthy as the code exchange: check the verifier
+// before keeping it.
+func WithContact(f func(Contact)) TransferOption {
+	return contactTransferOption{f: f}
+}
+
+// reportContact passes the Contact for a session with sharedKey to
+// the WithContact function, if there is one.
+func (o *transferOptions) reportContact(sharedKey []byte, initiator bool) {
+	if o.contactFunc != nil {
+		o.contactFunc(newContact(sharedKey, initiator))
+	}
+}
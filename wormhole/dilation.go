@@ -0,0 +1,792 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/psanford/wormhole-william/internal/crypto"
+	"github.com/psanford/wormhole-william/rendezvous"
+	"golang.org/x/crypto/hkdf"
+)
+
+// dilationVersion is the only dilation protocol version we speak.
+const dilationVersion = "1"
+
+// dilationMaxUnackedBytes bounds how much subchannel data may be
+// queued waiting for the peer to acknowledge it before writes block.
+const dilationMaxUnackedBytes = 1 << 20
+
+// dilationFlushTimeout is how long Close waits for queued records to
+// be written to the peer.
+const dilationFlushTimeout = 2 * time.Second
+
+var (
+	// ErrDilationUnsupported is returned when the peer did not
+	// advertise support for the dilation protocol.
+	ErrDilationUnsupported = errors.New("peer does not support dilation")
+
+	errDilationClosed = errors.New("dilation closed")
+)
+
+type dilationRole int
+
+const (
+	dilationLeader dilationRole = iota + 1
+	dilationFollower
+)
+
+func (r dilationRole) String() string {
+	switch r {
+	case dilationLeader:
+		return "Leader"
+	case dilationFollower:
+		return "Follower"
+	default:
+		return fmt.Sprintf("dilationRoleUnknown<%d>", r)
+	}
+}
+
+// dilationMsg is the body of a dilate-N mailbox message.
+type dilationMsg struct {
+	Type  string           `json:"type"`
+	Side  string           `json:"side,omitempty"`
+	Hints []transitHintsV1 `json:"hints,omitempty"`
+}
+
+const (
+	dilationMsgPlease       = "please"
+	dilationMsgHints        = "connection-hints"
+	dilationMsgReconnect    = "reconnect"
+	dilationMsgReconnecting = "reconnecting"
+)
+
+// A Dilation is a long-lived, encrypted connection to a peer that
+// carries any number of independent subchannels. The underlying
+// transit connection is transparently re-established if it is lost;
+// data written to a subchannel is retransmitted until the peer has
+// acknowledged it.
+//
+// A Dilation is created by Client.Dilate.
+type Dilation struct {
+	appID           string
+	relays          []transitRelay
+	disableListener bool
+	listenPort      int
+	extraHints      []TransitHint
+	dialer          Dialer
+	side            string
+	events          eventFunc
+
+	rc          *rendezvous.Client
+	clientProto *clientProtocol
+	dilationKey []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sendMsgMu sync.Mutex
+	nextPhase int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	role        dilationRole
+	conn        *dilationConn
+	transit     *TransitInfo
+	connector   *dilationConnector
+	peerHints   []transitHintsV1
+	outbound    []*dilationRecord
+	unacked     int
+	sendQueue   []*dilationRecord
+	nextSeqnum  uint32
+	highestSeen int64
+	subchannels map[uint32]*subchannel
+	nextSCID    uint32
+	accepted    []*subchannel
+	established bool
+	closed      bool
+	err         error
+}
+
+// Dilate establishes a dilated connection with a peer. Both peers
+// call Dilate; one side generates the code (or uses WithCode to
+// provide one) and the other side passes the same code with WithCode.
+//
+// It returns the nameplate+passphrase code and a Dilation that can be
+// used to open and accept subchannels. The connection to the peer is
+// established in the background; OpenSubchannel and AcceptSubchannel
+// block until it is ready or fails.
+func (c *Client) Dilate(ctx context.Context, disableListener bool, opts ...TransferOption) (string, *Dilation, error) {
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	sideID := crypto.RandSideID()
+	appID := c.AppID
+
+	code, rc, err := c.createOrAttachMailbox(ctx, sideID, appID, options.code, options.events)
+	if err != nil {
+		return "", nil, err
+	}
+
+	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.events = options.events
+	clientProto.versions.enableDilation()
+
+	d := newDilation(ctx, c, rc, clientProto, disableListener)
+
+	go func() {
+		err := d.handshake(c, code)
+		if err != nil {
+			d.fail(err)
+			return
+		}
+		d.run()
+	}()
+
+	return code, d, nil
+}
+
+// newDilation returns a Dilation for a mailbox whose PAKE may not
+// have completed yet. The caller must start d.run once the version
+// exchange is done and d.dilationKey is set.
+func newDilation(ctx context.Context, c *Client, rc *rendezvous.Client, clientProto *clientProtocol, disableListener bool) *Dilation {
+	dctx, cancel := context.WithCancel(ctx)
+
+	d := &Dilation{
+		appID:           clientProto.appID,
+		relays:          c.transitRelays(),
+		disableListener: disableListener,
+		listenPort:      c.TransitListenPort,
+		extraHints:      c.ExtraTransitHints,
+		dialer:          c.Dialer,
+		side:            crypto.RandHex(8),
+		events:          clientProto.events,
+		rc:              rc,
+		clientProto:     clientProto,
+		ctx:             dctx,
+		cancel:          cancel,
+		highestSeen:     -1,
+		subchannels:     make(map[uint32]*subchannel),
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	return d
+}
+
+// dilateEstablished starts dilation on a mailbox where the PAKE and
+// version exchange have already completed. The peer must have
+// advertised support for dilation in its app_versions.
+func (c *Client) dilateEstablished(ctx context.Context, rc *rendezvous.Client, clientProto *clientProtocol, disableListener bool) *Dilation {
+	d := newDilation(ctx, c, rc, clientProto, disableListener)
+	d.dilationKey = deriveDilationKey(clientProto.sharedKey)
+	go d.run()
+	return d
+}
+
+// enableDilation advertises support for the dilation protocol.
+func (v *versionMsg) enableDilation() {
+	v.CanDilate = []string{dilationVersion}
+	v.DilationAbilities = []transitAbility{
+		{Type: "direct-tcp-v1"},
+		{Type: "relay-v1"},
+	}
+}
+
+// canDilate reports whether the peer that sent v supports our
+// version of the dilation protocol.
+func (v *versionMsg) canDilate() bool {
+	for _, ver := range v.CanDilate {
+		if ver == dilationVersion {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dilation) run() {
+	err := d.sendDilationMsg(&dilationMsg{
+		Type: dilationMsgPlease,
+		Side: d.side,
+	})
+	if err != nil {
+		d.fail(err)
+		return
+	}
+
+	for {
+		var gotMsg rendezvous.MailboxEvent
+		var ok bool
+		select {
+		case <-d.ctx.Done():
+			d.fail(d.ctx.Err())
+			return
+		case gotMsg, ok = <-d.clientProto.ch:
+		}
+
+		if !ok {
+			d.mu.Lock()
+			established := d.established
+			d.mu.Unlock()
+			if established {
+				// We can keep using the connection we already have;
+				// we just won't be able to reconnect if it drops.
+				return
+			}
+			d.fail(errors.New("rendezvous connection closed"))
+			return
+		}
+		if gotMsg.Error != nil {
+			d.fail(gotMsg.Error)
+			return
+		}
+
+		if strings.HasPrefix(gotMsg.Phase, "dilate-") {
+			var msg dilationMsg
+			err := openAndUnmarshal(&msg, gotMsg, d.clientProto.sharedKey)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+
+			err = d.handleDilationMsg(&msg)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+		} else if _, err := strconv.Atoi(gotMsg.Phase); err == nil {
+			var msg genericMessage
+			err := openAndUnmarshal(&msg, gotMsg, d.clientProto.sharedKey)
+			if err != nil {
+				d.fail(err)
+				return
+			}
+			if msg.Error != nil {
+				d.fail(&PeerError{Message: *msg.Error})
+				return
+			}
+		} else {
+			d.fail(fmt.Errorf("got unexpected phase: %s", gotMsg.Phase))
+			return
+		}
+	}
+}
+
+// handshake performs the PAKE and version exchange with the peer.
+func (d *Dilation) handshake(c *Client, code string) error {
+	ctx := d.ctx
+	clientProto := d.clientProto
+
+	err := clientProto.WritePake(ctx, code)
+	if err != nil {
+		return err
+	}
+
+	err = clientProto.ReadPake()
+	if err != nil {
+		return err
+	}
+
+	err = clientProto.WriteVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	peerVersions, err := clientProto.ReadVersion()
+	if err != nil {
+		return err
+	}
+
+	if c.VerifierOk != nil {
+		verifier, err := clientProto.Verifier()
+		if err != nil {
+			return err
+		}
+
+		if ok := c.VerifierOk(hex.EncodeToString(verifier)); !ok {
+			errMsg := "sender rejected verification check, abandoned transfer"
+			writeErr := clientProto.WriteAppData(ctx, &genericMessage{
+				Error: &errMsg,
+			})
+			if writeErr != nil {
+				return writeErr
+			}
+
+			return errors.New(errMsg)
+		}
+	}
+
+	if !peerVersions.canDilate() {
+		return ErrDilationUnsupported
+	}
+
+	d.dilationKey = deriveDilationKey(clientProto.sharedKey)
+
+	return nil
+}
+
+func deriveDilationKey(key []byte) []byte {
+	r := hkdf.New(sha256.New, key, nil, []byte("dilation-v1"))
+	out := make([]byte, secreboxKeySize)
+
+	_, err := io.ReadFull(r, out)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+func (d *Dilation) sendDilationMsg(msg *dilationMsg) error {
+	d.sendMsgMu.Lock()
+	defer d.sendMsgMu.Unlock()
+
+	phase := fmt.Sprintf("dilate-%d", d.nextPhase)
+	d.nextPhase++
+
+	jsonOut, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return sendEncryptedMessage(d.ctx, d.rc, jsonOut, d.clientProto.sharedKey, d.clientProto.sideID, phase)
+}
+
+func (d *Dilation) handleDilationMsg(msg *dilationMsg) error {
+	switch msg.Type {
+	case dilationMsgPlease:
+		if msg.Side == d.side {
+			return errors.New("dilation: peer is using our side id")
+		}
+		d.mu.Lock()
+		if d.role != 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		if msg.Side > d.side {
+			d.role = dilationFollower
+		} else {
+			d.role = dilationLeader
+		}
+		d.mu.Unlock()
+		return d.startConnector()
+	case dilationMsgHints:
+		d.mu.Lock()
+		connector := d.connector
+		if connector == nil {
+			d.peerHints = append(d.peerHints, msg.Hints...)
+		}
+		d.mu.Unlock()
+
+		if connector != nil {
+			connector.addHints(msg.Hints)
+		}
+	case dilationMsgReconnect:
+		if d.getRole() != dilationFollower {
+			return nil
+		}
+		d.mu.Lock()
+		conn := d.conn
+		d.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+			d.connectionLost(conn)
+		}
+
+		err := d.sendDilationMsg(&dilationMsg{
+			Type: dilationMsgReconnecting,
+		})
+		if err != nil {
+			return err
+		}
+		return d.startConnector()
+	case dilationMsgReconnecting:
+		if d.getRole() != dilationLeader {
+			return nil
+		}
+		return d.startConnector()
+	}
+
+	return nil
+}
+
+// getRole returns the role picked when the peer's please message
+// arrived, or zero before then.
+func (d *Dilation) getRole() dilationRole {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.role
+}
+
+// startConnector stops any in-progress connection attempt and begins a
+// new generation of connection attempts to the peer.
+func (d *Dilation) startConnector() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	old := d.connector
+	d.connector = nil
+	d.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+
+	connector := newDilationConnector(d)
+	hints, err := connector.start()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.connector = connector
+	pending := d.peerHints
+	d.peerHints = nil
+	d.mu.Unlock()
+
+	err = d.sendDilationMsg(&dilationMsg{
+		Type:  dilationMsgHints,
+		Hints: hints,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		connector.addHints(pending)
+	}
+
+	return nil
+}
+
+// connectionMade is called by the connector once a L2 connection has
+// been selected.
+func (d *Dilation) connectionMade(connector *dilationConnector, conn *dilationConn, info TransitInfo) {
+	d.mu.Lock()
+	if d.closed || d.connector != connector {
+		d.mu.Unlock()
+		conn.Close()
+		return
+	}
+
+	d.connector = nil
+	d.conn = conn
+	d.transit = &info
+	d.established = true
+
+	// anything the peer has not acknowledged yet must be resent
+	// on the new connection.
+	d.sendQueue = append([]*dilationRecord(nil), d.outbound...)
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	connector.stop()
+
+	go d.writeLoop(conn)
+	go d.readLoop(conn)
+}
+
+// transitInfo describes the most recent connection to the peer, or
+// is nil if there hasn't been one.
+func (d *Dilation) transitInfo() *TransitInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.transit
+}
+
+func (d *Dilation) connectionLost(conn *dilationConn) {
+	d.mu.Lock()
+	if d.conn != conn {
+		d.mu.Unlock()
+		return
+	}
+	d.conn = nil
+	d.sendQueue = nil
+	closed := d.closed
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	conn.Close()
+
+	if closed {
+		return
+	}
+
+	if d.getRole() == dilationLeader {
+		err := d.sendDilationMsg(&dilationMsg{
+			Type: dilationMsgReconnect,
+		})
+		if err != nil {
+			d.fail(err)
+		}
+	}
+}
+
+func (d *Dilation) writeLoop(conn *dilationConn) {
+	for {
+		d.mu.Lock()
+		for d.conn == conn && len(d.sendQueue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.conn != conn {
+			d.mu.Unlock()
+			return
+		}
+		queue := d.sendQueue
+		d.sendQueue = nil
+		closing := d.closed
+		d.mu.Unlock()
+
+		for _, r := range queue {
+			err := conn.writeRecord(r)
+			if err != nil {
+				d.connectionLost(conn)
+				return
+			}
+		}
+
+		if closing {
+			close(conn.flushed)
+			return
+		}
+	}
+}
+
+func (d *Dilation) readLoop(conn *dilationConn) {
+	for {
+		r, err := conn.readRecord()
+		if err != nil {
+			d.connectionLost(conn)
+			return
+		}
+
+		d.handleRecord(r)
+	}
+}
+
+func (d *Dilation) handleRecord(r *dilationRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch r.kind {
+	case recordKCM, recordPong:
+		return
+	case recordPing:
+		d.queueLocked(&dilationRecord{kind: recordPong, pingID: r.pingID})
+		return
+	case recordAck:
+		for len(d.outbound) > 0 && d.outbound[0].seqnum <= r.seqnum {
+			d.unacked -= len(d.outbound[0].data)
+			d.outbound = d.outbound[1:]
+		}
+		d.cond.Broadcast()
+		return
+	}
+
+	// OPEN, DATA and CLOSE are acked even if we've seen them before
+	// since our previous ack may have been lost with the connection.
+	d.queueLocked(&dilationRecord{kind: recordAck, seqnum: r.seqnum})
+
+	if int64(r.seqnum) <= d.highestSeen {
+		return
+	}
+	d.highestSeen = int64(r.seqnum)
+
+	switch r.kind {
+	case recordOpen:
+		sc := newSubchannel(d, r.scid)
+		d.subchannels[r.scid] = sc
+		d.accepted = append(d.accepted, sc)
+		d.cond.Broadcast()
+	case recordData:
+		if sc := d.subchannels[r.scid]; sc != nil {
+			sc.deliver(r.data)
+		}
+	case recordClose:
+		if sc := d.subchannels[r.scid]; sc != nil {
+			if !sc.localClosed {
+				sc.localClosed = true
+				d.sendLocked(&dilationRecord{kind: recordClose, scid: r.scid})
+			}
+			sc.remoteClose()
+			delete(d.subchannels, r.scid)
+		}
+	}
+}
+
+// queueLocked queues a record that does not need to be acknowledged
+// (ACK, PING, PONG) for the current connection. d.mu must be held.
+func (d *Dilation) queueLocked(r *dilationRecord) {
+	if d.conn == nil {
+		return
+	}
+	d.sendQueue = append(d.sendQueue, r)
+	d.cond.Broadcast()
+}
+
+// sendLocked assigns a sequence number to r and queues it for
+// (re)transmission until it is acknowledged. d.mu must be held.
+func (d *Dilation) sendLocked(r *dilationRecord) {
+	r.seqnum = d.nextSeqnum
+	d.nextSeqnum++
+
+	d.outbound = append(d.outbound, r)
+	d.unacked += len(r.data)
+	if d.conn != nil {
+		d.sendQueue = append(d.sendQueue, r)
+	}
+	d.cond.Broadcast()
+}
+
+// waitEstablished blocks until the first L2 connection is up.
+// d.mu must be held.
+func (d *Dilation) waitEstablishedLocked(ctx context.Context) error {
+	stop := d.wakeOnDone(ctx)
+	defer stop()
+
+	for !d.established && d.err == nil && ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return ctx.Err()
+}
+
+// wakeOnDone broadcasts on d.cond when ctx is done so that waiters
+// can notice the cancellation.
+func (d *Dilation) wakeOnDone(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.mu.Lock()
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// OpenSubchannel opens a new subchannel to the peer. It blocks until
+// the dilated connection has been established.
+func (d *Dilation) OpenSubchannel(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.waitEstablishedLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The leader allocates odd subchannel ids and the follower even
+	// ones. Subchannel 0 is reserved for the control channel.
+	if d.nextSCID == 0 {
+		if d.role == dilationLeader {
+			d.nextSCID = 1
+		} else {
+			d.nextSCID = 2
+		}
+	}
+	scid := d.nextSCID
+	d.nextSCID += 2
+
+	sc := newSubchannel(d, scid)
+	d.subchannels[scid] = sc
+	d.sendLocked(&dilationRecord{kind: recordOpen, scid: scid})
+
+	return sc, nil
+}
+
+// AcceptSubchannel waits for the peer to open a subchannel and
+// returns it.
+func (d *Dilation) AcceptSubchannel(ctx context.Context) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stop := d.wakeOnDone(ctx)
+	defer stop()
+
+	for len(d.accepted) == 0 && d.err == nil && ctx.Err() == nil {
+		d.cond.Wait()
+	}
+
+	if len(d.accepted) > 0 {
+		sc := d.accepted[0]
+		d.accepted = d.accepted[1:]
+		return sc, nil
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return nil, ctx.Err()
+}
+
+// Close shuts down all subchannels, the connection to the peer and
+// the mailbox.
+func (d *Dilation) Close() error {
+	d.shutdown(errDilationClosed, rendezvous.Happy)
+	return nil
+}
+
+func (d *Dilation) fail(err error) {
+	mood := rendezvous.Errory
+	if errors.Is(err, ErrBadCode) || errors.Is(err, ErrDecrypt) {
+		mood = rendezvous.Scary
+	}
+	d.shutdown(err, mood)
+}
+
+func (d *Dilation) shutdown(err error, mood rendezvous.Mood) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	d.err = err
+	conn := d.conn
+	connector := d.connector
+	d.connector = nil
+	for _, sc := range d.subchannels {
+		sc.remoteClose()
+	}
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	if connector != nil {
+		connector.stop()
+	}
+	if conn != nil {
+		// Give the write loop a chance to send anything still queued
+		// (in particular acks for the peer's last records) before
+		// dropping the connection.
+		select {
+		case <-conn.flushed:
+		case <-time.After(dilationFlushTimeout):
+		}
+
+		d.mu.Lock()
+		d.conn = nil
+		d.mu.Unlock()
+		conn.Close()
+	}
+
+	d.rc.Close(context.Background(), mood)
+	d.cancel()
+}
@@ -0,0 +1,532 @@
+package wormhole
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"nhooyr.io/websocket"
+)
+
+var (
+	dilationLeaderPrologue   = []byte("Magic-Wormhole Dilation Handshake v1 Leader\n\n")
+	dilationFollowerPrologue = []byte("Magic-Wormhole Dilation Handshake v1 Follower\n\n")
+)
+
+// L3 record types sent over a dilated connection.
+const (
+	recordKCM byte = iota
+	recordPing
+	recordPong
+	recordOpen
+	recordData
+	recordClose
+	recordAck
+)
+
+// dilationMaxDataLen is the largest payload we put in a single DATA
+// record. It keeps frames well under the noise message size limit.
+const dilationMaxDataLen = 1 << 14
+
+type dilationRecord struct {
+	kind   byte
+	scid   uint32
+	seqnum uint32
+	pingID uint32
+	data   []byte
+}
+
+func (r *dilationRecord) marshal() []byte {
+	switch r.kind {
+	case recordKCM:
+		return []byte{recordKCM}
+	case recordPing, recordPong:
+		out := make([]byte, 5)
+		out[0] = r.kind
+		binary.BigEndian.PutUint32(out[1:], r.pingID)
+		return out
+	case recordAck:
+		out := make([]byte, 5)
+		out[0] = r.kind
+		binary.BigEndian.PutUint32(out[1:], r.seqnum)
+		return out
+	case recordOpen, recordData, recordClose:
+		out := make([]byte, 9, 9+len(r.data))
+		out[0] = r.kind
+		binary.BigEndian.PutUint32(out[1:], r.scid)
+		binary.BigEndian.PutUint32(out[5:], r.seqnum)
+		return append(out, r.data...)
+	default:
+		panic(fmt.Sprintf("unknown dilation record type %d", r.kind))
+	}
+}
+
+func parseDilationRecord(b []byte) (*dilationRecord, error) {
+	if len(b) < 1 {
+		return nil, errors.New("empty dilation record")
+	}
+
+	r := dilationRecord{
+		kind: b[0],
+	}
+
+	switch r.kind {
+	case recordKCM:
+		if len(b) != 1 {
+			return nil, errors.New("malformed KCM record")
+		}
+	case recordPing, recordPong:
+		if len(b) != 5 {
+			return nil, errors.New("malformed PING/PONG record")
+		}
+		r.pingID = binary.BigEndian.Uint32(b[1:])
+	case recordAck:
+		if len(b) != 5 {
+			return nil, errors.New("malformed ACK record")
+		}
+		r.seqnum = binary.BigEndian.Uint32(b[1:])
+	case recordOpen, recordData, recordClose:
+		if len(b) < 9 {
+			return nil, errors.New("malformed subchannel record")
+		}
+		r.scid = binary.BigEndian.Uint32(b[1:5])
+		r.seqnum = binary.BigEndian.Uint32(b[5:9])
+		if r.kind == recordData {
+			r.data = append([]byte(nil), b[9:]...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown dilation record type %d", r.kind)
+	}
+
+	return &r, nil
+}
+
+// dilationConn is an L2 connection: a transit connection secured by
+// the noise protocol that carries length-prefixed L3 records.
+type dilationConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	send    *noiseCipherState
+	recv    *noiseCipherState
+
+	// flushed is closed by the write loop once it has written
+	// everything that was queued before the Dilation was closed.
+	flushed chan struct{}
+}
+
+func (c *dilationConn) Close() error {
+	return c.conn.Close()
+}
+
+func writeDilationFrame(w io.Writer, frame []byte) error {
+	if len(frame) > noiseMaxMsgLen {
+		return fmt.Errorf("dilation frame too large: %d", len(frame))
+	}
+	buf := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	_, err := w.Write(append(buf, frame...))
+	return err
+}
+
+func readDilationFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	_, err := io.ReadFull(r, lenBuf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(lenBuf[:])
+	if l > noiseMaxMsgLen {
+		return nil, fmt.Errorf("dilation frame too large: %d", l)
+	}
+
+	frame := make([]byte, l)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (c *dilationConn) writeRecord(r *dilationRecord) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	return writeDilationFrame(c.conn, c.send.encrypt(nil, r.marshal()))
+}
+
+func (c *dilationConn) readRecord() (*dilationRecord, error) {
+	frame, err := readDilationFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := c.recv.decrypt(nil, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDilationRecord(plaintext)
+}
+
+// dilationHandshake exchanges prologues and performs the noise
+// handshake over conn.
+func dilationHandshake(conn net.Conn, role dilationRole, dilationKey []byte) (*dilationConn, error) {
+	outPrologue, inPrologue := dilationLeaderPrologue, dilationFollowerPrologue
+	if role == dilationFollower {
+		outPrologue, inPrologue = inPrologue, outPrologue
+	}
+
+	_, err := conn.Write(outPrologue)
+	if err != nil {
+		return nil, err
+	}
+
+	gotPrologue := make([]byte, len(inPrologue))
+	_, err = io.ReadFull(conn, gotPrologue)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(gotPrologue, inPrologue) {
+		return nil, errors.New("dilation: bad prologue")
+	}
+
+	hs := newNoiseHandshake(role == dilationLeader, dilationKey)
+
+	if role == dilationLeader {
+		err = writeDilationFrame(conn, hs.writeMessage1())
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := readDilationFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		err = hs.readMessage2(msg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		msg, err := readDilationFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		err = hs.readMessage1(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err := hs.writeMessage2()
+		if err != nil {
+			return nil, err
+		}
+		err = writeDilationFrame(conn, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	send, recv := hs.split()
+
+	return &dilationConn{
+		conn:    conn,
+		send:    send,
+		recv:    recv,
+		flushed: make(chan struct{}),
+	}, nil
+}
+
+// dilationConnector makes one generation of L2 connection attempts.
+// Both sides listen and dial each other's hints; every connection
+// that completes the handshake becomes a candidate. The leader picks
+// the first candidate whose key confirmation message (KCM) arrives and
+// answers with its own KCM, which is how the follower learns which
+// connection was selected.
+type dilationConnector struct {
+	d         *Dilation
+	transport *fileTransport
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	pending  map[net.Conn]struct{}
+	selected bool
+	stopped  bool
+}
+
+func newDilationConnector(d *Dilation) *dilationConnector {
+	ctx, cancel := context.WithCancel(d.ctx)
+
+	transport := newFileTransport(d.dilationKey, d.appID, d.relays, d.disableListener)
+	transport.side = d.side
+	transport.listenPort = d.listenPort
+	transport.extraHints = d.extraHints
+	transport.dialer = d.dialer
+	transport.events = d.events
+	transport.startConnecting()
+
+	return &dilationConnector{
+		d:         d,
+		transport: transport,
+		ctx:       ctx,
+		cancel:    cancel,
+		pending:   make(map[net.Conn]struct{}),
+	}
+}
+
+// start opens our listeners and returns the hints to send to the peer.
+func (c *dilationConnector) start() ([]transitHintsV1, error) {
+	err := c.transport.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.transport.listenRelay()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.transport.makeTransitMsg()
+	if err != nil {
+		return nil, fmt.Errorf("make transit msg error: %s", err)
+	}
+
+	if c.transport.listener != nil {
+		go func() {
+			for {
+				conn, err := c.transport.listener.Accept()
+				if err != nil {
+					return
+				}
+				go c.handleConn(conn, c.transport.incomingInfo(conn))
+			}
+		}()
+	}
+
+	if len(c.transport.relayConns) > 0 {
+		cancelCh := make(chan struct{})
+		go func() {
+			<-c.ctx.Done()
+			close(cancelCh)
+		}()
+
+		for _, rc := range c.transport.relayConns {
+			go func(rc relayConn) {
+				info := relayInfo(rc.relay)
+				err := c.transport.waitForRelayPeer(rc.Conn, cancelCh)
+				if err != nil {
+					c.failed(info.Addr, true, err)
+					return
+				}
+				c.handleConn(rc.Conn, info)
+			}(rc)
+		}
+	}
+
+	return msg.HintsV1, nil
+}
+
+func (c *dilationConnector) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	pending := c.pending
+	c.pending = make(map[net.Conn]struct{})
+	c.mu.Unlock()
+
+	c.cancel()
+
+	if c.transport.listener != nil {
+		c.transport.listener.Close()
+	}
+
+	for conn := range pending {
+		conn.Close()
+	}
+}
+
+func (c *dilationConnector) addHints(hints []transitHintsV1) {
+	for _, hint := range hints {
+		switch hint.Type {
+		case "direct-tcp-v1":
+			addr := net.JoinHostPort(hint.Hostname, strconv.Itoa(hint.Port))
+			go c.dialDirect(addr)
+		case "relay-v1":
+			for _, relayHint := range hint.Hints {
+				// If the peer uses the same relay as us our relay
+				// connection will already be paired with theirs.
+				if c.transport.waitingAt(relayHint) {
+					continue
+				}
+				go c.dialRelay(relayHint)
+			}
+		}
+	}
+}
+
+func (c *dilationConnector) dialDirect(addr string) {
+	c.transport.events.emit(Event{Type: EventTransitCandidate, Addr: addr})
+
+	conn, err := c.transport.dial(c.ctx, addr)
+	if err != nil {
+		c.failed(addr, false, err)
+		return
+	}
+
+	c.handleConn(conn, TransitInfo{Addr: addr, HintType: "direct-tcp-v1"})
+}
+
+func (c *dilationConnector) dialRelay(hint transitHintsV1Hint) {
+	var conn net.Conn
+	addr := net.JoinHostPort(hint.Hostname, strconv.Itoa(hint.Port))
+
+	switch hint.Type {
+	case "direct-tcp-v1":
+		c.transport.events.emit(Event{Type: EventTransitCandidate, Addr: addr, Relay: true})
+		var err error
+		conn, err = c.transport.dial(c.ctx, addr)
+		if err != nil {
+			c.failed(addr, true, err)
+			return
+		}
+	case "direct-ws-v1", "direct-wss-v1":
+		scheme := "ws"
+		if hint.Type == "direct-wss-v1" {
+			scheme = "wss"
+		}
+		c.transport.events.emit(Event{Type: EventTransitCandidate, Addr: addr, Relay: true})
+		wsconn, err := c.transport.dialWebsocket(c.ctx, scheme+"://"+addr)
+		if err != nil {
+			c.failed(addr, true, err)
+			return
+		}
+		wsconn.SetReadLimit(websocketReadSize)
+		conn = websocket.NetConn(c.ctx, wsconn, websocket.MessageBinary)
+	default:
+		return
+	}
+
+	if !c.track(conn) {
+		return
+	}
+
+	_, err := conn.Write(c.transport.relayHandshakeHeader())
+	if err != nil {
+		c.drop(conn)
+		c.failed(addr, true, err)
+		return
+	}
+
+	gotOk := make([]byte, 3)
+	_, err = io.ReadFull(conn, gotOk)
+	if err == nil && !bytes.Equal(gotOk, []byte("ok\n")) {
+		err = errors.New("got non ok status from relay server")
+	}
+	if err != nil {
+		c.drop(conn)
+		c.failed(addr, true, err)
+		return
+	}
+
+	c.handleConn(conn, TransitInfo{Relay: true, Addr: addr, HintType: hint.Type})
+}
+
+// track records conn as an in-progress candidate so that it is
+// closed when the connector stops. It returns false (and closes conn)
+// if the connector has already stopped.
+func (c *dilationConnector) track(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped || c.selected {
+		conn.Close()
+		return false
+	}
+	c.pending[conn] = struct{}{}
+	return true
+}
+
+// failed reports a failed candidate, unless the attempt was only
+// abandoned because the connector is done.
+func (c *dilationConnector) failed(addr string, relay bool, err error) {
+	c.mu.Lock()
+	done := c.stopped || c.selected
+	c.mu.Unlock()
+
+	if !done {
+		c.transport.candidateFailed(addr, relay, err)
+	}
+}
+
+func (c *dilationConnector) drop(conn net.Conn) {
+	c.mu.Lock()
+	delete(c.pending, conn)
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// handleConn does the dilation handshake on a candidate connection
+// described by info, and selects it if it wins.
+func (c *dilationConnector) handleConn(conn net.Conn, info TransitInfo) {
+	if !c.track(conn) {
+		return
+	}
+
+	fail := func(err error) {
+		c.drop(conn)
+		c.failed(info.Addr, info.Relay, err)
+	}
+
+	role := c.d.getRole()
+	dc, err := dilationHandshake(conn, role, c.d.dilationKey)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if role == dilationFollower {
+		err = dc.writeRecord(&dilationRecord{kind: recordKCM})
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	r, err := dc.readRecord()
+	if err == nil && r.kind != recordKCM {
+		err = errors.New("expected key confirmation message")
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	c.mu.Lock()
+	if c.stopped || c.selected {
+		c.mu.Unlock()
+		c.drop(conn)
+		return
+	}
+	c.selected = true
+	delete(c.pending, conn)
+	c.mu.Unlock()
+
+	if role == dilationLeader {
+		err = dc.writeRecord(&dilationRecord{kind: recordKCM})
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	tc := c.transport.established(&transitConn{Conn: conn, info: info})
+
+	c.d.connectionMade(c, dc, tc.info)
+}
@@ -0,0 +1,263 @@
+package wormhole
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/poly1305"
+)
+
+// noiseProtocolName is the Noise protocol used to secure L2
+// dilation connections. This must match the python client.
+const noiseProtocolName = "Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s"
+
+const (
+	noiseHashLen = blake2s.Size
+	noiseDHLen   = 32
+	noiseTagLen  = poly1305.TagSize
+
+	// noiseMaxMsgLen is the largest message noise allows on the wire.
+	noiseMaxMsgLen = 65535
+)
+
+var errNoiseDecrypt = errors.New("noise: message authentication failed")
+
+func newBlake2s() hash.Hash {
+	h, err := blake2s.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// noiseCipherState is the CipherState object from the noise spec.
+type noiseCipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipherState(k []byte) *noiseCipherState {
+	aead, err := chacha20poly1305.New(k)
+	if err != nil {
+		panic(err)
+	}
+	return &noiseCipherState{aead: aead}
+}
+
+func (cs *noiseCipherState) nonceBytes() []byte {
+	// 32 bits of zeros followed by the little-endian encoding of n
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	return nonce[:]
+}
+
+func (cs *noiseCipherState) encrypt(ad, plaintext []byte) []byte {
+	out := cs.aead.Seal(nil, cs.nonceBytes(), plaintext, ad)
+	cs.nonce++
+	return out
+}
+
+func (cs *noiseCipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	out, err := cs.aead.Open(nil, cs.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, errNoiseDecrypt
+	}
+	cs.nonce++
+	return out, nil
+}
+
+// noiseHandshake implements the NNpsk0 handshake pattern:
+//
+//	-> psk, e
+//	<- e, ee
+//
+// The leader of a dilated connection is always the initiator.
+type noiseHandshake struct {
+	initiator bool
+	psk       []byte
+
+	ck []byte
+	h  []byte
+	cs *noiseCipherState
+
+	ePriv [32]byte
+	ePub  [32]byte
+	rePub [32]byte
+}
+
+func newNoiseHandshake(initiator bool, psk []byte) *noiseHandshake {
+	hs := &noiseHandshake{
+		initiator: initiator,
+		psk:       psk,
+	}
+
+	name := []byte(noiseProtocolName)
+	if len(name) <= noiseHashLen {
+		hs.h = make([]byte, noiseHashLen)
+		copy(hs.h, name)
+	} else {
+		sum := blake2s.Sum256(name)
+		hs.h = sum[:]
+	}
+	hs.ck = append([]byte(nil), hs.h...)
+
+	// empty prologue
+	hs.mixHash(nil)
+
+	return hs
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	h := newBlake2s()
+	h.Write(hs.h)
+	h.Write(data)
+	hs.h = h.Sum(nil)
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) {
+	out := noiseHKDF(hs.ck, ikm, 2)
+	hs.ck = out[0]
+	hs.cs = newNoiseCipherState(out[1])
+}
+
+func (hs *noiseHandshake) mixKeyAndHash(ikm []byte) {
+	out := noiseHKDF(hs.ck, ikm, 3)
+	hs.ck = out[0]
+	hs.mixHash(out[1])
+	hs.cs = newNoiseCipherState(out[2])
+}
+
+func (hs *noiseHandshake) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := hs.cs.encrypt(hs.h, plaintext)
+	hs.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (hs *noiseHandshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := hs.cs.decrypt(hs.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (hs *noiseHandshake) generateEphemeral() {
+	if _, err := io.ReadFull(rand.Reader, hs.ePriv[:]); err != nil {
+		panic(err)
+	}
+	curve25519.ScalarBaseMult(&hs.ePub, &hs.ePriv)
+}
+
+func (hs *noiseHandshake) dh() ([]byte, error) {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, &hs.ePriv, &hs.rePub)
+
+	var zero [32]byte
+	if hmac.Equal(shared[:], zero[:]) {
+		return nil, errors.New("noise: invalid remote ephemeral key")
+	}
+	return shared[:], nil
+}
+
+// writeMessage1 produces the initiator's first handshake message.
+func (hs *noiseHandshake) writeMessage1() []byte {
+	hs.mixKeyAndHash(hs.psk)
+
+	hs.generateEphemeral()
+	hs.mixHash(hs.ePub[:])
+	hs.mixKey(hs.ePub[:])
+
+	msg := append([]byte(nil), hs.ePub[:]...)
+	return append(msg, hs.encryptAndHash(nil)...)
+}
+
+// readMessage1 consumes the initiator's first handshake message.
+func (hs *noiseHandshake) readMessage1(msg []byte) error {
+	if len(msg) != noiseDHLen+noiseTagLen {
+		return errors.New("noise: bad handshake message length")
+	}
+
+	hs.mixKeyAndHash(hs.psk)
+
+	copy(hs.rePub[:], msg[:noiseDHLen])
+	hs.mixHash(hs.rePub[:])
+	hs.mixKey(hs.rePub[:])
+
+	_, err := hs.decryptAndHash(msg[noiseDHLen:])
+	return err
+}
+
+// writeMessage2 produces the responder's handshake message.
+func (hs *noiseHandshake) writeMessage2() ([]byte, error) {
+	hs.generateEphemeral()
+	hs.mixHash(hs.ePub[:])
+	hs.mixKey(hs.ePub[:])
+
+	shared, err := hs.dh()
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(shared)
+
+	msg := append([]byte(nil), hs.ePub[:]...)
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// readMessage2 consumes the responder's handshake message.
+func (hs *noiseHandshake) readMessage2(msg []byte) error {
+	if len(msg) != noiseDHLen+noiseTagLen {
+		return errors.New("noise: bad handshake message length")
+	}
+
+	copy(hs.rePub[:], msg[:noiseDHLen])
+	hs.mixHash(hs.rePub[:])
+	hs.mixKey(hs.rePub[:])
+
+	shared, err := hs.dh()
+	if err != nil {
+		return err
+	}
+	hs.mixKey(shared)
+
+	_, err = hs.decryptAndHash(msg[noiseDHLen:])
+	return err
+}
+
+// split returns the (send, recv) cipher states for transport messages
+// once the handshake has completed.
+func (hs *noiseHandshake) split() (*noiseCipherState, *noiseCipherState) {
+	out := noiseHKDF(hs.ck, nil, 2)
+	c1 := newNoiseCipherState(out[0])
+	c2 := newNoiseCipherState(out[1])
+
+	if hs.initiator {
+		return c1, c2
+	}
+	return c2, c1
+}
+
+func noiseHKDF(chainingKey, ikm []byte, numOutputs int) [][]byte {
+	tempMac := hmac.New(newBlake2s, chainingKey)
+	tempMac.Write(ikm)
+	tempKey := tempMac.Sum(nil)
+
+	outputs := make([][]byte, 0, numOutputs)
+	var prev []byte
+	for i := 1; i <= numOutputs; i++ {
+		mac := hmac.New(newBlake2s, tempKey)
+		mac.Write(prev)
+		mac.Write([]byte{byte(i)})
+		prev = mac.Sum(nil)
+		outputs = append(outputs, prev)
+	}
+	return outputs
+}
@@ -0,0 +1,203 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var errSubchannelClosed = errors.New("subchannel closed")
+
+// subchannel is a single bidirectional stream carried over a Dilation.
+// All mutable state is protected by the parent Dilation's mutex.
+type subchannel struct {
+	d    *Dilation
+	scid uint32
+
+	inbound      [][]byte
+	localClosed  bool
+	remoteClosed bool
+
+	readDeadline time.Time
+	readTimer    *time.Timer
+}
+
+var _ net.Conn = (*subchannel)(nil)
+
+func newSubchannel(d *Dilation, scid uint32) *subchannel {
+	return &subchannel{
+		d:    d,
+		scid: scid,
+	}
+}
+
+// deliver appends data received from the peer. d.mu must be held.
+func (sc *subchannel) deliver(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	sc.inbound = append(sc.inbound, data)
+	sc.d.cond.Broadcast()
+}
+
+// remoteClose marks the subchannel as closed by the peer. d.mu must be
+// held.
+func (sc *subchannel) remoteClose() {
+	sc.remoteClosed = true
+	sc.d.cond.Broadcast()
+}
+
+func (sc *subchannel) Read(p []byte) (int, error) {
+	d := sc.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for len(sc.inbound) == 0 {
+		if sc.remoteClosed {
+			if d.err != nil && d.err != errDilationClosed {
+				return 0, d.err
+			}
+			return 0, io.EOF
+		}
+		if sc.localClosed {
+			return 0, errSubchannelClosed
+		}
+		if !sc.readDeadline.IsZero() && !time.Now().Before(sc.readDeadline) {
+			return 0, errTimeout
+		}
+		d.cond.Wait()
+	}
+
+	n := copy(p, sc.inbound[0])
+	if n == len(sc.inbound[0]) {
+		sc.inbound = sc.inbound[1:]
+	} else {
+		sc.inbound[0] = sc.inbound[0][n:]
+	}
+	return n, nil
+}
+
+// Write queues p for delivery to the peer. Each call is written as a
+// whole, so concurrent Writes never interleave their data.
+func (sc *subchannel) Write(p []byte) (int, error) {
+	d := sc.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.unacked >= dilationMaxUnackedBytes && !sc.localClosed && !d.closed {
+		d.cond.Wait()
+	}
+	if d.closed {
+		if d.err != nil && d.err != errDilationClosed {
+			return 0, d.err
+		}
+		return 0, errSubchannelClosed
+	}
+	if sc.localClosed || sc.remoteClosed {
+		return 0, errSubchannelClosed
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > dilationMaxDataLen {
+			chunk = chunk[:dilationMaxDataLen]
+		}
+		d.sendLocked(&dilationRecord{
+			kind: recordData,
+			scid: sc.scid,
+			data: append([]byte(nil), chunk...),
+		})
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Close closes the subchannel. Any buffered unread data is discarded.
+func (sc *subchannel) Close() error {
+	d := sc.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if sc.localClosed {
+		return nil
+	}
+	sc.localClosed = true
+	sc.inbound = nil
+	if sc.readTimer != nil {
+		sc.readTimer.Stop()
+	}
+
+	if !d.closed && !sc.remoteClosed {
+		d.sendLocked(&dilationRecord{kind: recordClose, scid: sc.scid})
+	}
+	if sc.remoteClosed {
+		delete(d.subchannels, sc.scid)
+	}
+	d.cond.Broadcast()
+
+	return nil
+}
+
+func (sc *subchannel) LocalAddr() net.Addr {
+	return subchannelAddr{scid: sc.scid}
+}
+
+func (sc *subchannel) RemoteAddr() net.Addr {
+	return subchannelAddr{scid: sc.scid}
+}
+
+func (sc *subchannel) SetDeadline(t time.Time) error {
+	return sc.SetReadDeadline(t)
+}
+
+func (sc *subchannel) SetReadDeadline(t time.Time) error {
+	d := sc.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sc.readDeadline = t
+	if sc.readTimer != nil {
+		sc.readTimer.Stop()
+		sc.readTimer = nil
+	}
+	if !t.IsZero() {
+		sc.readTimer = time.AfterFunc(time.Until(t), func() {
+			d.mu.Lock()
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline is not supported; writes only block while too much
+// data is waiting to be acknowledged by the peer.
+func (sc *subchannel) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type subchannelAddr struct {
+	scid uint32
+}
+
+func (a subchannelAddr) Network() string {
+	return "dilation"
+}
+
+func (a subchannelAddr) String() string {
+	return fmt.Sprintf("subchannel-%d", a.scid)
+}
+
+// errTimeout is returned by subchannel reads when the read deadline
+// is exceeded.
+var errTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
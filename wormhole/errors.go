@@ -0,0 +1,129 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/psanford/wormhole-william/rendezvous"
+)
+
+// These errors are returned by Receive, SendText and SendFile, in
+// SendResult.Error, and by IncomingMessage.Read. They may be wrapped,
+// so check for them with errors.Is.
+var (
+	// ErrBadCode means the peer used a different code, so the
+	// messages it sent could not be decrypted.
+	ErrBadCode = errors.New("decrypt message failed")
+
+	// ErrDecrypt means a message from the peer could not be
+	// decrypted after the code had been confirmed, so it was
+	// corrupted or tampered with on the way.
+	ErrDecrypt = errors.New("decrypt message from peer failed")
+
+	// ErrTransferRejected means the receiver rejected the transfer.
+	ErrTransferRejected = errors.New("transfer rejected")
+
+	// ErrPeerClosed means the peer closed the transit connection
+	// before the transfer was complete.
+	ErrPeerClosed = errors.New("peer closed the connection")
+
+	// ErrRelayUnreachable means the transit relay could not be
+	// reached.
+	ErrRelayUnreachable = errors.New("unable to connect to the relay server")
+
+	// ErrNameplateNotFound means Receive didn't find the code's
+	// nameplate on any of Client.RendezvousURLs. It is only checked
+	// for when there is more than one server.
+	ErrNameplateNotFound = errors.New("nameplate not found")
+)
+
+// A RendezvousError is returned when none of Client.RendezvousURLs
+// could be used. Use errors.As to check for it.
+type RendezvousError struct {
+	// URLs are the servers that were tried, in order.
+	URLs []string
+	// Errs are why each of them couldn't be used.
+	Errs []error
+}
+
+func (e *RendezvousError) add(url string, err error) {
+	e.URLs = append(e.URLs, url)
+	e.Errs = append(e.Errs, err)
+}
+
+func (e *RendezvousError) Error() string {
+	var b strings.Builder
+	b.WriteString("no usable rendezvous server")
+	for i, url := range e.URLs {
+		fmt.Fprintf(&b, "; %s: %s", url, e.Errs[i])
+	}
+	return b.String()
+}
+
+// Is reports whether any of the servers failed with target, for
+// example errors.Is(err, ErrNameplateNotFound).
+func (e *RendezvousError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// A ServerError is an error reported by the rendezvous server. Use
+// errors.As to check for it.
+type ServerError = rendezvous.ServerError
+
+// A PeerError is an error reported by the peer, such as the
+// receiver rejecting the transfer or the sender failing the
+// verification check. Use errors.As to check for it.
+type PeerError struct {
+	// Message is the error as sent by the peer.
+	Message string
+}
+
+func (e *PeerError) Error() string {
+	return "TransferError: " + e.Message
+}
+
+// Is reports whether the peer error means the transfer was
+// rejected, for errors.Is(err, ErrTransferRejected), or that a
+// resumed transfer didn't match, for errors.Is(err, ErrResumeMismatch).
+func (e *PeerError) Is(target error) bool {
+	switch target {
+	case ErrTransferRejected, ErrResumeMismatch:
+		return e.Message == target.Error()
+	}
+	return false
+}
+
+// peerClosedError is an error from the transit connection that means
+// the peer went away. It keeps the original error's message.
+type peerClosedError struct {
+	err error
+}
+
+func (e *peerClosedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *peerClosedError) Unwrap() error {
+	return e.err
+}
+
+func (e *peerClosedError) Is(target error) bool {
+	return target == ErrPeerClosed
+}
+
+// checkPeerClosed returns err marked as ErrPeerClosed if it means the
+// peer closed the connection mid transfer, and err otherwise.
+func checkPeerClosed(err error) error {
+	if err == io.ErrUnexpectedEOF || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return &peerClosedError{err: err}
+	}
+	return err
+}
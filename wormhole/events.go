@@ -0,0 +1,129 @@
+package wormhole
+
+import "fmt"
+
+// An EventType identifies a step of a transfer.
+type EventType int
+
+const (
+	// EventRendezvousConnected is emitted once connected to the
+	// rendezvous server. Event.URL is set.
+	EventRendezvousConnected EventType = iota + 1
+
+	// EventMailboxAllocated is emitted when a new nameplate has been
+	// allocated for the transfer. Event.Nameplate is set.
+	EventMailboxAllocated
+
+	// EventMailboxAttached is emitted when an existing nameplate,
+	// from the code, has been claimed. Event.Nameplate is set.
+	EventMailboxAttached
+
+	// EventPeerConnected is emitted when the peer's PAKE message
+	// arrives and the shared key has been computed.
+	EventPeerConnected
+
+	// EventKeyConfirmed is emitted when the peer's first encrypted
+	// message could be decrypted, so both sides used the same code.
+	EventKeyConfirmed
+
+	// EventTransitCandidate is emitted when a transit connection is
+	// attempted, either by dialing the peer or a relay, or by
+	// accepting a connection. Event.Addr and Event.Relay are set.
+	EventTransitCandidate
+
+	// EventTransitCandidateFailed is emitted when a transit
+	// connection attempt fails. Event.Addr, Event.Relay and
+	// Event.Err are set.
+	EventTransitCandidateFailed
+
+	// EventTransitConnected is emitted when a transit connection has
+	// been chosen for the transfer. Event.Addr and Event.Relay are
+	// set.
+	EventTransitConnected
+
+	// EventAckReceived is emitted on the sending side when the
+	// receiver acknowledges that it got everything.
+	EventAckReceived
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRendezvousConnected:
+		return "RendezvousConnected"
+	case EventMailboxAllocated:
+		return "MailboxAllocated"
+	case EventMailboxAttached:
+		return "MailboxAttached"
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventKeyConfirmed:
+		return "KeyConfirmed"
+	case EventTransitCandidate:
+		return "TransitCandidate"
+	case EventTransitCandidateFailed:
+		return "TransitCandidateFailed"
+	case EventTransitConnected:
+		return "TransitConnected"
+	case EventAckReceived:
+		return "AckReceived"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// An Event describes a step of a transfer. It is passed to the
+// handler set with WithEventHandler.
+type Event struct {
+	Type EventType
+
+	// Nameplate is the nameplate of the mailbox, for
+	// EventMailboxAllocated and EventMailboxAttached.
+	Nameplate string
+
+	// URL is the rendezvous server in use, for
+	// EventRendezvousConnected. With several Client.RendezvousURLs
+	// it is the one the code's nameplate is on.
+	URL string
+
+	// Addr is the address of the peer or relay for the transit
+	// events.
+	Addr string
+
+	// Relay is true for transit events about connections via a
+	// transit relay.
+	Relay bool
+
+	// Err is why a transit connection attempt failed, for
+	// EventTransitCandidateFailed.
+	Err error
+}
+
+func (e Event) String() string {
+	s := e.Type.String()
+	if e.Nameplate != "" {
+		s += " nameplate=" + e.Nameplate
+	}
+	if e.URL != "" {
+		s += " url=" + e.URL
+	}
+	if e.Addr != "" {
+		s += " addr=" + e.Addr
+	}
+	if e.Relay {
+		s += " relay"
+	}
+	if e.Err != nil {
+		s += " err=" + e.Err.Error()
+	}
+	return s
+}
+
+// eventFunc reports events to the handler set with WithEventHandler.
+// A nil eventFunc discards them.
+type eventFunc func(Event)
+
+func (f eventFunc) emit(e Event) {
+	if f != nil {
+		f(e)
+	}
+}
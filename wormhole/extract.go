@@ -0,0 +1,523 @@
+package wormhole
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// OverwritePolicy controls what ExtractTo does when a file it is about
+// to write already exists.
+type OverwritePolicy int
+
+const (
+	// OverwriteNever fails the extraction if a file already exists.
+	OverwriteNever OverwritePolicy = iota
+	// OverwriteSkip keeps existing files and skips the received ones.
+	OverwriteSkip
+	// OverwriteReplace replaces existing files with the received ones.
+	OverwriteReplace
+)
+
+// SymlinkPolicy controls what ExtractTo does with symlinks in a
+// received directory.
+type SymlinkPolicy int
+
+const (
+	// SymlinkInside creates symlinks that point inside the directory
+	// being extracted and fails the extraction if one points
+	// anywhere else.
+	SymlinkInside SymlinkPolicy = iota
+	// SymlinkSkip doesn't create any symlinks.
+	SymlinkSkip
+)
+
+const (
+	// maxLinkTargetLen is the longest symlink target we accept.
+	maxLinkTargetLen = 4096
+
+	// zipExtTimeExtraID tags the extended timestamp zip extra field.
+	zipExtTimeExtraID = 0x5455
+)
+
+type extractOptions struct {
+	overwrite    OverwritePolicy
+	symlinks     SymlinkPolicy
+	maxBytes     int64
+	maxFiles     int
+	progressFunc progressFunc
+}
+
+// An ExtractOption configures IncomingMessage.ExtractTo.
+type ExtractOption interface {
+	setOption(*extractOptions) error
+}
+
+type overwriteExtractOption struct {
+	policy OverwritePolicy
+}
+
+func (o overwriteExtractOption) setOption(opts *extractOptions) error {
+	switch o.policy {
+	case OverwriteNever, OverwriteSkip, OverwriteReplace:
+	default:
+		return fmt.Errorf("unknown overwrite policy %d", o.policy)
+	}
+	opts.overwrite = o.policy
+	return nil
+}
+
+// WithOverwrite returns an ExtractOption that sets what happens to
+// files that already exist. The default is OverwriteNever.
+func WithOverwrite(policy OverwritePolicy) ExtractOption {
+	return overwriteExtractOption{policy: policy}
+}
+
+type symlinkExtractOption struct {
+	policy SymlinkPolicy
+}
+
+func (o symlinkExtractOption) setOption(opts *extractOptions) error {
+	switch o.policy {
+	case SymlinkInside, SymlinkSkip:
+	default:
+		return fmt.Errorf("unknown symlink policy %d", o.policy)
+	}
+	opts.symlinks = o.policy
+	return nil
+}
+
+// WithSymlinks returns an ExtractOption that sets what happens to
+// symlinks. The default is SymlinkInside.
+func WithSymlinks(policy SymlinkPolicy) ExtractOption {
+	return symlinkExtractOption{policy: policy}
+}
+
+type limitsExtractOption struct {
+	maxBytes int64
+	maxFiles int
+}
+
+func (o limitsExtractOption) setOption(opts *extractOptions) error {
+	opts.maxBytes = o.maxBytes
+	opts.maxFiles = o.maxFiles
+	return nil
+}
+
+// WithExtractLimits returns an ExtractOption that refuses directories
+// with more than maxBytes of uncompressed data or more than maxFiles
+// files. A limit of 0 means no limit. The limits are checked against
+// the sender's offer before anything is received.
+func WithExtractLimits(maxBytes int64, maxFiles int) ExtractOption {
+	return limitsExtractOption{maxBytes: maxBytes, maxFiles: maxFiles}
+}
+
+type progressExtractOption struct {
+	progressFunc progressFunc
+}
+
+func (o progressExtractOption) setOption(opts *extractOptions) error {
+	opts.progressFunc = o.progressFunc
+	return nil
+}
+
+// WithExtractProgress returns an ExtractOption to track how much of
+// the directory has been received. The callback is called in addition
+// to any WithProgress callback passed to Receive.
+func WithExtractProgress(f func(receivedBytes int64, totalBytes int64)) ExtractOption {
+	return progressExtractOption{progressFunc: f}
+}
+
+// ExtractTo receives a TransferDirectory and writes its files into
+// dir, creating dir if it doesn't exist. It must be called instead of
+// Read.
+//
+// The whole zip file is first copied to a temporary file next to dir
+// and only extracted once it has been received completely, so the
+// directory takes up about twice its size on disk while it is being
+// received. The copy is needed because file modes and symlinks are
+// only recorded in the zip's central directory at its end. The
+// temporary file is removed before ExtractTo returns.
+//
+// Entries that would be written outside of dir are rejected, as are
+// directories containing more files or data than the sender offered.
+// File permissions and modification times are taken from the zip
+// entries, and empty directories and symlinks are recreated according
+// to the WithSymlinks policy. Nothing is ever written through a
+// symlink. If extraction fails part way through, the files written so
+// far are left in place.
+func (f *IncomingMessage) ExtractTo(dir string, opts ...ExtractOption) error {
+	var options extractOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.Type != TransferDirectory {
+		return errors.New("can only extract Directory transfers")
+	}
+
+	if f.transferInitialized {
+		return errors.New("cannot ExtractTo after calls to Read")
+	}
+
+	if options.maxBytes > 0 && f.UncompressedBytes64 > options.maxBytes {
+		f.Reject()
+		return fmt.Errorf("directory size %d exceeds limit of %d bytes", f.UncompressedBytes64, options.maxBytes)
+	}
+	if options.maxFiles > 0 && f.FileCount > options.maxFiles {
+		f.Reject()
+		return fmt.Errorf("directory has %d files, exceeding limit of %d", f.FileCount, options.maxFiles)
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		f.Reject()
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(dir), fmt.Sprintf(".%s.zip.tmp", filepath.Base(dir)))
+	if err != nil {
+		f.Reject()
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	var r io.Reader = f
+	if options.progressFunc != nil {
+		r = &progressReader{r: f, total: f.TransferBytes64, progressFunc: options.progressFunc}
+	}
+
+	n, err := io.Copy(tmpFile, r)
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(tmpFile, n)
+	if err != nil {
+		return err
+	}
+
+	return extractZip(zr, dir, f.UncompressedBytes64, f.FileCount, options)
+}
+
+// extractZip writes the files in zr into dir. It fails if the zip
+// contains more than numFiles files or numBytes of data.
+func extractZip(zr *zip.Reader, dir string, numBytes int64, numFiles int, options extractOptions) error {
+	var (
+		files    int
+		declared uint64
+		paths    = make([]string, len(zr.File))
+	)
+	for i, zf := range zr.File {
+		p, err := extractPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		paths[i] = p
+
+		if !zf.FileInfo().IsDir() {
+			files++
+			declared += zf.UncompressedSize64
+		}
+	}
+	if files > numFiles {
+		return fmt.Errorf("directory contains %d files but sender offered %d", files, numFiles)
+	}
+	if declared > uint64(numBytes) {
+		return fmt.Errorf("directory contains %d bytes but sender offered %d", declared, numBytes)
+	}
+
+	var dirs []int
+	remaining := numBytes
+	for i, zf := range zr.File {
+		err := checkNoSymlinks(dir, paths[i])
+		if err != nil {
+			return err
+		}
+
+		mode := zf.Mode()
+		if mode.IsDir() {
+			err := os.MkdirAll(paths[i], 0777)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, i)
+			continue
+		}
+
+		var n int64
+		if mode&os.ModeSymlink != 0 {
+			n, err = extractSymlink(zf, dir, paths[i], remaining, options)
+		} else {
+			n, err = extractFile(zf, paths[i], remaining, options.overwrite)
+		}
+		if err != nil {
+			return err
+		}
+		remaining -= n
+	}
+
+	// set directory times last, as creating the files in them
+	// changes them
+	for j := len(dirs) - 1; j >= 0; j-- {
+		i := dirs[j]
+		setModTime(zr.File[i], paths[i])
+	}
+
+	return nil
+}
+
+// extractPath returns where the zip entry name should be written
+// inside dir, rejecting names that would escape it.
+func extractPath(dir, name string) (string, error) {
+	if name == "" || strings.Contains(name, "\\") || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("dangerous filename detected: %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		// even when they cancel out, .. could walk back out of a
+		// symlink
+		if part == ".." {
+			return "", fmt.Errorf("dangerous filename detected: %q", name)
+		}
+	}
+
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("dangerous filename detected: %q", name)
+	}
+
+	return p, nil
+}
+
+// checkNoSymlinks fails if any of the directories between dir and p
+// is a symlink, so entries are never written through one.
+func checkNoSymlinks(dir, p string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	cur := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write %s through symlink %s", p, cur)
+		}
+	}
+	return nil
+}
+
+// removeExisting makes way for a new entry at p according to the
+// overwrite policy. It returns false if the entry should be skipped.
+func removeExisting(p string, overwrite OverwritePolicy) (bool, error) {
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch overwrite {
+	case OverwriteSkip:
+		return false, nil
+	case OverwriteReplace:
+		if fi.IsDir() {
+			return false, fmt.Errorf("refusing to replace directory %s", p)
+		}
+		return true, os.Remove(p)
+	default:
+		return false, fmt.Errorf("refusing to overwrite existing %s", p)
+	}
+}
+
+// extractFile writes a single zip entry to p, copying at most limit
+// bytes. It returns the number of bytes written.
+func extractFile(zf *zip.File, p string, limit int64, overwrite OverwritePolicy) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	ok, err := removeExisting(p, overwrite)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	perm := zf.Mode().Perm()
+	if perm == 0 {
+		perm = 0666
+	}
+
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return 0, err
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	if n > limit {
+		out.Close()
+		return n, errors.New("directory contains more data than the sender offered")
+	}
+
+	err = out.Close()
+	if err != nil {
+		return n, err
+	}
+
+	setModTime(zf, p)
+	return n, nil
+}
+
+// extractSymlink creates the symlink entry zf at p, if the policy
+// allows it. It returns the length of the link target.
+func extractSymlink(zf *zip.File, dir, p string, limit int64, options extractOptions) (int64, error) {
+	if limit > maxLinkTargetLen {
+		limit = maxLinkTargetLen
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(target))
+	if n > limit {
+		return n, fmt.Errorf("symlink %s target is too long", zf.Name)
+	}
+
+	if options.symlinks == SymlinkSkip {
+		return n, nil
+	}
+
+	if !symlinkInside(dir, p, string(target)) {
+		return n, fmt.Errorf("symlink %s points outside of the directory: %q", zf.Name, target)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0777)
+	if err != nil {
+		return n, err
+	}
+
+	ok, err := removeExisting(p, options.overwrite)
+	if err != nil || !ok {
+		return n, err
+	}
+
+	return n, os.Symlink(filepath.FromSlash(string(target)), p)
+}
+
+// symlinkInside reports whether a symlink at p to target points
+// inside dir.
+func symlinkInside(dir, p, target string) bool {
+	if target == "" || strings.Contains(target, "\\") || strings.HasPrefix(target, "/") || filepath.IsAbs(target) {
+		return false
+	}
+
+	// ".." may only lead the target. After a named component it would
+	// climb out of whatever that resolves to, which can be a symlink
+	// extracted earlier rather than the directory it looks like.
+	named := false
+	for _, c := range strings.Split(target, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if named {
+				return false
+			}
+		default:
+			named = true
+		}
+	}
+
+	resolved := filepath.Join(filepath.Dir(p), filepath.FromSlash(target))
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return false
+	}
+	return true
+}
+
+// setModTime sets the modification time of p to the one recorded for
+// zf. Only extended timestamps are used, as the MS-DOS time fields
+// have no time zone.
+func setModTime(zf *zip.File, p string) {
+	if !hasExtendedTimestamp(zf.Extra) || zf.Modified.IsZero() {
+		return
+	}
+	os.Chtimes(p, zf.Modified, zf.Modified)
+}
+
+// hasExtendedTimestamp reports whether a zip extra field contains an
+// extended timestamp record.
+func hasExtendedTimestamp(extra []byte) bool {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if tag == zipExtTimeExtraID {
+			return true
+		}
+		if len(extra) < 4+size {
+			break
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
+
+type progressReader struct {
+	r            io.Reader
+	n            int64
+	total        int64
+	progressFunc progressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if n > 0 {
+		p.progressFunc(p.n, p.total)
+	}
+	return n, err
+}
@@ -12,7 +12,9 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/psanford/wormhole-william/internal"
 	"github.com/psanford/wormhole-william/internal/crypto"
@@ -41,6 +43,10 @@ const websocketReadSize int64 = 65536
 // statements to account for unexpected protocols.
 var UnsupportedProtocolErr = errors.New("unsupported protocol")
 
+// errDecryptRecordFailed is returned when a transit record can't be
+// decrypted, e.g. because it was corrupted.
+var errDecryptRecordFailed = errors.New("decrypt transit record failed")
+
 func (tt TransferType) String() string {
 	switch tt {
 	case TransferFile:
@@ -97,7 +103,7 @@ func (d *transportCryptor) readRecord() ([]byte, error) {
 	}
 	_, err := io.ReadFull(d.conn, d.prefixBuf)
 	if err != nil {
-		d.err = err
+		d.err = checkPeerClosed(err)
 		return nil, d.err
 	}
 
@@ -117,14 +123,17 @@ func (d *transportCryptor) readRecord() ([]byte, error) {
 
 	sealedMsg := make([]byte, l-crypto.NonceSize)
 	_, err = io.ReadFull(d.conn, sealedMsg)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		d.err = err
+		d.err = checkPeerClosed(err)
 		return nil, d.err
 	}
 
 	out, ok := secretbox.Open(nil, sealedMsg, &nonce, &d.readKey)
 	if !ok {
-		d.err = errDecryptFailed
+		d.err = errDecryptRecordFailed
 		return nil, d.err
 	}
 
@@ -159,193 +168,554 @@ func (d *transportCryptor) writeRecord(msg []byte) error {
 	lenNonceAndSealedMsg := append(l, nonceAndSealedMsg...)
 
 	_, err := d.conn.Write(lenNonceAndSealedMsg)
-	return err
+	return checkPeerClosed(err)
 }
 
-func newFileTransport(transitKey []byte, appID string, relayURL internal.SimpleURL, disableListener bool) *fileTransport {
+func newFileTransport(transitKey []byte, appID string, relays []transitRelay, disableListener bool) *fileTransport {
 	return &fileTransport{
 		transitKey:      transitKey,
 		appID:           appID,
-		relayURL:        relayURL,
+		relays:          relays,
 		disableListener: disableListener,
 	}
 }
 
+// A TransitHint is an extra address advertised to the peer for direct
+// transit connections, such as a port-forwarded public address or a
+// DNS name that resolves to this machine.
+type TransitHint struct {
+	// Hostname is an IP address or a DNS name.
+	Hostname string
+	// Port is the TCP port to connect to. If 0 the port of the local
+	// listener is used.
+	Port int
+	// Priority tells the peer which hints to try first; higher
+	// values are tried first. Hints for this machine's own
+	// addresses have priority 0.
+	Priority float64
+}
+
+// A TransitRelay is a transit relay server to offer for file
+// transfers.
+type TransitRelay struct {
+	// URL is the proto:host:port address of the relay, as for
+	// Client.TransitRelayURL.
+	URL string
+	// Priority tells both sides which relays to try first; higher
+	// values are tried first.
+	Priority float64
+}
+
+// transitRelay is a parsed TransitRelay.
+type transitRelay struct {
+	url      internal.SimpleURL
+	priority float64
+}
+
+// relayFromHint returns the relay described by a hint inside a
+// relay-v1 hint.
+func relayFromHint(hint transitHintsV1Hint) (transitRelay, bool) {
+	var proto string
+	switch hint.Type {
+	case "direct-tcp-v1":
+		proto = "tcp"
+	case "direct-ws-v1":
+		proto = "ws"
+	case "direct-wss-v1":
+		proto = "wss"
+	default:
+		return transitRelay{}, false
+	}
+
+	return transitRelay{
+		url: internal.SimpleURL{
+			Proto: proto,
+			Host:  hint.Hostname,
+			Port:  hint.Port,
+		},
+		priority: hint.Priority,
+	}, true
+}
+
+// relayConn is a connection to one of our relays that is waiting to
+// be paired with the peer.
+type relayConn struct {
+	net.Conn
+	relay transitRelay
+}
+
+// A TransitInfo describes the transit connection a transfer used.
+type TransitInfo struct {
+	// Relay is true if the connection went via a transit relay
+	// rather than directly to the peer.
+	Relay bool
+
+	// Addr is the remote address of the connection: the peer's
+	// address for direct connections and the relay's for relayed
+	// ones.
+	Addr string
+
+	// HintType is the type of the hint the connection was made to,
+	// such as "direct-tcp-v1" or "direct-ws-v1". For relayed
+	// connections it is the type of the relay's hint.
+	HintType string
+
+	// HandshakeDuration is how long it took from the first
+	// connection attempt until this connection completed its
+	// handshake.
+	HandshakeDuration time.Duration
+}
+
+// transitConn is a transit connection that completed its handshake,
+// along with how it was made.
+type transitConn struct {
+	net.Conn
+	info TransitInfo
+}
+
+// directHintDelay is how long connectDirect waits for higher
+// priority hints before also trying lower priority ones.
+var directHintDelay = 250 * time.Millisecond
+
+// relayHintDelay is how long connectViaRelay waits for higher
+// priority relays before also trying lower priority ones. The peer
+// may not be waiting at every relay we know of, so a relay we
+// reached isn't given up on.
+var relayHintDelay = time.Second
+
+// relayListenDelay is how long listenRelay waits for slower relays
+// once it has reached one.
+var relayListenDelay = time.Second
+
 type fileTransport struct {
 	disableListener bool
+	listenPort      int
+	extraHints      []TransitHint
+	dialer          Dialer
 	listener        net.Listener
-	relayConn       net.Conn
-	relayURL        internal.SimpleURL
+	relays          []transitRelay
+	relayConns      []relayConn
 	transitKey      []byte
 	appID           string
-}
 
-func (t *fileTransport) connectViaRelay(otherTransit *transitMsg) (net.Conn, error) {
-	cancelFuncs := make(map[string]func())
+	// side is the side id sent in relay handshakes. If empty a
+	// random side is used for each relay connection.
+	side string
 
-	successChan := make(chan net.Conn)
-	failChan := make(chan string)
+	events eventFunc
 
-	var count int
+	// connectStart is when we started connecting to the peer.
+	connectStart time.Time
+}
 
-	for _, outerHint := range otherTransit.HintsV1 {
-		if outerHint.Type == "relay-v1" {
-			for _, innerHint := range outerHint.Hints {
-				addr := net.JoinHostPort(innerHint.Hostname, strconv.Itoa(innerHint.Port))
-				ctx, cancel := context.WithCancel(context.Background())
-				cancelFuncs[addr] = cancel
+// startConnecting records when we started connecting to the peer,
+// for TransitInfo.HandshakeDuration.
+func (t *fileTransport) startConnecting() {
+	if t.connectStart.IsZero() {
+		t.connectStart = time.Now()
+	}
+}
 
-				count++
-				go t.connectToRelay(ctx, successChan, failChan)
-			}
+// established finishes the TransitInfo of the connection chosen for
+// the transfer and reports it.
+func (t *fileTransport) established(conn *transitConn) *transitConn {
+	conn.info.HandshakeDuration = time.Since(t.connectStart)
+	t.events.emit(Event{Type: EventTransitConnected, Addr: conn.info.Addr, Relay: conn.info.Relay})
+	return conn
+}
+
+// incomingInfo describes a connection accepted by our listener or
+// paired by one of our relays.
+func (t *fileTransport) incomingInfo(conn net.Conn) TransitInfo {
+	for _, rc := range t.relayConns {
+		if rc.Conn == conn {
+			return relayInfo(rc.relay)
 		}
 	}
+	return TransitInfo{
+		Addr:     conn.RemoteAddr().String(),
+		HintType: "direct-tcp-v1",
+	}
+}
 
-	var conn net.Conn
+// relayInfo describes a connection via relay.
+func relayInfo(relay transitRelay) TransitInfo {
+	hintType, _ := relayHintType(relay.url.Proto)
+	return TransitInfo{
+		Relay:    true,
+		Addr:     relay.url.Addr(),
+		HintType: hintType,
+	}
+}
 
-	for i := 0; i < count; i++ {
-		select {
-		case <-failChan:
-		case conn = <-successChan:
+// waitingAt reports whether we have a connection waiting at the
+// relay described by hint, which the peer's connection to it will be
+// paired with.
+func (t *fileTransport) waitingAt(hint transitHintsV1Hint) bool {
+	relay, ok := relayFromHint(hint)
+	if !ok {
+		return false
+	}
+	for _, rc := range t.relayConns {
+		if rc.relay.url.Proto == relay.url.Proto && rc.relay.url.Addr() == relay.url.Addr() {
+			return true
 		}
 	}
+	return false
+}
 
-	return conn, nil
+// relayHintType returns the hint type for a relay reached with proto.
+func relayHintType(proto string) (string, error) {
+	switch proto {
+	case "tcp":
+		return "direct-tcp-v1", nil
+	case "ws":
+		return "direct-ws-v1", nil
+	case "wss":
+		return "direct-wss-v1", nil
+	default:
+		return "", fmt.Errorf("unknown relay protocol")
+	}
 }
 
-func (t *fileTransport) connectDirect(otherTransit *transitMsg) (net.Conn, error) {
-	cancelFuncs := make(map[string]func())
+// candidateFailed reports a failed transit connection attempt.
+func (t *fileTransport) candidateFailed(addr string, relay bool, err error) {
+	t.events.emit(Event{Type: EventTransitCandidateFailed, Addr: addr, Relay: relay, Err: err})
+}
+
+// connectViaRelay connects through the relays advertised by the
+// peer and our own, highest priority first. Relays with the same
+// priority are tried at the same time; lower priority ones are tried
+// once the higher priority ones have all failed or relayHintDelay has
+// passed.
+func (t *fileTransport) connectViaRelay(otherTransit *transitMsg) (*transitConn, error) {
+	t.startConnecting()
+
+	relays := t.relayCandidates(otherTransit)
+	if len(relays) == 0 {
+		return nil, nil
+	}
+
+	priorities := make([]float64, len(relays))
+	for i, relay := range relays {
+		priorities[i] = relay.priority
+	}
+
+	conn := connectByPriority(priorities, relayHintDelay, func(ctx context.Context, i int, successChan chan<- *transitConn, failChan chan<- string) {
+		t.connectToRelay(ctx, relays[i], successChan, failChan)
+	})
+	if conn == nil {
+		return nil, nil
+	}
+	return t.established(conn), nil
+}
+
+// relayCandidates returns the relays in the peer's hints and our own
+// relays, without duplicates, highest priority first.
+func (t *fileTransport) relayCandidates(otherTransit *transitMsg) []transitRelay {
+	var relays []transitRelay
+	seen := make(map[string]bool)
+
+	add := func(relay transitRelay) {
+		// NB: don't dial a relay if we don't have an address.
+		if relay.url.Host == "" && relay.url.Port == 0 {
+			return
+		}
+		key := relay.url.Proto + ":" + relay.url.Addr()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		relays = append(relays, relay)
+	}
+
+	for _, outerHint := range otherTransit.HintsV1 {
+		if outerHint.Type == "relay-v1" {
+			for _, innerHint := range outerHint.Hints {
+				relay, ok := relayFromHint(innerHint)
+				if ok {
+					add(relay)
+				}
+			}
+		}
+	}
+	for _, relay := range t.relays {
+		add(relay)
+	}
 
-	successChan := make(chan net.Conn)
-	failChan := make(chan string)
+	sort.SliceStable(relays, func(i, j int) bool {
+		return relays[i].priority > relays[j].priority
+	})
 
-	var count int
+	return relays
+}
+
+// connectDirect tries the peer's direct hints, highest priority
+// first. Hints with the same priority are tried at the same time;
+// lower priority hints are tried once the higher priority ones have
+// all failed or directHintDelay has passed.
+func (t *fileTransport) connectDirect(otherTransit *transitMsg) (*transitConn, error) {
+	t.startConnecting()
 
+	var hints []transitHintsV1
 	for _, hint := range otherTransit.HintsV1 {
 		if hint.Type == "direct-tcp-v1" {
-			count++
-			ctx, cancel := context.WithCancel(context.Background())
-			addr := net.JoinHostPort(hint.Hostname, strconv.Itoa(hint.Port))
+			hints = append(hints, hint)
+		}
+	}
+
+	if len(hints) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(hints, func(i, j int) bool {
+		return hints[i].Priority > hints[j].Priority
+	})
+
+	priorities := make([]float64, len(hints))
+	for i, hint := range hints {
+		priorities[i] = hint.Priority
+	}
+
+	conn := connectByPriority(priorities, directHintDelay, func(ctx context.Context, i int, successChan chan<- *transitConn, failChan chan<- string) {
+		addr := net.JoinHostPort(hints[i].Hostname, strconv.Itoa(hints[i].Port))
+		t.connectToSingleHost(ctx, addr, successChan, failChan)
+	})
+	if conn == nil {
+		return nil, nil
+	}
+	return t.established(conn), nil
+}
 
-			cancelFuncs[addr] = cancel
+// connectByPriority runs connect for each of the candidates whose
+// priorities are given, highest first, and returns the first
+// connection made or nil if every attempt failed. connect must send
+// exactly one value, on successChan or failChan; its context is
+// cancelled once connectByPriority returns.
+func connectByPriority(priorities []float64, delay time.Duration, connect func(ctx context.Context, i int, successChan chan<- *transitConn, failChan chan<- string)) *transitConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// buffered so attempts still in flight when we return don't block
+	successChan := make(chan *transitConn, len(priorities))
+	failChan := make(chan string, len(priorities))
+
+	var (
+		started  int
+		finished int
+		timer    <-chan time.Time
+	)
+
+	startNextPriority := func() {
+		priority := priorities[started]
+		for started < len(priorities) && priorities[started] == priority {
+			go connect(ctx, started, successChan, failChan)
+			started++
+		}
 
-			go t.connectToSingleHost(ctx, addr, successChan, failChan)
+		timer = nil
+		if started < len(priorities) {
+			timer = time.After(delay)
 		}
 	}
 
-	var conn net.Conn
+	startNextPriority()
 
-	for i := 0; i < count; i++ {
+	for finished < started {
 		select {
 		case <-failChan:
-		case conn = <-successChan:
+			finished++
+			if finished == started && started < len(priorities) {
+				startNextPriority()
+			}
+		case <-timer:
+			startNextPriority()
+		case conn := <-successChan:
+			return conn
 		}
 	}
 
-	return conn, nil
+	return nil
 }
 
-func (t *fileTransport) connectToRelay(ctx context.Context, successChan chan net.Conn, failChan chan string) {
+// dial makes a TCP connection to addr using the client's Dialer,
+// if any.
+func (t *fileTransport) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if t.dialer != nil {
+		return t.dialer.DialContext(ctx, "tcp", addr)
+	}
 	var d net.Dialer
-	var conn net.Conn
-	var err error
-	addr := t.relayURL.Addr()
+	return d.DialContext(ctx, "tcp", addr)
+}
 
-	switch t.relayURL.Proto {
-	case "tcp":
-		conn, err = d.DialContext(ctx, "tcp", addr)
+func (t *fileTransport) dialWebsocket(ctx context.Context, url string) (*websocket.Conn, error) {
+	opts, err := internal.WebsocketDialOptions(nil, t.dialer)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			failChan <- addr
-			return
-		}
-	case "ws", "wss":
-		var wsconn *websocket.Conn
-		wsconn, _, err = websocket.Dial(ctx, t.relayURL.String(), nil)
+	conn, _, err := websocket.Dial(ctx, url, opts)
+	return conn, err
+}
 
-		if err != nil {
-			failChan <- addr
-			return
+func (t *fileTransport) connectToRelay(ctx context.Context, relay transitRelay, successChan chan<- *transitConn, failChan chan<- string) {
+	addr := relay.url.Addr()
+	t.events.emit(Event{Type: EventTransitCandidate, Addr: addr, Relay: true})
+
+	conn, err := t.dialRelay(ctx, relay)
+	if err == nil {
+		// the peer may never show up at this relay, so give up
+		// waiting for it once another connection wins.
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+		err = t.directRecvHandshake(conn)
+		close(done)
+	}
+	if err != nil {
+		// don't report attempts abandoned after another one won
+		if ctx.Err() == nil {
+			t.candidateFailed(addr, true, err)
 		}
-		wsconn.SetReadLimit(websocketReadSize)
-		conn = websocket.NetConn(ctx, wsconn, websocket.MessageBinary)
+		failChan <- addr
+		return
+	}
+
+	successChan <- &transitConn{
+		Conn: conn,
+		info: relayInfo(relay),
+	}
+}
+
+// dialRelay connects to relay and completes the relay handshake.
+func (t *fileTransport) dialRelay(ctx context.Context, relay transitRelay) (net.Conn, error) {
+	conn, err := t.openRelay(ctx, relay)
+	if err != nil {
+		return nil, err
 	}
 
 	_, err = conn.Write(t.relayHandshakeHeader())
 	if err != nil {
-		failChan <- addr
-		return
+		conn.Close()
+		return nil, err
 	}
 	gotOk := make([]byte, 3)
 	_, err = io.ReadFull(conn, gotOk)
 	if err != nil {
 		conn.Close()
-		failChan <- addr
-		return
+		return nil, err
 	}
 
 	if !bytes.Equal(gotOk, []byte("ok\n")) {
 		conn.Close()
-		failChan <- addr
-		return
+		return nil, errors.New("got non ok status from relay server")
 	}
 
-	t.directRecvHandshake(ctx, conn, successChan, failChan)
+	return conn, nil
 }
 
-func (t *fileTransport) connectToSingleHost(ctx context.Context, addr string, successChan chan net.Conn, failChan chan string) {
-	var d net.Dialer
-	conn, err := d.DialContext(ctx, "tcp", addr)
+// openRelay connects to relay. ctx only bounds the dial.
+func (t *fileTransport) openRelay(ctx context.Context, relay transitRelay) (net.Conn, error) {
+	switch relay.url.Proto {
+	case "tcp":
+		return t.dial(ctx, relay.url.Addr())
+	case "ws", "wss":
+		// the websocket connection is tied to the context it was
+		// dialed with, so only cancel that while dialing.
+		dialCtx, cancel := context.WithCancel(context.Background())
+		dialed := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				select {
+				case <-dialed:
+				default:
+					cancel()
+				}
+			case <-dialed:
+			}
+		}()
+
+		wsconn, err := t.dialWebsocket(dialCtx, relay.url.String())
+		close(dialed)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("websocket.Dial failed: %s", err)
+		}
+		wsconn.SetReadLimit(websocketReadSize)
+		return websocket.NetConn(context.Background(), wsconn, websocket.MessageBinary), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", UnsupportedProtocolErr, relay.url.Proto)
+	}
+}
 
+func (t *fileTransport) connectToSingleHost(ctx context.Context, addr string, successChan chan<- *transitConn, failChan chan<- string) {
+	t.events.emit(Event{Type: EventTransitCandidate, Addr: addr})
+
+	conn, err := t.dial(ctx, addr)
+	if err == nil {
+		err = t.directRecvHandshake(conn)
+	}
 	if err != nil {
+		// don't report attempts abandoned after another one won
+		if ctx.Err() == nil {
+			t.candidateFailed(addr, false, err)
+		}
 		failChan <- addr
 		return
 	}
 
-	t.directRecvHandshake(ctx, conn, successChan, failChan)
+	successChan <- &transitConn{
+		Conn: conn,
+		info: TransitInfo{Addr: addr, HintType: "direct-tcp-v1"},
+	}
+}
+
+// directRecvHandshake does the receiver's side of the transit
+// handshake on conn. It closes conn if the handshake fails.
+func (t *fileTransport) directRecvHandshake(conn net.Conn) error {
+	err := t.recvHandshake(conn)
+	if err != nil {
+		conn.Close()
+	}
+	return err
 }
 
-func (t *fileTransport) directRecvHandshake(ctx context.Context, conn net.Conn, successChan chan net.Conn, failChan chan string) {
+func (t *fileTransport) recvHandshake(conn net.Conn) error {
 	expectHeader := t.senderHandshakeHeader()
 
-	addr := t.relayURL.Addr()
 	gotHeader := make([]byte, len(expectHeader))
 
 	_, err := io.ReadFull(conn, gotHeader)
 	if err != nil {
-		conn.Close()
-		failChan <- addr
-		return
+		return err
 	}
 
 	if subtle.ConstantTimeCompare(gotHeader, expectHeader) != 1 {
-		conn.Close()
-		failChan <- addr
-		return
+		return errors.New("bad handshake from sender")
 	}
 
 	_, err = conn.Write(t.receiverHandshakeHeader())
 	if err != nil {
-		conn.Close()
-		failChan <- addr
-		return
+		return err
 	}
 
 	gotGo := make([]byte, 3)
 	_, err = io.ReadFull(conn, gotGo)
 	if err != nil {
-		conn.Close()
-		failChan <- addr
-		return
+		return err
 	}
 
 	if !bytes.Equal(gotGo, []byte("go\n")) {
-		conn.Close()
-		failChan <- addr
-		return
+		return errors.New("sender chose another connection")
 	}
 
-	successChan <- conn
+	return nil
 }
 
 func (t *fileTransport) makeTransitMsg() (*transitMsg, error) {
@@ -363,17 +733,18 @@ func (t *fileTransport) makeTransitMsg() (*transitMsg, error) {
 	}
 
 	if t.listener != nil {
-		_, portStr, err := net.SplitHostPort(t.listener.Addr().String())
-		if err != nil {
-			return nil, err
+		tcpAddr, ok := t.listener.Addr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unexpected listener address %s", t.listener.Addr())
 		}
+		port := tcpAddr.Port
 
-		port, err := strconv.Atoi(portStr)
-		if err != nil {
-			return nil, fmt.Errorf("port isn't an integer? %s", portStr)
-		}
+		// a listener on the IPv6 wildcard address also accepts IPv4
+		// connections; one on the IPv4 wildcard address only
+		// accepts IPv4.
+		ipv6 := tcpAddr.IP.To4() == nil
 
-		addrs := nonLocalhostAddresses()
+		addrs := nonLocalhostAddresses(ipv6)
 
 		for _, addr := range addrs {
 			msg.HintsV1 = append(msg.HintsV1, transitHintsV1{
@@ -383,29 +754,40 @@ func (t *fileTransport) makeTransitMsg() (*transitMsg, error) {
 				Port:     port,
 			})
 		}
+
+		for _, hint := range t.extraHints {
+			hintPort := hint.Port
+			if hintPort == 0 {
+				hintPort = port
+			}
+
+			msg.HintsV1 = append(msg.HintsV1, transitHintsV1{
+				Type:     "direct-tcp-v1",
+				Priority: hint.Priority,
+				Hostname: hint.Hostname,
+				Port:     hintPort,
+			})
+		}
 	}
 
-	if t.relayConn != nil {
-		// TODO: use an enum
-		var relayType string
-		switch t.relayURL.Proto {
-		case "tcp":
-			relayType = "direct-tcp-v1"
-		case "ws":
-			relayType = "direct-ws-v1"
-		case "wss":
-			relayType = "direct-wss-v1"
-		default:
-			return nil, fmt.Errorf("unknown relay protocol")
+	for _, relay := range t.relays {
+		// NB: don't advertise a relay we don't have an address for.
+		if relay.url.Host == "" && relay.url.Port == 0 {
+			continue
+		}
+
+		relayType, err := relayHintType(relay.url.Proto)
+		if err != nil {
+			return nil, err
 		}
 		msg.HintsV1 = append(msg.HintsV1, transitHintsV1{
 			Type: "relay-v1",
 			Hints: []transitHintsV1Hint{
 				{
 					Type:     relayType,
-					Priority: 2.0,
-					Hostname: t.relayURL.Host,
-					Port:     t.relayURL.Port,
+					Priority: relay.priority,
+					Hostname: relay.url.Host,
+					Port:     relay.url.Port,
 				},
 			},
 		})
@@ -453,7 +835,10 @@ func (t *fileTransport) relayHandshakeHeader() []byte {
 		panic(err)
 	}
 
-	sideID := crypto.RandHex(8)
+	sideID := t.side
+	if sideID == "" {
+		sideID = crypto.RandHex(8)
+	}
 
 	return []byte(fmt.Sprintf("please relay %x for side %s\n", out, sideID))
 }
@@ -463,53 +848,128 @@ func (t *fileTransport) listen() error {
 		return nil
 	}
 
-	switch t.relayURL.Proto {
-	case "tcp":
-		l, err := net.Listen("tcp", ":0")
-		if err != nil {
-			return err
+	// only listen if we use a TCP relay; websocket relays are used
+	// where we can't accept connections.
+	useTCP := false
+	for _, relay := range t.relays {
+		switch relay.url.Proto {
+		case "tcp":
+			useTCP = true
+		case "ws", "wss":
+		default:
+			return fmt.Errorf("%w: %s", UnsupportedProtocolErr, relay.url.Proto)
 		}
+	}
 
-		t.listener = l
-	case "ws", "wss":
+	if !useTCP {
 		t.listener = nil
-	default:
-		return fmt.Errorf("%w: %s", UnsupportedProtocolErr, t.relayURL.Proto)
+		return nil
+	}
+
+	// listening on the wildcard address accepts both IPv4 and
+	// IPv6 connections where the system supports it.
+	l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(t.listenPort)))
+	if err != nil {
+		return err
 	}
 
+	t.listener = l
 	return nil
 }
 
-func (t *fileTransport) listenRelay() (err error) {
-	ctx := context.Background()
-
-	var conn net.Conn
-	switch t.relayURL.Proto {
-	case "tcp":
+// listenRelay connects to each of our relays so that the peer can
+// reach us through any of them. It waits up to relayListenDelay for
+// the others once one has been reached, and only fails if none of
+// them could be.
+func (t *fileTransport) listenRelay() error {
+	var relays []transitRelay
+	for _, relay := range t.relays {
 		// NB: don't dial the relay if we don't have an address.
-		addr := t.relayURL.Addr()
-		if addr == ":0" {
-			return nil
+		if relay.url.Proto == "tcp" && relay.url.Addr() == ":0" {
+			continue
 		}
-		conn, err = net.Dial("tcp", addr)
-		if err != nil {
-			return err
+		relays = append(relays, relay)
+	}
+
+	if len(relays) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		relay transitRelay
+		conn  net.Conn
+		err   error
+	}
+	results := make(chan result, len(relays))
+
+	for _, relay := range relays {
+		go func(relay transitRelay) {
+			conn, err := t.openRelayListener(ctx, relay)
+			results <- result{relay: relay, conn: conn, err: err}
+		}(relay)
+	}
+
+	var (
+		firstErr error
+		timer    <-chan time.Time
+	)
+
+	for pending := len(relays); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				if firstErr == nil {
+					firstErr = r.err
+				}
+				continue
+			}
+			t.relayConns = append(t.relayConns, relayConn{Conn: r.conn, relay: r.relay})
+			if timer == nil {
+				timer = time.After(relayListenDelay)
+			}
+		case <-timer:
+			// close the connections to relays that were too slow
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					r := <-results
+					if r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return nil
 		}
-	case "ws", "wss":
-		c, _, err := websocket.Dial(ctx, t.relayURL.String(), nil)
-		if err != nil {
-			return fmt.Errorf("websocket.Dial failed")
+	}
+
+	if len(t.relayConns) == 0 {
+		return firstErr
+	}
+	return nil
+}
+
+// openRelayListener connects to relay and sends the relay handshake,
+// leaving the connection to wait for the peer.
+func (t *fileTransport) openRelayListener(ctx context.Context, relay transitRelay) (conn net.Conn, err error) {
+	addr := relay.url.Addr()
+	t.events.emit(Event{Type: EventTransitCandidate, Addr: addr, Relay: true})
+
+	conn, err = t.openRelay(ctx, relay)
+	if err != nil {
+		t.candidateFailed(addr, true, err)
+		if errors.Is(err, UnsupportedProtocolErr) {
+			return nil, err
 		}
-		c.SetReadLimit(websocketReadSize)
-		conn = websocket.NetConn(ctx, c, websocket.MessageBinary)
-	default:
-		return fmt.Errorf("%w: %s", UnsupportedProtocolErr, t.relayURL.Proto)
+		return nil, fmt.Errorf("%w: %s", ErrRelayUnreachable, err)
 	}
 
 	// TODO: obsolete
 	defer func() {
-		if err := recover(); err != nil {
-			err = errors.New("unable to connect to the relay server")
+		if r := recover(); r != nil {
+			conn = nil
+			err = ErrRelayUnreachable
 		}
 	}()
 	// TODO: fix
@@ -517,11 +977,10 @@ func (t *fileTransport) listenRelay() (err error) {
 	_, err = conn.Write(t.relayHandshakeHeader())
 	if err != nil {
 		conn.Close()
-		return err
+		return nil, err
 	}
 
-	t.relayConn = conn
-	return nil
+	return conn, nil
 }
 
 func (t *fileTransport) waitForRelayPeer(conn net.Conn, cancelCh chan struct{}) error {
@@ -551,19 +1010,26 @@ func (t *fileTransport) waitForRelayPeer(conn net.Conn, cancelCh chan struct{})
 	return nil
 }
 
-func (t *fileTransport) acceptConnection(ctx context.Context) (net.Conn, error) {
-	readyCh := make(chan net.Conn)
+func (t *fileTransport) acceptConnection(ctx context.Context) (*transitConn, error) {
+	t.startConnecting()
+
+	readyCh := make(chan *transitConn)
 	cancelCh := make(chan struct{})
 	acceptErrCh := make(chan error, 1)
 
-	if t.relayConn != nil {
-		go func() {
-			waitErr := t.waitForRelayPeer(t.relayConn, cancelCh)
+	for _, rc := range t.relayConns {
+		go func(rc relayConn) {
+			waitErr := t.waitForRelayPeer(rc.Conn, cancelCh)
 			if waitErr != nil {
+				select {
+				case <-cancelCh:
+				default:
+					t.candidateFailed(rc.relay.url.Addr(), true, waitErr)
+				}
 				return
 			}
-			t.handleIncomingConnection(t.relayConn, readyCh, cancelCh)
-		}()
+			t.handleIncomingConnection(rc.Conn, readyCh, cancelCh)
+		}(rc)
 	}
 
 	if t.listener != nil {
@@ -598,11 +1064,11 @@ func (t *fileTransport) acceptConnection(ctx context.Context) (net.Conn, error)
 			return nil, err
 		}
 
-		return conn, nil
+		return t.established(conn), nil
 	}
 }
 
-func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- net.Conn, cancelCh chan struct{}) {
+func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- *transitConn, cancelCh chan struct{}) {
 	okCh := make(chan struct{})
 
 	go func() {
@@ -613,10 +1079,23 @@ func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- n
 		}
 	}()
 
-	_, err := conn.Write(t.senderHandshakeHeader())
-	if err != nil {
+	info := t.incomingInfo(conn)
+	t.events.emit(Event{Type: EventTransitCandidate, Addr: info.Addr, Relay: info.Relay})
+
+	fail := func(err error) {
 		conn.Close()
 		close(okCh)
+		select {
+		case <-cancelCh:
+			// another connection won
+		default:
+			t.candidateFailed(info.Addr, info.Relay, err)
+		}
+	}
+
+	_, err := conn.Write(t.senderHandshakeHeader())
+	if err != nil {
+		fail(err)
 		return
 	}
 
@@ -626,14 +1105,12 @@ func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- n
 
 	_, err = io.ReadFull(conn, gotHeader)
 	if err != nil {
-		conn.Close()
-		close(okCh)
+		fail(err)
 		return
 	}
 
 	if subtle.ConstantTimeCompare(gotHeader, expectHeader) != 1 {
-		conn.Close()
-		close(okCh)
+		fail(errors.New("bad handshake from receiver"))
 		return
 	}
 
@@ -647,11 +1124,15 @@ func (t *fileTransport) handleIncomingConnection(conn net.Conn, readyCh chan<- n
 		// One of the other connections won, shut this one down
 		conn.Write([]byte("nevermind\n"))
 		conn.Close()
-	case readyCh <- conn:
+	case readyCh <- &transitConn{Conn: conn, info: info}:
 	}
 }
 
-func nonLocalhostAddresses() []string {
+// nonLocalhostAddresses returns the addresses of this machine's
+// network interfaces, excluding loopback addresses. IPv6 addresses
+// are included if includeIPv6 is set; link-local IPv6 addresses are
+// always skipped since they can't be used without a zone.
+func nonLocalhostAddresses(includeIPv6 bool) []string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return nil
@@ -663,6 +1144,8 @@ func nonLocalhostAddresses() []string {
 		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
 				outAddrs = append(outAddrs, ipnet.IP.String())
+			} else if includeIPv6 && !ipnet.IP.IsLinkLocalUnicast() {
+				outAddrs = append(outAddrs, ipnet.IP.String())
 			}
 		}
 	}
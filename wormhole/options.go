@@ -1,8 +1,18 @@
 package wormhole
 
+import (
+	"errors"
+	"sync"
+)
+
 type transferOptions struct {
-	code         string
-	progressFunc progressFunc
+	code                 string
+	progressFunc         progressFunc
+	peerCapabilitiesFunc func(PeerCapabilities) error
+	streamDirectory      bool
+	events               eventFunc
+	sideID               string
+	contactFunc          func(Contact)
 }
 
 type TransferOption interface {
@@ -47,6 +57,94 @@ func (o progressTransferOption) setOption(opts *transferOptions) error {
 // not use the wormhole transit protocol so it is not able to detect
 // the progress of the receiver. This limitation does not apply to
 // SendFile or SendDirectory.
+//
+// totalBytes is -1 when the size of the transfer isn't known, as with
+// SendStream.
 func WithProgress(f func(sentBytes int64, totalBytes int64)) TransferOption {
 	return progressTransferOption{f}
 }
+
+type peerCapabilitiesTransferOption struct {
+	f func(PeerCapabilities) error
+}
+
+func (o peerCapabilitiesTransferOption) setOption(opts *transferOptions) error {
+	opts.peerCapabilitiesFunc = o.f
+	return nil
+}
+
+// WithPeerCapabilities returns a TransferOption that calls f with the
+// capabilities the peer advertised. f is called once the PAKE and
+// version exchange have completed, before anything is offered to or
+// accepted from the peer. If f returns an error the transfer is
+// abandoned and the error is reported to both sides.
+func WithPeerCapabilities(f func(caps PeerCapabilities) error) TransferOption {
+	return peerCapabilitiesTransferOption{f}
+}
+
+type streamDirectoryTransferOption struct{}
+
+func (o streamDirectoryTransferOption) setOption(opts *transferOptions) error {
+	opts.streamDirectory = true
+	return nil
+}
+
+// WithStreamingDirectory returns a TransferOption that makes
+// SendDirectory and SendMultiple stream directories to the receiver
+// instead of building a temporary zip file first. Entries are stored
+// uncompressed so the size of the zip can be computed up front. Each
+// DirectoryEntry Reader is opened twice: once to find its size and
+// once to send it. The transfer fails if a file's size changes in
+// between.
+func WithStreamingDirectory() TransferOption {
+	return streamDirectoryTransferOption{}
+}
+
+type eventHandlerTransferOption struct {
+	f func(Event)
+}
+
+func (o eventHandlerTransferOption) setOption(opts *transferOptions) error {
+	var mu sync.Mutex
+	opts.events = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		o.f(e)
+	}
+	return nil
+}
+
+// WithEventHandler returns a TransferOption that calls f as the
+// transfer progresses: when the mailbox is ready, when the peer
+// connects, for each transit connection attempt, and so on. See
+// EventType for the events reported.
+//
+// f is never called concurrently but may be called from other
+// goroutines than the one that started the transfer, including after
+// Receive or the Send function has returned. It should not block.
+func WithEventHandler(f func(Event)) TransferOption {
+	return eventHandlerTransferOption{f}
+}
+
+type sideIDTransferOption struct {
+	sideID string
+}
+
+func (o sideIDTransferOption) setOption(opts *transferOptions) error {
+	if o.sideID == "" {
+		return errors.New("side ID must not be empty")
+	}
+	opts.sideID = o.sideID
+	return nil
+}
+
+// WithSideID returns a TransferOption that sets the side ID this
+// client uses with the rendezvous server, instead of a random one.
+// A sender that retries a transfer with the same code, for example
+// after restarting, should reuse its side ID so the server doesn't
+// count it as a third client and turn the receiver away. The server
+// refuses a side that has already released the nameplate while the
+// receiver still holds it.
+func WithSideID(sideID string) TransferOption {
+	return sideIDTransferOption{sideID: sideID}
+}
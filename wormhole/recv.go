@@ -22,7 +22,25 @@ import (
 func (c *Client) Receive(ctx context.Context, code string, disableListener bool, opts ...TransferOption) (fr *IncomingMessage, returnErr error) {
 	sideID := crypto.RandSideID()
 	appID := c.AppID
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
+
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nameplate, err := nameplateFromCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, url, err := c.connectRendezvousFor(ctx, sideID, appID, nameplate)
+	if err != nil {
+		return nil, err
+	}
+	options.events.emit(Event{Type: EventRendezvousConnected, URL: url})
 
 	defer func() {
 		mood := rendezvous.Errory
@@ -30,27 +48,26 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			// don't close our connection in this case
 			// wait until the user actually accepts the transfer
 			return
-		} else if returnErr == errDecryptFailed {
+		} else if errors.Is(returnErr, ErrBadCode) || errors.Is(returnErr, ErrDecrypt) {
 			mood = rendezvous.Scary
 		}
 		rc.Close(ctx, mood)
 	}()
 
-	_, err := rc.Connect(ctx)
-	if err != nil {
-		return nil, err
-	}
-	nameplate, err := nameplateFromCode(code)
-	if err != nil {
-		return nil, err
-	}
-
 	err = rc.AttachMailbox(ctx, nameplate)
 	if err != nil {
 		return nil, err
 	}
+	options.events.emit(Event{Type: EventMailboxAttached, Nameplate: nameplate})
 
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.events = options.events
+	if !c.disableTransferV2 {
+		clientProto.versions.enableTransferV2()
+	}
+	if c.disableStream {
+		clientProto.versions.AppVersions.Stream = nil
+	}
 
 	err = clientProto.WritePake(ctx, code)
 	if err != nil {
@@ -67,7 +84,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		return nil, err
 	}
 
-	_, err = clientProto.ReadVersion()
+	peerVersions, err := clientProto.ReadVersion()
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +108,18 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		}
 	}
 
+	options.reportContact(clientProto.sharedKey, false)
+
+	peerCaps := peerVersions.capabilities()
+	err = checkPeerCapabilities(ctx, clientProto, peerCaps, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	if clientProto.useTransferV2(peerVersions) {
+		return c.receiveTransferV2(ctx, rc, clientProto, disableListener, options, peerCaps)
+	}
+
 	collector, err := clientProto.Collect(collectOffer, collectTransit)
 	if err != nil {
 		return nil, err
@@ -103,12 +132,10 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		return nil, err
 	}
 
-	fr = &IncomingMessage{}
-	for _, opt := range opts {
-		err := opt.setOption(&fr.options)
-		if err != nil {
-			return nil, err
-		}
+	fr = &IncomingMessage{
+		PeerCapabilities: peerCaps,
+		options:          options,
+		ctx:              ctx,
 	}
 
 	if offer.Message != nil {
@@ -128,26 +155,11 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 		fr.Type = TransferText
 		fr.textReader = bytes.NewReader([]byte(*offer.Message))
 		return fr, nil
-	} else if offer.File != nil {
-		fr.Type = TransferFile
-		fr.Name = offer.File.FileName
-		fr.TransferBytes = int(offer.File.FileSize)
-		fr.TransferBytes64 = offer.File.FileSize
-		fr.UncompressedBytes = int(offer.File.FileSize)
-		fr.UncompressedBytes64 = offer.File.FileSize
-		fr.FileCount = 1
-		fr.ctx = ctx
-	} else if offer.Directory != nil {
-		fr.Type = TransferDirectory
-		fr.Name = offer.Directory.Dirname
-		fr.TransferBytes = int(offer.Directory.ZipSize)
-		fr.TransferBytes64 = offer.Directory.ZipSize
-		fr.UncompressedBytes = int(offer.Directory.NumBytes)
-		fr.UncompressedBytes64 = offer.Directory.NumBytes
-		fr.FileCount = int(offer.Directory.NumFiles)
-		fr.ctx = ctx
-	} else {
-		return nil, errors.New("got non-file transfer offer")
+	}
+
+	err = fr.setOffer(&offer)
+	if err != nil {
+		return nil, err
 	}
 
 	var gotTransitMsg transitMsg
@@ -157,7 +169,8 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 	}
 
 	transitKey := deriveTransitKey(clientProto.sharedKey, appID)
-	transport := newFileTransport(transitKey, appID, c.relayURL(), disableListener)
+	transport := c.newFileTransport(transitKey, appID, disableListener)
+	transport.events = options.events
 
 	transitMsg, err := transport.makeTransitMsg()
 	if err != nil {
@@ -176,7 +189,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if errors.Is(returnErr, ErrBadCode) || errors.Is(returnErr, ErrDecrypt) {
 				mood = rendezvous.Scary
 			}
 			rc.Close(ctx, mood)
@@ -202,7 +215,7 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if errors.Is(returnErr, ErrBadCode) || errors.Is(returnErr, ErrDecrypt) {
 				mood = rendezvous.Scary
 			}
 			rc.Close(ctx, mood)
@@ -210,7 +223,9 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 
 		answer := &genericMessage{
 			Answer: &answerMsg{
-				FileAck: "ok",
+				FileAck:      "ok",
+				ResumeOffset: fr.resumeOffset,
+				ResumeSHA256: fr.resumeSHA256,
 			},
 		}
 		ctx := context.Background()
@@ -236,10 +251,14 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 			return errors.New("failed to establish connection")
 		}
 
+		fr.Transit = &conn.info
+
 		cryptor := newTransportCryptor(conn, transitKey, "transit_record_sender_key", "transit_record_receiver_key")
 
-		fr.cryptor = cryptor
-		fr.sha256 = sha256.New()
+		fr.stream = transitStream{cryptor}
+		if fr.sha256 == nil {
+			fr.sha256 = sha256.New()
+		}
 		return nil
 	}
 
@@ -249,11 +268,78 @@ func (c *Client) Receive(ctx context.Context, code string, disableListener bool,
 	return fr, nil
 }
 
+// setOffer fills in f's metadata from a file or directory offer.
+func (f *IncomingMessage) setOffer(offer *offerMsg) error {
+	if offer.File != nil {
+		f.Type = TransferFile
+		f.Name = offer.File.FileName
+		f.TransferBytes = int(offer.File.FileSize)
+		f.TransferBytes64 = offer.File.FileSize
+		f.UncompressedBytes = int(offer.File.FileSize)
+		f.UncompressedBytes64 = offer.File.FileSize
+		f.FileCount = 1
+		if offer.File.UnknownSize {
+			f.unknownSize = true
+			f.TransferBytes = -1
+			f.TransferBytes64 = -1
+			f.UncompressedBytes = -1
+			f.UncompressedBytes64 = -1
+		}
+	} else if offer.Directory != nil {
+		f.Type = TransferDirectory
+		f.Name = offer.Directory.Dirname
+		f.TransferBytes = int(offer.Directory.ZipSize)
+		f.TransferBytes64 = offer.Directory.ZipSize
+		f.UncompressedBytes = int(offer.Directory.NumBytes)
+		f.UncompressedBytes64 = offer.Directory.NumBytes
+		f.FileCount = int(offer.Directory.NumFiles)
+	} else {
+		return errors.New("got non-file transfer offer")
+	}
+	return nil
+}
+
+// incomingStream is the connection an IncomingMessage reads a file
+// or directory payload from.
+type incomingStream interface {
+	readRecord() ([]byte, error)
+	writeAck(sha256Sum string) error
+	// abort closes the stream after a local error.
+	abort(err error)
+	Close() error
+}
+
+// transitStream is an incomingStream for the v1 transfer protocol.
+type transitStream struct {
+	*transportCryptor
+}
+
+func (s transitStream) writeAck(sha256Sum string) error {
+	ack := fileTransportAck{
+		Ack:    "ok",
+		SHA256: sha256Sum,
+	}
+
+	msg, _ := json.Marshal(ack)
+	return s.writeRecord(msg)
+}
+
+func (s transitStream) abort(err error) {
+	s.Close()
+}
+
 // A IncomingMessage contains information about a payload sent to this wormhole client.
 //
 // The Type field indicates if the sender sent a single file or a directory.
 // If the Type is TransferDirectory then reading from the IncomingMessage will
 // read a zip file of the contents of the directory.
+//
+// Senders using the transfer-v2 protocol may offer several files and
+// directories in one session; use Next to receive the ones after the
+// first.
+//
+// The sizes are -1 if the sender doesn't know them, which is the case
+// for files sent with SendStream.
 type IncomingMessage struct {
 	Name string
 	Type TransferType
@@ -267,13 +353,27 @@ type IncomingMessage struct {
 	UncompressedBytes64 int64
 	FileCount           int
 
+	// unknownSize is set if the sender streams a file without
+	// knowing its size. The sizes above are -1 and the end of the
+	// file is marked by an empty record.
+	unknownSize bool
+
+	// PeerCapabilities describes what the sender advertised
+	// about itself.
+	PeerCapabilities *PeerCapabilities
+
+	// Transit describes the connection the data is being received
+	// over. It is nil for text messages and until the first call to
+	// Read.
+	Transit *TransitInfo
+
 	textReader io.Reader
 
 	transferInitialized bool
 	initializeTransfer  func() error
 	rejectTransfer      func() error
 
-	cryptor   *transportCryptor
+	stream    incomingStream
 	buf       []byte
 	readCount int64
 	options   transferOptions
@@ -281,11 +381,43 @@ type IncomingMessage struct {
 
 	readErr error
 
+	// resumeOffset and resumeSHA256 describe the part of the file
+	// we already have, set by Resume.
+	resumeOffset int64
+	resumeSHA256 string
+
+	// dilation is set for transfer-v2 sessions. final is set if
+	// the sender has no more offers after this one.
+	dilation *Dilation
+	final    bool
+
 	ctx context.Context
 }
 
+// Next waits for the next file or directory offered by the sender in
+// the same session. It returns io.EOF once the sender has no more
+// offers. The current message must have been read to completion or
+// rejected before calling Next.
+//
+// Sessions using the v1 transfer protocol always carry a single
+// offer, so Next returns io.EOF for them.
+func (f *IncomingMessage) Next(ctx context.Context) (*IncomingMessage, error) {
+	if f.dilation == nil || f.final {
+		return nil, io.EOF
+	}
+
+	if !f.transferInitialized || (f.readErr != io.EOF && f.readErr != ErrTransferRejected) {
+		return nil, errors.New("current message must be read or rejected before calling Next")
+	}
+
+	return receiveOfferV2(ctx, f.dilation, f.options, f.PeerCapabilities)
+}
+
 // Return true if the msg has finished being read.
 func (f *IncomingMessage) ReadDone() bool {
+	if f.unknownSize {
+		return f.readErr == io.EOF
+	}
 	return f.readCount >= f.UncompressedBytes64
 }
 
@@ -328,6 +460,7 @@ func (f *IncomingMessage) Reject() error {
 	}
 
 	f.transferInitialized = true
+	f.readErr = ErrTransferRejected
 	f.rejectTransfer()
 
 	return nil
@@ -340,8 +473,8 @@ func (f *IncomingMessage) readCrypt(p []byte) (int, error) {
 
 	if err := f.ctx.Err(); err != nil {
 		f.readErr = err
-		if f.cryptor != nil {
-			f.cryptor.Close()
+		if f.stream != nil {
+			f.stream.abort(err)
 		}
 		return 0, err
 	}
@@ -352,17 +485,35 @@ func (f *IncomingMessage) readCrypt(p []byte) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+
+		// nothing left to send if we resumed with the whole file
+		if !f.unknownSize && f.readCount >= f.TransferBytes64 {
+			f.finishRead()
+			return 0, io.EOF
+		}
 	}
 
 	if len(f.buf) == 0 {
-		rec, err := f.cryptor.readRecord()
+		rec, err := f.stream.readRecord()
 		if err == io.EOF {
-			f.readErr = io.ErrUnexpectedEOF
-			return 0, f.readErr
-		} else if err != nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			err = checkPeerClosed(err)
 			f.readErr = err
+			f.stream.abort(err)
 			return 0, err
 		}
+		if f.unknownSize && len(rec) == 0 {
+			f.finishRead()
+			return 0, io.EOF
+		}
+		if len(rec) == 0 && f.resumeOffset > 0 && f.readCount == f.resumeOffset {
+			// the sender's file doesn't start with what we have
+			f.readErr = ErrResumeMismatch
+			f.stream.abort(ErrResumeMismatch)
+			return 0, ErrResumeMismatch
+		}
 		f.buf = rec
 	}
 
@@ -371,23 +522,22 @@ func (f *IncomingMessage) readCrypt(p []byte) (int, error) {
 	f.readCount += int64(n)
 	f.updateProgress()
 	f.sha256.Write(p[:n])
-	if f.readCount >= f.TransferBytes64 {
-		f.readErr = io.EOF
-
-		sum := f.sha256.Sum(nil)
-		ack := fileTransportAck{
-			Ack:    "ok",
-			SHA256: fmt.Sprintf("%x", sum),
-		}
-
-		msg, _ := json.Marshal(ack)
-		f.cryptor.writeRecord(msg)
-		f.cryptor.Close()
+	if !f.unknownSize && f.readCount >= f.TransferBytes64 {
+		f.finishRead()
 	}
 
 	return n, nil
 }
 
+// finishRead acks the complete file to the sender.
+func (f *IncomingMessage) finishRead() {
+	f.readErr = io.EOF
+
+	sum := f.sha256.Sum(nil)
+	f.stream.writeAck(fmt.Sprintf("%x", sum))
+	f.stream.Close()
+}
+
 func (f *IncomingMessage) updateProgress() {
 	if f.options.progressFunc != nil {
 		// NB: f.readCount can be > f.UncompressedBytes64.
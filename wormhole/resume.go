@@ -0,0 +1,120 @@
+package wormhole
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Resuming lets a receiver that already has the start of a file from
+// an earlier, interrupted transfer ask the sender to continue where it
+// left off. The receiver puts the number of bytes it has and their
+// SHA256 in its answer to the offer (the v1 answer message or the
+// transfer-v2 accept message). The sender hashes the same prefix of
+// its file, checks it against the receiver's, and then sends only the
+// rest. Both sides keep hashing from the start of the file, so the
+// final ack still covers the whole file.
+//
+// If the prefixes differ the sender tells the receiver before giving
+// up: over transfer-v2 with an error message, and over the v1 transit
+// connection with an empty record, which it never sends otherwise for
+// a file of known size. Either way the receiver's Read fails with
+// ErrResumeMismatch.
+
+// resumeVersion is the version of the resume extension we advertise
+// in app_versions.
+const resumeVersion = 1
+
+var (
+	// ErrResumeUnsupported is returned by IncomingMessage.Resume if
+	// the sender can't continue an interrupted transfer.
+	ErrResumeUnsupported = errors.New("sender does not support resuming transfers")
+
+	// ErrResumeMismatch is returned by the sender, and by
+	// IncomingMessage.Read on the receiver, if the data the receiver
+	// already has doesn't match the file being sent. The receiver's
+	// partial copy is of no use and should be discarded.
+	ErrResumeMismatch = errors.New("resume data does not match file")
+)
+
+type resumeVersions struct {
+	Version int `json:"version"`
+}
+
+// supportsResume reports whether the side that sent v can continue
+// interrupted file transfers.
+func (v *appVersionsMsg) supportsResume() bool {
+	return v.Resume != nil && v.Resume.Version >= resumeVersion
+}
+
+// Resume continues an interrupted file transfer. partial must
+// contain the first offset bytes of the file, which are hashed so the
+// final integrity check covers the whole file. After a successful
+// call Read returns the file's contents starting at offset, and
+// exactly offset bytes will have been read from partial.
+//
+// Resume must be called before any calls to Read. It returns
+// ErrResumeUnsupported if the sender doesn't support resuming, in
+// which case the transfer can still be read from the start.
+func (f *IncomingMessage) Resume(partial io.Reader, offset int64) error {
+	if f.Type != TransferFile {
+		return errors.New("can only resume File transfers")
+	}
+
+	if f.transferInitialized {
+		return errors.New("cannot Resume after calls to Read")
+	}
+
+	if f.PeerCapabilities == nil || !f.PeerCapabilities.Resume {
+		return ErrResumeUnsupported
+	}
+
+	if f.unknownSize {
+		return errors.New("cannot resume transfers of unknown size")
+	}
+
+	if offset < 0 || offset > f.TransferBytes64 {
+		return fmt.Errorf("resume offset %d out of range for %d byte file", offset, f.TransferBytes64)
+	}
+
+	hasher := sha256.New()
+	_, err := io.CopyN(hasher, partial, offset)
+	if err != nil {
+		return fmt.Errorf("read partial file: %s", err)
+	}
+
+	f.sha256 = hasher
+	f.resumeOffset = offset
+	f.resumeSHA256 = fmt.Sprintf("%x", hasher.Sum(nil))
+	f.readCount = offset
+
+	return nil
+}
+
+// skipResumed reads the part of a file the receiver already has from
+// r into hasher and checks it against the receiver's hash, leaving r
+// positioned where the transfer continues.
+func skipResumed(r io.Reader, offer *offerMsg, hasher hash.Hash, offset int64, prefixSHA256 string) error {
+	if offer.File == nil {
+		return errors.New("receiver asked to resume a non-file transfer")
+	}
+	if offer.File.UnknownSize {
+		return errors.New("receiver asked to resume a transfer of unknown size")
+	}
+	if offset < 0 || offset > offer.File.FileSize {
+		return fmt.Errorf("receiver asked to resume at invalid offset %d", offset)
+	}
+
+	_, err := io.CopyN(hasher, r, offset)
+	if err != nil {
+		return err
+	}
+
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != prefixSHA256 {
+		return ErrResumeMismatch
+	}
+
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/klauspost/compress/zip"
 	"github.com/psanford/wormhole-william/internal/crypto"
@@ -22,19 +23,23 @@ import (
 
 // returns a code
 func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID string, code string) (string, *rendezvous.Client, error) {
+	return c.createOrAttachMailbox(ctx, sideID, appID, code, nil)
+}
 
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
+func (c *Client) createOrAttachMailbox(ctx context.Context, sideID string, appID string, code string, events eventFunc) (string, *rendezvous.Client, error) {
 
-	_, err := rc.Connect(ctx)
+	rc, url, err := c.connectRendezvous(ctx, sideID, appID)
 	if err != nil {
 		return "", nil, err
 	}
+	events.emit(Event{Type: EventRendezvousConnected, URL: url})
 
 	if code == "" {
 		nameplate, err := rc.CreateMailbox(ctx)
 		if err != nil {
 			return "", nil, err
 		}
+		events.emit(Event{Type: EventMailboxAllocated, Nameplate: nameplate})
 
 		code = nameplate + "-" + wordlist.ChooseWords(c.wordCount())
 	} else {
@@ -47,6 +52,7 @@ func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID
 		if err != nil {
 			return "", nil, err
 		}
+		events.emit(Event{Type: EventMailboxAttached, Nameplate: nameplate})
 	}
 
 	return code, rc, nil
@@ -54,6 +60,7 @@ func (c *Client) CreateOrAttachMailbox(ctx context.Context, sideID string, appID
 
 func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID string, appID string, code string, msg string, options *transferOptions) (chan SendResult, error) {
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.events = options.events
 
 	ch := make(chan SendResult, 1)
 	go func() {
@@ -62,7 +69,7 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if errors.Is(returnErr, ErrBadCode) || errors.Is(returnErr, ErrDecrypt) {
 				mood = rendezvous.Scary
 			}
 
@@ -95,7 +102,7 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 			return
 		}
 
-		_, err = clientProto.ReadVersion()
+		peerVersions, err := clientProto.ReadVersion()
 		if err != nil {
 			sendErr(err)
 			return
@@ -123,6 +130,14 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 			}
 		}
 
+		options.reportContact(clientProto.sharedKey, true)
+
+		err = checkPeerCapabilities(ctx, clientProto, peerVersions.capabilities(), options)
+		if err != nil {
+			sendErr(err)
+			return
+		}
+
 		offer := &genericMessage{
 			Offer: &offerMsg{
 				Message: &msg,
@@ -149,6 +164,8 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 		}
 
 		if answer.MessageAck == "ok" {
+			options.events.emit(Event{Type: EventAckReceived})
+
 			if options.progressFunc != nil {
 				// If called WithProgress, send a single progress update
 				// showing that the transfer is complete. This is to simplify
@@ -178,7 +195,6 @@ func (c *Client) SendTextMsg(ctx context.Context, rc *rendezvous.Client, sideID
 // that gets written to once the receiver actually attempts to read the message
 // (either successfully or not).
 func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOption) (string, chan SendResult, error) {
-	sideID := crypto.RandSideID()
 	appID := c.AppID
 
 	var options transferOptions
@@ -189,7 +205,12 @@ func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOptio
 		}
 	}
 
-	pwStr, rc, err := c.CreateOrAttachMailbox(ctx, sideID, appID, options.code)
+	sideID := options.sideID
+	if sideID == "" {
+		sideID = crypto.RandSideID()
+	}
+
+	pwStr, rc, err := c.createOrAttachMailbox(ctx, sideID, appID, options.code, options.events)
 	if err != nil {
 		return "", nil, err
 	}
@@ -200,6 +221,12 @@ func (c *Client) SendText(ctx context.Context, msg string, opts ...TransferOptio
 }
 
 func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Reader, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
+	return c.sendOffers(ctx, []outgoingOffer{{offer: offer, r: r}}, disableListener, opts...)
+}
+
+// sendOffers sends one or more files or directories in a single
+// session. Multiple offers require the peer to support transfer-v2.
+func (c *Client) sendOffers(ctx context.Context, offers []outgoingOffer, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
 	var options transferOptions
 	for _, opt := range opts {
 		err := opt.setOption(&options)
@@ -208,55 +235,52 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 		}
 	}
 
-	sideID := crypto.RandSideID()
+	sideID := options.sideID
+	if sideID == "" {
+		sideID = crypto.RandSideID()
+	}
 	appID := c.AppID
-	rc := rendezvous.NewClient(c.RendezvousURL, sideID, appID)
 
-	_, err := rc.Connect(ctx)
+	pwStr, rc, err := c.createOrAttachMailbox(ctx, sideID, appID, options.code, options.events)
 	if err != nil {
 		return "", nil, err
 	}
 
-	var pwStr string
-	if options.code == "" {
-		nameplate, err := rc.CreateMailbox(ctx)
-		if err != nil {
-			return "", nil, err
-		}
-
-		pwStr = nameplate + "-" + wordlist.ChooseWords(c.wordCount())
-	} else {
-		pwStr = options.code
-		nameplate, err := nameplateFromCode(pwStr)
-		if err != nil {
-			return "", nil, err
-		}
-
-		err = rc.AttachMailbox(ctx, nameplate)
-		if err != nil {
-			return "", nil, err
-		}
-	}
-
 	clientProto := newClientProtocol(ctx, rc, sideID, appID)
+	clientProto.events = options.events
+	if !c.disableTransferV2 {
+		clientProto.versions.enableTransferV2()
+	}
 
 	ch := make(chan SendResult, 1)
 	go func() {
-		var returnErr error
+		var (
+			returnErr error
+			// transfer-v2 hands the rendezvous connection over
+			// to the Dilation, which closes it when it is done.
+			closeRendezvous = true
+		)
 		defer func() {
+			if !closeRendezvous {
+				return
+			}
+
 			mood := rendezvous.Errory
 			if returnErr == nil {
 				mood = rendezvous.Happy
-			} else if returnErr == errDecryptFailed {
+			} else if errors.Is(returnErr, ErrBadCode) || errors.Is(returnErr, ErrDecrypt) {
 				mood = rendezvous.Scary
 			}
 
 			rc.Close(ctx, mood)
 		}()
 
+		var transit *TransitInfo
+
 		sendErr := func(err error) {
 			ch <- SendResult{
-				Error: err,
+				Error:   err,
+				Transit: transit,
 			}
 			returnErr = err
 			close(ch)
@@ -280,7 +304,7 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			return
 		}
 
-		_, err = clientProto.ReadVersion()
+		peerVersions, err := clientProto.ReadVersion()
 		if err != nil {
 			sendErr(err)
 			return
@@ -307,145 +331,222 @@ func (c *Client) sendFileDirectory(ctx context.Context, offer *offerMsg, r io.Re
 			}
 		}
 
-		transitKey := deriveTransitKey(clientProto.sharedKey, appID)
-		transport := newFileTransport(transitKey, appID, c.relayURL(), disableListener)
-		err = transport.listen()
-		if err != nil {
-			sendErr(err)
-			return
-		}
+		options.reportContact(clientProto.sharedKey, true)
 
-		err = transport.listenRelay()
+		err = checkPeerCapabilities(ctx, clientProto, peerVersions.capabilities(), &options)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		transit, err := transport.makeTransitMsg()
-		if err != nil {
-			sendErr(fmt.Errorf("make transit msg error: %s", err))
-			return
-		}
-
-		err = clientProto.WriteAppData(ctx, &genericMessage{
-			Transit: transit,
-		})
-		if err != nil {
-			sendErr(err)
-			return
+		var unknownSize bool
+		for _, o := range offers {
+			unknownSize = unknownSize || o.offer.unknownSize()
 		}
 
-		gmOffer := &genericMessage{
-			Offer: offer,
+		if unknownSize && !peerVersions.AppVersions.supportsStream() {
+			errMsg := "receiver does not support transfers of unknown size"
+			writeErr := clientProto.WriteAppData(ctx, &genericMessage{
+				Error: &errMsg,
+			})
+			if writeErr != nil {
+				sendErr(writeErr)
+				return
+			}
+			err = ErrStreamUnsupported
+		} else if clientProto.useTransferV2(peerVersions) {
+			closeRendezvous = false
+			transit, err = c.sendTransferV2(ctx, rc, clientProto, offers, disableListener, &options)
+		} else if len(offers) > 1 {
+			errMsg := "receiver does not support multiple files per transfer"
+			writeErr := clientProto.WriteAppData(ctx, &genericMessage{
+				Error: &errMsg,
+			})
+			if writeErr != nil {
+				sendErr(writeErr)
+				return
+			}
+			err = ErrTransferV2Unsupported
+		} else {
+			transit, err = c.sendTransferV1(ctx, clientProto, offers[0].offer, offers[0].r, disableListener, &options)
 		}
-		err = clientProto.WriteAppData(ctx, gmOffer)
 		if err != nil {
 			sendErr(err)
 			return
 		}
 
-		collector, err := clientProto.Collect()
-		if err != nil {
-			sendErr(err)
-			return
+		ch <- SendResult{
+			OK:      true,
+			Transit: transit,
 		}
-		defer collector.close()
+		close(ch)
+	}()
 
-		var answer answerMsg
-		err = collector.waitFor(&answer)
-		if err != nil {
-			sendErr(err)
-			return
-		}
+	return pwStr, ch, nil
+}
 
-		if answer.FileAck != "ok" {
-			sendErr(fmt.Errorf("unexpected answer"))
-			return
-		}
+// sendTransferV1 sends a single file or directory using the v1
+// offer/answer protocol and a direct transit connection.
+func (c *Client) sendTransferV1(ctx context.Context, clientProto *clientProtocol, offer *offerMsg, r io.Reader, disableListener bool, options *transferOptions) (*TransitInfo, error) {
+	transitKey := deriveTransitKey(clientProto.sharedKey, clientProto.appID)
+	transport := c.newFileTransport(transitKey, clientProto.appID, disableListener)
+	transport.events = options.events
+	err := transport.listen()
+	if err != nil {
+		return nil, err
+	}
 
-		conn, err := transport.acceptConnection(ctx)
-		if err != nil {
-			sendErr(err)
-			return
-		}
+	err = transport.listenRelay()
+	if err != nil {
+		return nil, err
+	}
 
-		cryptor := newTransportCryptor(conn, transitKey, "transit_record_receiver_key", "transit_record_sender_key")
+	transit, err := transport.makeTransitMsg()
+	if err != nil {
+		return nil, fmt.Errorf("make transit msg error: %s", err)
+	}
 
-		recordSize := (1 << 14)
-		// chunk
-		recordSlice := make([]byte, recordSize-secretbox.Overhead)
-		hasher := sha256.New()
+	err = clientProto.WriteAppData(ctx, &genericMessage{
+		Transit: transit,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		var (
-			progress  int64
-			totalSize int64
-		)
-		if offer.File != nil {
-			totalSize = offer.File.FileSize
-		} else if offer.Directory != nil {
-			totalSize = offer.Directory.ZipSize
+	gmOffer := &genericMessage{
+		Offer: offer,
+	}
+	err = clientProto.WriteAppData(ctx, gmOffer)
+	if err != nil {
+		return nil, err
+	}
+
+	collector, err := clientProto.Collect()
+	if err != nil {
+		return nil, err
+	}
+	defer collector.close()
+
+	var answer answerMsg
+	err = collector.waitFor(&answer)
+	if err != nil {
+		return nil, err
+	}
+
+	if answer.FileAck != "ok" {
+		return nil, fmt.Errorf("unexpected answer")
+	}
+
+	conn, err := transport.acceptConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	cryptor := newTransportCryptor(conn, transitKey, "transit_record_receiver_key", "transit_record_sender_key")
+
+	recordSize := (1 << 14)
+	// chunk
+	recordSlice := make([]byte, recordSize-secretbox.Overhead)
+	hasher := sha256.New()
+
+	var (
+		progress  int64
+		totalSize int64
+	)
+	if offer.unknownSize() {
+		totalSize = -1
+	} else if offer.File != nil {
+		totalSize = offer.File.FileSize
+	} else if offer.Directory != nil {
+		totalSize = offer.Directory.ZipSize
+	}
+
+	if answer.ResumeOffset > 0 {
+		err = skipResumed(r, offer, hasher, answer.ResumeOffset, answer.ResumeSHA256)
+		if errors.Is(err, ErrResumeMismatch) {
+			// see resume.go
+			cryptor.writeRecord(nil)
+		}
+		if err != nil {
+			return &conn.info, err
 		}
+		progress = answer.ResumeOffset
+	}
 
-		go func() {
-			<-ctx.Done()
-			ch <- SendResult{
-				Error: errors.New("context canceled"),
-			}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
 			conn.Close()
-		}()
+		case <-done:
+		}
+	}()
 
-		for {
-			n, err := r.Read(recordSlice)
-			if n > 0 {
-				hasher.Write(recordSlice[:n])
-				err = cryptor.writeRecord(recordSlice[:n])
-				if err != nil {
-					sendErr(err)
-					return
-				}
-				progress += int64(n)
-				if options.progressFunc != nil {
-					options.progressFunc(progress, totalSize)
-				}
+	// prefer reporting the cancellation over whatever error
+	// closing the connection caused.
+	wrapErr := func(err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	for {
+		n, err := r.Read(recordSlice)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return &conn.info, ctxErr
+		}
+		if n > 0 {
+			hasher.Write(recordSlice[:n])
+			err = cryptor.writeRecord(recordSlice[:n])
+			if err != nil {
+				return &conn.info, wrapErr(err)
 			}
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				sendErr(err)
-				return
+			progress += int64(n)
+			if options.progressFunc != nil {
+				options.progressFunc(progress, totalSize)
 			}
 		}
-
-		respRec, err := cryptor.readRecord()
-		if err != nil {
-			sendErr(err)
-			return
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return &conn.info, wrapErr(err)
 		}
+	}
 
-		var ack fileTransportAck
-		err = json.Unmarshal(respRec, &ack)
+	if offer.unknownSize() {
+		// an empty record marks the end of the file
+		err = cryptor.writeRecord(nil)
 		if err != nil {
-			sendErr(err)
-			return
+			return &conn.info, wrapErr(err)
 		}
+	}
 
-		if ack.Ack != "ok" {
-			sendErr(errors.New("got non ok final ack from receiver"))
-			return
-		}
+	respRec, err := cryptor.readRecord()
+	if err != nil {
+		return &conn.info, wrapErr(err)
+	}
 
-		shaSum := fmt.Sprintf("%x", hasher.Sum(nil))
-		if strings.ToLower(ack.SHA256) != shaSum {
-			sendErr(fmt.Errorf("receiver sha256 mismatch %s vs %s", ack.SHA256, shaSum))
-			return
-		}
+	var ack fileTransportAck
+	err = json.Unmarshal(respRec, &ack)
+	if err != nil {
+		return &conn.info, err
+	}
 
-		ch <- SendResult{
-			OK: true,
-		}
-	}()
+	if ack.Ack != "ok" {
+		return &conn.info, errors.New("got non ok final ack from receiver")
+	}
 
-	return pwStr, ch, nil
+	shaSum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if strings.ToLower(ack.SHA256) != shaSum {
+		return &conn.info, fmt.Errorf("receiver sha256 mismatch %s vs %s", ack.SHA256, shaSum)
+	}
+
+	options.events.emit(Event{Type: EventAckReceived})
+
+	return &conn.info, nil
 }
 
 // SendFile sends a single file via the wormhole protocol. It returns a nameplate+passhrase code to give to the
@@ -473,10 +574,59 @@ type DirectoryEntry struct {
 	Path string
 
 	// Mode controls the permission and mode bits for the file.
+	// If it has os.ModeDir set the entry is a directory, which lets
+	// empty directories be sent, and if it has os.ModeSymlink set
+	// the entry is a symlink to LinkTarget. Reader is not used for
+	// either.
 	Mode os.FileMode
 
 	// Reader is a function that returns a ReadCloser for the file's content.
 	Reader func() (io.ReadCloser, error)
+
+	// LinkTarget is where a symlink entry points.
+	LinkTarget string
+
+	// ModTime is the modification time to record for the entry.
+	// If it is zero no time is sent.
+	ModTime time.Time
+}
+
+// open returns the content to store in the zip file for e: nothing
+// for a directory and the target for a symlink.
+func (e DirectoryEntry) open() (io.ReadCloser, error) {
+	if e.Mode.IsDir() {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	} else if e.Mode&os.ModeSymlink != 0 {
+		return ioutil.NopCloser(strings.NewReader(e.LinkTarget)), nil
+	}
+	return e.Reader()
+}
+
+// zipHeader returns the zip file header for entry, which is called
+// name inside the zip file.
+func zipHeader(name string, entry DirectoryEntry, method uint16) *zip.FileHeader {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Modified: entry.ModTime,
+	}
+	if entry.Mode.IsDir() {
+		header.Name = strings.TrimSuffix(name, "/") + "/"
+	}
+
+	header.SetMode(entry.Mode)
+	return header
+}
+
+// zipFileCount returns the number of entries that aren't directories.
+func zipFileCount(entries []DirectoryEntry) int64 {
+	var n int64
+	for _, entry := range entries {
+		if !entry.Mode.IsDir() {
+			n++
+		}
+	}
+	return n
 }
 
 // SendDirectory sends a tree of files to a receiving client.
@@ -486,23 +636,24 @@ type DirectoryEntry struct {
 // receiver, a result channel that will be written to after the receiver attempts to read (either successfully or not)
 // and an error if one occurred.
 func (c *Client) SendDirectory(ctx context.Context, directoryName string, entries []DirectoryEntry, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
-	zipInfo, err := makeTmpZip(directoryName, entries)
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	zipInfo, err := makeZip(directoryName, entries, options.streamDirectory)
 	if err != nil {
 		return "", nil, err
 	}
 
-	offer := &offerMsg{
-		Directory: &offerDirectory{
-			Dirname:  directoryName,
-			Mode:     "zipfile/deflated",
-			NumBytes: zipInfo.numBytes,
-			NumFiles: zipInfo.numFiles,
-			ZipSize:  zipInfo.zipSize,
-		},
-	}
+	offer := zipInfo.offer(directoryName)
 
-	code, resultCh, err := c.sendFileDirectory(ctx, offer, zipInfo.file, disableListener, opts...)
+	code, resultCh, err := c.sendFileDirectory(ctx, offer, zipInfo.r, disableListener, opts...)
 	if err != nil {
+		zipInfo.r.Close()
 		return "", nil, err
 	}
 
@@ -510,32 +661,147 @@ func (c *Client) SendDirectory(ctx context.Context, directoryName string, entrie
 	retCh := make(chan SendResult, 1)
 	go func() {
 		r := <-resultCh
-		zipInfo.file.Close()
+		zipInfo.r.Close()
 		retCh <- r
 	}()
 
 	return code, retCh, err
 }
 
+// A SendItem is a single file or directory to send with SendMultiple.
+type SendItem struct {
+	// Name is the file or directory name presented to the receiver.
+	Name string
+
+	// File is the content of a single file. It must be nil for
+	// directories.
+	File io.ReadSeeker
+
+	// Entries are the files in a directory, as passed to
+	// SendDirectory. Each Path must be prefixed by Name.
+	Entries []DirectoryEntry
+}
+
+// SendMultiple sends several files and directories in one session.
+// The receiver gets the first item from Receive and the remaining
+// ones from IncomingMessage.Next, and can accept or reject each of
+// them individually.
+//
+// Sending more than one item requires the receiver to support the
+// transfer-v2 protocol; otherwise the result channel reports
+// ErrTransferV2Unsupported. If any item is rejected the result
+// reports the rejection once the remaining items have been sent.
+func (c *Client) SendMultiple(ctx context.Context, items []SendItem, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
+	if len(items) < 1 {
+		return "", nil, errors.New("no items provided")
+	}
+
+	var options transferOptions
+	for _, opt := range opts {
+		err := opt.setOption(&options)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var (
+		offers   []outgoingOffer
+		tmpFiles []io.Closer
+	)
+	closeTmpFiles := func() {
+		for _, f := range tmpFiles {
+			f.Close()
+		}
+	}
+
+	for _, item := range items {
+		if item.File != nil {
+			size, err := readSeekerSize(item.File)
+			if err != nil {
+				closeTmpFiles()
+				return "", nil, err
+			}
+
+			offers = append(offers, outgoingOffer{
+				offer: &offerMsg{
+					File: &offerFile{
+						FileName: item.Name,
+						FileSize: size,
+					},
+				},
+				r: item.File,
+			})
+			continue
+		}
+
+		zipInfo, err := makeZip(item.Name, item.Entries, options.streamDirectory)
+		if err != nil {
+			closeTmpFiles()
+			return "", nil, err
+		}
+		tmpFiles = append(tmpFiles, zipInfo.r)
+
+		offers = append(offers, outgoingOffer{
+			offer: zipInfo.offer(item.Name),
+			r:     zipInfo.r,
+		})
+	}
+
+	code, resultCh, err := c.sendOffers(ctx, offers, disableListener, opts...)
+	if err != nil {
+		closeTmpFiles()
+		return "", nil, err
+	}
+
+	// intercept result chan to close our tmpfiles after we are done with them
+	retCh := make(chan SendResult, 1)
+	go func() {
+		r := <-resultCh
+		closeTmpFiles()
+		retCh <- r
+	}()
+
+	return code, retCh, nil
+}
+
 type zipResult struct {
-	file     *os.File
+	r        io.ReadCloser
 	numBytes int64
 	numFiles int64
 	zipSize  int64
 }
 
-func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, error) {
-	f, err := ioutil.TempFile("", "wormhole-william-dir")
-	if err != nil {
-		return nil, err
+func (z *zipResult) offer(directoryName string) *offerMsg {
+	// streamed zips are stored rather than deflated, but each entry
+	// records its own method and the Python receiver rejects any
+	// other mode
+	return &offerMsg{
+		Directory: &offerDirectory{
+			Dirname:  directoryName,
+			Mode:     "zipfile/deflated",
+			NumBytes: z.numBytes,
+			NumFiles: z.numFiles,
+			ZipSize:  z.zipSize,
+		},
 	}
+}
 
+// makeZip packs entries into a zip file, either in a temporary file
+// or as a stream generated while it is being sent.
+func makeZip(directoryName string, entries []DirectoryEntry, stream bool) (*zipResult, error) {
+	if stream {
+		return makeZipStream(directoryName, entries)
+	}
+	return makeTmpZip(directoryName, entries)
+}
+
+// zipEntryNames checks directoryName and entries and returns the name
+// of each entry inside the zip file.
+func zipEntryNames(directoryName string, entries []DirectoryEntry) ([]string, error) {
 	if len(entries) < 1 {
 		return nil, errors.New("no files provided")
 	}
 
-	defer os.Remove(f.Name())
-
 	if strings.TrimSpace(directoryName) == "" {
 		return nil, errors.New("directoryName must be set")
 	}
@@ -545,32 +811,54 @@ func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, err
 		return nil, errors.New("directoryName must not include sub directories")
 	}
 
-	w := zip.NewWriter(f)
-
-	var totalBytes int64
-
 	prefixPath := filepath.ToSlash(directoryName) + "/"
 
-	for _, entry := range entries {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
 		entryPath := filepath.ToSlash(entry.Path)
 
 		if !strings.HasPrefix(entryPath, prefixPath) {
 			return nil, errors.New("each directory entry must be prefixed with the directoryName")
 		}
 
-		header := &zip.FileHeader{
-			Name:   strings.TrimPrefix(entryPath, prefixPath),
-			Method: zip.Deflate,
+		names[i] = strings.TrimPrefix(entryPath, prefixPath)
+
+		if entry.Mode&os.ModeSymlink != 0 && entry.LinkTarget == "" {
+			return nil, fmt.Errorf("symlink %s has no target", entry.Path)
+		} else if !entry.Mode.IsDir() && entry.Mode&os.ModeSymlink == 0 && entry.Reader == nil {
+			return nil, fmt.Errorf("file %s has no Reader", entry.Path)
 		}
+	}
+
+	return names, nil
+}
+
+func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, error) {
+	names, err := zipEntryNames(directoryName, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "wormhole-william-dir")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	w := zip.NewWriter(f)
+
+	var totalBytes int64
 
-		header.SetMode(entry.Mode)
+	for i, entry := range entries {
+		header := zipHeader(names[i], entry, zip.Deflate)
 
 		f, err := w.CreateHeader(header)
 		if err != nil {
 			return nil, err
 		}
 
-		r, err := entry.Reader()
+		r, err := entry.open()
 		if err != nil {
 			return nil, err
 		}
@@ -599,9 +887,9 @@ func makeTmpZip(directoryName string, entries []DirectoryEntry) (*zipResult, err
 	}
 
 	result := zipResult{
-		file:     f,
+		r:        f,
 		numBytes: totalBytes,
-		numFiles: int64(len(entries)),
+		numFiles: zipFileCount(entries),
 		zipSize:  zipSize,
 	}
 
@@ -0,0 +1,59 @@
+package wormhole
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Streaming lets a sender offer a file whose size it doesn't know up
+// front, such as the output of a pipe. The file offer sets
+// unknown_size and a filesize of 0, and the sender marks the end of
+// the data with an empty record (an empty v1 transit record or an
+// empty transfer-v2 data message). The receiver's ack still carries
+// the SHA256 of everything it read, so the sender can tell if any of
+// it was lost. Receivers that don't know about unknown_size would take
+// the file to be empty, so such offers are only made to peers that
+// advertise the extension.
+
+// streamVersion is the version of the stream extension we advertise
+// in app_versions.
+const streamVersion = 1
+
+// ErrStreamUnsupported is returned by the sender if the receiver
+// can't accept files of unknown size.
+var ErrStreamUnsupported = errors.New("receiver does not support transfers of unknown size")
+
+type streamVersions struct {
+	Version int `json:"version"`
+}
+
+// supportsStream reports whether the side that sent v can receive
+// files of unknown size.
+func (v *appVersionsMsg) supportsStream() bool {
+	return v.Stream != nil && v.Stream.Version >= streamVersion
+}
+
+// unknownSize reports whether o is a file offer without a size.
+func (o *offerMsg) unknownSize() bool {
+	return o.File != nil && o.File.UnknownSize
+}
+
+// SendStream sends the contents of r as a single file without
+// knowing its size in advance. It reads r until io.EOF.
+//
+// The receiver must support transfers of unknown size; if it doesn't
+// the result is ErrStreamUnsupported. It returns a nameplate+passhrase
+// code to give to the receiver, a result channel that will be written
+// to after the receiver attempts to read (either successfully or not)
+// and an error if one occurred.
+func (c *Client) SendStream(ctx context.Context, fileName string, r io.Reader, disableListener bool, opts ...TransferOption) (string, chan SendResult, error) {
+	offer := &offerMsg{
+		File: &offerFile{
+			FileName:    fileName,
+			UnknownSize: true,
+		},
+	}
+
+	return c.sendFileDirectory(ctx, offer, r, disableListener, opts...)
+}
@@ -0,0 +1,566 @@
+package wormhole
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/psanford/wormhole-william/internal/msgpack"
+	"github.com/psanford/wormhole-william/rendezvous"
+)
+
+// Transfer-v2 runs file transfers over a Dilation instead of a
+// single transit connection. Each file or directory offer is sent on
+// its own subchannel, so the receiver can accept or reject offers
+// individually and a session can carry any number of them.
+//
+// Every message on a subchannel is framed as a 4 byte big endian
+// length followed by a one byte message kind and the msgpack encoded
+// body. File data messages carry the raw bytes instead of a msgpack
+// body.
+//
+// The flow for a single offer is:
+//
+//	sender   -> offer
+//	receiver -> accept | reject
+//	sender   -> data...
+//	receiver -> ack
+//
+// Either side may send an error message at any point to abort the
+// session.
+
+// transferV2Version is the version of the transfer-v2 protocol we
+// advertise in app_versions.
+const transferV2Version = 1
+
+const (
+	transferV2MaxMsgLen  = 1 << 20
+	transferV2RecordSize = 1 << 14
+)
+
+// ErrTransferV2Unsupported is returned when sending multiple files or
+// directories to a peer that only speaks the v1 transfer protocol.
+var ErrTransferV2Unsupported = errors.New("peer does not support transfer-v2")
+
+const (
+	transferV2MsgOffer byte = iota + 1
+	transferV2MsgAccept
+	transferV2MsgReject
+	transferV2MsgData
+	transferV2MsgAck
+	transferV2MsgError
+)
+
+type transferV2Versions struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// enableTransferV2 advertises support for the transfer-v2 protocol.
+func (v *versionMsg) enableTransferV2() {
+	v.enableDilation()
+	v.AppVersions.TransferV2 = &transferV2Versions{
+		Version:  transferV2Version,
+		Features: []string{},
+	}
+}
+
+// supportsTransferV2 reports whether the side that sent v can
+// transfer files over transfer-v2.
+func (v *versionMsg) supportsTransferV2() bool {
+	tv := v.AppVersions.TransferV2
+	return tv != nil && tv.Version >= transferV2Version && v.canDilate()
+}
+
+// useTransferV2 reports whether both we and the peer advertised
+// transfer-v2 support.
+func (cc *clientProtocol) useTransferV2(peer *versionMsg) bool {
+	return cc.versions.supportsTransferV2() && peer.supportsTransferV2()
+}
+
+type transferV2OfferMsg struct {
+	File      *offerFile      `msgpack:"file,omitempty"`
+	Directory *offerDirectory `msgpack:"directory,omitempty"`
+
+	// Final is set on the last offer of the session. Once it has
+	// been answered both sides close the Dilation.
+	Final bool `msgpack:"final,omitempty"`
+}
+
+type transferV2AcceptMsg struct {
+	// ResumeOffset and ResumeSHA256 are set by a receiver that
+	// already has the start of the file. See resume.go.
+	ResumeOffset int64  `msgpack:"resume_offset,omitempty"`
+	ResumeSHA256 string `msgpack:"resume_sha256,omitempty"`
+}
+
+type transferV2RejectMsg struct {
+	Reason string `msgpack:"reason"`
+}
+
+type transferV2AckMsg struct {
+	SHA256 string `msgpack:"sha256"`
+}
+
+type transferV2ErrorMsg struct {
+	Message string `msgpack:"message"`
+}
+
+func writeTransferV2Msg(w io.Writer, kind byte, msg interface{}) error {
+	body, err := msgpack.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeTransferV2Frame(w, kind, body)
+}
+
+// writeTransferV2Frame writes a complete frame with a single Write
+// call so that frames written concurrently to a subchannel never
+// interleave.
+func writeTransferV2Frame(w io.Writer, kind byte, body []byte) error {
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(1+len(body)))
+	frame[4] = kind
+	copy(frame[5:], body)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readTransferV2Msg(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, checkPeerClosed(err)
+	}
+
+	l := binary.BigEndian.Uint32(header[:])
+	if l < 1 || l > transferV2MaxMsgLen {
+		return 0, nil, fmt.Errorf("invalid transfer-v2 message length %d", l)
+	}
+
+	msg := make([]byte, l)
+	_, err = io.ReadFull(r, msg)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, checkPeerClosed(err)
+	}
+
+	return msg[0], msg[1:], nil
+}
+
+// transferV2PeerError converts an error message received from the
+// peer into an error.
+func transferV2PeerError(body []byte) error {
+	var msg transferV2ErrorMsg
+	err := msgpack.Unmarshal(body, &msg)
+	if err != nil {
+		return err
+	}
+	return &PeerError{Message: msg.Message}
+}
+
+type offerRejectedError struct {
+	reason string
+}
+
+func (e offerRejectedError) Error() string {
+	return fmt.Sprintf("TransferError: %s", e.reason)
+}
+
+func (e offerRejectedError) Is(target error) bool {
+	return target == ErrTransferRejected
+}
+
+func (e offerRejectedError) Unwrap() error {
+	return &PeerError{Message: e.reason}
+}
+
+// outgoingOffer is a single file or directory to send along with its
+// content.
+type outgoingOffer struct {
+	offer *offerMsg
+	r     io.Reader
+}
+
+// size returns the number of bytes to send for o, or -1 if it isn't
+// known.
+func (o *outgoingOffer) size() int64 {
+	if o.offer.unknownSize() {
+		return -1
+	} else if o.offer.File != nil {
+		return o.offer.File.FileSize
+	} else if o.offer.Directory != nil {
+		return o.offer.Directory.ZipSize
+	}
+	return 0
+}
+
+// transferV2Sender sends a list of offers over a Dilation.
+type transferV2Sender struct {
+	d       *Dilation
+	options *transferOptions
+
+	mu      sync.Mutex
+	current net.Conn
+	aborted bool
+
+	progress  int64
+	totalSize int64
+}
+
+func (c *Client) sendTransferV2(ctx context.Context, rc *rendezvous.Client, clientProto *clientProtocol, offers []outgoingOffer, disableListener bool, options *transferOptions) (*TransitInfo, error) {
+	s := &transferV2Sender{
+		d:       c.dilateEstablished(context.Background(), rc, clientProto, disableListener),
+		options: options,
+	}
+	for i := range offers {
+		size := offers[i].size()
+		if size < 0 {
+			s.totalSize = -1
+			break
+		}
+		s.totalSize += size
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.abort(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	var firstErr error
+	for i := range offers {
+		err := s.sendOffer(ctx, &offers[i], i == len(offers)-1)
+		if _, ok := err.(offerRejectedError); ok {
+			s.closeCurrent()
+			// the receiver may still want the other offers
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		} else if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			s.abort(err)
+			return s.d.transitInfo(), err
+		}
+		s.closeCurrent()
+	}
+
+	s.d.Close()
+	return s.d.transitInfo(), firstErr
+}
+
+func (s *transferV2Sender) closeCurrent() {
+	s.mu.Lock()
+	sc := s.current
+	s.current = nil
+	s.mu.Unlock()
+
+	if sc != nil {
+		sc.Close()
+	}
+}
+
+// abort notifies the receiver that the transfer failed and tears
+// down the Dilation.
+func (s *transferV2Sender) abort(err error) {
+	s.mu.Lock()
+	sc := s.current
+	s.aborted = true
+	s.mu.Unlock()
+
+	if sc != nil {
+		writeTransferV2Msg(sc, transferV2MsgError, &transferV2ErrorMsg{
+			Message: err.Error(),
+		})
+	}
+	s.d.fail(err)
+}
+
+func (s *transferV2Sender) sendOffer(ctx context.Context, o *outgoingOffer, final bool) error {
+	sc, err := s.d.OpenSubchannel(ctx)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	aborted := s.aborted
+	s.current = sc
+	s.mu.Unlock()
+	if aborted {
+		return ctx.Err()
+	}
+
+	err = writeTransferV2Msg(sc, transferV2MsgOffer, &transferV2OfferMsg{
+		File:      o.offer.File,
+		Directory: o.offer.Directory,
+		Final:     final,
+	})
+	if err != nil {
+		return err
+	}
+
+	kind, body, err := readTransferV2Msg(sc)
+	if err != nil {
+		return err
+	}
+	var accept transferV2AcceptMsg
+	switch kind {
+	case transferV2MsgAccept:
+		err = msgpack.Unmarshal(body, &accept)
+		if err != nil {
+			return err
+		}
+	case transferV2MsgReject:
+		var reject transferV2RejectMsg
+		err = msgpack.Unmarshal(body, &reject)
+		if err != nil {
+			return err
+		}
+		if size := o.size(); size > 0 {
+			s.progress += size
+		}
+		return offerRejectedError{reason: reject.Reason}
+	case transferV2MsgError:
+		return transferV2PeerError(body)
+	default:
+		return fmt.Errorf("unexpected transfer-v2 message kind %d", kind)
+	}
+
+	// The receiver only answers once it has everything, unless it
+	// gives up part way through. Watch for that so we don't block
+	// forever writing data nobody is reading.
+	type response struct {
+		kind byte
+		body []byte
+		err  error
+	}
+	respCh := make(chan response, 1)
+	go func() {
+		kind, body, err := readTransferV2Msg(sc)
+		if err == nil && kind == transferV2MsgError {
+			s.d.fail(transferV2PeerError(body))
+		}
+		respCh <- response{kind, body, err}
+	}()
+
+	hasher := sha256.New()
+	if accept.ResumeOffset > 0 {
+		err = skipResumed(o.r, o.offer, hasher, accept.ResumeOffset, accept.ResumeSHA256)
+		if err != nil {
+			return err
+		}
+		s.progress += accept.ResumeOffset
+	}
+
+	buf := make([]byte, transferV2RecordSize)
+	for {
+		n, readErr := o.r.Read(buf)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if n > 0 {
+			hasher.Write(buf[:n])
+			err = writeTransferV2Frame(sc, transferV2MsgData, buf[:n])
+			if err != nil {
+				return err
+			}
+			s.progress += int64(n)
+			if s.options.progressFunc != nil {
+				s.options.progressFunc(s.progress, s.totalSize)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+
+	if o.offer.unknownSize() {
+		// an empty data message marks the end of the file
+		err = writeTransferV2Frame(sc, transferV2MsgData, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp := <-respCh
+	if resp.err != nil {
+		return resp.err
+	}
+	switch resp.kind {
+	case transferV2MsgAck:
+	case transferV2MsgError:
+		return transferV2PeerError(resp.body)
+	default:
+		return fmt.Errorf("unexpected transfer-v2 message kind %d", resp.kind)
+	}
+
+	var ack transferV2AckMsg
+	err = msgpack.Unmarshal(resp.body, &ack)
+	if err != nil {
+		return err
+	}
+
+	shaSum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if strings.ToLower(ack.SHA256) != shaSum {
+		return fmt.Errorf("receiver sha256 mismatch %s vs %s", ack.SHA256, shaSum)
+	}
+
+	s.options.events.emit(Event{Type: EventAckReceived})
+
+	return nil
+}
+
+func (c *Client) receiveTransferV2(ctx context.Context, rc *rendezvous.Client, clientProto *clientProtocol, disableListener bool, options transferOptions, peerCaps *PeerCapabilities) (*IncomingMessage, error) {
+	d := c.dilateEstablished(context.Background(), rc, clientProto, disableListener)
+
+	fr, err := receiveOfferV2(ctx, d, options, peerCaps)
+	if err != nil {
+		d.fail(err)
+		return nil, err
+	}
+	return fr, nil
+}
+
+// receiveOfferV2 waits for the sender's next offer.
+func receiveOfferV2(ctx context.Context, d *Dilation, options transferOptions, peerCaps *PeerCapabilities) (*IncomingMessage, error) {
+	sc, err := d.AcceptSubchannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, body, err := readTransferV2Msg(sc)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case transferV2MsgOffer:
+	case transferV2MsgError:
+		return nil, transferV2PeerError(body)
+	default:
+		return nil, fmt.Errorf("unexpected transfer-v2 message kind %d", kind)
+	}
+
+	var offer transferV2OfferMsg
+	err = msgpack.Unmarshal(body, &offer)
+	if err != nil {
+		return nil, err
+	}
+
+	fr := &IncomingMessage{
+		PeerCapabilities: peerCaps,
+		options:          options,
+		ctx:              ctx,
+		dilation:         d,
+		final:            offer.Final,
+		Transit:          d.transitInfo(),
+	}
+	err = fr.setOffer(&offerMsg{
+		File:      offer.File,
+		Directory: offer.Directory,
+	})
+	if err != nil {
+		writeTransferV2Msg(sc, transferV2MsgError, &transferV2ErrorMsg{
+			Message: err.Error(),
+		})
+		return nil, err
+	}
+
+	stream := &transferV2Stream{
+		d:     d,
+		sc:    sc,
+		final: offer.Final,
+	}
+
+	fr.rejectTransfer = func() error {
+		err := writeTransferV2Msg(sc, transferV2MsgReject, &transferV2RejectMsg{
+			Reason: "transfer rejected",
+		})
+		stream.Close()
+		return err
+	}
+
+	fr.initializeTransfer = func() error {
+		err := writeTransferV2Msg(sc, transferV2MsgAccept, &transferV2AcceptMsg{
+			ResumeOffset: fr.resumeOffset,
+			ResumeSHA256: fr.resumeSHA256,
+		})
+		if err != nil {
+			return err
+		}
+
+		fr.stream = stream
+		if fr.sha256 == nil {
+			fr.sha256 = sha256.New()
+		}
+		return nil
+	}
+
+	return fr, nil
+}
+
+// transferV2Stream is the receiving side of a single transfer-v2
+// offer.
+type transferV2Stream struct {
+	d     *Dilation
+	sc    net.Conn
+	final bool
+}
+
+func (s *transferV2Stream) readRecord() ([]byte, error) {
+	kind, body, err := readTransferV2Msg(s.sc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case transferV2MsgData:
+		return body, nil
+	case transferV2MsgError:
+		err := transferV2PeerError(body)
+		s.d.fail(err)
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unexpected transfer-v2 message kind %d", kind)
+	}
+}
+
+func (s *transferV2Stream) writeAck(sha256Sum string) error {
+	return writeTransferV2Msg(s.sc, transferV2MsgAck, &transferV2AckMsg{
+		SHA256: sha256Sum,
+	})
+}
+
+// abort tells the sender we are giving up on the transfer.
+func (s *transferV2Stream) abort(err error) {
+	writeTransferV2Msg(s.sc, transferV2MsgError, &transferV2ErrorMsg{
+		Message: err.Error(),
+	})
+	s.sc.Close()
+	s.d.fail(err)
+}
+
+func (s *transferV2Stream) Close() error {
+	err := s.sc.Close()
+	if s.final {
+		s.d.Close()
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// A wormhole URI carries a code, and the rendezvous server it was
+// made on, as a link or a QR code that a phone can scan instead of
+// the user typing the code. It uses the format of other magic
+// wormhole clients:
+//
+//	wormhole-transfer:7-crossover-clockwork?version=0
+//	wormhole-transfer:7-crossover-clockwork?rendezvous=ws%3A%2F%2Fexample.com%3A4000%2Fv1&version=0
+//
+// The code is percent-encoded and the rendezvous parameter is left
+// out for the default server. ParseURI also accepts the shorter
+// wormhole: scheme.
+
+const (
+	// URIScheme is the scheme of the URIs made by URI.String.
+	URIScheme = "wormhole-transfer"
+
+	// uriVersion is the version of the URI format we understand.
+	uriVersion = 0
+)
+
+// A URI is a parsed wormhole URI.
+type URI struct {
+	// Code is the wormhole code.
+	Code string
+	// RendezvousURL is the rendezvous server the code belongs to,
+	// or empty for DefaultRendezvousURL.
+	RendezvousURL string
+}
+
+// String returns u as a wormhole-transfer: URI.
+func (u URI) String() string {
+	q := url.Values{}
+	if u.RendezvousURL != "" && u.RendezvousURL != DefaultRendezvousURL {
+		q.Set("rendezvous", u.RendezvousURL)
+	}
+	q.Set("version", strconv.Itoa(uriVersion))
+
+	return URIScheme + ":" + url.PathEscape(u.Code) + "?" + q.Encode()
+}
+
+// ParseURI parses a wormhole-transfer: or wormhole: URI.
+func ParseURI(s string) (*URI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != URIScheme && u.Scheme != "wormhole" {
+		return nil, fmt.Errorf("not a wormhole URI: %q", s)
+	}
+	if u.Opaque == "" {
+		return nil, errors.New("wormhole URI has no code")
+	}
+
+	code, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	if v := q.Get("version"); v != "" && v != strconv.Itoa(uriVersion) {
+		return nil, fmt.Errorf("unsupported wormhole URI version %s", v)
+	}
+
+	err = validateCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	return &URI{
+		Code:          code,
+		RendezvousURL: q.Get("rendezvous"),
+	}, nil
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,11 +34,54 @@ type Client struct {
 	// DefaultRendezvousURL will be used.
 	RendezvousURL string
 
+	// RendezvousURLs are rendezvous servers to fall back between,
+	// in order. If set, RendezvousURL is ignored. Senders use the
+	// first one that can be reached; Receive looks for the code's
+	// nameplate on each in turn, so the sender must have allocated
+	// or claimed it first. The code doesn't say which server was
+	// used.
+	RendezvousURLs []string
+
+	// RendezvousOptions are passed to rendezvous.NewClient when
+	// connecting to the rendezvous server, for example
+	// rendezvous.WithDialOptions to set request headers or a custom
+	// TLS configuration. The connection to the rendezvous server is
+	// re-established if it drops, giving up after 8 failed attempts
+	// in a row (about two minutes); pass rendezvous.WithReconnect to
+	// change how often and for how long that is attempted.
+	RendezvousOptions []rendezvous.ClientOption
+
 	// TransitRelayURL is the proto:host:port address to offer
 	// to use for file transfers where direct connections are unavailable.
 	// If empty, DefaultTransitRelayURL will be used.
 	TransitRelayURL string
 
+	// TransitRelays are the transit relays to offer, for failover
+	// between several of them. If set, TransitRelayURL is ignored.
+	// All of them are advertised to the peer and connections are
+	// attempted through each, highest priority first.
+	TransitRelays []TransitRelay
+
+	// TransitListenPort is the TCP port to listen on for direct
+	// transit connections. If 0 a random port is used. Set it when
+	// forwarding a port to this machine so that ExtraTransitHints
+	// can point at it.
+	TransitListenPort int
+
+	// ExtraTransitHints are advertised to the peer for direct
+	// connections in addition to the addresses of this machine's
+	// network interfaces. They are only advertised when listening
+	// for direct connections.
+	ExtraTransitHints []TransitHint
+
+	// Dialer is used to connect to the rendezvous server, the transit
+	// relay and the peer's direct transit hints. If nil, connections
+	// are made directly. Set it to a SOCKS5 dialer to go through a
+	// proxy such as Tor; in that case you probably also want to
+	// disable the transit listener so that local addresses aren't
+	// advertised to the peer.
+	Dialer Dialer
+
 	// PassPhraseComponentLength is the number of words to use
 	// when generating a passprase. Any value less than 2 will
 	// default to 2.
@@ -52,6 +96,14 @@ type Client struct {
 	// of band mechanism before proceeding with the file transmission.
 	// If VerifierOk returns false the transmission will be aborted.
 	VerifierOk func(verifier string) bool
+
+	// disableTransferV2 stops the client from advertising transfer-v2
+	// support, forcing file transfers to use the v1 protocol.
+	disableTransferV2 bool
+
+	// disableStream stops the client from advertising that it can
+	// receive files of unknown size.
+	disableStream bool
 }
 
 var (
@@ -67,6 +119,10 @@ var (
 	DefaultTransitRelayURL = "tcp:transit.magic-wormhole.io:4001"
 )
 
+// A Dialer makes network connections. net.Dialer implements it, as
+// do proxy dialers. It is the same type as rendezvous.Dialer.
+type Dialer = rendezvous.Dialer
+
 func (c *Client) wordCount() int {
 	if c.PassPhraseComponentLength > 1 {
 		return c.PassPhraseComponentLength
@@ -82,13 +138,139 @@ func (c *Client) relayURL() internal.SimpleURL {
 	return internal.MustNewSimpleURL(DefaultTransitRelayURL)
 }
 
+// defaultRelayPriority is the priority advertised for
+// TransitRelayURL.
+const defaultRelayPriority = 2.0
+
+// transitRelays returns the relays to use, highest priority first.
+func (c *Client) transitRelays() []transitRelay {
+	if len(c.TransitRelays) == 0 {
+		return []transitRelay{{url: c.relayURL(), priority: defaultRelayPriority}}
+	}
+
+	relays := make([]transitRelay, 0, len(c.TransitRelays))
+	for _, relay := range c.TransitRelays {
+		relays = append(relays, transitRelay{
+			url:      internal.MustNewSimpleURL(relay.URL),
+			priority: relay.Priority,
+		})
+	}
+	sort.SliceStable(relays, func(i, j int) bool {
+		return relays[i].priority > relays[j].priority
+	})
+	return relays
+}
+
+func (c *Client) newFileTransport(transitKey []byte, appID string, disableListener bool) *fileTransport {
+	t := newFileTransport(transitKey, appID, c.transitRelays(), disableListener)
+	t.listenPort = c.TransitListenPort
+	t.extraHints = c.ExtraTransitHints
+	t.dialer = c.Dialer
+	return t
+}
+
+// rendezvousURLs returns the rendezvous servers to try, in order.
+func (c *Client) rendezvousURLs() []string {
+	if len(c.RendezvousURLs) > 0 {
+		return c.RendezvousURLs
+	}
+	return []string{c.RendezvousURL}
+}
+
+// connectRendezvous connects to the first rendezvous server that can
+// be reached. It returns the client and the server's URL.
+func (c *Client) connectRendezvous(ctx context.Context, sideID, appID string) (*rendezvous.Client, string, error) {
+	return c.findRendezvous(ctx, sideID, appID, func(*rendezvous.Client) error {
+		return nil
+	})
+}
+
+// connectRendezvousFor connects to the first rendezvous server that
+// has nameplate. With a single server the nameplate isn't looked
+// for, so that it can be claimed before the sender gets there.
+func (c *Client) connectRendezvousFor(ctx context.Context, sideID, appID, nameplate string) (*rendezvous.Client, string, error) {
+	if len(c.rendezvousURLs()) == 1 {
+		return c.connectRendezvous(ctx, sideID, appID)
+	}
+
+	return c.findRendezvous(ctx, sideID, appID, func(rc *rendezvous.Client) error {
+		nameplates, err := rc.ListNameplates(ctx)
+		if err != nil {
+			return err
+		}
+		for _, n := range nameplates {
+			if n == nameplate {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrNameplateNotFound, nameplate)
+	})
+}
+
+// findRendezvous connects to each rendezvous server in turn and
+// returns the first for which check succeeds. With a single server
+// its error is returned as is; otherwise it is a *RendezvousError.
+func (c *Client) findRendezvous(ctx context.Context, sideID, appID string, check func(*rendezvous.Client) error) (*rendezvous.Client, string, error) {
+	urls := c.rendezvousURLs()
+
+	var rerr RendezvousError
+	for _, url := range urls {
+		rc := c.newRendezvousClient(url, sideID, appID)
+
+		_, err := rc.Connect(ctx)
+		if err == nil {
+			err = check(rc)
+			if err != nil {
+				rc.Close(ctx, rendezvous.Happy)
+			}
+		}
+		if err == nil {
+			return rc, url, nil
+		}
+
+		if len(urls) == 1 {
+			return nil, "", err
+		}
+		rerr.add(url, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, "", &rerr
+}
+
+// defaultReconnectAttempts bounds how often a dropped connection to
+// the rendezvous server is retried, so that a transfer fails after a
+// couple of minutes if the server has gone away for good instead of
+// retrying forever.
+const defaultReconnectAttempts = 8
+
+func (c *Client) newRendezvousClient(url, sideID, appID string) *rendezvous.Client {
+	// survive the rendezvous server restarting while we wait for
+	// the other side
+	opts := []rendezvous.ClientOption{
+		rendezvous.WithReconnect(rendezvous.ReconnectPolicy{
+			MaxAttempts: defaultReconnectAttempts,
+		}),
+	}
+	if c.Dialer != nil {
+		opts = append(opts, rendezvous.WithDialer(c.Dialer))
+	}
+	opts = append(opts, c.RendezvousOptions...)
+	return rendezvous.NewClient(url, sideID, appID, opts...)
+}
+
 // SendResult has information about whether or not a Send command was successful.
 type SendResult struct {
 	OK    bool
 	Error error
-}
 
-var errDecryptFailed = errors.New("decrypt message failed")
+	// Transit describes the connection the data was sent over. It
+	// is nil for text messages and if no connection was made.
+	Transit *TransitInfo
+}
 
 func openAndUnmarshal(v interface{}, mb rendezvous.MailboxEvent, sharedKey []byte) error {
 	keySlice := derivePhaseKey(string(sharedKey), mb.Side, mb.Phase)
@@ -104,7 +286,12 @@ func openAndUnmarshal(v interface{}, mb rendezvous.MailboxEvent, sharedKey []byt
 
 	out, ok := secretbox.Open(nil, sealedMsg, &nonce, &openKey)
 	if !ok {
-		return errDecryptFailed
+		// the version message is the first one encrypted with the
+		// shared key, so failing to open it means the codes differ
+		if mb.Phase == "version" {
+			return ErrBadCode
+		}
+		return fmt.Errorf("phase %s: %w", mb.Phase, ErrDecrypt)
 	}
 
 	return json.Unmarshal(out, v)
@@ -200,16 +387,19 @@ func (m *offerMsg) Type() collectType {
 }
 
 type offerDirectory struct {
-	Dirname  string `json:"dirname"`
-	Mode     string `json:"mode"`
-	NumBytes int64  `json:"numbytes"`
-	NumFiles int64  `json:"numfiles"`
-	ZipSize  int64  `json:"zipsize"`
+	Dirname  string `json:"dirname" msgpack:"dirname"`
+	Mode     string `json:"mode" msgpack:"mode"`
+	NumBytes int64  `json:"numbytes" msgpack:"numbytes"`
+	NumFiles int64  `json:"numfiles" msgpack:"numfiles"`
+	ZipSize  int64  `json:"zipsize" msgpack:"zipsize"`
 }
 
 type offerFile struct {
-	FileName string `json:"filename"`
-	FileSize int64  `json:"filesize"`
+	FileName string `json:"filename" msgpack:"filename"`
+	FileSize int64  `json:"filesize" msgpack:"filesize"`
+	// UnknownSize is set if the sender doesn't know the size of
+	// the file and FileSize is 0. See SendStream.
+	UnknownSize bool `json:"unknown_size,omitempty" msgpack:"unknown_size,omitempty"`
 }
 
 type genericMessage struct {
@@ -221,11 +411,47 @@ type genericMessage struct {
 }
 
 type appVersionsMsg struct {
+	// Client identifies the software this side is running.
+	Client *appVersionsClient `json:"client,omitempty"`
+	// TransitAbilities lists the transit connection types this side
+	// supports for v1 file transfers.
+	TransitAbilities []transitAbility `json:"transit-abilities,omitempty"`
+	// Compression lists the payload compression schemes this side
+	// can decode. We don't compress payloads yet so we advertise
+	// none, but we record what the peer sends.
+	Compression []string `json:"compression,omitempty"`
+	// Resume is set if this side can continue interrupted file
+	// transfers.
+	Resume *resumeVersions `json:"resume,omitempty"`
+	// Stream is set if this side can receive files of unknown
+	// size.
+	Stream *streamVersions `json:"stream,omitempty"`
+
+	// TransferV2 is set if this side supports the transfer-v2 file
+	// transfer protocol. It needs dilation, which is advertised in
+	// versionMsg.
+	TransferV2 *transferV2Versions `json:"transfer-v2,omitempty"`
+}
+
+// versionMsg is the message sent in the version phase. Dilation
+// support goes at its top level: the Python implementation reads it
+// from there and only passes app_versions on to the application.
+type versionMsg struct {
+	// CanDilate lists the dilation protocol versions this side
+	// supports.
+	CanDilate         []string         `json:"can-dilate,omitempty"`
+	DilationAbilities []transitAbility `json:"dilation-abilities,omitempty"`
+	AppVersions       appVersionsMsg   `json:"app_versions"`
 }
 
 type answerMsg struct {
 	MessageAck string `json:"message_ack"`
 	FileAck    string `json:"file_ack"`
+
+	// ResumeOffset and ResumeSHA256 are set by a receiver that
+	// already has the start of the file. See resume.go.
+	ResumeOffset int64  `json:"resume_offset,omitempty"`
+	ResumeSHA256 string `json:"resume_sha256,omitempty"`
 }
 
 func (m *answerMsg) Type() collectType {
@@ -421,7 +647,7 @@ func (c *msgCollector) collect(ch <-chan rendezvous.MailboxEvent) {
 				t = collectAnswer
 				resultMsg = msg.Answer
 			} else if msg.Error != nil {
-				errorResult(fmt.Errorf("TransferError: %s", *msg.Error))
+				errorResult(&PeerError{Message: *msg.Error})
 				return
 			} else {
 				continue
@@ -451,16 +677,21 @@ type clientProtocol struct {
 	spake        *gospake2.SPAKE2
 	sideID       string
 	appID        string
+	events       eventFunc
+
+	// versions is sent to the peer by WriteVersion.
+	versions versionMsg
 }
 
 func newClientProtocol(ctx context.Context, rc *rendezvous.Client, sideID, appID string) *clientProtocol {
 	recvChan := rc.MsgChan(ctx)
 
 	return &clientProtocol{
-		ch:     recvChan,
-		rc:     rc,
-		sideID: sideID,
-		appID:  appID,
+		ch:       recvChan,
+		rc:       rc,
+		sideID:   sideID,
+		appID:    appID,
+		versions: versionMsg{AppVersions: defaultAppVersions()},
 	}
 }
 
@@ -495,6 +726,7 @@ func (cc *clientProtocol) ReadPake() error {
 	}
 
 	cc.sharedKey = sharedKey
+	cc.events.emit(Event{Type: EventPeerConnected})
 
 	return nil
 }
@@ -509,11 +741,7 @@ func (cc *clientProtocol) Verifier() ([]byte, error) {
 
 func (cc *clientProtocol) WriteVersion(ctx context.Context) error {
 	phase := "version"
-	verInfo := genericMessage{
-		AppVersions: &appVersionsMsg{},
-	}
-
-	jsonOut, err := json.Marshal(verInfo)
+	jsonOut, err := json.Marshal(&cc.versions)
 	if err != nil {
 		return err
 	}
@@ -522,12 +750,14 @@ func (cc *clientProtocol) WriteVersion(ctx context.Context) error {
 	return err
 }
 
-func (cc *clientProtocol) ReadVersion() (*appVersionsMsg, error) {
-	var v appVersionsMsg
+func (cc *clientProtocol) ReadVersion() (*versionMsg, error) {
+	var v versionMsg
 	err := cc.openAndUnmarshal("version", &v)
 	if err != nil {
 		return nil, err
 	}
+	cc.events.emit(Event{Type: EventKeyConfirmed})
+
 	return &v, nil
 }
 
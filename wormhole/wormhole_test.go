@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/psanford/wormhole-william/internal"
@@ -12,14 +13,20 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/klauspost/compress/zip"
+	"github.com/psanford/wormhole-william/rendezvous"
 	"github.com/psanford/wormhole-william/rendezvous/rendezvousservertest"
+	"github.com/psanford/wormhole-william/rendezvous/server"
+	"github.com/psanford/wormhole-william/version"
+	"golang.org/x/crypto/nacl/secretbox"
 	"nhooyr.io/websocket"
 )
 
@@ -65,12 +72,12 @@ func TestWormholeSendRecvText(t *testing.T) {
 
 	// recv with wrong code
 	_, err = c1.Receive(ctx, fmt.Sprintf("%s-intermarrying-aliased", nameplate), false)
-	if err != errDecryptFailed {
+	if !errors.Is(err, ErrBadCode) {
 		t.Fatalf("Recv side expected decrypt failed due to wrong code but got: %s", err)
 	}
 
 	status := <-statusChan
-	if status.OK || status.Error != errDecryptFailed {
+	if status.OK || !errors.Is(status.Error, ErrBadCode) {
 		t.Fatalf("Send side expected decrypt failed but got status: %+v", status)
 	}
 
@@ -159,6 +166,58 @@ func TestWormholeSendRecvText(t *testing.T) {
 	}
 }
 
+func TestWormholeSendTextRendezvousReconnect(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay
+	DefaultTransitRelayURL = ""
+
+	reconnect := rendezvous.WithReconnect(rendezvous.ReconnectPolicy{
+		MinDelay: 10 * time.Millisecond,
+	})
+
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.RendezvousOptions = []rendezvous.ClientOption{reconnect}
+
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.RendezvousOptions = []rendezvous.ClientOption{reconnect}
+
+	secretText := "Sheboygan-unscrupulous"
+	code, statusChan, err := c0.SendText(ctx, secretText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server restarts while the sender waits for the receiver
+	rs.DropConnections()
+
+	msg, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != secretText {
+		t.Fatalf("Got Message: %s, expected %s", got, secretText)
+	}
+
+	status := <-statusChan
+	if !status.OK || status.Error != nil {
+		t.Fatalf("Send side expected OK status but got: %+v", status)
+	}
+}
+
 func TestVerifierAbort(t *testing.T) {
 	ctx := context.Background()
 
@@ -202,6 +261,46 @@ func TestVerifierAbort(t *testing.T) {
 	}
 }
 
+func TestOpenAndUnmarshalErrors(t *testing.T) {
+	side := "side-a"
+	sealWith := []byte("sealing-key")
+	openWith := []byte("different-key")
+
+	for _, tc := range []struct {
+		phase   string
+		badCode bool
+	}{
+		{"version", true},
+		{"0", false},
+		{"dilate-0", false},
+	} {
+		var key [32]byte
+		copy(key[:], derivePhaseKey(string(sealWith), side, tc.phase))
+		var nonce [24]byte
+		sealed := secretbox.Seal(nonce[:], []byte("{}"), &nonce, &key)
+
+		mb := rendezvous.MailboxEvent{
+			Side:  side,
+			Phase: tc.phase,
+			Body:  hex.EncodeToString(sealed),
+		}
+
+		var v genericMessage
+		err := openAndUnmarshal(&v, mb, openWith)
+		if errors.Is(err, ErrBadCode) != tc.badCode {
+			t.Errorf("phase %s: got %v, expected ErrBadCode=%t", tc.phase, err, tc.badCode)
+		}
+		if errors.Is(err, ErrDecrypt) == tc.badCode {
+			t.Errorf("phase %s: got %v, expected ErrDecrypt=%t", tc.phase, err, !tc.badCode)
+		}
+
+		err = openAndUnmarshal(&v, mb, sealWith)
+		if err != nil {
+			t.Errorf("phase %s: %s", tc.phase, err)
+		}
+	}
+}
+
 func TestWormholeFileReject(t *testing.T) {
 	ctx := context.Background()
 
@@ -243,6 +342,13 @@ func TestWormholeFileReject(t *testing.T) {
 	if result.Error.Error() != expectErr {
 		t.Fatalf("Expected %q result but got: %+v", expectErr, result)
 	}
+	if !errors.Is(result.Error, ErrTransferRejected) {
+		t.Fatalf("Expected ErrTransferRejected but got: %+v", result)
+	}
+	var peerErr *PeerError
+	if !errors.As(result.Error, &peerErr) || peerErr.Message != "transfer rejected" {
+		t.Fatalf("Expected a PeerError but got: %+v", result)
+	}
 }
 
 func TestWormholeFileTransportSendRecvViaRelayServer(t *testing.T) {
@@ -301,159 +407,208 @@ func TestWormholeFileTransportSendRecvViaRelayServer(t *testing.T) {
 	}
 }
 
-func TestWormholeBigFileTransportSendRecvViaRelayServer(t *testing.T) {
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) handle(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// expect checks that the recorded events include events of the
+// given types in order, and returns the first of the last type.
+func (r *eventRecorder) expect(t *testing.T, types ...EventType) Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		i    int
+		last Event
+	)
+	for _, e := range r.events {
+		if i < len(types) && e.Type == types[i] {
+			last = e
+			i++
+		}
+	}
+	if i < len(types) {
+		t.Fatalf("expected %s event after %v, got events %v", types[i], types[:i], r.events)
+	}
+	return last
+}
+
+func TestWormholeEvents(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
 	defer rs.Close()
 
-	url := rs.WebSocketURL()
-
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+	relayServer := newTestTCPRelayServer()
+	defer relayServer.close()
 
+	for _, transferV2 := range []bool{false, true} {
+		transferV2 := transferV2
+		t.Run(fmt.Sprintf("transfer-v2=%t", transferV2), func(t *testing.T) {
 			var c0 Client
-			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayURL
+			c0.RendezvousURL = rs.WebSocketURL()
+			c0.TransitRelayURL = relayServer.url.String()
+			c0.disableTransferV2 = !transferV2
 
 			var c1 Client
-			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayURL
+			c1.RendezvousURL = rs.WebSocketURL()
+			c1.TransitRelayURL = relayServer.url.String()
+			c1.disableTransferV2 = !transferV2
 
-			// Create a fake file offer
-			var fakeBigSize int64 = 32098461509
-			offer := &offerMsg{
-				File: &offerFile{
-					FileName: "fakefile",
-					FileSize: fakeBigSize,
-				},
-			}
+			var sendEvents, recvEvents eventRecorder
 
-			// just a pretend reader
-			r := bytes.NewReader(make([]byte, 1))
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", strings.NewReader("calumniated-pawnshops"), true, WithEventHandler(sendEvents.handle))
+			if err != nil {
+				t.Fatal(err)
+			}
 
-			// skip th wrapper so we can provide our own offer
-			code, _, err := c0.sendFileDirectory(ctx, offer, r, true)
-			//c0.SendFile(ctx, "file.txt", buf)
+			receiver, err := c1.Receive(ctx, code, true, WithEventHandler(recvEvents.handle))
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			receiver, err := c1.Receive(ctx, code, true)
+			_, err = ioutil.ReadAll(receiver)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			if int64(receiver.TransferBytes64) != fakeBigSize {
-				t.Fatalf("Mismatch in size between what we are trying to send and what is (our parsed) offer. Expected %v but got %v", fakeBigSize, receiver.TransferBytes64)
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			nameplate := strings.SplitN(code, "-", 2)[0]
+
+			allocated := sendEvents.expect(t, EventRendezvousConnected, EventMailboxAllocated)
+			if allocated.Nameplate != nameplate {
+				t.Fatalf("got nameplate %q expected %q", allocated.Nameplate, nameplate)
+			}
+			connected := sendEvents.expect(t, EventPeerConnected, EventKeyConfirmed, EventTransitConnected)
+			if !connected.Relay {
+				t.Fatalf("expected relay connection but got %v", connected)
+			}
+			sendEvents.expect(t, EventTransitConnected, EventAckReceived)
+
+			attached := recvEvents.expect(t, EventRendezvousConnected, EventMailboxAttached)
+			if attached.Nameplate != nameplate {
+				t.Fatalf("got nameplate %q expected %q", attached.Nameplate, nameplate)
+			}
+			connected = recvEvents.expect(t, EventPeerConnected, EventKeyConfirmed, EventTransitCandidate, EventTransitConnected)
+			if !connected.Relay {
+				t.Fatalf("expected relay connection but got %v", connected)
 			}
 		})
 	}
 }
 
-func TestWormholeFileTransportRecvMidStreamCancel(t *testing.T) {
+func TestWormholeTransitInfo(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
 	defer rs.Close()
 
-	url := rs.WebSocketURL()
-
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+	relayServer := newTestTCPRelayServer()
+	defer relayServer.close()
 
+	for _, transferV2 := range []bool{false, true} {
+		transferV2 := transferV2
+		t.Run(fmt.Sprintf("transfer-v2=%t", transferV2), func(t *testing.T) {
 			var c0 Client
-			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayURL
+			c0.RendezvousURL = rs.WebSocketURL()
+			c0.TransitRelayURL = relayServer.url.String()
+			c0.disableTransferV2 = !transferV2
 
 			var c1 Client
-			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayURL
+			c1.RendezvousURL = rs.WebSocketURL()
+			c1.TransitRelayURL = relayServer.url.String()
+			c1.disableTransferV2 = !transferV2
 
-			fileContent := make([]byte, 1<<16)
-			for i := 0; i < len(fileContent); i++ {
-				fileContent[i] = byte(i)
-			}
-
-			buf := bytes.NewReader(fileContent)
-
-			code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", strings.NewReader("hydroplaning-marmalades"), true)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			childCtx, cancel := context.WithCancel(ctx)
-			defer cancel()
-
-			receiver, err := c1.Receive(childCtx, code, true)
+			receiver, err := c1.Receive(ctx, code, true)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			initialBuffer := make([]byte, 1<<10)
-
-			_, err = io.ReadFull(receiver, initialBuffer)
+			_, err = ioutil.ReadAll(receiver)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			cancel()
-
-			_, err = ioutil.ReadAll(receiver)
-			if err == nil {
-				t.Fatalf("Expected read error but got none")
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
 			}
 
-			result := <-resultCh
-			if result.OK {
-				t.Fatalf("Expected error result but got ok")
+			for side, info := range map[string]*TransitInfo{"sender": result.Transit, "receiver": receiver.Transit} {
+				if info == nil {
+					t.Fatalf("%s: expected transit info", side)
+				}
+				if !info.Relay || info.Addr != relayServer.url.Addr() || info.HintType != "direct-tcp-v1" {
+					t.Fatalf("%s: expected relay connection to %s but got %+v", side, relayServer.url.Addr(), info)
+				}
+				if info.HandshakeDuration <= 0 {
+					t.Fatalf("%s: expected handshake duration but got %+v", side, info)
+				}
 			}
 		})
 	}
 }
 
-func TestWormholeFileTransportSendMidStreamCancel(t *testing.T) {
+func TestWormholeTransitRelayFailover(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
 	defer rs.Close()
 
-	url := rs.WebSocketURL()
+	relayServer := newTestTCPRelayServer()
+	defer relayServer.close()
 
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
-			relayURL := relayServer.url.String()
-			defer relayServer.close()
+	// a relay that refuses connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadRelayURL := "tcp:" + l.Addr().String()
+	l.Close()
 
-			var c0 Client
-			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayURL
+	// a relay only the receiver knows of, where the sender never
+	// waits for it
+	otherRelayServer := newTestTCPRelayServer()
+	defer otherRelayServer.close()
 
-			var c1 Client
-			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayURL
+	defer func(d time.Duration) { relayHintDelay = d }(relayHintDelay)
+	relayHintDelay = 50 * time.Millisecond
 
-			fileContent := make([]byte, 1<<16)
-			for i := 0; i < len(fileContent); i++ {
-				fileContent[i] = byte(i)
-			}
+	relays := []TransitRelay{
+		{URL: relayServer.url.String(), Priority: 1},
+		{URL: deadRelayURL, Priority: 2},
+	}
 
-			sendCtx, cancel := context.WithCancel(ctx)
+	for _, transferV2 := range []bool{false, true} {
+		transferV2 := transferV2
+		t.Run(fmt.Sprintf("transfer-v2=%t", transferV2), func(t *testing.T) {
+			var c0 Client
+			c0.RendezvousURL = rs.WebSocketURL()
+			c0.TransitRelays = relays
+			c0.disableTransferV2 = !transferV2
 
-			splitR := splitReader{
-				Reader:   bytes.NewReader(fileContent),
-				cancelAt: 1 << 10,
-				cancel:   cancel,
-			}
+			var c1 Client
+			c1.RendezvousURL = rs.WebSocketURL()
+			c1.TransitRelays = append([]TransitRelay{{URL: otherRelayServer.url.String(), Priority: 3}}, relays...)
+			c1.disableTransferV2 = !transferV2
 
-			code, resultCh, err := c0.SendFile(sendCtx, "file.txt", &splitR, true)
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", strings.NewReader("redistributed-snowplows"), true)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -463,130 +618,1881 @@ func TestWormholeFileTransportSendMidStreamCancel(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			_, err = ioutil.ReadAll(receiver)
-			if err == nil {
-				t.Fatal("Expected read error but got none")
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "redistributed-snowplows" {
+				t.Fatalf("got %q", got)
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			if !transferV2 && (result.Transit == nil || result.Transit.Addr != relayServer.url.Addr()) {
+				t.Fatalf("expected connection via %s but got %+v", relayServer.url.Addr(), result.Transit)
 			}
+		})
+	}
+}
+
+func TestMakeTransitMsgRelayHints(t *testing.T) {
+	c := Client{
+		TransitRelays: []TransitRelay{
+			{URL: "tcp:relay1.example.com:4001", Priority: 1},
+			{URL: "ws://relay2.example.com:443", Priority: 3},
+		},
+	}
+
+	transport := c.newFileTransport(make([]byte, 32), "appid", true)
+	msg, err := transport.makeTransitMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []transitHintsV1{
+		{
+			Type: "relay-v1",
+			Hints: []transitHintsV1Hint{
+				{Type: "direct-ws-v1", Priority: 3, Hostname: "relay2.example.com", Port: 443},
+			},
+		},
+		{
+			Type: "relay-v1",
+			Hints: []transitHintsV1Hint{
+				{Type: "direct-tcp-v1", Priority: 1, Hostname: "relay1.example.com", Port: 4001},
+			},
+		},
+	}
+	if !reflect.DeepEqual(msg.HintsV1, expect) {
+		t.Fatalf("got hints %+v expected %+v", msg.HintsV1, expect)
+	}
+
+	peer := &transitMsg{HintsV1: []transitHintsV1{
+		{
+			Type: "relay-v1",
+			Hints: []transitHintsV1Hint{
+				{Type: "direct-tcp-v1", Priority: 2, Hostname: "relay3.example.com", Port: 4001},
+				{Type: "direct-tcp-v1", Priority: 1, Hostname: "relay1.example.com", Port: 4001},
+			},
+		},
+	}}
+
+	var got []string
+	for _, relay := range transport.relayCandidates(peer) {
+		got = append(got, relay.url.String())
+	}
+	expectRelays := []string{"ws://relay2.example.com:443", "tcp:relay3.example.com:4001", "tcp:relay1.example.com:4001"}
+	if !reflect.DeepEqual(got, expectRelays) {
+		t.Fatalf("got relays %v expected %v", got, expectRelays)
+	}
+}
+
+func TestWormholeRendezvousFallback(t *testing.T) {
+	ctx := context.Background()
+
+	newServer := func() (*httptest.Server, string) {
+		ts := httptest.NewServer(server.NewServer())
+		return ts, "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1"
+	}
+
+	tsA, urlA := newServer()
+	defer tsA.Close()
+	tsB, urlB := newServer()
+	defer tsB.Close()
+
+	// a server that refuses connections
+	tsDead, deadURL := newServer()
+	tsDead.Close()
+
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.AppID = WormholeCLIAppID
+	c0.RendezvousURLs = []string{deadURL, urlA, urlB}
+
+	var sendURL string
+	code, statusChan, err := c0.SendText(ctx, "unsympathetic-chandeliers", WithEventHandler(func(e Event) {
+		if e.Type == EventRendezvousConnected {
+			sendURL = e.URL
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendURL != urlA {
+		t.Fatalf("expected to be connected to %s but got %q", urlA, sendURL)
+	}
+
+	// the nameplate is only on A, so it isn't found here
+	var c1 Client
+	c1.AppID = WormholeCLIAppID
+	c1.RendezvousURLs = []string{deadURL, urlB}
+
+	_, err = c1.Receive(ctx, code, true)
+	if !errors.Is(err, ErrNameplateNotFound) {
+		t.Fatalf("expected ErrNameplateNotFound but got %v", err)
+	}
+	var rerr *RendezvousError
+	if !errors.As(err, &rerr) || !reflect.DeepEqual(rerr.URLs, c1.RendezvousURLs) {
+		t.Fatalf("expected RendezvousError for %v but got %v", c1.RendezvousURLs, err)
+	}
+
+	c1.RendezvousURLs = []string{deadURL, urlB, urlA}
+
+	var recvURL string
+	msg, err := c1.Receive(ctx, code, true, WithEventHandler(func(e Event) {
+		if e.Type == EventRendezvousConnected {
+			recvURL = e.URL
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recvURL != urlA {
+		t.Fatalf("expected to be connected to %s but got %q", urlA, recvURL)
+	}
+
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "unsympathetic-chandeliers" {
+		t.Fatalf("got %q", got)
+	}
+
+	result := <-statusChan
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+// recordingDialer records the addresses it is asked to dial.
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, address)
+	d.mu.Unlock()
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+func (d *recordingDialer) dialed(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, a := range d.addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWormholeFileTransportViaDialer(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+	rendezvousAddr := strings.TrimPrefix(rs.URL, "http://")
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			relayURL := relayServer.url.String()
+			defer relayServer.close()
+
+			var d0, d1 recordingDialer
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+			c0.Dialer = &d0
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+			c1.Dialer = &d1
+
+			fileContent := make([]byte, 1<<16)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, fileContent) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			relayAddr := relayServer.url.Addr()
+			for i, d := range []*recordingDialer{&d0, &d1} {
+				if !d.dialed(rendezvousAddr) {
+					t.Errorf("client %d: rendezvous server %s not dialed through Dialer", i, rendezvousAddr)
+				}
+				if !d.dialed(relayAddr) {
+					t.Errorf("client %d: relay %s not dialed through Dialer", i, relayAddr)
+				}
+			}
+		})
+	}
+}
+
+func TestWormholeBigFileTransportSendRecvViaRelayServer(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			relayURL := relayServer.url.String()
+			defer relayServer.close()
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+
+			// Create a fake file offer
+			var fakeBigSize int64 = 32098461509
+			offer := &offerMsg{
+				File: &offerFile{
+					FileName: "fakefile",
+					FileSize: fakeBigSize,
+				},
+			}
+
+			// just a pretend reader
+			r := bytes.NewReader(make([]byte, 1))
+
+			// skip th wrapper so we can provide our own offer
+			code, _, err := c0.sendFileDirectory(ctx, offer, r, true)
+			//c0.SendFile(ctx, "file.txt", buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if int64(receiver.TransferBytes64) != fakeBigSize {
+				t.Fatalf("Mismatch in size between what we are trying to send and what is (our parsed) offer. Expected %v but got %v", fakeBigSize, receiver.TransferBytes64)
+			}
+
+			// transfer-v2 connects to the peer before the offer is
+			// answered, so release the relay connection.
+			receiver.Reject()
+		})
+	}
+}
+
+func TestWormholeFileTransportRecvMidStreamCancel(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			relayURL := relayServer.url.String()
+			defer relayServer.close()
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+
+			fileContent := make([]byte, 1<<16)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			buf := bytes.NewReader(fileContent)
+
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", buf, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			childCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			receiver, err := c1.Receive(childCtx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			initialBuffer := make([]byte, 1<<10)
+
+			_, err = io.ReadFull(receiver, initialBuffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cancel()
+
+			_, err = ioutil.ReadAll(receiver)
+			if err == nil {
+				t.Fatalf("Expected read error but got none")
+			}
+
+			result := <-resultCh
+			if result.OK {
+				t.Fatalf("Expected error result but got ok")
+			}
+		})
+	}
+}
+
+func TestWormholeFileTransportSendMidStreamCancel(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			relayURL := relayServer.url.String()
+			defer relayServer.close()
+
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+
+			fileContent := make([]byte, 1<<16)
+			for i := 0; i < len(fileContent); i++ {
+				fileContent[i] = byte(i)
+			}
+
+			sendCtx, cancel := context.WithCancel(ctx)
+
+			splitR := splitReader{
+				Reader:   bytes.NewReader(fileContent),
+				cancelAt: 1 << 10,
+				cancel:   cancel,
+			}
+
+			code, resultCh, err := c0.SendFile(sendCtx, "file.txt", &splitR, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ioutil.ReadAll(receiver)
+			if err == nil {
+				t.Fatal("Expected read error but got none")
+			}
+
+			result := <-resultCh
+			if result.OK {
+				t.Fatal("Expected send resultCh to error but got none")
+			}
+		})
+	}
+}
+
+func TestTransportCryptorPeerClosed(t *testing.T) {
+	transitKey := make([]byte, 32)
+
+	c0, c1 := net.Pipe()
+	sender := newTransportCryptor(c0, transitKey, "transit_record_receiver_key", "transit_record_sender_key")
+	receiver := newTransportCryptor(c1, transitKey, "transit_record_sender_key", "transit_record_receiver_key")
+
+	go func() {
+		sender.writeRecord([]byte("allegorically-hydrants"))
+		// only send part of the next record
+		c0.Write([]byte{0, 0, 1, 0})
+		c0.Close()
+	}()
+
+	got, err := receiver.readRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "allegorically-hydrants" {
+		t.Fatalf("got record %q", got)
+	}
+
+	_, err = receiver.readRecord()
+	if !errors.Is(err, ErrPeerClosed) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected ErrPeerClosed but got %v", err)
+	}
+}
+
+func TestWormholeDirectoryTransportSendRecvDirect(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0Verifier string
+	var c0 Client
+	c0.RendezvousURL = url
+	c0.VerifierOk = func(code string) bool {
+		c0Verifier = code
+		return true
+	}
+
+	var c1Verifier string
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.VerifierOk = func(code string) bool {
+		c1Verifier = code
+		return true
+	}
+
+	personalizeContent := make([]byte, 1<<16)
+	for i := 0; i < len(personalizeContent); i++ {
+		personalizeContent[i] = byte(i)
+	}
+
+	bodiceContent := []byte("placarding-whereat")
+
+	entries := []DirectoryEntry{
+		{
+			Path: filepath.Join("skyjacking", "personalize.txt"),
+			Reader: func() (io.ReadCloser, error) {
+				b := bytes.NewReader(personalizeContent)
+				return ioutil.NopCloser(b), nil
+			},
+		},
+		{
+			Path: filepath.Join("skyjacking", "bodice-Maytag.txt"),
+			Reader: func() (io.ReadCloser, error) {
+				b := bytes.NewReader(bodiceContent)
+				return ioutil.NopCloser(b), nil
+			},
+		},
+	}
+
+	code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+
+		if f.Name == "personalize.txt" {
+			if !bytes.Equal(body, personalizeContent) {
+				t.Fatal("personalize.txt file content does not match")
+			}
+		} else if f.Name == "bodice-Maytag.txt" {
+			if !bytes.Equal(bodiceContent, body) {
+				t.Fatalf("bodice-Maytag.txt file content does not match %s vs %s", bodiceContent, body)
+			}
+		} else {
+			t.Fatalf("Unexpected file %s", f.Name)
+		}
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	if c0Verifier == "" || c1Verifier == "" {
+		t.Fatalf("Failed to get verifier code c0=%q c1=%q", c0Verifier, c1Verifier)
+	}
+
+	if c0Verifier != c1Verifier {
+		t.Fatalf("Expected verifiers to match but were different")
+	}
+
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+func TestWormholeDirectoryStreaming(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	personalizeContent := make([]byte, 1<<16)
+	for i := 0; i < len(personalizeContent); i++ {
+		personalizeContent[i] = byte(i)
+	}
+
+	files := map[string][]byte{
+		"personalize.txt":       personalizeContent,
+		"sub/bodice-Maytag.txt": []byte("placarding-whereat"),
+		"empty.txt":             {},
+		"überhaupt.txt":         []byte("crisscrossing-Kent"),
+	}
+
+	var entries []DirectoryEntry
+	for name, content := range files {
+		content := content
+		entries = append(entries, DirectoryEntry{
+			Path: filepath.Join("skyjacking", name),
+			Mode: 0644,
+			Reader: func() (io.ReadCloser, error) {
+				b := bytes.NewReader(content)
+				if len(content)%2 == 0 {
+					return nopSeekCloser{b}, nil
+				}
+				return ioutil.NopCloser(b), nil
+			},
+		})
+	}
+
+	code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, false, WithStreamingDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receiver.FileCount != len(files) {
+		t.Fatalf("Expected %d files but got %d", len(files), receiver.FileCount)
+	}
+
+	got, err := ioutil.ReadAll(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(got)) != receiver.TransferBytes64 {
+		t.Fatalf("Expected %d bytes but got %d", receiver.TransferBytes64, len(got))
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.File) != len(files) {
+		t.Fatalf("Expected %d files in zip but got %d", len(files), len(r.File))
+	}
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+
+		expect, ok := files[f.Name]
+		if !ok {
+			t.Fatalf("Unexpected file %s", f.Name)
+		}
+		if !bytes.Equal(body, expect) {
+			t.Fatalf("%s file content does not match", f.Name)
+		}
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// a file that changes size after the offer was sent
+	var opened int
+	entries = []DirectoryEntry{
+		{
+			Path: filepath.Join("skyjacking", "growing.txt"),
+			Reader: func() (io.ReadCloser, error) {
+				opened++
+				b := bytes.NewReader(personalizeContent[:1000*opened])
+				return ioutil.NopCloser(b), nil
+			},
+		},
+	}
+
+	code, resultCh, err = c0.SendDirectory(ctx, "skyjacking", entries, false, WithStreamingDirectory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err = c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ioutil.ReadAll(receiver)
+	if err == nil {
+		t.Fatalf("Expected read error for a file that changed size")
+	}
+
+	result = <-resultCh
+	if result.OK || !strings.Contains(result.Error.Error(), "file grew while sending") {
+		t.Fatalf("Expected file grew error but got: %+v", result)
+	}
+}
+
+func TestStoredZipSize(t *testing.T) {
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	entries := []DirectoryEntry{
+		{Path: "a.txt"},
+		{Path: "sub/dir/b.bin", ModTime: mtime},
+		{Path: "überhaupt.txt"},
+		{Path: "empty"},
+		{Path: "emptydir", Mode: os.ModeDir | 0755, ModTime: mtime},
+		{Path: "link", Mode: os.ModeSymlink | 0777, LinkTarget: "a.txt"},
+	}
+	sizes := []int64{3, 1 << 17, 42, 0, 0, 5}
+
+	for n := 1; n <= len(entries); n++ {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		headers := make([]*zip.FileHeader, n)
+		for i := 0; i < n; i++ {
+			headers[i] = zipHeader(entries[i].Path, entries[i], zip.Store)
+
+			f, err := w.CreateHeader(zipHeader(entries[i].Path, entries[i], zip.Store))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(make([]byte, sizes[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := storedZipSize(headers, sizes[:n])
+		if got != int64(buf.Len()) {
+			t.Fatalf("storedZipSize for %d entries = %d, expected %d", n, got, buf.Len())
+		}
+	}
+}
+
+func TestWormholeDirectoryExtract(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	files := []struct {
+		name    string
+		mode    os.FileMode
+		content []byte
+	}{
+		{"run.sh", 0755, []byte("#!/bin/sh\necho overtaxing-Tunis\n")},
+		{"sub/private.txt", 0600, []byte("befuddles-Kaye")},
+		{"sub/deeper/default.txt", 0, []byte("rapacity-Hiss")},
+	}
+
+	var entries []DirectoryEntry
+	for _, f := range files {
+		content := f.content
+		entries = append(entries, DirectoryEntry{
+			Path: filepath.Join("skyjacking", f.name),
+			Mode: f.mode,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(content)), nil
+			},
+		})
+	}
+
+	code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "wormhole-extract-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dest := filepath.Join(tmpDir, receiver.Name)
+
+	var progress int64
+	err = receiver.ExtractTo(dest, WithExtractProgress(func(receivedBytes, totalBytes int64) {
+		progress = receivedBytes
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress != receiver.TransferBytes64 {
+		t.Fatalf("Expected progress to reach %d but got %d", receiver.TransferBytes64, progress)
+	}
+
+	for _, f := range files {
+		p := filepath.Join(dest, filepath.FromSlash(f.name))
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, f.content) {
+			t.Fatalf("%s file content does not match", f.name)
+		}
+
+		if f.mode != 0 {
+			info, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the umask may have removed some bits
+			if info.Mode().Perm()&^f.mode != 0 {
+				t.Fatalf("%s has mode %s, expected at most %s", f.name, info.Mode().Perm(), f.mode)
+			}
+		}
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	// limits are checked before accepting the offer
+	code, resultCh, err = c0.SendDirectory(ctx, "skyjacking", entries, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err = c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.ExtractTo(filepath.Join(tmpDir, "limited"), WithExtractLimits(0, 2))
+	if err == nil {
+		t.Fatalf("Expected file count limit error")
+	}
+
+	result = <-resultCh
+	expectErr := "TransferError: transfer rejected"
+	if result.Error == nil || result.Error.Error() != expectErr {
+		t.Fatalf("Expected %q result but got: %+v", expectErr, result)
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	makeZip := func(files map[string]string) *zip.Reader {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for name, content := range files {
+			f, err := w.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write([]byte(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	}
+
+	tmpDir, err := ioutil.TempDir("", "wormhole-extract-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "dest")
+
+	for _, name := range []string{"../evil.txt", "a/../../evil.txt", "/etc/evil.txt", "a\\..\\..\\evil.txt"} {
+		zr := makeZip(map[string]string{name: "evil"})
+		err = extractZip(zr, dir, 100, 1, extractOptions{overwrite: OverwriteNever})
+		if err == nil || !strings.Contains(err.Error(), "dangerous filename") {
+			t.Fatalf("Expected dangerous filename error for %q but got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "evil.txt")); !os.IsNotExist(err) {
+		t.Fatalf("evil.txt was written outside of the destination")
+	}
+
+	zr := makeZip(map[string]string{"a.txt": "cultivars", "b.txt": "tiptoe"})
+	err = extractZip(zr, dir, 100, 1, extractOptions{overwrite: OverwriteNever})
+	if err == nil {
+		t.Fatalf("Expected error for more files than offered")
+	}
+	err = extractZip(zr, dir, 10, 2, extractOptions{overwrite: OverwriteNever})
+	if err == nil {
+		t.Fatalf("Expected error for more data than offered")
+	}
+
+	err = extractZip(zr, dir, 100, 2, extractOptions{overwrite: OverwriteNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr = makeZip(map[string]string{"a.txt": "Lucretius"})
+	err = extractZip(zr, dir, 100, 1, extractOptions{overwrite: OverwriteNever})
+	if err == nil {
+		t.Fatalf("Expected error overwriting existing file")
+	}
+
+	err = extractZip(zr, dir, 100, 1, extractOptions{overwrite: OverwriteSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if string(got) != "cultivars" {
+		t.Fatalf("Expected skipped file to be unchanged but got %q", got)
+	}
+
+	err = extractZip(zr, dir, 100, 1, extractOptions{overwrite: OverwriteReplace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if string(got) != "Lucretius" {
+		t.Fatalf("Expected replaced file but got %q", got)
+	}
+
+	makeLinkZip := func(links [][2]string, files ...string) *zip.Reader {
+		var buf bytes.Buffer
+		w := zip.NewWriter(&buf)
+		for _, l := range links {
+			header := &zip.FileHeader{Name: l[0]}
+			header.SetMode(os.ModeSymlink | 0777)
+			f, err := w.CreateHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(l[1]))
+		}
+		for _, name := range files {
+			f, err := w.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte("evil"))
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr
+	}
+
+	for _, target := range []string{"../outside", "sub/../../outside", "/etc", "..", "a\\..\\.."} {
+		zr := makeLinkZip([][2]string{{"evil-link", target}})
+		err = extractZip(zr, dir, 100, 1, extractOptions{})
+		if err == nil || !strings.Contains(err.Error(), "points outside") {
+			t.Fatalf("Expected outside symlink error for %q but got %v", target, err)
+		}
+	}
+
+	// each link points inside, but writing through them would not
+	zr = makeLinkZip([][2]string{{"here", "."}, {"here/up", "../outside"}}, "here/up/evil.txt")
+	err = extractZip(zr, dir, 100, 3, extractOptions{})
+	if err == nil || !strings.Contains(err.Error(), "through symlink") {
+		t.Fatalf("Expected error writing through symlink but got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpDir, "up")); !os.IsNotExist(err) {
+		t.Fatalf("symlink was written outside of the destination")
+	}
+
+	// l/.. looks like dir, but l is itself a link to dir
+	zr = makeLinkZip([][2]string{{"l", "."}, {"l-up", "l/.."}})
+	err = extractZip(zr, dir, 100, 2, extractOptions{})
+	if err == nil || !strings.Contains(err.Error(), "points outside") {
+		t.Fatalf("Expected outside symlink error but got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "l-up")); !os.IsNotExist(err) {
+		t.Fatalf("Expected l-up not to be created")
+	}
+
+	zr = makeLinkZip([][2]string{{"sub/link.txt", "../a.txt"}})
+	err = extractZip(zr, dir, 100, 1, extractOptions{symlinks: SymlinkSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "sub/link.txt")); !os.IsNotExist(err) {
+		t.Fatalf("Expected symlink to be skipped")
+	}
+
+	err = extractZip(zr, dir, 100, 1, extractOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = ioutil.ReadFile(filepath.Join(dir, "sub/link.txt"))
+	if string(got) != "Lucretius" {
+		t.Fatalf("Expected symlink to a.txt but got %q", got)
+	}
+}
+
+func TestWormholeDirectoryMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	tmpDir, err := ioutil.TempDir("", "wormhole-metadata-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileTime := time.Date(2019, 7, 14, 12, 30, 0, 0, time.UTC)
+	dirTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	entries := []DirectoryEntry{
+		{
+			Path:    "heirloom/sub/old.txt",
+			Mode:    0644,
+			ModTime: fileTime,
+			Reader: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader("gingham-Tuesday")), nil
+			},
+		},
+		{
+			Path:    "heirloom/empty",
+			Mode:    os.ModeDir | 0755,
+			ModTime: dirTime,
+		},
+		{
+			Path:       "heirloom/latest.txt",
+			Mode:       os.ModeSymlink | 0777,
+			LinkTarget: "sub/old.txt",
+		},
+	}
+
+	for _, stream := range []bool{false, true} {
+		var opts []TransferOption
+		if stream {
+			opts = append(opts, WithStreamingDirectory())
+		}
+
+		code, resultCh, err := c0.SendDirectory(ctx, "heirloom", entries, false, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receiver, err := c1.Receive(ctx, code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if receiver.FileCount != 2 {
+			t.Fatalf("Expected 2 files but got %d", receiver.FileCount)
+		}
+
+		dir := filepath.Join(tmpDir, fmt.Sprintf("stream-%t", stream))
+		err = receiver.ExtractTo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := <-resultCh
+		if !result.OK {
+			t.Fatalf("Expected ok result but got: %+v", result)
+		}
+
+		fi, err := os.Stat(filepath.Join(dir, "sub/old.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(fileTime) {
+			t.Fatalf("Expected file mtime %s but got %s", fileTime, fi.ModTime())
+		}
+
+		fi, err = os.Stat(filepath.Join(dir, "empty"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.IsDir() || !fi.ModTime().Equal(dirTime) {
+			t.Fatalf("Expected empty directory with mtime %s but got %s %s", dirTime, fi.Mode(), fi.ModTime())
+		}
+
+		target, err := os.Readlink(filepath.Join(dir, "latest.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != "sub/old.txt" {
+			t.Fatalf("Expected symlink to sub/old.txt but got %q", target)
+		}
+	}
+}
+
+func TestWormholeDirectoryTransportSendRecvRelay(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	for relayProtocol, newRelayServer := range relayServerConstructors {
+		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
+			relayServer := newRelayServer()
+			defer relayServer.close()
+			relayURL := relayServer.url.String()
+
+			var c0Verifier string
+			var c0 Client
+			c0.RendezvousURL = url
+			c0.TransitRelayURL = relayURL
+			c0.VerifierOk = func(code string) bool {
+				c0Verifier = code
+				return true
+			}
+
+			var c1Verifier string
+			var c1 Client
+			c1.RendezvousURL = url
+			c1.TransitRelayURL = relayURL
+			c1.VerifierOk = func(code string) bool {
+				c1Verifier = code
+				return true
+			}
+
+			personalizeContent := make([]byte, 1<<16)
+			for i := 0; i < len(personalizeContent); i++ {
+				personalizeContent[i] = byte(i)
+			}
+
+			bodiceContent := []byte("placarding-whereat")
+
+			entries := []DirectoryEntry{
+				{
+					Path: filepath.Join("skyjacking", "personalize.txt"),
+					Reader: func() (io.ReadCloser, error) {
+						b := bytes.NewReader(personalizeContent)
+						return ioutil.NopCloser(b), nil
+					},
+				},
+				{
+					Path: filepath.Join("skyjacking", "bodice-Maytag.txt"),
+					Reader: func() (io.ReadCloser, error) {
+						b := bytes.NewReader(bodiceContent)
+						return ioutil.NopCloser(b), nil
+					},
+				},
+			}
+
+			code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := c1.Receive(ctx, code, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadAll(receiver)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, f := range r.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err := ioutil.ReadAll(rc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rc.Close()
+
+				if f.Name == "personalize.txt" {
+					if !bytes.Equal(body, personalizeContent) {
+						t.Fatal("personalize.txt file content does not match")
+					}
+				} else if f.Name == "bodice-Maytag.txt" {
+					if !bytes.Equal(bodiceContent, body) {
+						t.Fatalf("bodice-Maytag.txt file content does not match %s vs %s", bodiceContent, body)
+					}
+				} else {
+					t.Fatalf("Unexpected file %s", f.Name)
+				}
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+
+			if c0Verifier == "" || c1Verifier == "" {
+				t.Fatalf("Failed to get verifier code c0=%q c1=%q", c0Verifier, c1Verifier)
+			}
+
+			if c0Verifier != c1Verifier {
+				t.Fatalf("Expected verifiers to match but were different")
+			}
+		})
+	}
+}
+
+func TestWormholeTransferV2MultipleOffers(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	firstContent := make([]byte, 1<<17)
+	for i := 0; i < len(firstContent); i++ {
+		firstContent[i] = byte(i)
+	}
+	lastContent := []byte("unwisdom-sulfonamide")
+
+	items := []SendItem{
+		{
+			Name: "first.txt",
+			File: bytes.NewReader(firstContent),
+		},
+		{
+			Name: "skyjacking",
+			Entries: []DirectoryEntry{
+				{
+					Path: filepath.Join("skyjacking", "bodice-Maytag.txt"),
+					Reader: func() (io.ReadCloser, error) {
+						return ioutil.NopCloser(strings.NewReader("placarding-whereat")), nil
+					},
+				},
+			},
+		},
+		{
+			Name: "last.txt",
+			File: bytes.NewReader(lastContent),
+		},
+	}
+
+	var progressSentBytes, progressTotalBytes int64
+	code, resultCh, err := c0.SendMultiple(ctx, items, false, WithProgress(func(sent, total int64) {
+		progressSentBytes = sent
+		progressTotalBytes = total
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Type != TransferFile || msg.Name != "first.txt" {
+		t.Fatalf("unexpected first offer: %s %s", msg.Type, msg.Name)
+	}
+
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, firstContent) {
+		t.Fatalf("first.txt content mismatch")
+	}
+
+	msg, err = msg.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != TransferDirectory || msg.Name != "skyjacking" || msg.FileCount != 1 {
+		t.Fatalf("unexpected second offer: %+v", msg)
+	}
+
+	err = msg.Reject()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = msg.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != TransferFile || msg.Name != "last.txt" {
+		t.Fatalf("unexpected last offer: %s %s", msg.Type, msg.Name)
+	}
+
+	got, err = ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, lastContent) {
+		t.Fatalf("last.txt content mismatch got=%q expected=%q", got, lastContent)
+	}
+
+	_, err = msg.Next(ctx)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF after last offer but got %v", err)
+	}
+
+	result := <-resultCh
+	expectErr := "TransferError: transfer rejected"
+	if result.OK || result.Error == nil || result.Error.Error() != expectErr {
+		t.Fatalf("Expected %q result but got: %+v", expectErr, result)
+	}
+	if !errors.Is(result.Error, ErrTransferRejected) {
+		t.Fatalf("Expected ErrTransferRejected but got: %+v", result)
+	}
+
+	if progressTotalBytes != progressSentBytes || progressSentBytes <= int64(len(firstContent)+len(lastContent)) {
+		t.Fatalf("unexpected progress sent=%d total=%d", progressSentBytes, progressTotalBytes)
+	}
+}
+
+func TestWormholeTransferV1Fallback(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	// c1 acts like a peer that only speaks the v1 protocol
+	var c1 Client
+	c1.RendezvousURL = url
+	c1.disableTransferV2 = true
+
+	fileContent := []byte("hydrographic-Blaine")
+
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, fileContent) {
+		t.Fatalf("File contents mismatch")
+	}
+
+	_, err = msg.Next(ctx)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF from Next on v1 transfer but got %v", err)
+	}
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	items := []SendItem{
+		{Name: "a.txt", File: bytes.NewReader(fileContent)},
+		{Name: "b.txt", File: bytes.NewReader(fileContent)},
+	}
+	code, resultCh, err = c0.SendMultiple(ctx, items, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c1.Receive(ctx, code, false)
+	if err == nil {
+		t.Fatalf("Expected multiple file transfer to v1 peer to fail")
+	}
+
+	result = <-resultCh
+	if result.Error != ErrTransferV2Unsupported {
+		t.Fatalf("Expected %q result but got: %+v", ErrTransferV2Unsupported, result)
+	}
+}
+
+func TestWormholePeerCapabilities(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.RendezvousURL = url
+
+	checkCaps := func(caps PeerCapabilities) {
+		t.Helper()
+		if caps.ClientName != version.AgentString || caps.ClientVersion != version.AgentVersion {
+			t.Errorf("Unexpected client %s %s", caps.ClientName, caps.ClientVersion)
+		}
+		if len(caps.TransferVersions) != 2 || caps.TransferVersions[0] != 1 || caps.TransferVersions[1] != 2 {
+			t.Errorf("Unexpected transfer versions: %v", caps.TransferVersions)
+		}
+		if !caps.CanDilate {
+			t.Errorf("Expected peer to support dilation")
+		}
+		var direct bool
+		for _, a := range caps.TransitAbilities {
+			if a == "direct-tcp-v1" {
+				direct = true
+			}
+		}
+		if !direct {
+			t.Errorf("Expected direct-tcp-v1 in transit abilities: %v", caps.TransitAbilities)
+		}
+	}
+
+	var senderCaps PeerCapabilities
+	code, resultCh, err := c0.SendFile(ctx, "file.txt", strings.NewReader("grossly-Maine"), false, WithPeerCapabilities(func(caps PeerCapabilities) error {
+		senderCaps = caps
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.PeerCapabilities == nil {
+		t.Fatalf("Expected PeerCapabilities to be set")
+	}
+	checkCaps(*msg.PeerCapabilities)
+
+	_, err = ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Reject()
+
+	result := <-resultCh
+	if !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+	checkCaps(senderCaps)
+
+	// sender refuses the receiver
+	refuseErr := errors.New("peer is too old")
+	code, resultCh, err = c0.SendText(ctx, "unanimous-Lisbon", WithPeerCapabilities(func(caps PeerCapabilities) error {
+		return refuseErr
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c1.Receive(ctx, code, false)
+	expectErr := "TransferError: peer is too old"
+	if err == nil || err.Error() != expectErr {
+		t.Fatalf("Expected recv error %q but got %v", expectErr, err)
+	}
+
+	result = <-resultCh
+	if result.Error != refuseErr {
+		t.Fatalf("Expected refuse error but got: %+v", result)
+	}
+}
+
+func TestVersionMsgDilation(t *testing.T) {
+	v := versionMsg{AppVersions: defaultAppVersions()}
+	v.enableTransferV2()
+
+	out, err := json.Marshal(&v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var top map[string]json.RawMessage
+	err = json.Unmarshal(out, &top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"can-dilate", "dilation-abilities", "app_versions"} {
+		if _, ok := top[key]; !ok {
+			t.Fatalf("expected %s at the top level of %s", key, out)
+		}
+	}
+
+	var app map[string]json.RawMessage
+	err = json.Unmarshal(top["app_versions"], &app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"can-dilate", "dilation-abilities"} {
+		if _, ok := app[key]; ok {
+			t.Fatalf("expected no %s in app_versions: %s", key, top["app_versions"])
+		}
+	}
+
+	// as sent by the Python implementation
+	pyVersion := `{"can-dilate": ["1"], "dilation-abilities": [{"type": "direct-tcp-v1"}, {"type": "relay-v1"}], "app_versions": {}}`
+	var peer versionMsg
+	err = json.Unmarshal([]byte(pyVersion), &peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps := peer.capabilities()
+	if !caps.CanDilate || !reflect.DeepEqual(caps.DilationAbilities, []string{"direct-tcp-v1", "relay-v1"}) {
+		t.Fatalf("expected peer to support dilation but got %+v", caps)
+	}
+}
+
+func TestWormholeFileResume(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	fileContent := make([]byte, 1<<16)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	for _, v1 := range []bool{false, true} {
+		var c0 Client
+		c0.RendezvousURL = url
+
+		var c1 Client
+		c1.RendezvousURL = url
+		c1.disableTransferV2 = v1
+
+		for _, offset := range []int64{1000, int64(len(fileContent))} {
+			code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := c1.Receive(ctx, code, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !msg.PeerCapabilities.Resume {
+				t.Fatalf("Expected sender to support resume")
+			}
+
+			partial := bytes.NewReader(fileContent)
+			err = msg.Resume(partial, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(offset)+partial.Len() != len(fileContent) {
+				t.Fatalf("Resume read %d bytes of partial file, expected %d", len(fileContent)-partial.Len(), offset)
+			}
+
+			got, err := ioutil.ReadAll(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, fileContent[offset:]) {
+				t.Fatalf("File contents mismatch")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+		}
+
+		// partial data that doesn't match the file
+		code, resultCh, err := c0.SendFile(ctx, "file.txt", bytes.NewReader(fileContent), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := c1.Receive(ctx, code, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = msg.Resume(bytes.NewReader(make([]byte, 1000)), 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ioutil.ReadAll(msg)
+		if !errors.Is(err, ErrResumeMismatch) {
+			t.Fatalf("Expected %q read error when resuming with mismatched data but got %v", ErrResumeMismatch, err)
+		}
+
+		result := <-resultCh
+		if result.Error != ErrResumeMismatch {
+			t.Fatalf("Expected %q result but got: %+v", ErrResumeMismatch, result)
+		}
+	}
+}
+
+func TestWormholeSendStream(t *testing.T) {
+	ctx := context.Background()
+
+	rs := rendezvousservertest.NewServerLegacy()
+	defer rs.Close()
+
+	url := rs.WebSocketURL()
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	fileContent := make([]byte, 1<<16+7)
+	for i := 0; i < len(fileContent); i++ {
+		fileContent[i] = byte(i)
+	}
+
+	for _, v1 := range []bool{false, true} {
+		var c0 Client
+		c0.RendezvousURL = url
+
+		var c1 Client
+		c1.RendezvousURL = url
+		c1.disableTransferV2 = v1
+
+		for _, content := range [][]byte{fileContent, {}} {
+			var sendTotal int64
+			// hide Seek so the size can't be found
+			r := struct{ io.Reader }{bytes.NewReader(content)}
+			code, resultCh, err := c0.SendStream(ctx, "file.tar.gz", r, false, WithProgress(func(sent, total int64) {
+				sendTotal = total
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := c1.Receive(ctx, code, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Name != "file.tar.gz" || msg.TransferBytes64 != -1 || msg.UncompressedBytes64 != -1 {
+				t.Fatalf("Unexpected offer %s %d %d", msg.Name, msg.TransferBytes64, msg.UncompressedBytes64)
+			}
+			if !msg.PeerCapabilities.Stream {
+				t.Fatalf("Expected sender to support streams")
+			}
+			if err := msg.Resume(bytes.NewReader(nil), 0); err == nil {
+				t.Fatalf("Expected Resume of unknown size transfer to fail")
+			}
+
+			got, err := ioutil.ReadAll(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("File contents mismatch")
+			}
+			if !msg.ReadDone() {
+				t.Fatalf("Expected ReadDone after reading stream")
+			}
+
+			result := <-resultCh
+			if !result.OK {
+				t.Fatalf("Expected ok result but got: %+v", result)
+			}
+			if len(content) > 0 && sendTotal != -1 {
+				t.Fatalf("Expected progress total of -1 but got %d", sendTotal)
+			}
+		}
+
+		// c2 acts like a peer that can't receive streams
+		var c2 Client
+		c2.RendezvousURL = url
+		c2.disableTransferV2 = v1
+		c2.disableStream = true
+
+		code, resultCh, err := c0.SendStream(ctx, "file.tar.gz", bytes.NewReader(fileContent), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c2.Receive(ctx, code, false)
+		if err == nil {
+			t.Fatalf("Expected stream to peer without support to fail")
+		}
 
-			result := <-resultCh
-			if result.OK {
-				t.Fatal("Expected send resultCh to error but got none")
-			}
-		})
+		result := <-resultCh
+		if result.Error != ErrStreamUnsupported {
+			t.Fatalf("Expected %q result but got: %+v", ErrStreamUnsupported, result)
+		}
 	}
 }
 
-func TestWormholeDirectoryTransportSendRecvDirect(t *testing.T) {
-	ctx := context.Background()
+func TestConnectDirectHintPriority(t *testing.T) {
+	transitKey := make([]byte, 32)
+	relays := []transitRelay{{url: internal.MustNewSimpleURL("tcp:127.0.0.1:0")}}
 
-	rs := rendezvousservertest.NewServerLegacy()
-	defer rs.Close()
+	receiver := newFileTransport(transitKey, "appid", relays, false)
 
-	url := rs.WebSocketURL()
+	// fakeSender accepts a single connection and completes the
+	// sender's side of the transit handshake on it.
+	fakeSender := func() (net.Listener, int) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	// disable transit relay for this test
-	DefaultTransitRelayURL = ""
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(receiver.senderHandshakeHeader())
+			gotHeader := make([]byte, len(receiver.receiverHandshakeHeader()))
+			_, err = io.ReadFull(conn, gotHeader)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			conn.Write([]byte("go\n"))
+		}()
 
-	var c0Verifier string
-	var c0 Client
-	c0.RendezvousURL = url
-	c0.VerifierOk = func(code string) bool {
-		c0Verifier = code
-		return true
+		return l, l.Addr().(*net.TCPAddr).Port
 	}
 
-	var c1Verifier string
-	var c1 Client
-	c1.RendezvousURL = url
-	c1.VerifierOk = func(code string) bool {
-		c1Verifier = code
-		return true
+	low, lowPort := fakeSender()
+	defer low.Close()
+	high, highPort := fakeSender()
+	defer high.Close()
+
+	conn, err := receiver.connectDirect(&transitMsg{
+		HintsV1: []transitHintsV1{
+			{Type: "direct-tcp-v1", Hostname: "127.0.0.1", Port: lowPort, Priority: 0},
+			{Type: "direct-tcp-v1", Hostname: "127.0.0.1", Port: highPort, Priority: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
+	if conn == nil {
+		t.Fatalf("Expected a connection")
+	}
+	defer conn.Close()
 
-	personalizeContent := make([]byte, 1<<16)
-	for i := 0; i < len(personalizeContent); i++ {
-		personalizeContent[i] = byte(i)
+	if port := conn.RemoteAddr().(*net.TCPAddr).Port; port != highPort {
+		t.Fatalf("Expected connection to the high priority hint (port %d) but got port %d", highPort, port)
 	}
 
-	bodiceContent := []byte("placarding-whereat")
+	// lower priority hints are tried once the higher ones fail
+	dead, deadPort := fakeSender()
+	dead.Close()
+	fallback, fallbackPort := fakeSender()
+	defer fallback.Close()
 
-	entries := []DirectoryEntry{
-		{
-			Path: filepath.Join("skyjacking", "personalize.txt"),
-			Reader: func() (io.ReadCloser, error) {
-				b := bytes.NewReader(personalizeContent)
-				return ioutil.NopCloser(b), nil
-			},
-		},
-		{
-			Path: filepath.Join("skyjacking", "bodice-Maytag.txt"),
-			Reader: func() (io.ReadCloser, error) {
-				b := bytes.NewReader(bodiceContent)
-				return ioutil.NopCloser(b), nil
-			},
+	conn, err = receiver.connectDirect(&transitMsg{
+		HintsV1: []transitHintsV1{
+			{Type: "direct-tcp-v1", Hostname: "127.0.0.1", Port: deadPort, Priority: 1},
+			{Type: "direct-tcp-v1", Hostname: "127.0.0.1", Port: fallbackPort, Priority: 0},
 		},
-	}
-
-	code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, false)
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if conn == nil {
+		t.Fatalf("Expected a connection to the fallback hint")
+	}
+	conn.Close()
+}
 
-	receiver, err := c1.Receive(ctx, code, false)
-	if err != nil {
-		t.Fatal(err)
+func TestMakeTransitMsgHints(t *testing.T) {
+	transitKey := make([]byte, 32)
+	relays := []transitRelay{{url: internal.MustNewSimpleURL("tcp:127.0.0.1:0")}}
+
+	transport := newFileTransport(transitKey, "appid", relays, false)
+	transport.extraHints = []TransitHint{
+		{Hostname: "wormhole.example.com", Priority: 1},
+		{Hostname: "2001:db8::1", Port: 4001, Priority: 0.5},
 	}
 
-	got, err := ioutil.ReadAll(receiver)
+	err := transport.listen()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer transport.listener.Close()
 
-	r, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+	port := transport.listener.Addr().(*net.TCPAddr).Port
+
+	msg, err := transport.makeTransitMsg()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			t.Fatal(err)
-		}
-		body, err := ioutil.ReadAll(rc)
-		if err != nil {
-			t.Fatal(err)
+	found := make(map[string]transitHintsV1)
+	for _, hint := range msg.HintsV1 {
+		if hint.Type != "direct-tcp-v1" {
+			continue
 		}
-		rc.Close()
+		found[hint.Hostname] = hint
 
-		if f.Name == "personalize.txt" {
-			if !bytes.Equal(body, personalizeContent) {
-				t.Fatal("personalize.txt file content does not match")
-			}
-		} else if f.Name == "bodice-Maytag.txt" {
-			if !bytes.Equal(bodiceContent, body) {
-				t.Fatalf("bodice-Maytag.txt file content does not match %s vs %s", bodiceContent, body)
-			}
-		} else {
-			t.Fatalf("Unexpected file %s", f.Name)
+		ip := net.ParseIP(hint.Hostname)
+		if ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			t.Errorf("Unexpected hint for %s", hint.Hostname)
 		}
 	}
 
-	result := <-resultCh
-	if !result.OK {
-		t.Fatalf("Expected ok result but got: %+v", result)
-	}
-
-	if c0Verifier == "" || c1Verifier == "" {
-		t.Fatalf("Failed to get verifier code c0=%q c1=%q", c0Verifier, c1Verifier)
+	if hint := found["wormhole.example.com"]; hint.Port != port || hint.Priority != 1 {
+		t.Errorf("Unexpected hint for wormhole.example.com: %+v", hint)
 	}
-
-	if c0Verifier != c1Verifier {
-		t.Fatalf("Expected verifiers to match but were different")
+	if hint := found["2001:db8::1"]; hint.Port != 4001 || hint.Priority != 0.5 {
+		t.Errorf("Unexpected hint for 2001:db8::1: %+v", hint)
 	}
-
 }
 
-func TestWormholeDirectoryTransportSendRecvRelay(t *testing.T) {
+func TestWormholeDilation(t *testing.T) {
 	ctx := context.Background()
 
 	rs := rendezvousservertest.NewServerLegacy()
@@ -594,109 +2500,96 @@ func TestWormholeDirectoryTransportSendRecvRelay(t *testing.T) {
 
 	url := rs.WebSocketURL()
 
-	for relayProtocol, newRelayServer := range relayServerConstructors {
-		t.Run(fmt.Sprintf("With %s relay server", relayProtocol), func(t *testing.T) {
-			relayServer := newRelayServer()
-			defer relayServer.close()
-			relayURL := relayServer.url.String()
+	relayServer := newTestTCPRelayServer()
+	defer relayServer.close()
+
+	testCases := []struct {
+		name            string
+		relayURL        string
+		disableListener bool
+	}{
+		{name: "Direct", relayURL: "", disableListener: false},
+		{name: "Relay", relayURL: relayServer.url.String(), disableListener: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			DefaultTransitRelayURL = tc.relayURL
 
-			var c0Verifier string
 			var c0 Client
 			c0.RendezvousURL = url
-			c0.TransitRelayURL = relayURL
-			c0.VerifierOk = func(code string) bool {
-				c0Verifier = code
-				return true
-			}
 
-			var c1Verifier string
 			var c1 Client
 			c1.RendezvousURL = url
-			c1.TransitRelayURL = relayURL
-			c1.VerifierOk = func(code string) bool {
-				c1Verifier = code
-				return true
-			}
 
-			personalizeContent := make([]byte, 1<<16)
-			for i := 0; i < len(personalizeContent); i++ {
-				personalizeContent[i] = byte(i)
+			code, d0, err := c0.Dilate(ctx, tc.disableListener)
+			if err != nil {
+				t.Fatal(err)
 			}
+			defer d0.Close()
 
-			bodiceContent := []byte("placarding-whereat")
-
-			entries := []DirectoryEntry{
-				{
-					Path: filepath.Join("skyjacking", "personalize.txt"),
-					Reader: func() (io.ReadCloser, error) {
-						b := bytes.NewReader(personalizeContent)
-						return ioutil.NopCloser(b), nil
-					},
-				},
-				{
-					Path: filepath.Join("skyjacking", "bodice-Maytag.txt"),
-					Reader: func() (io.ReadCloser, error) {
-						b := bytes.NewReader(bodiceContent)
-						return ioutil.NopCloser(b), nil
-					},
-				},
+			_, d1, err := c1.Dilate(ctx, tc.disableListener, WithCode(code))
+			if err != nil {
+				t.Fatal(err)
 			}
+			defer d1.Close()
 
-			code, resultCh, err := c0.SendDirectory(ctx, "skyjacking", entries, true)
+			sc0, err := d0.OpenSubchannel(ctx)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			receiver, err := c1.Receive(ctx, code, true)
+			msg := []byte("paradigmatic-escarpment")
+			_, err = sc0.Write(msg)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			got, err := ioutil.ReadAll(receiver)
+			sc1, err := d1.AcceptSubchannel(ctx)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			r, err := zip.NewReader(bytes.NewReader(got), int64(len(got)))
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(sc1, got)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("subchannel msg mismatch got=%q expected=%q", got, msg)
+			}
 
-			for _, f := range r.File {
-				rc, err := f.Open()
-				if err != nil {
-					t.Fatal(err)
-				}
-				body, err := ioutil.ReadAll(rc)
-				if err != nil {
-					t.Fatal(err)
-				}
-				rc.Close()
+			// kill the underlying connection; the subchannel should
+			// survive the reconnection.
+			d0.mu.Lock()
+			conn := d0.conn
+			d0.mu.Unlock()
+			conn.Close()
 
-				if f.Name == "personalize.txt" {
-					if !bytes.Equal(body, personalizeContent) {
-						t.Fatal("personalize.txt file content does not match")
-					}
-				} else if f.Name == "bodice-Maytag.txt" {
-					if !bytes.Equal(bodiceContent, body) {
-						t.Fatalf("bodice-Maytag.txt file content does not match %s vs %s", bodiceContent, body)
-					}
-				} else {
-					t.Fatalf("Unexpected file %s", f.Name)
-				}
+			bigMsg := make([]byte, 1<<18)
+			for i := 0; i < len(bigMsg); i++ {
+				bigMsg[i] = byte(i)
 			}
 
-			result := <-resultCh
-			if !result.OK {
-				t.Fatalf("Expected ok result but got: %+v", result)
+			go sc1.Write(bigMsg)
+
+			got = make([]byte, len(bigMsg))
+			_, err = io.ReadFull(sc0, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, bigMsg) {
+				t.Fatalf("subchannel msg mismatch after reconnect")
 			}
 
-			if c0Verifier == "" || c1Verifier == "" {
-				t.Fatalf("Failed to get verifier code c0=%q c1=%q", c0Verifier, c1Verifier)
+			err = sc1.Close()
+			if err != nil {
+				t.Fatal(err)
 			}
 
-			if c0Verifier != c1Verifier {
-				t.Fatalf("Expected verifiers to match but were different")
+			_, err = sc0.Read(got)
+			if err != io.EOF {
+				t.Fatalf("expected EOF after remote close but got %v", err)
 			}
 		})
 	}
@@ -854,6 +2747,8 @@ func (ts *testRelayServer) handleConn(c net.Conn) {
 	existing, found := ts.streams[chanID]
 	if !found {
 		ts.streams[chanID] = c
+	} else {
+		delete(ts.streams, chanID)
 	}
 	ts.mu.Unlock()
 
@@ -955,3 +2850,140 @@ func (s *splitReader) Read(b []byte) (int, error) {
 	}
 	return n, err
 }
+
+func TestWormholeContact(t *testing.T) {
+	ctx := context.Background()
+
+	// contact codes claim nameplates the server didn't allocate
+	ts := httptest.NewServer(server.NewServer())
+	defer ts.Close()
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/v1"
+
+	// disable transit relay for this test
+	DefaultTransitRelayURL = ""
+
+	var c0 Client
+	c0.AppID = WormholeCLIAppID
+	c0.RendezvousURL = url
+
+	var c1 Client
+	c1.AppID = WormholeCLIAppID
+	c1.RendezvousURL = url
+
+	var contact0, contact1 Contact
+	code, resultCh, err := c0.SendFile(ctx, "hello.txt", strings.NewReader("hello"), false, WithContact(func(c Contact) {
+		contact0 = c
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := c1.Receive(ctx, code, false, WithContact(func(c Contact) {
+		contact1 = c
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(msg); err != nil {
+		t.Fatal(err)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+
+	if len(contact0.Key) != 32 || !bytes.Equal(contact0.Key, contact1.Key) {
+		t.Fatalf("Expected the same contact key on both sides, got %x and %x", contact0.Key, contact1.Key)
+	}
+	if !contact0.Initiator || contact1.Initiator {
+		t.Fatalf("Expected the sender to be the initiator, got %t and %t", contact0.Initiator, contact1.Initiator)
+	}
+	if contact0.SendCode() != contact1.ReceiveCode() || contact1.SendCode() != contact0.ReceiveCode() {
+		t.Fatalf("Contact codes don't match")
+	}
+	if contact0.SendCode() == contact0.ReceiveCode() {
+		t.Fatalf("Expected a different code for each direction")
+	}
+	if err := validateCode(contact0.SendCode()); err != nil {
+		t.Fatalf("Bad contact code %q: %s", contact0.SendCode(), err)
+	}
+
+	// the receiver sends back without a new code
+	_, resultCh, err = c1.SendText(ctx, "thanks", WithCode(contact1.SendCode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = c0.Receive(ctx, contact0.ReceiveCode(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "thanks" {
+		t.Fatalf("Got message %q", got)
+	}
+	if result := <-resultCh; !result.OK {
+		t.Fatalf("Expected ok result but got: %+v", result)
+	}
+}
+
+func TestWormholeURI(t *testing.T) {
+	uris := []struct {
+		uri URI
+		s   string
+	}{
+		{
+			uri: URI{Code: "7-crossover-clockwork"},
+			s:   "wormhole-transfer:7-crossover-clockwork?version=0",
+		},
+		{
+			uri: URI{Code: "7-crossover-clockwork", RendezvousURL: DefaultRendezvousURL},
+			s:   "wormhole-transfer:7-crossover-clockwork?version=0",
+		},
+		{
+			uri: URI{Code: "12-über-gelb", RendezvousURL: "ws://example.com:4000/v1"},
+			s:   "wormhole-transfer:12-%C3%BCber-gelb?rendezvous=ws%3A%2F%2Fexample.com%3A4000%2Fv1&version=0",
+		},
+	}
+
+	for _, tc := range uris {
+		if got := tc.uri.String(); got != tc.s {
+			t.Errorf("String of %+v: got %q expected %q", tc.uri, got, tc.s)
+		}
+
+		u, err := ParseURI(tc.s)
+		if err != nil {
+			t.Fatalf("ParseURI(%q): %s", tc.s, err)
+		}
+		if u.Code != tc.uri.Code {
+			t.Errorf("ParseURI(%q): got code %q expected %q", tc.s, u.Code, tc.uri.Code)
+		}
+		if tc.uri.RendezvousURL != DefaultRendezvousURL && u.RendezvousURL != tc.uri.RendezvousURL {
+			t.Errorf("ParseURI(%q): got rendezvous %q expected %q", tc.s, u.RendezvousURL, tc.uri.RendezvousURL)
+		}
+	}
+
+	u, err := ParseURI("wormhole:4-purple-sausages?role=leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Code != "4-purple-sausages" || u.RendezvousURL != "" {
+		t.Fatalf("Got %+v", u)
+	}
+
+	bad := []string{
+		"4-purple-sausages",
+		"https://example.com/4-purple-sausages",
+		"wormhole-transfer:",
+		"wormhole-transfer:purple-sausages",
+		"wormhole-transfer:4-purple-sausages?version=1",
+	}
+	for _, s := range bad {
+		if _, err := ParseURI(s); err == nil {
+			t.Errorf("Expected ParseURI(%q) to fail", s)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package wormhole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// Sizes of the fixed parts of the zip records written by zip.Writer
+// for a stored (uncompressed) entry without extra fields or comments.
+const (
+	zipLocalHeaderLen      = 30
+	zipDataDescriptorLen   = 16
+	zipDataDescriptor64Len = 24
+	zipCentralHeaderLen    = 46
+	zipCentralExtra64Len   = 28
+	zipExtTimeExtraLen     = 9
+	zipDirectoryEndLen     = 22
+	zipDirectory64EndLen   = 56
+	zipDirectory64LocLen   = 20
+	zipUint16Max           = (1 << 16) - 1
+	zipUint32Max           = (1 << 32) - 1
+)
+
+// storedZipSize returns the exact size of the zip file zip.Writer
+// produces for stored entries with the given headers and sizes. It
+// mirrors the layout decisions in zip.Writer, including when it
+// switches to zip64 records, skips the data descriptor for
+// directories and adds an extended timestamp for modification times.
+func storedZipSize(headers []*zip.FileHeader, sizes []int64) int64 {
+	var (
+		offset  int64
+		dirSize int64
+	)
+
+	for i, header := range headers {
+		size := sizes[i]
+		zip64 := size >= zipUint32Max
+		// the name and extra fields appear in both headers
+		varLen := int64(len(header.Name))
+		if !header.Modified.IsZero() {
+			varLen += zipExtTimeExtraLen
+		}
+
+		entryOffset := offset
+		offset += zipLocalHeaderLen + varLen + size
+		if strings.HasSuffix(header.Name, "/") {
+			// directories have no data descriptor
+		} else if zip64 {
+			offset += zipDataDescriptor64Len
+		} else {
+			offset += zipDataDescriptorLen
+		}
+
+		dirSize += zipCentralHeaderLen + varLen
+		if zip64 || entryOffset >= zipUint32Max {
+			dirSize += zipCentralExtra64Len
+		}
+	}
+
+	total := offset + dirSize + zipDirectoryEndLen
+	if len(headers) >= zipUint16Max || dirSize >= zipUint32Max || offset >= zipUint32Max {
+		total += zipDirectory64EndLen + zipDirectory64LocLen
+	}
+
+	return total
+}
+
+// directoryEntrySize finds the size of an entry's content, seeking
+// to the end if its reader supports it and reading through it
+// otherwise.
+func directoryEntrySize(entry DirectoryEntry) (int64, error) {
+	r, err := entry.open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if s, ok := r.(io.Seeker); ok {
+		return s.Seek(0, io.SeekEnd)
+	}
+
+	return io.Copy(ioutil.Discard, r)
+}
+
+// makeZipStream returns a zipResult whose reader generates the zip
+// file on the fly from the directory entries. Entries are stored
+// rather than deflated so that the size of the zip file is known
+// before any of it is written.
+func makeZipStream(directoryName string, entries []DirectoryEntry) (*zipResult, error) {
+	names, err := zipEntryNames(directoryName, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var totalBytes int64
+	headers := make([]*zip.FileHeader, len(entries))
+	sizes := make([]int64, len(entries))
+	for i, entry := range entries {
+		headers[i] = zipHeader(names[i], entry, zip.Store)
+		sizes[i], err = directoryEntrySize(entry)
+		if err != nil {
+			return nil, err
+		}
+		totalBytes += sizes[i]
+	}
+
+	zipSize := storedZipSize(headers, sizes)
+
+	pr, pw := io.Pipe()
+	zs := &zipStreamReader{
+		pr: pr,
+		write: func() {
+			pw.CloseWithError(writeZipStream(pw, entries, headers, sizes, zipSize))
+		},
+	}
+
+	result := zipResult{
+		r:        zs,
+		numBytes: totalBytes,
+		numFiles: zipFileCount(entries),
+		zipSize:  zipSize,
+	}
+
+	return &result, nil
+}
+
+// zipStreamReader starts generating the zip file on the first call
+// to Read, so nothing is opened if the receiver rejects the offer.
+type zipStreamReader struct {
+	once  sync.Once
+	pr    *io.PipeReader
+	write func()
+}
+
+func (z *zipStreamReader) Read(p []byte) (int, error) {
+	z.once.Do(func() {
+		go z.write()
+	})
+	return z.pr.Read(p)
+}
+
+// Close stops generating the zip file.
+func (z *zipStreamReader) Close() error {
+	return z.pr.Close()
+}
+
+var errZipStreamSize = errors.New("zip stream size mismatch")
+
+func writeZipStream(w io.Writer, entries []DirectoryEntry, headers []*zip.FileHeader, sizes []int64, zipSize int64) error {
+	cw := &countWriter{w: w, limit: zipSize}
+	zw := zip.NewWriter(cw)
+
+	for i, entry := range entries {
+		f, err := zw.CreateHeader(headers[i])
+		if err != nil {
+			return err
+		}
+
+		err = copyDirectoryEntry(f, entry, sizes[i])
+		if err != nil {
+			return fmt.Errorf("%s: %s", entry.Path, err)
+		}
+	}
+
+	err := zw.Close()
+	if err != nil {
+		return err
+	}
+
+	if cw.count != zipSize {
+		return errZipStreamSize
+	}
+
+	return nil
+}
+
+// copyDirectoryEntry copies exactly size bytes of entry's content to
+// w, failing if the content turns out to be a different size.
+func copyDirectoryEntry(w io.Writer, entry DirectoryEntry, size int64) error {
+	r, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.CopyN(w, r, size)
+	if err == io.EOF {
+		return errors.New("file shrank while sending")
+	} else if err != nil {
+		return err
+	}
+
+	var extra [1]byte
+	n, _ := io.ReadFull(r, extra[:])
+	if n > 0 {
+		return errors.New("file grew while sending")
+	}
+
+	return nil
+}
+
+// countWriter counts the bytes written to w, and fails writes that
+// would go past limit.
+type countWriter struct {
+	w     io.Writer
+	count int64
+	limit int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.count+int64(len(p)) > c.limit {
+		return 0, errZipStreamSize
+	}
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}